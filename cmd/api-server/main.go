@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"os"
@@ -9,11 +10,16 @@ import (
 
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/apimerchant"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/apimgmt"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/tlsconfig"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/lifecycle"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/reconciler"
 )
 
 func main() {
@@ -26,6 +32,10 @@ func mainLogic() int {
 	logger := core.NewAppLogger(os.Stdout, log.INFO)
 	defer logger.Sync()
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		return migrateLogic(logger, os.Args[2:])
+	}
+
 	logger.Info("APP starting")
 
 	// Read config
@@ -41,33 +51,135 @@ func mainLogic() int {
 	// logger.SetLevel(config.Options.LogLevel)
 
 	// Setup Database
-	db, err := repository.NewDatabaseService(config.Database.Host, config.Database.Port,
-		config.Database.Username, config.Database.Password, config.Database.DBName)
+	db, err := repository.NewDatabaseService(config.Database)
 	if err != nil {
 		logger.Error(fmt.Sprintf("database error: %s", err.Error()), log.Field("type", "setup"))
 		return 1
 	}
 	defer db.Close()
+	db.QueryTimeout = config.Timeouts.Database
+
+	if err := checkMigrations(db.Database, config.Database.Driver); err != nil {
+		logger.Error(fmt.Sprintf("database schema error: %s", err.Error()), log.Field("type", "setup"))
+		return 1
+	}
 
 	httpClient := &http.Client{
 		Timeout: time.Second * time.Duration(config.Options.HTTPClientTimeout),
 	}
 
+	// Setup card vault
+	cardVault, err := vault.New(config.Vault.KeyEncryptionKey)
+	if err != nil {
+		logger.Error(fmt.Sprintf("vault error: %s", err.Error()), log.Field("type", "setup"))
+		return 1
+	}
+
+	// Setup circuit breakers
+	authServiceBreaker := breaker.New("authservice", breaker.Settings{
+		FailureThreshold:    config.AuthService.Breaker.FailureThreshold,
+		OpenTimeout:         config.AuthService.Breaker.OpenTimeout,
+		HalfOpenMaxRequests: config.AuthService.Breaker.HalfOpenMaxRequests,
+	})
+	pprocessorBreaker := breaker.New("pprocessor", breaker.Settings{
+		FailureThreshold:    config.PProcessorService.Breaker.FailureThreshold,
+		OpenTimeout:         config.PProcessorService.Breaker.OpenTimeout,
+		HalfOpenMaxRequests: config.PProcessorService.Breaker.HalfOpenMaxRequests,
+	})
+
 	// Setup Payment processor service
 	pprocservice := pprocessor.NewClient(config.PProcessorService.Host, config.PProcessorService.Port, httpClient)
+	pprocservice.Timeouts = pprocessor.Timeouts{
+		Authorise: config.Timeouts.PProcessorAuthorise,
+		Capture:   config.Timeouts.PProcessorCapture,
+		Refund:    config.Timeouts.PProcessorRefund,
+		Void:      config.Timeouts.PProcessorVoid,
+		Query:     config.Timeouts.PProcessorQuery,
+	}
+	pprocservice.Retry = pprocessor.RetryPolicy{
+		MaxAttempts:    config.PProcessorService.RetryMaxAttempts,
+		InitialBackoff: config.PProcessorService.RetryInitialBackoff,
+		MaxBackoff:     config.PProcessorService.RetryMaxBackoff,
+		Budget:         config.PProcessorService.RetryBudget,
+	}
+	pprocservice.Breaker = pprocessorBreaker
+
+	// Setup credential backend
+	credentialVerifier, err := newCredentialVerifier(config, httpClient, authServiceBreaker)
+	if err != nil {
+		logger.Error(fmt.Sprintf("credentials error: %s", err.Error()), log.Field("type", "setup"))
+		return 1
+	}
+	logger.Info(fmt.Sprintf("checking credentials with the %s backend", config.AuthService.Backend),
+		log.Field("type", "setup"))
+
+	// The auth service cannot list merchants, the other backends can
+	merchants, _ := credentialVerifier.(core.MerchantDirectory)
+	if merchants == nil {
+		logger.Info("merchant names of new API keys not checked (the credential backend cannot list merchants)",
+			log.Field("type", "setup"))
+	}
+
+	var authCache *credentials.CachingVerifier
+	if config.AuthService.CacheTTL > 0 {
+		authCache, err = credentials.NewCachingVerifier(credentialVerifier, config.AuthService.CacheTTL,
+			config.AuthService.CacheNegativeTTL, config.AuthService.CacheMaxEntries)
+		if err != nil {
+			logger.Error(fmt.Sprintf("credentials error: %s", err.Error()), log.Field("type", "setup"))
+			return 1
+		}
+		credentialVerifier = authCache
+	}
 
 	serverMerchant := apimerchant.NewServer(config.WebserverMerchant.Host, config.WebserverMerchant.Port, config.Options.DevMode,
-		config.AuthService.Host, config.AuthService.Port,
-		logger, httpClient, db, pprocservice)
-	serverMgmt := apimgmt.NewServer(config.WebserverMgmt.Host, config.WebserverMgmt.Port, config.Options.DevMode, logger, db)
+		credentialVerifier, config.APIKeys.SignatureWindow, logger, db, pprocservice, cardVault, config.MerchantLimits)
+	serverMgmt := apimgmt.NewServer(config.WebserverMgmt.Host, config.WebserverMgmt.Port, config.Options.DevMode, logger, db,
+		cardVault, config.CardReveal.Accounts, config.Admin.Accounts, merchants, authCache,
+		[]*breaker.Breaker{authServiceBreaker, pprocessorBreaker})
+
+	// Setup TLS, whose certificates are reloaded on SIGHUP
+	reloaders := []core.Reloader{}
+	webservers := []struct {
+		name      string
+		config    core.WebserverConfiguration
+		tlsConfig **tls.Config
+	}{
+		{name: "apimerchant", config: config.WebserverMerchant, tlsConfig: &serverMerchant.HTTPServer.TLSConfig},
+		{name: "apimgmt", config: config.WebserverMgmt, tlsConfig: &serverMgmt.HTTPServer.TLSConfig},
+	}
 
-	// Spawn SIGINT listener
-	go lifecycle.TerminateHandler(logger, serverMerchant, serverMgmt)
+	for _, w := range webservers {
+		if !w.config.TLS.Enabled() {
+			logger.Warn(fmt.Sprintf("TLS disabled on %s (no certificate configured)", w.name), log.Field("type", "setup"))
+			continue
+		}
+
+		tlsConfig, reloader, err := tlsconfig.New(w.config.TLS)
+		if err != nil {
+			logger.Error(fmt.Sprintf("TLS error on %s: %s", w.name, err.Error()), log.Field("type", "setup"))
+			return 1
+		}
+		*w.tlsConfig = tlsConfig
+		reloaders = append(reloaders, reloader)
+
+		if w.config.TLS.ClientCAFile != "" {
+			logger.Info(fmt.Sprintf("client certificates required on %s", w.name), log.Field("type", "setup"))
+		}
+	}
+
+	// Setup reconciler of operations whose outcome at the payment processor is unknown
+	rec := reconciler.New(logger, db, pprocservice, config.Reconciler.Interval, config.Reconciler.MinAge,
+		config.Reconciler.MaxAttempts, config.Reconciler.AuthorisationValidity)
+
+	// Spawn SIGINT and SIGHUP listeners
+	go lifecycle.TerminateHandler(logger, serverMerchant, serverMgmt, rec)
+	go lifecycle.ReloadHandler(logger, reloaders...)
 
 	errSignal := make(chan struct{}, 2)
 	var wg sync.WaitGroup
 	wg.Add(2)
 
+	go rec.Run()
 	go RunMerchantWebserver(logger, serverMerchant, &wg, errSignal)
 	go RunMgmtWebserver(logger, serverMgmt, &wg, errSignal)
 
@@ -83,6 +195,22 @@ func mainLogic() int {
 	}
 }
 
+// newCredentialVerifier returns the credential backend selected in the configuration.
+func newCredentialVerifier(config core.Configuration, httpClient *http.Client, authServiceBreaker *breaker.Breaker) (
+	core.CredentialVerifier, error) {
+	switch config.AuthService.Backend {
+	case core.AuthBackendFile:
+		return credentials.NewFileVerifier(config.AuthService.CredentialsFile)
+	case core.AuthBackendStatic:
+		return credentials.NewStaticVerifier(config.AuthService.Accounts), nil
+	default:
+		verifier := credentials.NewRemoteVerifier(config.AuthService.Host, config.AuthService.Port, httpClient)
+		verifier.Timeout = config.Timeouts.AuthService
+		verifier.Breaker = authServiceBreaker
+		return verifier, nil
+	}
+}
+
 func RunMerchantWebserver(logger log.Logger, serverMerchant *apimerchant.Server, wg *sync.WaitGroup, errSignal chan struct{}) {
 	defer wg.Done()
 
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/migrations"
+)
+
+// migrateTimeout bounds how long running the migrations can take.
+const migrateTimeout = 10 * time.Minute
+
+const migrateUsage = "usage: api-server migrate up | down [steps] | status | force <version>"
+
+// migrateLogic runs the migrate subcommand, which manages the schema of the database:
+//   - up applies all the migrations not applied yet.
+//   - down reverts the latest migration, or the given number of migrations.
+//   - status lists the migrations and whether they are applied.
+//   - force records the migrations up to the given version as applied without running them, e.g. for databases
+//     created before migrations existed, or once a migration that failed halfway has been fixed by hand.
+func migrateLogic(logger log.Logger, args []string) int {
+	if len(args) == 0 {
+		logger.Error(migrateUsage)
+		return 2
+	}
+
+	// Only the database configuration is needed
+	config := core.NewConfig()
+	if err := config.LoadDatabaseConfig(); err != nil {
+		logger.Error(err.Error(), log.Field("type", "setup"))
+		return 1
+	}
+
+	db, err := repository.NewDatabase(config.Database)
+	if err != nil {
+		logger.Error(fmt.Sprintf("database error: %s", err.Error()), log.Field("type", "setup"))
+		return 1
+	}
+	defer db.Close()
+
+	sqlDB, err := db.SQLDB()
+	if err != nil {
+		logger.Error(fmt.Sprintf("database error: %s", err.Error()), log.Field("type", "setup"))
+		return 1
+	}
+
+	migrator, err := migrations.NewMigrator(sqlDB, config.Database.Driver)
+	if err != nil {
+		logger.Error(fmt.Sprintf("migrations error: %s", err.Error()), log.Field("type", "setup"))
+		return 1
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), migrateTimeout)
+	defer cancel()
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, migration := range applied {
+			logger.Info(fmt.Sprintf("applied migration %d_%s", migration.Version, migration.Name))
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		logger.Info(fmt.Sprintf("database up to date, %d migrations applied", len(applied)))
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps <= 0 {
+				logger.Error(fmt.Sprintf("number of steps not allowed <%s>", args[1]))
+				return 2
+			}
+		}
+
+		reverted, err := migrator.Down(ctx, steps)
+		for _, migration := range reverted {
+			logger.Info(fmt.Sprintf("reverted migration %d_%s", migration.Version, migration.Name))
+		}
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+
+	case "status":
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		for _, status := range statuses {
+			state := "pending"
+			if status.Dirty {
+				state = "dirty"
+			} else if status.Applied {
+				state = "applied at " + status.AppliedAt.Format(time.RFC3339)
+			}
+			logger.Info(fmt.Sprintf("migration %d_%s: %s", status.Version, status.Name, state))
+		}
+
+	case "force":
+		if len(args) < 2 {
+			logger.Error(migrateUsage)
+			return 2
+		}
+		version, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			logger.Error(fmt.Sprintf("version not allowed <%s>", args[1]))
+			return 2
+		}
+
+		if err := migrator.Force(ctx, version); err != nil {
+			logger.Error(err.Error())
+			return 1
+		}
+		logger.Info(fmt.Sprintf("database recorded at migration %d", version))
+
+	default:
+		logger.Error(migrateUsage)
+		return 2
+	}
+
+	return 0
+}
+
+// checkMigrations checks the schema of the database is up to date, so the gateway never runs against a schema it
+// does not expect.
+func checkMigrations(db *repository.Database, driver string) error {
+	sqlDB, err := db.SQLDB()
+	if err != nil {
+		return err
+	}
+
+	migrator, err := migrations.NewMigrator(sqlDB, driver)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	pending, err := migrator.Pending(ctx)
+	if err != nil {
+		return err
+	}
+	if pending > 0 {
+		return fmt.Errorf("%d migrations not applied, run 'api-server migrate up'", pending)
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Command pprocessor-sim serves a fake payment processor, for running the gateway locally end to end.
+// See package pprocessorsim for the card numbers and amounts scripting its behaviour.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/pprocessorsim"
+)
+
+func main() {
+	retCode := mainLogic()
+	os.Exit(retCode)
+}
+
+func mainLogic() int {
+	host := flag.String("host", "127.0.0.1", "address to listen on")
+	port := flag.Int("port", 9090, "port to listen on")
+	delay := flag.Duration("delay", 2*time.Second, "how long delayed requests take to be approved")
+	hang := flag.Duration("hang", 30*time.Second, "how long requests that time out hang before answering 504")
+	flag.Parse()
+
+	logger := core.NewAppLogger(os.Stdout, log.DEBUG)
+	defer logger.Sync()
+
+	gin.SetMode(gin.ReleaseMode)
+	sim := pprocessorsim.NewSimulator(logger)
+	sim.Delay = *delay
+	sim.Hang = *hang
+
+	server := http.Server{Addr: fmt.Sprintf("%s:%d", *host, *port), Handler: sim}
+
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	logger.Info(fmt.Sprintf("payment processor simulator listening on %s", server.Addr), log.Field("type", "setup"))
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		logger.Error(fmt.Sprintf("unexpected error while serving HTTP: %s", err))
+		return 1
+	}
+
+	logger.Info("payment processor simulator terminated")
+	return 0
+}
@@ -3,6 +3,7 @@ package apimerchant
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -11,6 +12,7 @@ import (
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
 )
 
 // Server is the webserver environment, which holds all its dependencies.
@@ -18,21 +20,28 @@ type Server struct {
 	Logger     log.Logger
 	Repo       core.Repository
 	PProcessor core.PaymentProcessor
+	Vault      *vault.Vault
+	// Limits holds the maximum amount of an authorisation and the card brands accepted per merchant
+	Limits core.MerchantLimitsConfiguration
 
-	AuthServiceHost string
-	AuthServicePort int
+	// Credentials checks the merchants' credentials
+	Credentials core.CredentialVerifier
+	// SignatureWindow is how far from now the timestamp of requests signed with an API key can be
+	SignatureWindow time.Duration
 
 	Router     *gin.Engine
 	HTTPServer http.Server
-	HTTPClient *http.Client
+
+	// cancelRequests cancels the context of all in-flight requests
+	cancelRequests context.CancelFunc
 }
 
 // NewServer creates a new server.
-func NewServer(addr string, port int, devMode bool, authServiceHost string, authServicePort int,
-	logger log.Logger, httpClient *http.Client, repo core.Repository, pproc core.PaymentProcessor) *Server {
-	s := &Server{Logger: logger, Repo: repo, HTTPClient: httpClient,
-		AuthServiceHost: authServiceHost, AuthServicePort: authServicePort,
-		PProcessor: pproc}
+func NewServer(addr string, port int, devMode bool, credentials core.CredentialVerifier,
+	signatureWindow time.Duration, logger log.Logger, repo core.Repository, pproc core.PaymentProcessor,
+	cardVault *vault.Vault, limits core.MerchantLimitsConfiguration) *Server {
+	s := &Server{Logger: logger, Repo: repo, Credentials: credentials, SignatureWindow: signatureWindow,
+		PProcessor: pproc, Vault: cardVault, Limits: limits}
 
 	if !devMode {
 		gin.SetMode(gin.ReleaseMode)
@@ -48,12 +57,16 @@ func NewServer(addr string, port int, devMode bool, authServiceHost string, auth
 	}
 
 	// Create http.Server
+	// Requests contexts derive from baseCtx, so they can be cancelled if the server fails to shutdown gracefully
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	s.cancelRequests = cancelRequests
 	s.HTTPServer = http.Server{
 		Addr:           fmt.Sprintf("%s:%d", addr, port),
 		Handler:        s.Router,
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		WriteTimeout:   core.MaxRequestDuration,
 		MaxHeaderBytes: 1 << 20,
+		BaseContext:    func(net.Listener) context.Context { return baseCtx },
 	}
 
 	s.setupRoutes(devMode)
@@ -66,24 +79,49 @@ func (s *Server) setupRoutes(devMode bool) {
 	s.Router.NoRoute(api.NoRoute)
 	v1 := s.Router.Group("/api/v1")
 
-	basicAuthMW := middleware.GinBasicAuth(s.Logger, s.HTTPClient, s.AuthServiceHost, s.AuthServicePort)
-
-	v1.POST("/authorise", basicAuthMW, s.AuthoriseTransaction)
-	v1.POST("/capture", basicAuthMW, s.CaptureTransaction)
-	v1.POST("/refund", basicAuthMW, s.RefundTransaction)
-	v1.POST("/void", basicAuthMW, s.VoidTransaction)
-
+	// Merchants authenticate either with their credentials or by signing requests with an API key
+	authMW := middleware.GinMerchantAuth(
+		middleware.GinSignatureAuth(s.Logger, s.Repo, s.Vault, s.SignatureWindow),
+		middleware.GinBasicAuth(s.Logger, s.Credentials),
+	)
+	idempotencyMW := middleware.GinIdempotency(s.Logger, s.Repo)
+
+	v1.POST("/authorise", authMW, idempotencyMW, s.AuthoriseTransaction)
+	v1.POST("/capture", authMW, idempotencyMW, s.CaptureTransaction)
+	v1.POST("/refund", authMW, idempotencyMW, s.RefundTransaction)
+	v1.POST("/void", authMW, idempotencyMW, s.VoidTransaction)
+
+	// v2 only changes the shape of authorisation requests, where card details are strings of digits
+	v2 := s.Router.Group("/api/v2")
+	v2.POST("/authorise", authMW, idempotencyMW, s.AuthoriseTransactionV2)
+	v2.POST("/capture", authMW, idempotencyMW, s.CaptureTransaction)
+	v2.POST("/refund", authMW, idempotencyMW, s.RefundTransaction)
+	v2.POST("/void", authMW, idempotencyMW, s.VoidTransaction)
 }
 
-// ListenAndServe listens and serves incoming requests.
+// ListenAndServe listens and serves incoming requests, over TLS if HTTPServer.TLSConfig is set.
 func (s *Server) ListenAndServe() error {
-	if err := s.HTTPServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if s.HTTPServer.TLSConfig != nil {
+		// The certificate comes from the TLS configuration
+		err = s.HTTPServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.HTTPServer.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
 
 // ShutDown gracefully shuts down server.
+// If in-flight requests do not finish before ctx is done, their contexts are cancelled, which aborts any pending
+// calls to the payment processor, the auth service or the database.
 func (s *Server) ShutDown(ctx context.Context) error {
-	return s.HTTPServer.Shutdown(ctx)
+	err := s.HTTPServer.Shutdown(ctx)
+	if s.cancelRequests != nil {
+		s.cancelRequests()
+	}
+	return err
 }
@@ -0,0 +1,92 @@
+package apimerchant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+)
+
+// Error codes returned to merchants when the payment processor does not complete an operation.
+// These are part of the API and must not change.
+const (
+	ErrorCodeDeclined             = "declined"
+	ErrorCodeProcessorUnavailable = "processor_unavailable"
+	ErrorCodeProcessorTimeout     = "processor_timeout"
+	ErrorCodeProcessorError       = "processor_error"
+	ErrorCodeProcessorCircuitOpen = "processor_circuit_open"
+)
+
+// failureResponse holds the reason an operation failed, and is embedded in every response body.
+type failureResponse struct {
+	ErrorCode    string `json:"error_code,omitempty"`
+	ErrorMessage string `json:"error_message,omitempty"`
+	DeclineCode  uint   `json:"decline_code,omitempty"`
+}
+
+// processorFailure maps an error returned by the payment processor to the HTTP status code and failure details
+// returned to the merchant.
+func processorFailure(err error) (httpCode int, failure failureResponse) {
+	var declineErr *pprocessor.DeclineError
+
+	switch {
+	case errors.As(err, &declineErr):
+		failure = failureResponse{ErrorCode: ErrorCodeDeclined, ErrorMessage: declineErr.Error(),
+			DeclineCode: declineErr.Code}
+		return 200, failure
+	case errors.Is(err, pprocessor.ErrCircuitOpen):
+		return 503, failureResponse{ErrorCode: ErrorCodeProcessorCircuitOpen,
+			ErrorMessage: pprocessor.ErrCircuitOpen.Error()}
+	case errors.Is(err, pprocessor.ErrTimeout):
+		return 504, failureResponse{ErrorCode: ErrorCodeProcessorTimeout, ErrorMessage: pprocessor.ErrTimeout.Error()}
+	case errors.Is(err, pprocessor.ErrUnavailable):
+		return 502, failureResponse{ErrorCode: ErrorCodeProcessorUnavailable,
+			ErrorMessage: pprocessor.ErrUnavailable.Error()}
+	default:
+		return 502, failureResponse{ErrorCode: ErrorCodeProcessorError, ErrorMessage: pprocessor.ErrProtocol.Error()}
+	}
+}
+
+// logProcessorError logs declines as information, as they are part of the normal business flow,
+// and any other payment processor error as an error.
+func (s *Server) logProcessorError(err error) {
+	if errors.Is(err, pprocessor.ErrDeclined) {
+		s.Logger.Info(err.Error())
+		return
+	}
+	s.Logger.Error(err.Error())
+}
+
+// markProcessorCalled records that the request may have reached the payment processor (i.e. unless the circuit
+// breaker stopped it), so that retries with the same idempotency key are never processed again.
+func markProcessorCalled(c *gin.Context, err error) {
+	if !errors.Is(err, pprocessor.ErrCircuitOpen) {
+		c.Set(middleware.ProcessorCalledKey, true)
+	}
+}
+
+// failLostAuthorisation marks the authorisation as failed if the payment processor declined the operation because it
+// does not hold the authorisation, as nothing can be done with it anymore.
+// Payments already captured keep their state, so their captures can still be looked up.
+func (s *Server) failLostAuthorisation(authID string, err error) {
+	var declineErr *pprocessor.DeclineError
+	if !errors.As(err, &declineErr) || declineErr.Code != pprocessor.DeclineCodeAuthorisationNotFound {
+		return
+	}
+
+	err = s.Repo.UpdateAuthorisationState(context.Background(), authID, entities.StateFailed)
+	var illegalErr *core.IllegalTransitionError
+	if errors.As(err, &illegalErr) {
+		return
+	} else if err != nil {
+		s.Logger.Error(fmt.Sprintf("failed to mark authorisation '%s' as failed: %s", authID, err.Error()))
+		return
+	}
+
+	s.Logger.Info(fmt.Sprintf("authorisation '%s' not held by the payment processor, marked as failed", authID))
+}
@@ -1,6 +1,9 @@
 package apimerchant
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 
 	"github.com/gin-gonic/gin"
@@ -8,23 +11,17 @@ import (
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
 )
 
-// AuthoriseTransaction handles authorisation of transactions.
+// AuthoriseTransaction handles authorisation of transactions sent to the v1 API, where card numbers are numbers.
+//
+// Merchants can either provide the card details or the token of a card used in a previous authorisation.
 func (s *Server) AuthoriseTransaction(c *gin.Context) {
-	requestBody := struct {
-		CreditCard struct {
-			Name        string `json:"name" binding:"required"`
-			Number      uint64 `json:"number" binding:"required"`
-			ExpiryMonth uint   `json:"expiry_month" binding:"required"`
-			ExpiryYear  uint   `json:"expiry_year" binding:"required"`
-			CVV         uint   `json:"cvv" binding:"required"`
-		} `json:"credit_card" binding:"required"`
-		Currency string  `json:"currency" binding:"required"`
-		Amount   float64 `json:"amount" binding:"required"`
-	}{}
+	requestBody := authorisationRequestV1{}
 
 	err := c.ShouldBindJSON(&requestBody)
 	if err != nil {
@@ -33,68 +30,256 @@ func (s *Server) AuthoriseTransaction(c *gin.Context) {
 		return
 	}
 
+	s.authorise(c, requestBody.normalise(), &validator{})
+}
+
+// AuthoriseTransactionV2 handles authorisation of transactions sent to the v2 API, where card numbers, expiry dates
+// and CVVs are strings of digits.
+//
+// Merchants can either provide the card details or the token of a card used in a previous authorisation.
+func (s *Server) AuthoriseTransactionV2(c *gin.Context) {
+	requestBody := authorisationRequestV2{}
+
+	err := c.ShouldBindJSON(&requestBody)
+	if err != nil {
+		s.Logger.Info(fmt.Sprintf("error parsing body: %s", err.Error()))
+		api.RespondWithError(c, 400, "error parsing body")
+		return
+	}
+
+	v := &validator{}
+	s.authorise(c, requestBody.normalise(v), v)
+}
+
+// authorise validates the authorisation request and sends it to the payment processor.
+// The validator holds the fields found invalid while parsing the request, if any.
+func (s *Server) authorise(c *gin.Context, requestBody authorisationRequest, v *validator) {
 	responseBody := struct {
-		AuthorisationID string  `json:"authorisation_id,omitempty"`
-		Status          string  `json:"status"`
-		ErrorMessage    string  `json:"error_message,omitempty"`
-		Amount          float64 `json:"amount,omitempty"`
-		Currency        string  `json:"currency,omitempty"`
+		AuthorisationID string `json:"authorisation_id,omitempty"`
+		Status          string `json:"status"`
+		failureResponse
+		Amount     json.Number         `json:"amount,omitempty"`
+		Currency   string              `json:"currency,omitempty"`
+		CreditCard *creditCardResponse `json:"credit_card,omitempty"`
 	}{}
 
-	// Validate credit card number
-	if !core.LuhnValid(requestBody.CreditCard.Number) {
-		errMessage := "credit card number provided does not pass Luhn check"
-		s.Logger.Info(errMessage)
-		api.RespondWithError(c, 400, errMessage)
+	// Get merchant_name
+	merchantName := c.MustGet(middleware.AuthUserKey).(string)
+
+	// Validate the whole request before any external call
+	var brand core.CardBrand
+	if (requestBody.CreditCard == nil) == (requestBody.CardToken == "") {
+		v.addError("credit_card", "either credit_card or card_token must be provided")
+	}
+
+	if requestBody.CreditCard != nil {
+		v.cardHolderName("credit_card.name", requestBody.CreditCard.Name)
+		brand = v.cardNumber("credit_card.number", requestBody.CreditCard.Number)
+		if brand != "" {
+			v.acceptedBrand("credit_card.number", brand, s.Limits.AcceptedBrands, merchantName)
+		}
+		v.cardExpiry("credit_card.expiry_month", "credit_card.expiry_year",
+			requestBody.CreditCard.ExpiryMonth, requestBody.CreditCard.ExpiryYear)
+		v.cvv("credit_card.cvv", requestBody.CreditCard.CVV, brand)
+	}
+
+	currencyValid, err := v.currency(c.Request.Context(), s.Repo, "currency", requestBody.Currency)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
 		return
 	}
 
-	// Validate expiry date
-	if !core.CardExpiryValid(requestBody.CreditCard.ExpiryYear, requestBody.CreditCard.ExpiryMonth) {
-		errMessage := "credit card provided has expired"
-		s.Logger.Info(errMessage)
-		api.RespondWithError(c, 400, errMessage)
+	var amount money.Money
+	if currencyValid {
+		var amountValid bool
+		amount, amountValid = v.amount("amount", requestBody.Amount, requestBody.Currency)
+		if amountValid {
+			v.maxAmount("amount", amount, s.Limits.MaxAmount, merchantName)
+		}
+	} else {
+		v.required("amount", requestBody.Amount != "")
+	}
+
+	if !v.valid() {
+		s.Logger.Info(fmt.Sprintf("invalid authorisation request: %d invalid fields", len(v.fieldErrors)))
+		api.RespondWithValidationErrors(c, v.fieldErrors)
 		return
 	}
 
-	// make external request to payment processor
-	authReq := pprocessor.AuthorisationRequest{
-		Currency: requestBody.Currency,
-		Amount:   requestBody.Amount,
-		CreditCard: pprocessor.CreditCard{
+	var creditCard entities.CreditCard
+	var ppCreditCard pprocessor.CreditCard
+
+	if requestBody.CardToken != "" {
+		// Retrieve card tokenised previously
+		creditCard, err = s.Repo.GetCreditCard(c.Request.Context(), merchantName, requestBody.CardToken)
+		if e, ok := err.(*repository.DBServiceError); ok {
+			if e.NotFound {
+				s.Logger.Info(err.Error())
+				api.RespondWithValidationErrors(c, []api.FieldError{{Field: "card_token", Message: err.Error()}})
+				return
+			}
+			s.Logger.Error(err.Error())
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		} else if err != nil {
+			s.Logger.Error(err.Error())
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+
+		number, err := s.Vault.Detokenise(creditCard)
+		if err != nil {
+			s.Logger.Error(fmt.Sprintf("vault error: %s", err.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+
+		if !core.OnlyDigits(number) {
+			s.Logger.Error(fmt.Sprintf("vault error: card number not numeric for token '%s'", creditCard.Token))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+
+		// Validate the card tokenised previously, cards stored before brands were recorded get it from their BIN
+		brand = core.CardBrand(creditCard.Brand)
+		if brand == "" {
+			brand = core.DetectCardBrand(creditCard.BIN)
+		}
+		v.acceptedBrand("card_token", brand, s.Limits.AcceptedBrands, merchantName)
+		if !core.CardExpiryValid(int(creditCard.ExpiryYear), int(creditCard.ExpiryMonth)) {
+			v.addError("card_token", "credit card provided has expired")
+		}
+		if !v.valid() {
+			s.Logger.Info(fmt.Sprintf("invalid authorisation request: %d invalid fields", len(v.fieldErrors)))
+			api.RespondWithValidationErrors(c, v.fieldErrors)
+			return
+		}
+
+		ppCreditCard = pprocessor.CreditCard{
+			Name:        creditCard.Name,
+			Number:      number,
+			ExpiryMonth: creditCard.ExpiryMonth,
+			ExpiryYear:  creditCard.ExpiryYear,
+		}
+	} else {
+		creditCard, err = s.Vault.Tokenise(requestBody.CreditCard.Number, requestBody.CreditCard.Name,
+			requestBody.CreditCard.ExpiryMonth, requestBody.CreditCard.ExpiryYear)
+		if errors.Is(err, vault.ErrInvalidCardNumber) {
+			s.Logger.Info(err.Error())
+			api.RespondWithValidationErrors(c, []api.FieldError{{Field: "credit_card.number", Message: err.Error()}})
+			return
+		} else if err != nil {
+			s.Logger.Error(fmt.Sprintf("vault error: %s", err.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+		creditCard.Brand = string(brand)
+
+		ppCreditCard = pprocessor.CreditCard{
 			Name:        requestBody.CreditCard.Name,
 			Number:      requestBody.CreditCard.Number,
 			ExpiryMonth: requestBody.CreditCard.ExpiryMonth,
 			ExpiryYear:  requestBody.CreditCard.ExpiryYear,
 			CVV:         requestBody.CreditCard.CVV,
-		},
+		}
 	}
-	authID, ok := s.PProcessor.AuthorisePayment(authReq)
-	if !ok {
-		responseBody.Status = "fail"
-		c.JSON(200, responseBody)
+
+	if requestBody.CardToken == "" {
+		// Store card in the vault (or get the token of the same card tokenised before)
+		creditCard, err = s.Repo.SaveCreditCard(c.Request.Context(), merchantName, creditCard)
+		if err != nil {
+			s.Logger.Error(err.Error())
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+	}
+
+	// Journal the authorisation request before sending it, so it can be reconciled if its outcome is unknown
+	reference, err := core.NewReference()
+	if err != nil {
+		s.Logger.Error(fmt.Sprintf("failed to generate authorisation reference: %s", err.Error()))
+		api.RespondWithError(c, 500, "Internal error")
 		return
 	}
 
-	// Get merchant_name
-	merchantName := c.MustGet(middleware.AuthUserKey).(string)
+	journalEntry := entities.AuthorisationJournalEntry{
+		Reference:       reference,
+		MerchantName:    merchantName,
+		Amount:          amount,
+		CreditCardToken: creditCard.Token,
+	}
+	err = s.Repo.JournalAuthorisation(c.Request.Context(), journalEntry)
+	if e, ok := err.(*repository.DBServiceError); ok {
+		if e.ValidationFail {
+			s.Logger.Info(err.Error())
+			api.RespondWithError(c, 400, err.Error())
+			return
+		}
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	} else if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	// make external request to payment processor
+	authReq := pprocessor.AuthorisationRequest{
+		Amount:     amount,
+		CreditCard: ppCreditCard,
+		Reference:  reference,
+	}
+	authID, err := s.PProcessor.AuthorisePayment(c.Request.Context(), authReq)
+	markProcessorCalled(c, err)
+	if err != nil {
+		s.logProcessorError(err)
+
+		// If the payment processor might have authorised the payment, the journal entry is left for the reconciler
+		if !pprocessor.OutcomeUnknown(err) {
+			if err := s.Repo.FailAuthorisationJournalEntry(context.Background(), reference); err != nil {
+				s.Logger.Error(fmt.Sprintf("failed to record outcome of authorisation request '%s': %s",
+					reference, err.Error()))
+			}
+		}
+
+		httpCode, failure := processorFailure(err)
+		responseBody.Status = "fail"
+		responseBody.failureResponse = failure
+		c.JSON(httpCode, responseBody)
+		return
+	}
 
 	authRecord := entities.Authorisation{
 		ID:           authID,
-		State:        "Authorised",
-		Currency:     requestBody.Currency,
-		Amount:       requestBody.Amount,
+		State:        entities.StateAuthorised,
+		Amount:       amount,
 		MerchantName: merchantName,
-		CreditCard: &entities.CreditCard{
-			Number:      requestBody.CreditCard.Number,
-			Name:        requestBody.CreditCard.Name,
-			ExpiryMonth: requestBody.CreditCard.ExpiryMonth,
-			ExpiryYear:  requestBody.CreditCard.ExpiryYear,
-			CVV:         requestBody.CreditCard.CVV,
-		},
+		CreditCard:   &creditCard,
+		Reference:    reference,
 	}
 
-	err = s.Repo.AddAuthorisation(authRecord)
+	// The authorisation is recorded even if the merchant has gone away in the meantime
+	err = s.Repo.AddAuthorisation(context.Background(), authRecord)
+	if err != nil {
+		stored, errCheck := s.authorisationStored(authID, err)
+		if errCheck != nil {
+			// Whether the authorisation was stored is unknown, its journal entry is left for the reconciler
+			s.Logger.Error(fmt.Sprintf("failed to store authorisation '%s' (left to the reconciler): %s "+
+				"(and to check whether it was stored: %s)", authID, err.Error(), errCheck.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+
+		if stored {
+			s.Logger.Info(fmt.Sprintf("authorisation '%s' already stored: %s", authID, err.Error()))
+			err = nil
+		} else {
+			// The payment processor holds funds for an authorisation the merchant will never know about
+			s.compensateAuthorisation(reference, authID)
+		}
+	}
 	if e, ok := err.(*repository.DBServiceError); ok {
 		if e.ValidationFail {
 			s.Logger.Info(err.Error())
@@ -110,10 +295,16 @@ func (s *Server) AuthoriseTransaction(c *gin.Context) {
 		return
 	}
 
-	responseBody.Amount = requestBody.Amount
-	responseBody.Currency = requestBody.Currency
+	responseBody.Amount = json.Number(amount.Decimal())
+	responseBody.Currency = amount.Currency
 	responseBody.Status = "success"
 	responseBody.AuthorisationID = authID
+	responseBody.CreditCard = &creditCardResponse{
+		Token:    creditCard.Token,
+		BIN:      creditCard.BIN,
+		LastFour: creditCard.LastFour,
+		Brand:    string(brand),
+	}
 
 	c.JSON(200, responseBody)
 }
@@ -121,8 +312,8 @@ func (s *Server) AuthoriseTransaction(c *gin.Context) {
 // CaptureTransaction handles capturing of transactions.
 func (s *Server) CaptureTransaction(c *gin.Context) {
 	requestBody := struct {
-		AuthorisationID string  `json:"authorisation_id" binding:"required"`
-		Amount          float64 `json:"amount" binding:"required"`
+		AuthorisationID string      `json:"authorisation_id"`
+		Amount          json.Number `json:"amount"`
 	}{}
 
 	err := c.ShouldBindJSON(&requestBody)
@@ -133,17 +324,25 @@ func (s *Server) CaptureTransaction(c *gin.Context) {
 	}
 
 	responseBody := struct {
-		Status       string  `json:"status"`
-		ErrorMessage string  `json:"error_message,omitempty"`
-		Amount       float64 `json:"amount,omitempty"`
-		Currency     string  `json:"currency,omitempty"`
+		Status string `json:"status"`
+		failureResponse
+		Amount   json.Number `json:"amount,omitempty"`
+		Currency string      `json:"currency,omitempty"`
 	}{}
 
+	v := validator{}
+	v.required("authorisation_id", requestBody.AuthorisationID != "")
+	v.required("amount", requestBody.Amount != "")
+	if !v.valid() {
+		api.RespondWithValidationErrors(c, v.fieldErrors)
+		return
+	}
+
 	// Get merchant_name
 	merchantName := c.MustGet(middleware.AuthUserKey).(string)
 
 	// Check if authID is in authorisations table
-	authDetails, err := s.Repo.GetAuthorisationDetails(requestBody.AuthorisationID)
+	authDetails, err := s.Repo.GetAuthorisationDetails(c.Request.Context(), requestBody.AuthorisationID)
 	if e, ok := err.(*repository.DBServiceError); ok {
 		if e.NotFound {
 			api.RespondWithError(c, 404, err.Error())
@@ -164,50 +363,72 @@ func (s *Server) CaptureTransaction(c *gin.Context) {
 		return
 	}
 
-	// check state is either "authorised" or "captured"
-	if authDetails.State != "Authorised" && authDetails.State != "Captured" {
-		api.RespondWithError(c, 400, fmt.Sprintf("cannot capture payment - payment has been '%s'", authDetails.State))
+	// Validate amount, which is always in the currency of the authorisation
+	amount, amountValid := v.amount("amount", requestBody.Amount, authDetails.Amount.Currency)
+	if !amountValid {
+		api.RespondWithValidationErrors(c, v.fieldErrors)
 		return
 	}
 
-	// Check we can still capture money (haven't reached the limit yet)
-	capturedSum := 0.0
-
-	for _, transItem := range authDetails.Transaction {
-		if transItem.Type == "Capture" {
-			capturedSum += transItem.Amount
+	// Reserve the capture, which checks the payment state and amounts while no other operation can run on it
+	transItem := entities.Transaction{Type: entities.TransactionCapture, Amount: amount}
+	transID, err := s.Repo.ReserveTransaction(c.Request.Context(), requestBody.AuthorisationID, transItem)
+	if e, ok := err.(*repository.DBServiceError); ok {
+		var inProgressErr *core.OperationInProgressError
+		if errors.As(err, &inProgressErr) {
+			api.RespondWithError(c, 409, err.Error())
+			return
+		} else if e.ValidationFail {
+			api.RespondWithError(c, 400, err.Error())
+			return
+		} else if e.NotFound {
+			api.RespondWithError(c, 404, err.Error())
+			return
 		}
-	}
-
-	if requestBody.Amount > authDetails.Amount-capturedSum {
-		api.RespondWithError(c, 400, "cannot request more money than what was authorised")
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	} else if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
 		return
 	}
 
 	// make external request to payment processor
 	captureReq := pprocessor.CaptureRequest{
 		AuthorisationID: requestBody.AuthorisationID,
-		Amount:          requestBody.Amount,
+		Amount:          amount,
+		RequestID:       transID,
+	}
+
+	ppErr := s.PProcessor.CaptureTransaction(c.Request.Context(), captureReq)
+	markProcessorCalled(c, ppErr)
+
+	// update DB with the outcome of the transaction (and new state)
+	// The outcome is recorded even if the merchant has gone away in the meantime
+	// If the outcome is unknown, the capture is left pending for the reconciler
+	if !pprocessor.OutcomeUnknown(ppErr) {
+		err = s.Repo.CompleteTransaction(context.Background(), requestBody.AuthorisationID, transID, ppErr == nil)
+		if err != nil {
+			s.Logger.Error(fmt.Sprintf("failed to record outcome of capture '%s' for authorisation '%s': %s",
+				transID, requestBody.AuthorisationID, err.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+		s.failLostAuthorisation(requestBody.AuthorisationID, ppErr)
 	}
 
-	ok := s.PProcessor.CaptureTransaction(captureReq)
-	if !ok {
+	if ppErr != nil {
+		s.logProcessorError(ppErr)
+		httpCode, failure := processorFailure(ppErr)
 		responseBody.Status = "fail"
-		c.JSON(200, responseBody)
+		responseBody.failureResponse = failure
+		c.JSON(httpCode, responseBody)
 		return
 	}
 
-	// update DB with new transaction and state
-	transItem := entities.Transaction{Type: "Capture", Amount: requestBody.Amount}
-	err = s.Repo.AddTransaction(requestBody.AuthorisationID, transItem)
-	if err != nil {
-		s.Logger.Error(err.Error())
-		api.RespondWithError(c, 500, "Internal error")
-		return
-	}
-
-	responseBody.Amount = requestBody.Amount
-	responseBody.Currency = authDetails.Currency
+	responseBody.Amount = json.Number(amount.Decimal())
+	responseBody.Currency = amount.Currency
 	responseBody.Status = "success"
 
 	c.JSON(200, responseBody)
@@ -216,8 +437,8 @@ func (s *Server) CaptureTransaction(c *gin.Context) {
 // RefundTransaction handles refunding of transactions.
 func (s *Server) RefundTransaction(c *gin.Context) {
 	requestBody := struct {
-		AuthorisationID string  `json:"authorisation_id" binding:"required"`
-		Amount          float64 `json:"amount" binding:"required"`
+		AuthorisationID string      `json:"authorisation_id"`
+		Amount          json.Number `json:"amount"`
 	}{}
 
 	err := c.ShouldBindJSON(&requestBody)
@@ -228,17 +449,25 @@ func (s *Server) RefundTransaction(c *gin.Context) {
 	}
 
 	responseBody := struct {
-		Status       string  `json:"status"`
-		ErrorMessage string  `json:"error_message,omitempty"`
-		Amount       float64 `json:"amount,omitempty"`
-		Currency     string  `json:"currency,omitempty"`
+		Status string `json:"status"`
+		failureResponse
+		Amount   json.Number `json:"amount,omitempty"`
+		Currency string      `json:"currency,omitempty"`
 	}{}
 
+	v := validator{}
+	v.required("authorisation_id", requestBody.AuthorisationID != "")
+	v.required("amount", requestBody.Amount != "")
+	if !v.valid() {
+		api.RespondWithValidationErrors(c, v.fieldErrors)
+		return
+	}
+
 	// Get merchant_name
 	merchantName := c.MustGet(middleware.AuthUserKey).(string)
 
 	// Check if authID is in authorisations table
-	authDetails, err := s.Repo.GetAuthorisationDetails(requestBody.AuthorisationID)
+	authDetails, err := s.Repo.GetAuthorisationDetails(c.Request.Context(), requestBody.AuthorisationID)
 	if e, ok := err.(*repository.DBServiceError); ok {
 		if e.NotFound {
 			api.RespondWithError(c, 404, err.Error())
@@ -259,52 +488,71 @@ func (s *Server) RefundTransaction(c *gin.Context) {
 		return
 	}
 
-	// check state is either "refunded" or "captured"
-	if authDetails.State != "Refunded" && authDetails.State != "Captured" {
-		api.RespondWithError(c, 400, fmt.Sprintf("cannot refund payment - payment has been '%s'", authDetails.State))
+	// Validate amount, which is always in the currency of the authorisation
+	amount, amountValid := v.amount("amount", requestBody.Amount, authDetails.Amount.Currency)
+	if !amountValid {
+		api.RespondWithValidationErrors(c, v.fieldErrors)
 		return
 	}
 
-	// Check we can still refund money (haven't reached 0)
-	capturedSum := 0.0
-
-	for _, transItem := range authDetails.Transaction {
-		if transItem.Type == "Capture" {
-			capturedSum += transItem.Amount
-		} else if transItem.Type == "Refund" {
-			capturedSum -= transItem.Amount
+	// Reserve the refund, which checks the payment state and amounts while no other operation can run on it
+	transItem := entities.Transaction{Type: entities.TransactionRefund, Amount: amount}
+	transID, err := s.Repo.ReserveTransaction(c.Request.Context(), requestBody.AuthorisationID, transItem)
+	if e, ok := err.(*repository.DBServiceError); ok {
+		var inProgressErr *core.OperationInProgressError
+		if errors.As(err, &inProgressErr) {
+			api.RespondWithError(c, 409, err.Error())
+			return
+		} else if e.ValidationFail {
+			api.RespondWithError(c, 400, err.Error())
+			return
+		} else if e.NotFound {
+			api.RespondWithError(c, 404, err.Error())
+			return
 		}
-	}
-
-	if requestBody.Amount > capturedSum {
-		api.RespondWithError(c, 400, "cannot refund more money than what was captured")
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	} else if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
 		return
 	}
 
 	// make external request to payment processor
 	refundReq := pprocessor.RefundRequest{
 		AuthorisationID: requestBody.AuthorisationID,
-		Amount:          requestBody.Amount,
+		Amount:          amount,
+		RequestID:       transID,
+	}
+
+	ppErr := s.PProcessor.RefundTransaction(c.Request.Context(), refundReq)
+	markProcessorCalled(c, ppErr)
+
+	// update DB with the outcome of the transaction (and new state)
+	// The outcome is recorded even if the merchant has gone away in the meantime
+	// If the outcome is unknown, the refund is left pending for the reconciler
+	if !pprocessor.OutcomeUnknown(ppErr) {
+		err = s.Repo.CompleteTransaction(context.Background(), requestBody.AuthorisationID, transID, ppErr == nil)
+		if err != nil {
+			s.Logger.Error(fmt.Sprintf("failed to record outcome of refund '%s' for authorisation '%s': %s",
+				transID, requestBody.AuthorisationID, err.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
 	}
 
-	ok := s.PProcessor.RefundTransaction(refundReq)
-	if !ok {
+	if ppErr != nil {
+		s.logProcessorError(ppErr)
+		httpCode, failure := processorFailure(ppErr)
 		responseBody.Status = "fail"
-		c.JSON(200, responseBody)
+		responseBody.failureResponse = failure
+		c.JSON(httpCode, responseBody)
 		return
 	}
 
-	// update DB with new transaction and state
-	transItem := entities.Transaction{Type: "Refund", Amount: requestBody.Amount}
-	err = s.Repo.AddTransaction(requestBody.AuthorisationID, transItem)
-	if err != nil {
-		s.Logger.Error(err.Error())
-		api.RespondWithError(c, 500, "Internal error")
-		return
-	}
-
-	responseBody.Amount = requestBody.Amount
-	responseBody.Currency = authDetails.Currency
+	responseBody.Amount = json.Number(amount.Decimal())
+	responseBody.Currency = amount.Currency
 	responseBody.Status = "success"
 
 	c.JSON(200, responseBody)
@@ -313,7 +561,7 @@ func (s *Server) RefundTransaction(c *gin.Context) {
 // VoidTransaction handles voiding transactions.
 func (s *Server) VoidTransaction(c *gin.Context) {
 	requestBody := struct {
-		AuthorisationID string `json:"authorisation_id" binding:"required"`
+		AuthorisationID string `json:"authorisation_id"`
 	}{}
 
 	err := c.ShouldBindJSON(&requestBody)
@@ -324,15 +572,21 @@ func (s *Server) VoidTransaction(c *gin.Context) {
 	}
 
 	responseBody := struct {
-		Status       string `json:"status"`
-		ErrorMessage string `json:"error_message,omitempty"`
+		Status string `json:"status"`
+		failureResponse
 	}{}
 
+	v := validator{}
+	if !v.required("authorisation_id", requestBody.AuthorisationID != "") {
+		api.RespondWithValidationErrors(c, v.fieldErrors)
+		return
+	}
+
 	// Get merchant_name
 	merchantName := c.MustGet(middleware.AuthUserKey).(string)
 
 	// Check if authID is in authorisations table
-	authDetails, err := s.Repo.GetAuthorisationDetails(requestBody.AuthorisationID)
+	authDetails, err := s.Repo.GetAuthorisationDetails(c.Request.Context(), requestBody.AuthorisationID)
 	if e, ok := err.(*repository.DBServiceError); ok {
 		if e.NotFound {
 			api.RespondWithError(c, 404, err.Error())
@@ -353,33 +607,113 @@ func (s *Server) VoidTransaction(c *gin.Context) {
 		return
 	}
 
-	// check state is "authorised"
-	if authDetails.State != "Authorised" {
-		api.RespondWithError(c, 400, fmt.Sprintf("cannot void payment - payment has been '%s'", authDetails.State))
+	// Reserve the void, which checks the payment state while no other operation can run on it
+	transItem := entities.Transaction{Type: entities.TransactionVoid, Amount: money.Zero(authDetails.Amount.Currency)}
+	transID, err := s.Repo.ReserveTransaction(c.Request.Context(), requestBody.AuthorisationID, transItem)
+	if e, ok := err.(*repository.DBServiceError); ok {
+		var inProgressErr *core.OperationInProgressError
+		if errors.As(err, &inProgressErr) {
+			api.RespondWithError(c, 409, err.Error())
+			return
+		} else if e.ValidationFail {
+			api.RespondWithError(c, 400, err.Error())
+			return
+		} else if e.NotFound {
+			api.RespondWithError(c, 404, err.Error())
+			return
+		}
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	} else if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
 		return
 	}
 
 	// make external request to payment processor
 	voidReq := pprocessor.VoidRequest{
 		AuthorisationID: requestBody.AuthorisationID,
+		RequestID:       transID,
+	}
+
+	ppErr := s.PProcessor.VoidPayment(c.Request.Context(), voidReq)
+	markProcessorCalled(c, ppErr)
+
+	// update DB with the outcome of the void (and new state)
+	// The outcome is recorded even if the merchant has gone away in the meantime
+	// If the outcome is unknown, the void is left pending for the reconciler
+	if !pprocessor.OutcomeUnknown(ppErr) {
+		err = s.Repo.CompleteTransaction(context.Background(), requestBody.AuthorisationID, transID, ppErr == nil)
+		if err != nil {
+			s.Logger.Error(fmt.Sprintf("failed to record outcome of void '%s' for authorisation '%s': %s",
+				transID, requestBody.AuthorisationID, err.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		}
+		s.failLostAuthorisation(requestBody.AuthorisationID, ppErr)
 	}
 
-	ok := s.PProcessor.VoidPayment(voidReq)
-	if !ok {
+	if ppErr != nil {
+		s.logProcessorError(ppErr)
+		httpCode, failure := processorFailure(ppErr)
 		responseBody.Status = "fail"
-		c.JSON(200, responseBody)
+		responseBody.failureResponse = failure
+		c.JSON(httpCode, responseBody)
+		return
+	}
+
+	responseBody.Status = "success"
+
+	c.JSON(200, responseBody)
+}
+
+// authorisationStored returns whether the authorisation is stored, although storing it failed with err.
+// It may be, if the commit succeeded but its outcome was lost, or if the reconciler stored it in the meantime.
+func (s *Server) authorisationStored(authID string, err error) (bool, error) {
+	if errors.Is(err, repository.ErrAuthorisationExists) {
+		return true, nil
+	}
+
+	_, err = s.Repo.GetAuthorisationDetails(context.Background(), authID)
+	if e, ok := err.(*repository.DBServiceError); ok && e.NotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// compensateAuthorisation voids the authorisation granted by the payment processor that could not be stored.
+// If the void fails, it is retried by the reconciler.
+func (s *Server) compensateAuthorisation(reference string, authID string) {
+	ctx := context.Background()
+
+	// The compensation must be recorded before voiding: an authorisation voided while its journal entry is still
+	// pending would be recorded by the reconciler
+	err := s.Repo.StartCompensation(ctx, reference, authID)
+	if err != nil {
+		s.Logger.Error(fmt.Sprintf("failed to record compensation of authorisation '%s' (left to the reconciler): %s",
+			authID, err.Error()))
 		return
 	}
 
-	// update DB with new transaction and state
-	err = s.Repo.UpdateAuthorisationState(requestBody.AuthorisationID, "Voided")
+	err = core.CompensateAuthorisation(ctx, s.Repo, s.PProcessor, reference, authID)
 	if err != nil {
-		s.Logger.Error(err.Error())
-		api.RespondWithError(c, 500, "Internal error")
+		s.Logger.Error(fmt.Sprintf("compensation of authorisation request '%s' failed (retried by the reconciler): %s",
+			reference, err.Error()))
 		return
 	}
 
-	responseBody.Status = "success"
+	s.Logger.Info(fmt.Sprintf("authorisation '%s' could not be stored and was voided", authID))
+}
 
-	c.JSON(200, responseBody)
+// creditCardResponse is the tokenised card handed back to merchants.
+// The token can be used in place of the card details on subsequent authorisations.
+type creditCardResponse struct {
+	Token    string `json:"token"`
+	BIN      string `json:"bin"`
+	LastFour string `json:"last4"`
+	Brand    string `json:"brand"`
 }
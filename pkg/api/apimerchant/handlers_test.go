@@ -0,0 +1,905 @@
+package apimerchant_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/apimerchant"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/inmemory"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowProcessor approves everything after a short delay, which widens the window for races between requests.
+type slowProcessor struct {
+	mu       sync.Mutex
+	captured int64
+	refunded int64
+}
+
+func (p *slowProcessor) AuthorisePayment(context.Context, pprocessor.AuthorisationRequest) (string, error) {
+	return "", &pprocessor.DeclineError{Code: 2}
+}
+
+func (p *slowProcessor) CaptureTransaction(_ context.Context, req pprocessor.CaptureRequest) error {
+	time.Sleep(5 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.captured += req.Amount.MinorUnits
+	return nil
+}
+
+func (p *slowProcessor) RefundTransaction(_ context.Context, req pprocessor.RefundRequest) error {
+	time.Sleep(5 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.refunded += req.Amount.MinorUnits
+	return nil
+}
+
+func (p *slowProcessor) VoidPayment(context.Context, pprocessor.VoidRequest) error {
+	return nil
+}
+
+func (p *slowProcessor) QueryOperation(context.Context, pprocessor.QueryRequest) (pprocessor.QueryResponse, error) {
+	return pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryNotFound}, nil
+}
+
+func setupConcurrencyTest(t *testing.T) (*gin.Engine, *inmemory.Repository, *slowProcessor) {
+	repo := inmemory.NewRepository("EUR")
+	_, err := repo.SaveCreditCard(context.Background(), "bill", entities.CreditCard{Token: "tok_1", Fingerprint: "fp_1"})
+	require.NoError(t, err)
+	err = repo.AddAuthorisation(context.Background(), entities.Authorisation{
+		ID:           "auth1",
+		State:        entities.StateAuthorised,
+		Amount:       money.Money{MinorUnits: 1000, Currency: "EUR"},
+		MerchantName: "bill",
+		CreditCard:   &entities.CreditCard{Token: "tok_1"},
+	})
+	require.NoError(t, err)
+
+	pproc := &slowProcessor{}
+	s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+	router.POST("/capture", s.CaptureTransaction)
+	router.POST("/refund", s.RefundTransaction)
+	router.POST("/void", s.VoidTransaction)
+
+	return router, repo, pproc
+}
+
+// fireParallel sends the same request n times concurrently and returns how many succeeded.
+func fireParallel(router *gin.Engine, n int, path string, body string) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	successes := 0
+
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code == 200 && strings.Contains(w.Body.String(), `"status":"success"`) {
+				mu.Lock()
+				successes++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return successes
+}
+
+func completedSum(t *testing.T, repo *inmemory.Repository, transactionType entities.TransactionType) int64 {
+	auth, err := repo.GetAuthorisationDetails(context.Background(), "auth1")
+	require.NoError(t, err)
+
+	var sum int64
+	for _, transItem := range auth.Transaction {
+		if transItem.Type == transactionType && transItem.Status == entities.TransactionCompleted {
+			sum += transItem.Amount.MinorUnits
+		}
+	}
+	return sum
+}
+
+func TestParallelCapturesNeverExceedAuthorisedAmount(t *testing.T) {
+	router, repo, pproc := setupConcurrencyTest(t)
+
+	// 30 captures of 0.70 against 10.00 authorised: only 14 can go through
+	successes := fireParallel(router, 30, "/capture", `{"authorisation_id": "auth1", "amount": 0.70}`)
+
+	assert.Equal(t, 14, successes)
+	assert.Equal(t, int64(980), pproc.captured)
+	assert.Equal(t, int64(980), completedSum(t, repo, entities.TransactionCapture))
+}
+
+func TestParallelRefundsNeverExceedCapturedAmount(t *testing.T) {
+	router, repo, pproc := setupConcurrencyTest(t)
+
+	successes := fireParallel(router, 1, "/capture", `{"authorisation_id": "auth1", "amount": 5.00}`)
+	require.Equal(t, 1, successes)
+
+	// 20 refunds of 1.00 against 5.00 captured: only 5 can go through
+	successes = fireParallel(router, 20, "/refund", `{"authorisation_id": "auth1", "amount": 1.00}`)
+
+	assert.Equal(t, 5, successes)
+	assert.Equal(t, int64(500), pproc.refunded)
+	assert.Equal(t, int64(500), completedSum(t, repo, entities.TransactionRefund))
+}
+
+// failingProcessor fails every capture with the given error.
+type failingProcessor struct {
+	slowProcessor
+	err error
+}
+
+func (p *failingProcessor) CaptureTransaction(context.Context, pprocessor.CaptureRequest) error {
+	return p.err
+}
+
+func TestCaptureProcessorFailures(t *testing.T) {
+	tests := map[string]struct {
+		err                error
+		expectedStatusCode int
+		expectedErrorCode  string
+		expectedStatus     entities.TransactionStatus
+		expectedState      entities.PaymentState
+	}{
+		"declined": {err: &pprocessor.DeclineError{Code: 5, Reason: "insufficient funds"},
+			expectedStatusCode: 200, expectedErrorCode: apimerchant.ErrorCodeDeclined,
+			expectedStatus: entities.TransactionFailed},
+		"authorisation not found": {err: &pprocessor.DeclineError{Code: pprocessor.DeclineCodeAuthorisationNotFound,
+			Reason: "authorisation not found"}, expectedStatusCode: 200, expectedErrorCode: apimerchant.ErrorCodeDeclined,
+			expectedStatus: entities.TransactionFailed, expectedState: entities.StateFailed},
+		"unavailable": {err: &pprocessor.Error{Kind: pprocessor.ErrUnavailable, Op: "capture"},
+			expectedStatusCode: 502, expectedErrorCode: apimerchant.ErrorCodeProcessorUnavailable,
+			expectedStatus: entities.TransactionPending},
+		"timeout": {err: &pprocessor.Error{Kind: pprocessor.ErrTimeout, Op: "capture"},
+			expectedStatusCode: 504, expectedErrorCode: apimerchant.ErrorCodeProcessorTimeout,
+			expectedStatus: entities.TransactionPending},
+		"protocol error": {err: &pprocessor.Error{Kind: pprocessor.ErrProtocol, Op: "capture"},
+			expectedStatusCode: 502, expectedErrorCode: apimerchant.ErrorCodeProcessorError,
+			expectedStatus: entities.TransactionPending},
+		"circuit open": {err: &pprocessor.Error{Kind: pprocessor.ErrCircuitOpen, Op: "capture"},
+			expectedStatusCode: 503, expectedErrorCode: apimerchant.ErrorCodeProcessorCircuitOpen,
+			expectedStatus: entities.TransactionFailed},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, repo, _ := setupConcurrencyTest(t)
+			s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: &failingProcessor{err: test.err}}
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+			router.POST("/capture", s.CaptureTransaction)
+
+			req := httptest.NewRequest(http.MethodPost, "/capture",
+				strings.NewReader(`{"authorisation_id": "auth1", "amount": 1.00}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatusCode, w.Code)
+			assert.Contains(t, w.Body.String(), `"status":"fail"`)
+			assert.Contains(t, w.Body.String(), `"error_code":"`+test.expectedErrorCode+`"`)
+
+			// a refused capture no longer counts towards the limits,
+			// a capture with an unknown outcome is left pending for the reconciler
+			auth, err := repo.GetAuthorisationDetails(context.Background(), "auth1")
+			require.NoError(t, err)
+			require.Len(t, auth.Transaction, 1)
+			assert.Equal(t, test.expectedStatus, auth.Transaction[0].Status)
+
+			// the payment fails once the payment processor no longer holds the authorisation
+			if test.expectedState == "" {
+				test.expectedState = entities.StateAuthorised
+			}
+			assert.Equal(t, test.expectedState, auth.State)
+		})
+	}
+}
+
+// authorisingProcessor approves every authorisation (as "pp_auth1", "pp_auth2", ...) and fails voids with the given
+// error.
+type authorisingProcessor struct {
+	slowProcessor
+	voidErr        error
+	voids          []pprocessor.VoidRequest
+	authorisations []pprocessor.AuthorisationRequest
+}
+
+func (p *authorisingProcessor) AuthorisePayment(_ context.Context, req pprocessor.AuthorisationRequest) (string,
+	error) {
+	p.authorisations = append(p.authorisations, req)
+	return "pp_auth" + strconv.Itoa(len(p.authorisations)), nil
+}
+
+func (p *authorisingProcessor) VoidPayment(_ context.Context, req pprocessor.VoidRequest) error {
+	p.voids = append(p.voids, req)
+	return p.voidErr
+}
+
+// unwritableRepository fails to store authorisations.
+type unwritableRepository struct {
+	*inmemory.Repository
+}
+
+func (r unwritableRepository) AddAuthorisation(context.Context, entities.Authorisation) error {
+	return &repository.DBServiceError{Msg: "database error", Err: errors.New("connection lost")}
+}
+
+func TestAuthorisationNotStoredIsVoided(t *testing.T) {
+	tests := map[string]struct {
+		voidErr               error
+		expectedJournalStatus entities.JournalStatus
+	}{
+		"void accepted": {expectedJournalStatus: entities.JournalVoided},
+		"void failed": {voidErr: &pprocessor.Error{Kind: pprocessor.ErrUnavailable, Op: "void"},
+			expectedJournalStatus: entities.JournalCompensating},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := unwritableRepository{inmemory.NewRepository("EUR")}
+			pproc := &authorisingProcessor{voidErr: test.voidErr}
+			cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+			require.NoError(t, err)
+
+			s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc, Vault: cardVault}
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+			router.POST("/authorise", s.AuthoriseTransaction)
+
+			expiryYear := strconv.Itoa(time.Now().Year() + 1)
+			req := httptest.NewRequest(http.MethodPost, "/authorise", strings.NewReader(`{"credit_card": {
+				"name": "Bill", "number": 4242424242424242, "expiry_month": 12, "expiry_year": `+expiryYear+`,
+				"cvv": 123}, "currency": "EUR", "amount": 10.00}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, 500, w.Code)
+			require.Len(t, pproc.voids, 1)
+			assert.Equal(t, "pp_auth1", pproc.voids[0].AuthorisationID)
+
+			entries, err := repo.GetAuthorisationJournal(context.Background(), test.expectedJournalStatus,
+				time.Now().Add(time.Second))
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, "pp_auth1", entries[0].AuthorisationID)
+		})
+	}
+}
+
+// lostCommitRepository stores authorisations but reports a failure, as when the outcome of a commit is lost.
+// If alreadyStored is set, it reports the authorisation as already stored instead.
+// If lookupErr is set, looking up authorisations fails.
+type lostCommitRepository struct {
+	*inmemory.Repository
+	alreadyStored bool
+	lookupErr     error
+}
+
+func (r lostCommitRepository) AddAuthorisation(ctx context.Context, auth entities.Authorisation) error {
+	if err := r.Repository.AddAuthorisation(ctx, auth); err != nil {
+		return err
+	}
+	if r.alreadyStored {
+		return repository.ErrAuthorisationExists
+	}
+	return &repository.DBServiceError{Msg: "database error", Err: errors.New("connection lost")}
+}
+
+func (r lostCommitRepository) GetAuthorisationDetails(ctx context.Context, authID string) (entities.Authorisation,
+	error) {
+	if r.lookupErr != nil {
+		return entities.Authorisation{}, r.lookupErr
+	}
+	return r.Repository.GetAuthorisationDetails(ctx, authID)
+}
+
+func TestAuthorisationAlreadyStoredIsNotVoided(t *testing.T) {
+	tests := map[string]struct {
+		repo                  lostCommitRepository
+		expectedStatusCode    int
+		expectedJournalStatus entities.JournalStatus
+	}{
+		"already stored": {repo: lostCommitRepository{alreadyStored: true},
+			expectedStatusCode: 200, expectedJournalStatus: entities.JournalCompleted},
+		"commit outcome lost": {repo: lostCommitRepository{},
+			expectedStatusCode: 200, expectedJournalStatus: entities.JournalCompleted},
+		"lookup failed": {repo: lostCommitRepository{lookupErr: &repository.DBServiceError{Msg: "database error",
+			Err: errors.New("connection lost")}},
+			expectedStatusCode: 500, expectedJournalStatus: entities.JournalCompleted},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := test.repo
+			repo.Repository = inmemory.NewRepository("EUR")
+			pproc := &authorisingProcessor{}
+			cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+			require.NoError(t, err)
+
+			s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc, Vault: cardVault}
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+			router.POST("/authorise", s.AuthoriseTransaction)
+
+			expiryYear := strconv.Itoa(time.Now().Year() + 1)
+			req := httptest.NewRequest(http.MethodPost, "/authorise", strings.NewReader(`{"credit_card": {
+				"name": "Bill", "number": 4242424242424242, "expiry_month": 12, "expiry_year": `+expiryYear+`,
+				"cvv": 123}, "currency": "EUR", "amount": 10.00}`))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatusCode, w.Code)
+			if test.expectedStatusCode == 200 {
+				assert.Contains(t, w.Body.String(), `"authorisation_id":"pp_auth1"`)
+			}
+
+			// The authorisation stored is never voided, nor its journal entry overwritten
+			assert.Empty(t, pproc.voids)
+			auth, err := repo.Repository.GetAuthorisationDetails(context.Background(), "pp_auth1")
+			require.NoError(t, err)
+			assert.Equal(t, entities.StateAuthorised, auth.State)
+
+			entries, err := repo.GetAuthorisationJournal(context.Background(), test.expectedJournalStatus,
+				time.Now().Add(time.Second))
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, "pp_auth1", entries[0].AuthorisationID)
+		})
+	}
+}
+
+// timingOutProcessor times out on every authorisation and capture, after receiving them.
+type timingOutProcessor struct {
+	slowProcessor
+	authorisations int
+	captures       int
+}
+
+func (p *timingOutProcessor) AuthorisePayment(context.Context, pprocessor.AuthorisationRequest) (string, error) {
+	p.authorisations++
+	return "", &pprocessor.Error{Kind: pprocessor.ErrTimeout, Op: "authorise"}
+}
+
+func (p *timingOutProcessor) CaptureTransaction(context.Context, pprocessor.CaptureRequest) error {
+	p.captures++
+	return &pprocessor.Error{Kind: pprocessor.ErrTimeout, Op: "capture"}
+}
+
+func TestProcessorTimeoutRetriedWithSameKey(t *testing.T) {
+	expiryYear := strconv.Itoa(time.Now().Year() + 1)
+
+	tests := map[string]struct {
+		path string
+		body string
+	}{
+		"authorise": {path: "/authorise", body: `{"credit_card": {"name": "Bill", "number": 4242424242424242,
+			"expiry_month": 12, "expiry_year": ` + expiryYear + `, "cvv": 123}, "currency": "EUR", "amount": 10.00}`},
+		"capture": {path: "/capture", body: `{"authorisation_id": "auth1", "amount": 1.00}`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, repo, _ := setupConcurrencyTest(t)
+			pproc := &timingOutProcessor{}
+			cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+			require.NoError(t, err)
+
+			s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc, Vault: cardVault}
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") },
+				middleware.GinIdempotency(log.NullLogger{}, repo))
+			router.POST("/authorise", s.AuthoriseTransaction)
+			router.POST("/capture", s.CaptureTransaction)
+
+			// The retry gets the timeout replayed rather than sending the operation again
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+				req.Header.Set(middleware.IdempotencyKeyHeader, "k1")
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				assert.Equal(t, 504, w.Code, "request %d", i+1)
+				assert.Contains(t, w.Body.String(), `"error_code":"`+apimerchant.ErrorCodeProcessorTimeout+`"`)
+			}
+
+			assert.Equal(t, 1, pproc.authorisations+pproc.captures)
+		})
+	}
+}
+
+func TestOperationInProgressRetriedWithSameKey(t *testing.T) {
+	_, repo, pproc := setupConcurrencyTest(t)
+	s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") },
+		middleware.GinIdempotency(log.NullLogger{}, repo))
+	router.POST("/capture", s.CaptureTransaction)
+
+	capture := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/capture",
+			strings.NewReader(`{"authorisation_id": "auth1", "amount": 1.00}`))
+		req.Header.Set(middleware.IdempotencyKeyHeader, "k1")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	voidID, err := repo.ReserveTransaction(context.Background(), "auth1",
+		entities.Transaction{Type: entities.TransactionVoid})
+	require.NoError(t, err)
+	assert.Equal(t, 409, capture().Code)
+
+	// Once the void is over, the capture goes through with the same key
+	require.NoError(t, repo.CompleteTransaction(context.Background(), "auth1", voidID, false))
+	w := capture()
+	assert.Equal(t, 200, w.Code)
+	assert.Empty(t, w.Header().Get(middleware.IdempotencyReplayedHeader))
+	assert.Equal(t, int64(100), pproc.captured)
+}
+
+func TestAuthoriseValidation(t *testing.T) {
+	expiryYear := strconv.Itoa(time.Now().Year() + 1)
+	card := func(name string, number string, month string, year string, cvv string) string {
+		return `"credit_card": {"name": "` + name + `", "number": ` + number + `, "expiry_month": ` + month +
+			`, "expiry_year": ` + year + `, "cvv": ` + cvv + `}`
+	}
+
+	tests := map[string]struct {
+		body           string
+		expectedFields []string
+	}{
+		"missing everything": {body: `{}`,
+			expectedFields: []string{"credit_card", "currency", "amount"}},
+		"card and token": {body: `{` + card("Bill", "4242424242424242", "12", expiryYear, "123") +
+			`, "card_token": "tok_1", "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card"}},
+		"invalid card": {body: `{` + card("B1ll", "4242424242424241", "13", expiryYear, "12345") +
+			`, "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card.name", "credit_card.number", "credit_card.expiry_month",
+				"credit_card.cvv"}},
+		"expired card": {body: `{` + card("Bill", "4242424242424242", "1", "2000", "123") +
+			`, "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card.expiry_year"}},
+		"wrong length for brand": {body: `{` + card("Bill", "400000000000006", "12", expiryYear, "123") +
+			`, "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card.number"}},
+		"cvv too long for brand": {body: `{` + card("Bill", "4242424242424242", "12", expiryYear, "1234") +
+			`, "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card.cvv"}},
+		"brand not accepted": {body: `{` + card("Bill", "378282246310005", "12", expiryYear, "1234") +
+			`, "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card.number"}},
+		"name too long": {body: `{` + card(strings.Repeat("a", 51), "4242424242424242", "12", expiryYear, "123") +
+			`, "currency": "EUR", "amount": 1}`,
+			expectedFields: []string{"credit_card.name"}},
+		"currency not supported": {body: `{"card_token": "tok_1", "currency": "USD", "amount": 1}`,
+			expectedFields: []string{"currency"}},
+		"currency invalid and amount missing": {body: `{"card_token": "tok_1", "currency": "EURO"}`,
+			expectedFields: []string{"currency", "amount"}},
+		"too many decimals": {body: `{"card_token": "tok_1", "currency": "EUR", "amount": 1.001}`,
+			expectedFields: []string{"amount"}},
+		"negative amount": {body: `{"card_token": "tok_1", "currency": "EUR", "amount": -1}`,
+			expectedFields: []string{"amount"}},
+		"over merchant limit": {body: `{"card_token": "tok_1", "currency": "EUR", "amount": 500.01}`,
+			expectedFields: []string{"amount"}},
+		"unknown card token": {body: `{"card_token": "tok_2", "currency": "EUR", "amount": 500}`,
+			expectedFields: []string{"card_token"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := inmemory.NewRepository("EUR")
+			pproc := &authorisingProcessor{}
+			limits, err := core.ParseMerchantLimits("bill:EUR:500")
+			require.NoError(t, err)
+
+			brands, err := core.ParseMerchantBrands("bill:Visa,bill:Mastercard")
+			require.NoError(t, err)
+
+			s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc,
+				Limits: core.MerchantLimitsConfiguration{MaxAmount: limits, AcceptedBrands: brands}}
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+			router.POST("/authorise", s.AuthoriseTransaction)
+
+			req := httptest.NewRequest(http.MethodPost, "/authorise", strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, 400, w.Code)
+			responseBody := struct {
+				Errors []api.FieldError `json:"errors"`
+			}{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+
+			fields := []string{}
+			for _, fieldError := range responseBody.Errors {
+				fields = append(fields, fieldError.Field)
+			}
+			assert.Equal(t, test.expectedFields, fields)
+		})
+	}
+}
+
+func TestAuthoriseCardFormats(t *testing.T) {
+	expiryYear := strconv.Itoa(time.Now().Year() + 1)
+
+	tests := map[string]struct {
+		path           string
+		card           string
+		expectedCode   int
+		expectedCard   pprocessor.CreditCard
+		expectedFields []string
+	}{
+		"v1 numbers": {path: "/api/v1/authorise",
+			card: `{"name": "Bill", "number": 4242424242424242, "expiry_month": 9, "expiry_year": ` + expiryYear +
+				`, "cvv": 12}`,
+			expectedCode: 200,
+			expectedCard: pprocessor.CreditCard{Name: "Bill", Number: "4242424242424242", ExpiryMonth: 9,
+				ExpiryYear: uint(time.Now().Year() + 1), CVV: "012"}},
+		"v1 19 digits": {path: "/api/v1/authorise",
+			card: `{"name": "Bill", "number": 4242424242424242428, "expiry_month": 9, "expiry_year": ` + expiryYear +
+				`, "cvv": 123}`,
+			expectedCode: 200,
+			expectedCard: pprocessor.CreditCard{Name: "Bill", Number: "4242424242424242428", ExpiryMonth: 9,
+				ExpiryYear: uint(time.Now().Year() + 1), CVV: "123"}},
+		"v1 not an integer": {path: "/api/v1/authorise",
+			card: `{"name": "Bill", "number": 4.242424242424242e15, "expiry_month": 9, "expiry_year": ` + expiryYear +
+				`, "cvv": 123}`,
+			expectedCode: 400, expectedFields: []string{"credit_card.number"}},
+		"v2 strings": {path: "/api/v2/authorise",
+			card: `{"name": "Bill", "number": "4242424242424242", "expiry_month": "09", "expiry_year": "` +
+				expiryYear + `", "cvv": "012"}`,
+			expectedCode: 200,
+			expectedCard: pprocessor.CreditCard{Name: "Bill", Number: "4242424242424242", ExpiryMonth: 9,
+				ExpiryYear: uint(time.Now().Year() + 1), CVV: "012"}},
+		"v2 amex": {path: "/api/v2/authorise",
+			card: `{"name": "Bill", "number": "378282246310005", "expiry_month": "12", "expiry_year": "` +
+				expiryYear + `", "cvv": "0123"}`,
+			expectedCode: 200,
+			expectedCard: pprocessor.CreditCard{Name: "Bill", Number: "378282246310005", ExpiryMonth: 12,
+				ExpiryYear: uint(time.Now().Year() + 1), CVV: "0123"}},
+		"v2 numbers": {path: "/api/v2/authorise",
+			card: `{"name": "Bill", "number": 4242424242424242, "expiry_month": 9, "expiry_year": ` + expiryYear +
+				`, "cvv": 123}`,
+			expectedCode: 400},
+		"v2 malformed": {path: "/api/v2/authorise",
+			card: `{"name": "Bill", "number": "4242 4242 4242 4242", "expiry_month": "9", "expiry_year": "30", ` +
+				`"cvv": "12"}`,
+			expectedCode: 400,
+			expectedFields: []string{"credit_card.expiry_month", "credit_card.expiry_year", "credit_card.number",
+				"credit_card.cvv"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			pproc := &authorisingProcessor{}
+			cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+			require.NoError(t, err)
+
+			s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: inmemory.NewRepository("EUR"), PProcessor: pproc,
+				Vault: cardVault}
+			router := gin.New()
+			router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+			router.POST("/api/v1/authorise", s.AuthoriseTransaction)
+			router.POST("/api/v2/authorise", s.AuthoriseTransactionV2)
+
+			body := `{"credit_card": ` + test.card + `, "currency": "EUR", "amount": 10.00}`
+			req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			require.Equal(t, test.expectedCode, w.Code)
+			if test.expectedCode == 200 {
+				require.Len(t, pproc.authorisations, 1)
+				assert.Equal(t, test.expectedCard, pproc.authorisations[0].CreditCard)
+				return
+			}
+
+			assert.Empty(t, pproc.authorisations)
+			responseBody := struct {
+				Errors []api.FieldError `json:"errors"`
+			}{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+
+			var fields []string
+			for _, fieldError := range responseBody.Errors {
+				fields = append(fields, fieldError.Field)
+			}
+			assert.Equal(t, test.expectedFields, fields)
+		})
+	}
+}
+
+func TestAuthorisationsKeepTheirCardDetails(t *testing.T) {
+	repo := inmemory.NewRepository("EUR")
+	cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: &authorisingProcessor{},
+		Vault: cardVault}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+	router.POST("/authorise", s.AuthoriseTransactionV2)
+
+	// The same card is used twice, renewed in between
+	expiryYear := time.Now().Year() + 1
+	cards := []struct {
+		name       string
+		expiryYear int
+		authID     string
+	}{
+		{name: "Jane Doe", expiryYear: expiryYear, authID: "pp_auth1"},
+		{name: "Jane Smith", expiryYear: expiryYear + 3, authID: "pp_auth2"},
+	}
+
+	tokens := []string{}
+	for _, card := range cards {
+		body := `{"credit_card": {"name": "` + card.name + `", "number": "4242424242424242", "expiry_month": "09", ` +
+			`"expiry_year": "` + strconv.Itoa(card.expiryYear) + `", "cvv": "123"}, "currency": "EUR", "amount": 10}`
+		req := httptest.NewRequest(http.MethodPost, "/authorise", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		require.Equal(t, 200, w.Code)
+
+		responseBody := struct {
+			AuthorisationID string `json:"authorisation_id"`
+			CreditCard      struct {
+				Token string `json:"token"`
+			} `json:"credit_card"`
+		}{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+		assert.Equal(t, card.authID, responseBody.AuthorisationID)
+		tokens = append(tokens, responseBody.CreditCard.Token)
+	}
+
+	// Both authorisations use the same tokenised card, each with the details it was made with
+	assert.Equal(t, tokens[0], tokens[1])
+	for _, card := range cards {
+		auth, err := repo.GetAuthorisationDetails(context.Background(), card.authID)
+		require.NoError(t, err)
+		assert.Equal(t, tokens[0], auth.CreditCard.Token)
+		assert.Equal(t, card.name, auth.CreditCard.Name)
+		assert.Equal(t, uint(card.expiryYear), auth.CreditCard.ExpiryYear)
+	}
+
+	// Payments made with the token use the latest details
+	storedCard, err := repo.GetCreditCard(context.Background(), "bill", tokens[0])
+	require.NoError(t, err)
+	assert.Equal(t, "Jane Smith", storedCard.Name)
+	assert.Equal(t, uint(expiryYear+3), storedCard.ExpiryYear)
+}
+
+func TestTransactionEndpoints(t *testing.T) {
+	ctx := context.Background()
+	eur := func(minorUnits int64) money.Money { return money.Money{MinorUnits: minorUnits, Currency: "EUR"} }
+
+	// captured captures the amount of auth1
+	captured := func(minorUnits int64) func(t *testing.T, repo *inmemory.Repository) {
+		return func(t *testing.T, repo *inmemory.Repository) {
+			transID, err := repo.ReserveTransaction(ctx, "auth1",
+				entities.Transaction{Type: entities.TransactionCapture, Amount: eur(minorUnits)})
+			require.NoError(t, err)
+			require.NoError(t, repo.CompleteTransaction(ctx, "auth1", transID, true))
+		}
+	}
+
+	tests := map[string]struct {
+		setup              func(t *testing.T, repo *inmemory.Repository)
+		path               string
+		body               string
+		expectedStatusCode int
+		expectedBody       string
+		expectedState      entities.PaymentState
+	}{
+		"partial capture": {path: "/capture", body: `{"authorisation_id": "auth1", "amount": 4.00}`,
+			expectedStatusCode: 200, expectedBody: `{"status":"success","amount":4.00,"currency":"EUR"}`,
+			expectedState: entities.StatePartiallyCaptured},
+		"full capture": {path: "/capture", body: `{"authorisation_id": "auth1", "amount": 10}`,
+			expectedStatusCode: 200, expectedState: entities.StateCaptured},
+		"capture over amount": {path: "/capture", body: `{"authorisation_id": "auth1", "amount": 10.01}`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+		"capture too many decimals": {path: "/capture", body: `{"authorisation_id": "auth1", "amount": 1.001}`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+		"capture missing fields": {path: "/capture", body: `{}`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+		"capture malformed": {path: "/capture", body: `{"authorisation_id": 1`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+		"capture unknown authorisation": {path: "/capture", body: `{"authorisation_id": "auth2", "amount": 1}`,
+			expectedStatusCode: 404, expectedState: entities.StateAuthorised},
+		"capture other merchant": {path: "/capture", body: `{"authorisation_id": "auth_alice", "amount": 1}`,
+			expectedStatusCode: 403, expectedState: entities.StateAuthorised},
+		"capture after void": {path: "/capture", body: `{"authorisation_id": "auth1", "amount": 1}`,
+			setup: func(t *testing.T, repo *inmemory.Repository) {
+				transID, err := repo.ReserveTransaction(ctx, "auth1",
+					entities.Transaction{Type: entities.TransactionVoid, Amount: eur(0)})
+				require.NoError(t, err)
+				require.NoError(t, repo.CompleteTransaction(ctx, "auth1", transID, true))
+			},
+			expectedStatusCode: 400, expectedState: entities.StateVoided},
+		"refund": {path: "/refund", body: `{"authorisation_id": "auth1", "amount": 2.50}`, setup: captured(1000),
+			expectedStatusCode: 200, expectedBody: `{"status":"success","amount":2.50,"currency":"EUR"}`,
+			expectedState: entities.StatePartiallyRefunded},
+		"full refund": {path: "/refund", body: `{"authorisation_id": "auth1", "amount": 4}`, setup: captured(400),
+			expectedStatusCode: 200, expectedState: entities.StateRefunded},
+		"refund before capture": {path: "/refund", body: `{"authorisation_id": "auth1", "amount": 1}`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+		"refund over captured": {path: "/refund", body: `{"authorisation_id": "auth1", "amount": 4.01}`,
+			setup: captured(400), expectedStatusCode: 400, expectedState: entities.StatePartiallyCaptured},
+		"refund while capturing": {path: "/refund", body: `{"authorisation_id": "auth1", "amount": 1}`,
+			setup: func(t *testing.T, repo *inmemory.Repository) {
+				captured(400)(t, repo)
+				_, err := repo.ReserveTransaction(ctx, "auth1",
+					entities.Transaction{Type: entities.TransactionCapture, Amount: eur(100)})
+				require.NoError(t, err)
+			},
+			expectedStatusCode: 409, expectedState: entities.StatePartiallyCaptured},
+		"refund unknown authorisation": {path: "/refund", body: `{"authorisation_id": "auth2", "amount": 1}`,
+			expectedStatusCode: 404, expectedState: entities.StateAuthorised},
+		"refund other merchant": {path: "/refund", body: `{"authorisation_id": "auth_alice", "amount": 1}`,
+			expectedStatusCode: 403, expectedState: entities.StateAuthorised},
+		"refund missing amount": {path: "/refund", body: `{"authorisation_id": "auth1"}`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+		"void": {path: "/void", body: `{"authorisation_id": "auth1"}`,
+			expectedStatusCode: 200, expectedBody: `{"status":"success"}`, expectedState: entities.StateVoided},
+		"void after capture": {path: "/void", body: `{"authorisation_id": "auth1"}`, setup: captured(100),
+			expectedStatusCode: 400, expectedState: entities.StatePartiallyCaptured},
+		"void while capturing": {path: "/void", body: `{"authorisation_id": "auth1"}`,
+			setup: func(t *testing.T, repo *inmemory.Repository) {
+				_, err := repo.ReserveTransaction(ctx, "auth1",
+					entities.Transaction{Type: entities.TransactionCapture, Amount: eur(100)})
+				require.NoError(t, err)
+			},
+			expectedStatusCode: 409, expectedState: entities.StateAuthorised},
+		"void unknown authorisation": {path: "/void", body: `{"authorisation_id": "auth2"}`,
+			expectedStatusCode: 404, expectedState: entities.StateAuthorised},
+		"void other merchant": {path: "/void", body: `{"authorisation_id": "auth_alice"}`,
+			expectedStatusCode: 403, expectedState: entities.StateAuthorised},
+		"void missing authorisation": {path: "/void", body: `{}`,
+			expectedStatusCode: 400, expectedState: entities.StateAuthorised},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			router, repo, _ := setupConcurrencyTest(t)
+
+			// An authorisation of another merchant
+			_, err := repo.SaveCreditCard(ctx, "alice", entities.CreditCard{Token: "tok_2", Fingerprint: "fp_1"})
+			require.NoError(t, err)
+			require.NoError(t, repo.AddAuthorisation(ctx, entities.Authorisation{ID: "auth_alice",
+				State: entities.StateAuthorised, Amount: eur(1000), MerchantName: "alice",
+				CreditCard: &entities.CreditCard{Token: "tok_2"}}))
+
+			if test.setup != nil {
+				test.setup(t, repo)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, test.path, strings.NewReader(test.body))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatusCode, w.Code, w.Body.String())
+			if test.expectedBody != "" {
+				assert.JSONEq(t, test.expectedBody, w.Body.String())
+			}
+
+			auth, err := repo.GetAuthorisationDetails(ctx, "auth1")
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedState, auth.State)
+
+			// Authorisations of other merchants are never touched
+			auth, err = repo.GetAuthorisationDetails(ctx, "auth_alice")
+			require.NoError(t, err)
+			assert.Empty(t, auth.Transaction)
+		})
+	}
+}
+
+func TestAuthoriseWithCardToken(t *testing.T) {
+	repo := inmemory.NewRepository("EUR")
+	pproc := &authorisingProcessor{}
+	cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: pproc, Vault: cardVault}
+	authorise := func(merchantName string, body string) *httptest.ResponseRecorder {
+		router := gin.New()
+		router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, merchantName) })
+		router.POST("/authorise", s.AuthoriseTransactionV2)
+
+		req := httptest.NewRequest(http.MethodPost, "/authorise", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	expiryYear := strconv.Itoa(time.Now().Year() + 1)
+	w := authorise("bill", `{"credit_card": {"name": "Bill", "number": "4242424242424242", "expiry_month": "12", `+
+		`"expiry_year": "`+expiryYear+`", "cvv": "123"}, "currency": "EUR", "amount": 10}`)
+	require.Equal(t, 200, w.Code)
+	responseBody := struct {
+		CreditCard struct {
+			Token string `json:"token"`
+		} `json:"credit_card"`
+	}{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+	token := responseBody.CreditCard.Token
+	require.NotEmpty(t, token)
+
+	// The token stands for the card, without its CVV
+	w = authorise("bill", `{"card_token": "`+token+`", "currency": "EUR", "amount": 5}`)
+	require.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"authorisation_id":"pp_auth2"`)
+	require.Len(t, pproc.authorisations, 2)
+	assert.Equal(t, pprocessor.CreditCard{Name: "Bill", Number: "4242424242424242", ExpiryMonth: 12,
+		ExpiryYear: uint(time.Now().Year() + 1)}, pproc.authorisations[1].CreditCard)
+	assert.Equal(t, money.Money{MinorUnits: 500, Currency: "EUR"}, pproc.authorisations[1].Amount)
+
+	// Tokens are private to the merchant
+	w = authorise("alice", `{"card_token": "`+token+`", "currency": "EUR", "amount": 5}`)
+	assert.Equal(t, 400, w.Code)
+	assert.Contains(t, w.Body.String(), `"field":"card_token"`)
+	assert.Len(t, pproc.authorisations, 2)
+}
+
+func TestAuthoriseDeclined(t *testing.T) {
+	repo := inmemory.NewRepository("EUR")
+	cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	// slowProcessor declines every authorisation
+	s := &apimerchant.Server{Logger: log.NullLogger{}, Repo: repo, PProcessor: &slowProcessor{}, Vault: cardVault}
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set(middleware.AuthUserKey, "bill") })
+	router.POST("/authorise", s.AuthoriseTransaction)
+
+	expiryYear := strconv.Itoa(time.Now().Year() + 1)
+	req := httptest.NewRequest(http.MethodPost, "/authorise", strings.NewReader(`{"credit_card": {"name": "Bill", `+
+		`"number": 4242424242424242, "expiry_month": 12, "expiry_year": `+expiryYear+`, "cvv": 123}, `+
+		`"currency": "EUR", "amount": 10}`))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"status":"fail"`)
+	assert.Contains(t, w.Body.String(), `"error_code":"`+apimerchant.ErrorCodeDeclined+`"`)
+
+	// Nothing is stored but the card, and the journal entry is closed
+	auths, err := repo.GetAllAuthorisations(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, auths)
+
+	entries, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalFailed,
+		time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
@@ -0,0 +1,100 @@
+package apimerchant
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+)
+
+// authorisationRequest is an authorisation request, whichever version of the API it was received on.
+type authorisationRequest struct {
+	CreditCard *cardDetails
+	CardToken  string
+	Currency   string
+	Amount     json.Number
+}
+
+// cardDetails holds the card provided by the merchant.
+// The card number and CVV are strings of digits, so leading zeros are kept.
+type cardDetails struct {
+	Name        string
+	Number      string
+	ExpiryMonth uint
+	ExpiryYear  uint
+	CVV         string
+}
+
+// authorisationRequestV1 is the body of v1 authorisation requests, where the card number, expiry date and CVV are
+// numbers, e.g. {"number": 4242424242424242, "expiry_month": 9, "expiry_year": 2030, "cvv": 123}.
+type authorisationRequestV1 struct {
+	CreditCard *struct {
+		Name        string      `json:"name"`
+		Number      json.Number `json:"number"`
+		ExpiryMonth uint        `json:"expiry_month"`
+		ExpiryYear  uint        `json:"expiry_year"`
+		CVV         json.Number `json:"cvv"`
+	} `json:"credit_card"`
+	CardToken string      `json:"card_token"`
+	Currency  string      `json:"currency"`
+	Amount    json.Number `json:"amount"`
+}
+
+// normalise returns the request with the card number and CVV as digits.
+// The leading zeros of a numeric CVV are lost, so they are restored from the length of the CVV of the card brand.
+func (r authorisationRequestV1) normalise() authorisationRequest {
+	req := authorisationRequest{CardToken: r.CardToken, Currency: r.Currency, Amount: r.Amount}
+	if r.CreditCard == nil {
+		return req
+	}
+
+	number := r.CreditCard.Number.String()
+	cvv := r.CreditCard.CVV.String()
+	if cvv != "" {
+		length := core.CVVLength(core.DetectCardBrand(number))
+		if len(cvv) < length {
+			cvv = strings.Repeat("0", length-len(cvv)) + cvv
+		}
+	}
+
+	req.CreditCard = &cardDetails{
+		Name:        r.CreditCard.Name,
+		Number:      number,
+		ExpiryMonth: r.CreditCard.ExpiryMonth,
+		ExpiryYear:  r.CreditCard.ExpiryYear,
+		CVV:         cvv,
+	}
+	return req
+}
+
+// authorisationRequestV2 is the body of v2 authorisation requests, where the card number, expiry date and CVV are
+// strings of digits, e.g. {"number": "4242424242424242", "expiry_month": "09", "expiry_year": "2030", "cvv": "012"}.
+type authorisationRequestV2 struct {
+	CreditCard *struct {
+		Name        string `json:"name"`
+		Number      string `json:"number"`
+		ExpiryMonth string `json:"expiry_month"`
+		ExpiryYear  string `json:"expiry_year"`
+		CVV         string `json:"cvv"`
+	} `json:"credit_card"`
+	CardToken string      `json:"card_token"`
+	Currency  string      `json:"currency"`
+	Amount    json.Number `json:"amount"`
+}
+
+// normalise returns the request with the expiry date parsed, recording malformed expiry dates in the validator.
+func (r authorisationRequestV2) normalise(v *validator) authorisationRequest {
+	req := authorisationRequest{CardToken: r.CardToken, Currency: r.Currency, Amount: r.Amount}
+	if r.CreditCard == nil {
+		return req
+	}
+
+	req.CreditCard = &cardDetails{
+		Name:        r.CreditCard.Name,
+		Number:      r.CreditCard.Number,
+		ExpiryMonth: v.fixedDigits("credit_card.expiry_month", r.CreditCard.ExpiryMonth, 2),
+		ExpiryYear:  v.fixedDigits("credit_card.expiry_year", r.CreditCard.ExpiryYear, 4),
+		CVV:         r.CreditCard.CVV,
+	}
+	return req
+}
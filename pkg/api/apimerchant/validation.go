@@ -0,0 +1,209 @@
+package apimerchant
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+)
+
+// maxCardHolderNameLength is the longest card holder name that can be stored.
+const maxCardHolderNameLength = 50
+
+// validator collects the invalid fields of a request, so merchants get all of them at once.
+type validator struct {
+	fieldErrors []api.FieldError
+}
+
+// addError records why a field is invalid.
+func (v *validator) addError(field string, message string) {
+	v.fieldErrors = append(v.fieldErrors, api.FieldError{Field: field, Message: message})
+}
+
+// valid returns true if no field is invalid.
+func (v *validator) valid() bool {
+	return len(v.fieldErrors) == 0
+}
+
+// hasError returns true if the field was found invalid already.
+func (v *validator) hasError(field string) bool {
+	for _, fieldError := range v.fieldErrors {
+		if fieldError.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+// required checks a mandatory field is present, returning false if it is not.
+func (v *validator) required(field string, present bool) bool {
+	if !present {
+		v.addError(field, "is required")
+	}
+	return present
+}
+
+// currency checks the currency is an ISO 4217 code supported by the gateway, returning false if it is not.
+// Only database errors are returned.
+func (v *validator) currency(ctx context.Context, repo core.Repository, field string, currency string) (bool, error) {
+	if !v.required(field, currency != "") {
+		return false, nil
+	}
+
+	if _, err := money.Exponent(currency); err != nil {
+		v.addError(field, err.Error())
+		return false, nil
+	}
+
+	exists, err := repo.CurrencyExists(ctx, currency)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		v.addError(field, "currency not supported")
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// amount checks the amount is positive and has no more decimal places than the currency allows, returning false if
+// it does not. The currency must be valid.
+func (v *validator) amount(field string, amount json.Number, currency string) (money.Money, bool) {
+	if !v.required(field, amount != "") {
+		return money.Money{}, false
+	}
+
+	value, err := money.Parse(amount.String(), currency)
+	if err != nil {
+		v.addError(field, err.Error())
+		return value, false
+	}
+
+	if !value.IsPositive() {
+		v.addError(field, "must be greater than zero")
+		return value, false
+	}
+
+	return value, true
+}
+
+// maxAmount checks the amount does not exceed the merchant's limit (if any) in its currency.
+func (v *validator) maxAmount(field string, amount money.Money, limits core.MerchantLimits, merchantName string) {
+	limit, ok := limits.Limit(merchantName, amount.Currency)
+	if !ok {
+		return
+	}
+
+	if cmp, err := amount.Cmp(limit); err == nil && cmp > 0 {
+		v.addError(field, fmt.Sprintf("exceeds the maximum amount of %s allowed", limit.String()))
+	}
+}
+
+// cardHolderName checks the name is made of letters, spaces and the punctuation found in names, and fits in the
+// database. Digits are refused, so card numbers never end up in the name by mistake.
+func (v *validator) cardHolderName(field string, name string) {
+	if !v.required(field, strings.TrimSpace(name) != "") {
+		return
+	}
+
+	if utf8.RuneCountInString(name) > maxCardHolderNameLength {
+		v.addError(field, fmt.Sprintf("must be at most %d characters long", maxCardHolderNameLength))
+		return
+	}
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) && r != ' ' && r != '\'' && r != '-' && r != '.' {
+			v.addError(field, "must only contain letters, spaces and the characters ' - .")
+			return
+		}
+	}
+}
+
+// cardNumber checks the card number is made of digits, passes the Luhn check and has a length issued by its brand.
+// It returns the brand of the card, or an empty brand if the card number is missing.
+func (v *validator) cardNumber(field string, number string) core.CardBrand {
+	if !v.required(field, number != "") {
+		return ""
+	}
+
+	if !core.OnlyDigits(number) {
+		v.addError(field, "must only contain digits")
+		return ""
+	}
+
+	brand := core.DetectCardBrand(number)
+
+	if !core.LuhnValid(number) {
+		v.addError(field, "credit card number provided does not pass Luhn check")
+	} else if !core.ValidCardNumberLength(brand, len(number)) {
+		v.addError(field, fmt.Sprintf("invalid number of digits for a %s card", brand))
+	}
+
+	return brand
+}
+
+// acceptedBrand checks the merchant accepts cards of the brand.
+func (v *validator) acceptedBrand(field string, brand core.CardBrand, brands core.MerchantBrands, merchantName string) {
+	if !brands.Accepts(merchantName, brand) {
+		v.addError(field, fmt.Sprintf("%s cards are not accepted", brand))
+	}
+}
+
+// fixedDigits parses a number written with exactly the given number of digits, e.g. "09" for an expiry month.
+// It returns 0 if the value is missing or malformed.
+func (v *validator) fixedDigits(field string, value string, length int) uint {
+	if value == "" {
+		return 0
+	}
+
+	if len(value) != length || !core.OnlyDigits(value) {
+		v.addError(field, fmt.Sprintf("must have %d digits", length))
+		return 0
+	}
+
+	number, _ := strconv.ParseUint(value, 10, 32)
+	return uint(number)
+}
+
+// cardExpiry checks the expiry date is valid and not in the past.
+// Fields found malformed already are not checked again.
+func (v *validator) cardExpiry(monthField string, yearField string, month uint, year uint) {
+	if v.hasError(monthField) || v.hasError(yearField) {
+		return
+	}
+
+	monthPresent := v.required(monthField, month != 0)
+	yearPresent := v.required(yearField, year != 0)
+	if !monthPresent || !yearPresent {
+		return
+	}
+
+	if month > 12 {
+		v.addError(monthField, "must be between 1 and 12")
+		return
+	}
+
+	if !core.CardExpiryValid(int(year), int(month)) {
+		v.addError(yearField, "credit card provided has expired")
+	}
+}
+
+// cvv checks the card verification value is made of the number of digits of the brand (4 for Amex, 3 otherwise).
+func (v *validator) cvv(field string, cvv string, brand core.CardBrand) {
+	if !v.required(field, cvv != "") {
+		return
+	}
+
+	length := core.CVVLength(brand)
+	if len(cvv) != length || !core.OnlyDigits(cvv) {
+		v.addError(field, fmt.Sprintf("must have %d digits", length))
+	}
+}
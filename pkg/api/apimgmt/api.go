@@ -3,6 +3,7 @@ package apimgmt
 import (
 	"context"
 	"fmt"
+	"net"
 	"net/http"
 	"time"
 
@@ -11,21 +12,44 @@ import (
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
 )
 
 // Server is the webserver environment, which holds all its dependencies.
 type Server struct {
 	Logger log.Logger
 	Repo   core.Repository
+	Vault  *vault.Vault
+
+	// RevealAccounts holds the credentials allowed to reveal card numbers
+	RevealAccounts map[string]string
+	// AdminAccounts holds the credentials allowed to manage merchants' API keys
+	AdminAccounts map[string]string
+	// Merchants (if set) lists the merchants API keys can be created for
+	Merchants core.MerchantDirectory
+
+	// AuthCache (if set) caches merchants' credentials, and can be inspected and invalidated
+	AuthCache *credentials.CachingVerifier
+
+	// Breakers are the circuit breakers of the downstream services, reported on the healthcheck
+	Breakers []*breaker.Breaker
 
 	Router     *gin.Engine
 	HTTPServer http.Server
+
+	// cancelRequests cancels the context of all in-flight requests
+	cancelRequests context.CancelFunc
 }
 
 // NewServer creates a new server.
-func NewServer(addr string, port int, devMode bool, logger log.Logger, repo core.Repository) *Server {
-	s := &Server{Logger: logger, Repo: repo}
+func NewServer(addr string, port int, devMode bool, logger log.Logger, repo core.Repository,
+	cardVault *vault.Vault, revealAccounts map[string]string, adminAccounts map[string]string,
+	merchants core.MerchantDirectory, authCache *credentials.CachingVerifier, breakers []*breaker.Breaker) *Server {
+	s := &Server{Logger: logger, Repo: repo, Vault: cardVault, RevealAccounts: revealAccounts,
+		AdminAccounts: adminAccounts, Merchants: merchants, AuthCache: authCache, Breakers: breakers}
 
 	if !devMode {
 		gin.SetMode(gin.ReleaseMode)
@@ -41,12 +65,16 @@ func NewServer(addr string, port int, devMode bool, logger log.Logger, repo core
 	}
 
 	// Create http.Server
+	// Requests contexts derive from baseCtx, so they can be cancelled if the server fails to shutdown gracefully
+	baseCtx, cancelRequests := context.WithCancel(context.Background())
+	s.cancelRequests = cancelRequests
 	s.HTTPServer = http.Server{
 		Addr:           fmt.Sprintf("%s:%d", addr, port),
 		Handler:        s.Router,
 		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
+		WriteTimeout:   core.MaxRequestDuration,
 		MaxHeaderBytes: 1 << 20,
+		BaseContext:    func(net.Listener) context.Context { return baseCtx },
 	}
 
 	s.setupRoutes(devMode)
@@ -63,6 +91,31 @@ func (s *Server) setupRoutes(devMode bool) {
 	v1.GET("/authorisations", s.GetAuthorisations)
 	v1.GET("/authorisations/:authID", s.GetAuthorisation)
 
+	// Revealing card numbers is only enabled if there are accounts allowed to do it
+	if len(s.RevealAccounts) != 0 {
+		revealAuthMW := gin.BasicAuthForRealm(s.RevealAccounts, "Card reveal")
+		v1.POST("/authorisations/:authID/card/reveal", s.auditCardReveal, revealAuthMW, s.RevealCreditCard)
+	} else {
+		s.Logger.Info("card reveal disabled (no accounts configured)", log.Field("type", "setup"))
+	}
+
+	// Managing API keys and the credentials cache is only enabled if there are accounts allowed to do it
+	if len(s.AdminAccounts) != 0 {
+		admin := v1.Group("", gin.BasicAuthForRealm(s.AdminAccounts, "Administration"))
+		admin.POST("/merchants/:merchantName/apikeys", s.CreateAPIKey)
+		admin.GET("/merchants/:merchantName/apikeys", s.GetAPIKeys)
+		admin.DELETE("/apikeys/:keyID", s.RevokeAPIKey)
+
+		if s.AuthCache != nil {
+			admin.GET("/authcache", s.GetAuthCacheStats)
+			admin.DELETE("/authcache", s.InvalidateAuthCache)
+			admin.DELETE("/authcache/:merchantName", s.InvalidateAuthCacheMerchant)
+		}
+	} else {
+		s.Logger.Info("api key and credentials cache management disabled (no admin accounts configured)",
+			log.Field("type", "setup"))
+	}
+
 	// Profiler
 	// URL: https://<IP>:<PORT>/debug/pprof/
 	if devMode {
@@ -71,15 +124,28 @@ func (s *Server) setupRoutes(devMode bool) {
 	}
 }
 
-// ListenAndServe listens and serves incoming requests.
+// ListenAndServe listens and serves incoming requests, over TLS if HTTPServer.TLSConfig is set.
 func (s *Server) ListenAndServe() error {
-	if err := s.HTTPServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if s.HTTPServer.TLSConfig != nil {
+		// The certificate comes from the TLS configuration
+		err = s.HTTPServer.ListenAndServeTLS("", "")
+	} else {
+		err = s.HTTPServer.ListenAndServe()
+	}
+
+	if err != nil && err != http.ErrServerClosed {
 		return err
 	}
 	return nil
 }
 
 // ShutDown gracefully shuts down server.
+// If in-flight requests do not finish before ctx is done, their contexts are cancelled.
 func (s *Server) ShutDown(ctx context.Context) error {
-	return s.HTTPServer.Shutdown(ctx)
+	err := s.HTTPServer.Shutdown(ctx)
+	if s.cancelRequests != nil {
+		s.cancelRequests()
+	}
+	return err
 }
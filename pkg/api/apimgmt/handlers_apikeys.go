@@ -0,0 +1,129 @@
+package apimgmt
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+)
+
+// APIKeyIDPrefix is the prefix of every API key ID, so IDs are easy to tell apart from secrets.
+const APIKeyIDPrefix = "key_"
+
+// maxMerchantNameLength matches the size of the merchant name columns in the database.
+const maxMerchantNameLength = 50
+
+// CreateAPIKey creates an API key for a merchant, who must be known to the merchant directory (if any).
+// The secret is only ever returned here, merchants must create a new key if they lose it.
+func (s *Server) CreateAPIKey(c *gin.Context) {
+	merchantName := c.Param("merchantName")
+	if len(merchantName) > maxMerchantNameLength {
+		api.RespondWithError(c, 400, fmt.Sprintf("merchant name cannot be longer than %d characters",
+			maxMerchantNameLength))
+		return
+	}
+
+	if s.Merchants != nil {
+		exists, err := s.Merchants.MerchantExists(c.Request.Context(), merchantName)
+		if err != nil {
+			s.Logger.Error(fmt.Sprintf("merchant directory error: %s", err.Error()))
+			api.RespondWithError(c, 500, "Internal error")
+			return
+		} else if !exists {
+			api.RespondWithError(c, 404, fmt.Sprintf("merchant '%s' not found", merchantName))
+			return
+		}
+	}
+
+	keyID, secret, err := newAPIKey()
+	if err != nil {
+		s.Logger.Error(fmt.Sprintf("api key generation error: %s", err.Error()))
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	encryptedSecret, encryptedKey, err := s.Vault.Seal(secret, keyID)
+	if err != nil {
+		s.Logger.Error(fmt.Sprintf("vault error: %s", err.Error()))
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	key := entities.APIKey{
+		ID:              keyID,
+		MerchantName:    merchantName,
+		CreatedAt:       time.Now().UTC().Truncate(time.Second),
+		EncryptedSecret: encryptedSecret,
+		EncryptedKey:    encryptedKey,
+	}
+
+	err = s.Repo.AddAPIKey(c.Request.Context(), key)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	s.Logger.Info("api key created", log.Field("type", "audit"), log.Field("merchant", merchantName),
+		log.Field("key_id", keyID), log.Field("operator", c.GetString(gin.AuthUserKey)), log.Field("ip", c.ClientIP()))
+
+	responseBody := struct {
+		entities.APIKey
+		Secret string `json:"secret"`
+	}{APIKey: key, Secret: secret}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(201, responseBody)
+}
+
+// GetAPIKeys returns the API keys of a merchant, without their secrets.
+func (s *Server) GetAPIKeys(c *gin.Context) {
+	keys, err := s.Repo.GetAPIKeys(c.Request.Context(), c.Param("merchantName"))
+	if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	c.JSON(200, keys)
+}
+
+// RevokeAPIKey revokes an API key, after which requests signed with it are rejected.
+func (s *Server) RevokeAPIKey(c *gin.Context) {
+	keyID := c.Param("keyID")
+
+	err := s.Repo.RevokeAPIKey(c.Request.Context(), keyID)
+	if e, ok := err.(*repository.DBServiceError); ok {
+		if e.NotFound {
+			api.RespondWithError(c, 404, err.Error())
+			return
+		}
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	} else if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	s.Logger.Info("api key revoked", log.Field("type", "audit"), log.Field("key_id", keyID),
+		log.Field("operator", c.GetString(gin.AuthUserKey)), log.Field("ip", c.ClientIP()))
+	c.Status(204)
+}
+
+// newAPIKey returns a new random API key ID and secret.
+func newAPIKey() (keyID string, secret string, err error) {
+	b := make([]byte, 16+32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+
+	return APIKeyIDPrefix + hex.EncodeToString(b[:16]), hex.EncodeToString(b[16:]), nil
+}
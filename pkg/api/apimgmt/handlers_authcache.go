@@ -0,0 +1,29 @@
+package apimgmt
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+)
+
+// GetAuthCacheStats returns the number of merchants' credentials cached and the cache hit ratio.
+func (s *Server) GetAuthCacheStats(c *gin.Context) {
+	c.JSON(200, s.AuthCache.Stats())
+}
+
+// InvalidateAuthCache empties the cache of merchants' credentials.
+func (s *Server) InvalidateAuthCache(c *gin.Context) {
+	s.AuthCache.InvalidateAll()
+
+	s.Logger.Info("credentials cache invalidated", log.Field("type", "audit"), log.Field("ip", c.ClientIP()))
+	c.Status(204)
+}
+
+// InvalidateAuthCacheMerchant removes the cached credentials of a merchant, e.g. once their password changed.
+func (s *Server) InvalidateAuthCacheMerchant(c *gin.Context) {
+	merchantName := c.Param("merchantName")
+	s.AuthCache.Invalidate(merchantName)
+
+	s.Logger.Info("credentials cache invalidated", log.Field("type", "audit"), log.Field("merchant", merchantName),
+		log.Field("ip", c.ClientIP()))
+	c.Status(204)
+}
@@ -1,29 +1,81 @@
 package apimgmt
 
 import (
+	"encoding/json"
+	"fmt"
+
 	"github.com/gin-gonic/gin"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
 )
 
 // GetAuthorisations returns all authorisations from the database.
 func (s *Server) GetAuthorisations(c *gin.Context) {
 
-	authList, err := s.Repo.GetAllAuthorisations()
+	authList, err := s.Repo.GetAllAuthorisations(c.Request.Context())
 	if err != nil {
 		s.Logger.Error(err.Error())
 		api.RespondWithError(c, 500, "Internal error")
 		return
 	}
 
-	c.JSON(200, authList)
+	responseBody := make([]authorisationResponse, 0, len(authList))
+	for _, authItem := range authList {
+		responseBody = append(responseBody, newAuthorisationResponse(authItem))
+	}
+
+	c.JSON(200, responseBody)
 }
 
 // GetAuthorisation returns a detailed authorisation.
+// The credit card is masked, only its first 6 and last 4 digits are shown.
 func (s *Server) GetAuthorisation(c *gin.Context) {
 	authID := c.Param("authID")
 
-	authDetails, err := s.Repo.GetAuthorisationDetails(authID)
+	authDetails, err := s.Repo.GetAuthorisationDetails(c.Request.Context(), authID)
+	if e, ok := err.(*repository.DBServiceError); ok {
+		if e.NotFound {
+			api.RespondWithError(c, 404, err.Error())
+			return
+		}
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	} else if err != nil {
+		s.Logger.Error(err.Error())
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	responseBody := newAuthorisationResponse(authDetails)
+
+	if authDetails.CreditCard != nil {
+		// Cards stored before brands were recorded get it from their BIN
+		brand := authDetails.CreditCard.Brand
+		if brand == "" {
+			brand = string(core.DetectCardBrand(authDetails.CreditCard.BIN))
+		}
+
+		responseBody.CreditCard = &maskedCreditCard{
+			MaskedNumber: core.MaskCardNumber(authDetails.CreditCard.BIN, authDetails.CreditCard.LastFour),
+			Brand:        brand,
+			ExpiryMonth:  authDetails.CreditCard.ExpiryMonth,
+			ExpiryYear:   authDetails.CreditCard.ExpiryYear,
+		}
+	}
+
+	c.JSON(200, responseBody)
+}
+
+// RevealCreditCard returns the full card number used in an authorisation.
+// This endpoint requires its own credentials and every call is audit logged.
+func (s *Server) RevealCreditCard(c *gin.Context) {
+	authID := c.Param("authID")
+
+	authDetails, err := s.Repo.GetAuthorisationDetails(c.Request.Context(), authID)
 	if e, ok := err.(*repository.DBServiceError); ok {
 		if e.NotFound {
 			api.RespondWithError(c, 404, err.Error())
@@ -38,5 +90,103 @@ func (s *Server) GetAuthorisation(c *gin.Context) {
 		return
 	}
 
-	c.JSON(200, authDetails)
+	if authDetails.CreditCard == nil {
+		api.RespondWithError(c, 404, "credit card record not found")
+		return
+	}
+
+	number, err := s.Vault.Detokenise(*authDetails.CreditCard)
+	if err != nil {
+		s.Logger.Error(fmt.Sprintf("vault error: %s", err.Error()))
+		api.RespondWithError(c, 500, "Internal error")
+		return
+	}
+
+	responseBody := struct {
+		AuthorisationID string `json:"authorisation_id"`
+		Number          string `json:"number"`
+		Name            string `json:"name"`
+		ExpiryMonth     uint   `json:"expiry_month"`
+		ExpiryYear      uint   `json:"expiry_year"`
+	}{
+		AuthorisationID: authID,
+		Number:          number,
+		Name:            authDetails.CreditCard.Name,
+		ExpiryMonth:     authDetails.CreditCard.ExpiryMonth,
+		ExpiryYear:      authDetails.CreditCard.ExpiryYear,
+	}
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(200, responseBody)
+}
+
+// auditCardReveal logs every attempt to reveal card data, whether it was allowed or not.
+func (s *Server) auditCardReveal(c *gin.Context) {
+	c.Next()
+
+	fields := log.FieldsMap{
+		"type":             "audit",
+		"action":           "card-reveal",
+		"authorisation_id": c.Param("authID"),
+		"operator":         c.GetString(gin.AuthUserKey),
+		"status":           c.Writer.Status(),
+		"ip":               c.ClientIP(),
+	}
+
+	// With client certificates required, the certificate tells which system the operator used
+	if c.Request.TLS != nil && len(c.Request.TLS.PeerCertificates) != 0 {
+		fields["client_certificate"] = c.Request.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	s.Logger.Warn("card reveal requested", log.Fields(fields))
+}
+
+// maskedCreditCard is the credit card as exposed by the management API.
+type maskedCreditCard struct {
+	MaskedNumber string `json:"masked_number"`
+	Brand        string `json:"brand"`
+	ExpiryMonth  uint   `json:"expiry_month"`
+	ExpiryYear   uint   `json:"expiry_year"`
+}
+
+// authorisationResponse is the authorisation as exposed by the management API.
+// Amounts are decimals in the currency of the authorisation, as in the merchant API.
+type authorisationResponse struct {
+	ID           string                `json:"id"`
+	State        entities.PaymentState `json:"state"`
+	Currency     string                `json:"currency"`
+	Amount       json.Number           `json:"amount"`
+	MerchantName string                `json:"merchant_name"`
+	CreditCard   *maskedCreditCard     `json:"credit_card,omitempty"`
+	Transaction  []transactionResponse `json:"transactions,omitempty"`
+}
+
+// transactionResponse is a transaction as exposed by the management API.
+type transactionResponse struct {
+	ID     string                     `json:"id"`
+	Type   entities.TransactionType   `json:"type"`
+	Status entities.TransactionStatus `json:"status"`
+	Amount json.Number                `json:"amount"`
+}
+
+// newAuthorisationResponse returns the authorisation as exposed by the management API, without its credit card.
+func newAuthorisationResponse(authItem entities.Authorisation) authorisationResponse {
+	response := authorisationResponse{
+		ID:           authItem.ID,
+		State:        authItem.State,
+		Currency:     authItem.Amount.Currency,
+		Amount:       json.Number(authItem.Amount.Decimal()),
+		MerchantName: authItem.MerchantName,
+	}
+
+	for _, transItem := range authItem.Transaction {
+		response.Transaction = append(response.Transaction, transactionResponse{
+			ID:     transItem.ID,
+			Type:   transItem.Type,
+			Status: transItem.Status,
+			Amount: json.Number(transItem.Amount.Decimal()),
+		})
+	}
+
+	return response
 }
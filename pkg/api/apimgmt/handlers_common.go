@@ -4,16 +4,23 @@ import (
 	"fmt"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
 )
 
 // Healthcheck checks health of the service.
+// It also reports the state of the circuit breakers of the downstream services.
 func (s *Server) Healthcheck(c *gin.Context) {
-	err := s.Repo.HealthCheck()
+	breakers := make(map[string]breaker.State, len(s.Breakers))
+	for _, b := range s.Breakers {
+		breakers[b.Name()] = b.State()
+	}
+
+	err := s.Repo.HealthCheck(c.Request.Context())
 	if err != nil {
 		s.Logger.Error(fmt.Sprintf("database health check error: %s", err.Error()))
-		c.JSON(500, gin.H{"status": "FAIL"})
-        return
+		c.JSON(500, gin.H{"status": "FAIL", "circuit_breakers": breakers})
+		return
 	}
 
-	c.JSON(200, gin.H{"status": "OK"})
+	c.JSON(200, gin.H{"status": "OK", "circuit_breakers": breakers})
 }
@@ -0,0 +1,357 @@
+package apimgmt_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/apimgmt"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/inmemory"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adminAccounts are the accounts allowed to use the administration endpoints of the servers set up.
+var adminAccounts = map[string]string{"admin": "secret"}
+
+// setupServer returns a management server with one authorisation, auth1, made with a Visa card.
+// The merchants known are bill and mary.
+func setupServer(t *testing.T, revealAccounts map[string]string) (*apimgmt.Server, *inmemory.Repository) {
+	cardVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	card, err := cardVault.Tokenise("4242424242424242", "Bill", 9, 2030)
+	require.NoError(t, err)
+	card.Brand = "Visa"
+
+	repo := inmemory.NewRepository("EUR")
+	card, err = repo.SaveCreditCard(context.Background(), "bill", card)
+	require.NoError(t, err)
+	err = repo.AddAuthorisation(context.Background(), entities.Authorisation{
+		ID:           "auth1",
+		State:        entities.StateAuthorised,
+		Amount:       money.Money{MinorUnits: 1050, Currency: "EUR"},
+		MerchantName: "bill",
+		CreditCard:   &card,
+	})
+	require.NoError(t, err)
+
+	breakers := []*breaker.Breaker{breaker.New("payment-processor", breaker.Settings{})}
+	merchants := credentials.NewStaticVerifier(map[string]string{"bill": "pass1", "mary": "pass2"})
+	s := apimgmt.NewServer("127.0.0.1", 0, false, log.NullLogger{}, repo, cardVault, revealAccounts, adminAccounts,
+		merchants, nil, breakers)
+
+	return s, repo
+}
+
+func serve(s *apimgmt.Server, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.Router.ServeHTTP(w, req)
+	return w
+}
+
+// unhealthyRepository fails its health checks.
+type unhealthyRepository struct {
+	*inmemory.Repository
+}
+
+func (r unhealthyRepository) HealthCheck(context.Context) error {
+	return errors.New("connection refused")
+}
+
+func TestHealthcheck(t *testing.T) {
+	s, repo := setupServer(t, nil)
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/api/v1/healthcheck", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"status": "OK", "circuit_breakers": {"payment-processor": "closed"}}`, w.Body.String())
+
+	s.Repo = unhealthyRepository{repo}
+	w = serve(s, httptest.NewRequest(http.MethodGet, "/api/v1/healthcheck", nil))
+	assert.Equal(t, 500, w.Code)
+	assert.JSONEq(t, `{"status": "FAIL", "circuit_breakers": {"payment-processor": "closed"}}`, w.Body.String())
+}
+
+func TestGetAuthorisations(t *testing.T) {
+	s, _ := setupServer(t, nil)
+
+	w := serve(s, httptest.NewRequest(http.MethodGet, "/api/v1/authorisations", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `[{"id": "auth1", "state": "Authorised", "merchant_name": "bill",
+		"currency": "EUR", "amount": 10.50}]`, w.Body.String())
+}
+
+func TestGetAuthorisation(t *testing.T) {
+	tests := map[string]struct {
+		authID             string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		"found": {authID: "auth1", expectedStatusCode: 200,
+			expectedBody: `{"id": "auth1", "state": "Authorised", "merchant_name": "bill",
+				"currency": "EUR", "amount": 10.50,
+				"credit_card": {"masked_number": "424242******4242", "brand": "Visa", "expiry_month": 9,
+					"expiry_year": 2030}}`},
+		"not found": {authID: "auth2", expectedStatusCode: 404,
+			expectedBody: `{"message": "authorisation record not found"}`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, _ := setupServer(t, nil)
+
+			w := serve(s, httptest.NewRequest(http.MethodGet, "/api/v1/authorisations/"+test.authID, nil))
+			assert.Equal(t, test.expectedStatusCode, w.Code)
+			assert.JSONEq(t, test.expectedBody, w.Body.String())
+		})
+	}
+}
+
+func TestRevealCreditCard(t *testing.T) {
+	tests := map[string]struct {
+		authID             string
+		username           string
+		password           string
+		expectedStatusCode int
+	}{
+		"revealed":       {authID: "auth1", username: "auditor", password: "secret", expectedStatusCode: 200},
+		"wrong password": {authID: "auth1", username: "auditor", password: "guess", expectedStatusCode: 401},
+		"no credentials": {authID: "auth1", expectedStatusCode: 401},
+		"unknown authorisation": {authID: "auth2", username: "auditor", password: "secret",
+			expectedStatusCode: 404},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, _ := setupServer(t, map[string]string{"auditor": "secret"})
+
+			req := httptest.NewRequest(http.MethodPost, "/api/v1/authorisations/"+test.authID+"/card/reveal", nil)
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+			w := serve(s, req)
+
+			require.Equal(t, test.expectedStatusCode, w.Code)
+			if test.expectedStatusCode != 200 {
+				assert.NotContains(t, w.Body.String(), "4242424242424242")
+				return
+			}
+
+			assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+			responseBody := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal(w.Body.Bytes(), &responseBody))
+			assert.Equal(t, map[string]interface{}{"authorisation_id": "auth1", "number": "4242424242424242",
+				"name": "Bill", "expiry_month": float64(9), "expiry_year": float64(2030)}, responseBody)
+		})
+	}
+}
+
+func TestRevealCreditCardDisabled(t *testing.T) {
+	s, _ := setupServer(t, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/authorisations/auth1/card/reveal", nil)
+	req.SetBasicAuth("auditor", "secret")
+	w := serve(s, req)
+
+	assert.Equal(t, 404, w.Code)
+	assert.NotContains(t, w.Body.String(), "4242424242424242")
+}
+
+func TestAuthCache(t *testing.T) {
+	s, _ := setupServer(t, nil)
+	authCache, err := credentials.NewCachingVerifier(credentials.NewStaticVerifier(map[string]string{"bill": "pass1"}),
+		time.Minute, time.Minute, 10)
+	require.NoError(t, err)
+	s = apimgmt.NewServer("127.0.0.1", 0, false, log.NullLogger{}, s.Repo, s.Vault, nil, adminAccounts, nil,
+		authCache, s.Breakers)
+
+	for _, password := range []string{"pass1", "pass1", "guess"} {
+		_, err := authCache.VerifyCredentials(context.Background(), "bill", password)
+		require.NoError(t, err)
+	}
+
+	w := serve(s, adminRequest(http.MethodGet, "/api/v1/authcache"))
+	assert.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `{"entries": 2, "hits": 1, "misses": 2, "hit_ratio": 0.3333333333333333}`, w.Body.String())
+
+	w = serve(s, adminRequest(http.MethodDelete, "/api/v1/authcache/mary"))
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, 2, authCache.Stats().Entries)
+
+	w = serve(s, adminRequest(http.MethodDelete, "/api/v1/authcache/bill"))
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, 0, authCache.Stats().Entries)
+
+	_, err = authCache.VerifyCredentials(context.Background(), "bill", "pass1")
+	require.NoError(t, err)
+	w = serve(s, adminRequest(http.MethodDelete, "/api/v1/authcache"))
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, 0, authCache.Stats().Entries)
+}
+
+func TestAuthCacheUnauthenticated(t *testing.T) {
+	tests := map[string]struct {
+		method   string
+		path     string
+		username string
+		password string
+	}{
+		"stats without credentials":               {method: http.MethodGet, path: "/api/v1/authcache"},
+		"invalidate without credentials":          {method: http.MethodDelete, path: "/api/v1/authcache"},
+		"invalidate merchant without credentials": {method: http.MethodDelete, path: "/api/v1/authcache/bill"},
+		"invalidate with wrong password": {method: http.MethodDelete, path: "/api/v1/authcache",
+			username: "admin", password: "guess"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, _ := setupServer(t, nil)
+			authCache, err := credentials.NewCachingVerifier(
+				credentials.NewStaticVerifier(map[string]string{"bill": "pass1"}), time.Minute, time.Minute, 10)
+			require.NoError(t, err)
+			s = apimgmt.NewServer("127.0.0.1", 0, false, log.NullLogger{}, s.Repo, s.Vault, nil, adminAccounts, nil,
+				authCache, s.Breakers)
+
+			_, err = authCache.VerifyCredentials(context.Background(), "bill", "pass1")
+			require.NoError(t, err)
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+			w := serve(s, req)
+			assert.Equal(t, 401, w.Code)
+			assert.Equal(t, 1, authCache.Stats().Entries)
+		})
+	}
+}
+
+func TestAuthCacheDisabled(t *testing.T) {
+	s, _ := setupServer(t, nil)
+
+	w := serve(s, adminRequest(http.MethodGet, "/api/v1/authcache"))
+	assert.Equal(t, 404, w.Code)
+
+	// Nor is it managed without admin accounts
+	authCache, err := credentials.NewCachingVerifier(credentials.NewStaticVerifier(map[string]string{"bill": "pass1"}),
+		time.Minute, time.Minute, 10)
+	require.NoError(t, err)
+	s = apimgmt.NewServer("127.0.0.1", 0, false, log.NullLogger{}, s.Repo, s.Vault, nil, nil, nil, authCache,
+		s.Breakers)
+
+	w = serve(s, httptest.NewRequest(http.MethodGet, "/api/v1/authcache", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestAPIKeys(t *testing.T) {
+	s, repo := setupServer(t, nil)
+
+	w := serve(s, adminRequest(http.MethodPost, "/api/v1/merchants/bill/apikeys"))
+	require.Equal(t, 201, w.Code)
+	assert.Equal(t, "no-store", w.Header().Get("Cache-Control"))
+
+	var created struct {
+		ID           string `json:"id"`
+		MerchantName string `json:"merchant_name"`
+		Secret       string `json:"secret"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &created))
+	assert.True(t, strings.HasPrefix(created.ID, apimgmt.APIKeyIDPrefix))
+	assert.Equal(t, "bill", created.MerchantName)
+	assert.Len(t, created.Secret, 64)
+
+	// The secret is stored encrypted by the vault
+	key, err := repo.GetAPIKey(context.Background(), created.ID)
+	require.NoError(t, err)
+	secret, err := s.Vault.Open(key.EncryptedSecret, key.EncryptedKey, created.ID)
+	require.NoError(t, err)
+	assert.Equal(t, created.Secret, secret)
+
+	w = serve(s, adminRequest(http.MethodGet, "/api/v1/merchants/bill/apikeys"))
+	require.Equal(t, 200, w.Code)
+	assert.NotContains(t, w.Body.String(), created.Secret)
+	var keys []map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &keys))
+	require.Len(t, keys, 1)
+	assert.Equal(t, created.ID, keys[0]["id"])
+	assert.NotContains(t, keys[0], "revoked_at")
+
+	w = serve(s, adminRequest(http.MethodGet, "/api/v1/merchants/mary/apikeys"))
+	require.Equal(t, 200, w.Code)
+	assert.JSONEq(t, `[]`, w.Body.String())
+
+	w = serve(s, adminRequest(http.MethodDelete, "/api/v1/apikeys/"+created.ID))
+	assert.Equal(t, 204, w.Code)
+
+	key, err = repo.GetAPIKey(context.Background(), created.ID)
+	require.NoError(t, err)
+	assert.True(t, key.Revoked())
+
+	w = serve(s, adminRequest(http.MethodDelete, "/api/v1/apikeys/key_unknown"))
+	assert.Equal(t, 404, w.Code)
+
+	// Only for known merchants
+	w = serve(s, adminRequest(http.MethodPost, "/api/v1/merchants/unknown/apikeys"))
+	assert.Equal(t, 404, w.Code)
+}
+
+func TestAPIKeysUnauthenticated(t *testing.T) {
+	tests := map[string]struct {
+		method   string
+		path     string
+		username string
+		password string
+	}{
+		"create without credentials": {method: http.MethodPost, path: "/api/v1/merchants/bill/apikeys"},
+		"list without credentials":   {method: http.MethodGet, path: "/api/v1/merchants/bill/apikeys"},
+		"revoke without credentials": {method: http.MethodDelete, path: "/api/v1/apikeys/key_1"},
+		"create with wrong password": {method: http.MethodPost, path: "/api/v1/merchants/bill/apikeys",
+			username: "admin", password: "guess"},
+		"create with reveal account": {method: http.MethodPost, path: "/api/v1/merchants/bill/apikeys",
+			username: "alice", password: "secret1"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			s, repo := setupServer(t, map[string]string{"alice": "secret1"})
+
+			req := httptest.NewRequest(test.method, test.path, nil)
+			if test.username != "" {
+				req.SetBasicAuth(test.username, test.password)
+			}
+			w := serve(s, req)
+			assert.Equal(t, 401, w.Code)
+
+			keys, err := repo.GetAPIKeys(context.Background(), "bill")
+			require.NoError(t, err)
+			assert.Empty(t, keys)
+		})
+	}
+}
+
+func TestAPIKeysDisabled(t *testing.T) {
+	s, _ := setupServer(t, nil)
+	s = apimgmt.NewServer("127.0.0.1", 0, false, log.NullLogger{}, s.Repo, s.Vault, nil, nil, nil, nil, s.Breakers)
+
+	w := serve(s, httptest.NewRequest(http.MethodPost, "/api/v1/merchants/bill/apikeys", nil))
+	assert.Equal(t, 404, w.Code)
+}
+
+// adminRequest returns a request authenticated with an admin account.
+func adminRequest(method string, path string) *http.Request {
+	req := httptest.NewRequest(method, path, nil)
+	req.SetBasicAuth("admin", "secret")
+	return req
+}
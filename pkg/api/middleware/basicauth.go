@@ -1,22 +1,24 @@
 package middleware
 
 import (
-	"bytes"
 	"encoding/base64"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
 )
 
 // AuthUserKey is the name of the user credential in basic auth.
 const AuthUserKey = "user"
 
-func GinBasicAuth(logger log.Logger, httpClient *http.Client, authServiceHost string, authServicePort int) gin.HandlerFunc {
+// GinBasicAuth checks the request credentials with the verifier.
+// While the verifier's circuit breaker (if any) is open, requests fail straight away with 503.
+func GinBasicAuth(logger log.Logger, verifier core.CredentialVerifier) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Get Authorization header
 		auth := c.Request.Header.Get("Authorization")
@@ -41,16 +43,19 @@ func GinBasicAuth(logger log.Logger, httpClient *http.Client, authServiceHost st
 		}
 
 		decodedTokenStr := string(decodedToken)
-		credentials := strings.Split(decodedTokenStr, ":")
+		credentials := strings.SplitN(decodedTokenStr, ":", 2)
 		if len(credentials) != 2 {
 			c.JSON(http.StatusForbidden, gin.H{"message": "could not decode BasicAuth Authorization token"})
 			c.Abort()
 			return
 		}
 
-		// Send http request to validate credentials
-		valid, err := CheckCredentials(httpClient, authServiceHost, authServicePort, credentials[0], credentials[1])
-		if err != nil {
+		valid, err := verifier.VerifyCredentials(c.Request.Context(), credentials[0], credentials[1])
+		if errors.Is(err, breaker.ErrOpen) {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message": "auth service temporarily unavailable"})
+			c.Abort()
+			return
+		} else if err != nil {
 			logger.Error(fmt.Sprintf("basicauth middleware error: %s", err.Error()))
 			c.JSON(http.StatusInternalServerError, gin.H{"message": "internal error"})
 			c.Abort()
@@ -67,53 +72,3 @@ func GinBasicAuth(logger log.Logger, httpClient *http.Client, authServiceHost st
 		c.Set(AuthUserKey, credentials[0])
 	}
 }
-
-func CheckCredentials(httpClient *http.Client, host string, port int, username string, password string) (bool, error) {
-	requestBodyData := struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}{Username: username, Password: password}
-
-	requestBody, err := json.Marshal(requestBodyData)
-	if err != nil {
-		return false, err
-	}
-
-	url := fmt.Sprintf("http://%s:%d/api/v1/auth", host, port)
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return false, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return false, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return false, nil
-	}
-
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false, err
-	}
-
-	responseBodyData := struct {
-		Valid bool `json:"valid"`
-	}{}
-
-	err = json.Unmarshal(responseBody, &responseBodyData)
-	if err != nil {
-		return false, err
-	}
-
-	if !responseBodyData.Valid {
-		return false, nil
-	}
-
-	return true, nil
-}
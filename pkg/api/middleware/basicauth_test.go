@@ -0,0 +1,73 @@
+package middleware_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/stretchr/testify/assert"
+)
+
+// failingVerifier fails to check any credentials.
+type failingVerifier struct {
+	err error
+}
+
+func (v failingVerifier) VerifyCredentials(context.Context, string, string) (bool, error) {
+	return false, v.err
+}
+
+func TestGinBasicAuth(t *testing.T) {
+	static := credentials.NewStaticVerifier(map[string]string{"bill": "secret", "mary": "p4ss:word"})
+
+	tests := map[string]struct {
+		verifier           core.CredentialVerifier
+		authorization      string
+		expectedStatusCode int
+	}{
+		"valid":             {verifier: static, authorization: basic("bill", "secret"), expectedStatusCode: 200},
+		"colon in password": {verifier: static, authorization: basic("mary", "p4ss:word"), expectedStatusCode: 200},
+		"wrong password":    {verifier: static, authorization: basic("bill", "guess"), expectedStatusCode: 403},
+		"no credentials":    {verifier: static, expectedStatusCode: 401},
+		"not basic":         {verifier: static, authorization: "Bearer token", expectedStatusCode: 403},
+		"not base64":        {verifier: static, authorization: "Basic !!!", expectedStatusCode: 403},
+		"circuit open":      {verifier: failingVerifier{err: fmt.Errorf("auth service: %w", breaker.ErrOpen)}, authorization: basic("bill", "secret"), expectedStatusCode: 503},
+		"verifier failed":   {verifier: failingVerifier{err: errors.New("connection refused")}, authorization: basic("bill", "secret"), expectedStatusCode: 500},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", middleware.GinBasicAuth(log.NullLogger{}, test.verifier), func(c *gin.Context) {
+				c.String(200, c.GetString(middleware.AuthUserKey))
+			})
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if test.authorization != "" {
+				req.Header.Set("Authorization", test.authorization)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			assert.Equal(t, test.expectedStatusCode, w.Code)
+			if test.expectedStatusCode == 200 {
+				assert.NotEmpty(t, w.Body.String())
+			}
+		})
+	}
+}
+
+func basic(username string, password string) string {
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.SetBasicAuth(username, password)
+	return req.Header.Get("Authorization")
+}
@@ -0,0 +1,187 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+)
+
+// IdempotencyKeyHeader is the header merchants use to make a request safe to retry.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyReplayedHeader is set on responses replayed from a previous request.
+const IdempotencyReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLength matches the size of the key column in the database.
+const maxIdempotencyKeyLength = 255
+
+// IdempotencyLease is how long a request can be in progress before a retry with the same key takes it over, as the
+// process handling it must have died. It is much longer than any request can take (core.MaxRequestDuration).
+const IdempotencyLease = 6 * core.MaxRequestDuration
+
+// ProcessorCalledKey is set (to true) by handlers once the request may have reached the payment processor.
+const ProcessorCalledKey = "processor_called"
+
+// GinIdempotency returns a gin.HandlerFunc (middleware) that honours the Idempotency-Key header.
+//
+// The first request made with a given key (per merchant) is processed normally and its response is persisted.
+// Retries with the same key and the same request get the stored response replayed byte-for-byte.
+// Reusing a key with a different request is rejected with 422, and a retry arriving while the first
+// request is still being processed is rejected with 409.
+// Failed requests (5xx) and requests refused for a transient reason (e.g. 409 while another operation is in progress)
+// are not stored, nor requests whose handler panicked, so they can be retried with the same key.
+// Once the request may have reached the payment processor (see ProcessorCalledKey) its response is always stored,
+// as a retry could otherwise charge the customer twice while the outcome is unknown.
+// Requests without the header are not affected.
+//
+// This middleware must run after GinBasicAuth (or GinMerchantAuth), as keys are scoped by the authenticated merchant.
+func GinIdempotency(logger log.Logger, repo core.Repository) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.Request.Header.Get(IdempotencyKeyHeader)
+		if key == "" {
+			return
+		}
+
+		if len(key) > maxIdempotencyKeyLength {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("idempotency key cannot be longer than %d characters",
+				maxIdempotencyKeyLength)})
+			c.Abort()
+			return
+		}
+
+		merchantName := c.MustGet(AuthUserKey).(string)
+
+		requestBody, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "error reading body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+
+		requestHash := hashRequest(c.Request.Method, c.Request.URL.Path, requestBody)
+
+		keyItem, created, err := repo.StartIdempotentRequest(c.Request.Context(), merchantName, key, requestHash,
+			time.Now().Add(-IdempotencyLease))
+		if err != nil {
+			logger.Error(fmt.Sprintf("idempotency middleware error: %s", err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "Internal error"})
+			c.Abort()
+			return
+		}
+
+		if !created {
+			if keyItem.RequestHash != requestHash {
+				c.JSON(http.StatusUnprocessableEntity, gin.H{"message": "idempotency key already used with a different request"})
+				c.Abort()
+				return
+			}
+
+			if !keyItem.Completed {
+				c.JSON(http.StatusConflict, gin.H{"message": "request with the same idempotency key is in progress"})
+				c.Abort()
+				return
+			}
+
+			c.Header(IdempotencyReplayedHeader, "true")
+			c.Data(keyItem.StatusCode, "application/json; charset=utf-8", keyItem.ResponseBody)
+			c.Abort()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		// The outcome must be recorded even if the client has gone away in the meantime (or the handler panicked),
+		// otherwise retries with the same key would be rejected as in progress until the lease expires
+		completed := false
+		defer func() {
+			if completed {
+				return
+			}
+			if c.GetBool(ProcessorCalledKey) {
+				completeIdempotencyKey(logger, repo, merchantName, key, http.StatusInternalServerError,
+					[]byte(`{"message":"Internal error"}`))
+				return
+			}
+			releaseIdempotencyKey(logger, repo, merchantName, key)
+		}()
+
+		c.Next()
+
+		completed = true
+
+		// Failures are not stored, so the merchant can retry with the same key
+		if !c.GetBool(ProcessorCalledKey) && (recorder.Status() >= http.StatusInternalServerError ||
+			retryableStatus(recorder.Status())) {
+			releaseIdempotencyKey(logger, repo, merchantName, key)
+			return
+		}
+
+		completeIdempotencyKey(logger, repo, merchantName, key, recorder.Status(), recorder.body.Bytes())
+	}
+}
+
+// retryableStatus returns true if the request was refused for a reason that may go away by itself.
+func retryableStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusRequestTimeout, http.StatusConflict, http.StatusTooManyRequests:
+		return true
+	}
+	return false
+}
+
+// completeIdempotencyKey stores the response to the request made with the key, to be replayed to retries.
+func completeIdempotencyKey(logger log.Logger, repo core.Repository, merchantName string, key string,
+	statusCode int, responseBody []byte) {
+	err := repo.CompleteIdempotentRequest(context.Background(), merchantName, key, statusCode, responseBody)
+	if err != nil {
+		// The key stays in progress until its lease expires, rather than letting a retry process it again now
+		logger.Error(fmt.Sprintf("idempotency middleware error: failed to store response for key '%s': %s",
+			key, err.Error()))
+	}
+}
+
+// releaseIdempotencyKey forgets the request made with the key, so it can be retried.
+func releaseIdempotencyKey(logger log.Logger, repo core.Repository, merchantName string, key string) {
+	err := repo.ReleaseIdempotentRequest(context.Background(), merchantName, key)
+	if err != nil {
+		logger.Error(fmt.Sprintf("idempotency middleware error: failed to release key '%s': %s", key, err.Error()))
+	}
+}
+
+// hashRequest returns a digest identifying the request, so reused keys can be matched against it.
+func hashRequest(method string, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write([]byte(path))
+	h.Write([]byte{0})
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// responseRecorder keeps a copy of everything written to the response body.
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,175 @@
+package middleware_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/inmemory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// idempotentRouter serves POST /capture, counting the requests processed. The merchant is taken from the
+// X-Merchant header. Requests whose body is "fail" get a 503, requests whose body is "busy" get a 409, and requests
+// whose body is "panic" panic.
+// Requests whose body is "timeout" get a 504 after reaching the payment processor, and requests whose body is
+// "crash" panic after reaching it. If block is set, requests wait for it to be closed before answering.
+func idempotentRouter(repo *inmemory.Repository, calls *int32, block chan struct{}) *gin.Engine {
+	router := gin.New()
+	router.Use(gin.RecoveryWithWriter(ioutil.Discard))
+	router.POST("/capture", func(c *gin.Context) {
+		c.Set(middleware.AuthUserKey, c.GetHeader("X-Merchant"))
+	}, middleware.GinIdempotency(log.NullLogger{}, repo), func(c *gin.Context) {
+		n := atomic.AddInt32(calls, 1)
+		if block != nil {
+			<-block
+		}
+
+		body, _ := c.GetRawData()
+		switch string(body) {
+		case "fail":
+			c.JSON(503, gin.H{"status": "fail"})
+		case "busy":
+			c.JSON(409, gin.H{"message": "another operation is in progress"})
+		case "panic":
+			panic("handler failed")
+		case "timeout":
+			c.Set(middleware.ProcessorCalledKey, true)
+			c.JSON(504, gin.H{"status": "fail"})
+		case "crash":
+			c.Set(middleware.ProcessorCalledKey, true)
+			panic("handler failed")
+		default:
+			c.JSON(201, gin.H{"call": n})
+		}
+	})
+
+	return router
+}
+
+func idempotentRequest(router *gin.Engine, merchantName string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/capture", strings.NewReader(body))
+	req.Header.Set("X-Merchant", merchantName)
+	if key != "" {
+		req.Header.Set(middleware.IdempotencyKeyHeader, key)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestGinIdempotency(t *testing.T) {
+	tests := map[string]struct {
+		requests            []string // merchant, key and body, separated by "|"
+		expectedStatusCodes []int
+		expectedCalls       int32
+	}{
+		"replay of a stored response": {
+			requests:            []string{"bill|k1|{}", "bill|k1|{}"},
+			expectedStatusCodes: []int{201, 201},
+			expectedCalls:       1,
+		},
+		"different request": {
+			requests:            []string{"bill|k1|{}", "bill|k1|{\"amount\":1}"},
+			expectedStatusCodes: []int{201, 422},
+			expectedCalls:       1,
+		},
+		"keys scoped per merchant": {
+			requests:            []string{"bill|k1|{}", "mary|k1|{}"},
+			expectedStatusCodes: []int{201, 201},
+			expectedCalls:       2,
+		},
+		"no key": {
+			requests:            []string{"bill||{}", "bill||{}"},
+			expectedStatusCodes: []int{201, 201},
+			expectedCalls:       2,
+		},
+		"failures not stored": {
+			requests:            []string{"bill|k1|fail", "bill|k1|fail"},
+			expectedStatusCodes: []int{503, 503},
+			expectedCalls:       2,
+		},
+		"panics not stored": {
+			requests:            []string{"bill|k1|panic", "bill|k1|panic"},
+			expectedStatusCodes: []int{500, 500},
+			expectedCalls:       2,
+		},
+		"transient refusals not stored": {
+			requests:            []string{"bill|k1|busy", "bill|k1|busy"},
+			expectedStatusCodes: []int{409, 409},
+			expectedCalls:       2,
+		},
+		"outcome unknown stored": {
+			requests:            []string{"bill|k1|timeout", "bill|k1|timeout"},
+			expectedStatusCodes: []int{504, 504},
+			expectedCalls:       1,
+		},
+		"panics after reaching the payment processor stored": {
+			requests:            []string{"bill|k1|crash", "bill|k1|crash"},
+			expectedStatusCodes: []int{500, 500},
+			expectedCalls:       1,
+		},
+		"key too long": {
+			requests:            []string{"bill|" + strings.Repeat("k", 256) + "|{}"},
+			expectedStatusCodes: []int{400},
+			expectedCalls:       0,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var calls int32
+			router := idempotentRouter(inmemory.NewRepository(), &calls, nil)
+
+			for i, request := range test.requests {
+				parts := strings.SplitN(request, "|", 3)
+				w := idempotentRequest(router, parts[0], parts[1], parts[2])
+				assert.Equal(t, test.expectedStatusCodes[i], w.Code, "request %d", i+1)
+			}
+			assert.Equal(t, test.expectedCalls, atomic.LoadInt32(&calls))
+		})
+	}
+}
+
+func TestGinIdempotencyReplayedHeader(t *testing.T) {
+	var calls int32
+	router := idempotentRouter(inmemory.NewRepository(), &calls, nil)
+
+	w := idempotentRequest(router, "bill", "k1", "{}")
+	assert.Empty(t, w.Header().Get(middleware.IdempotencyReplayedHeader))
+
+	w = idempotentRequest(router, "bill", "k1", "{}")
+	assert.Equal(t, "true", w.Header().Get(middleware.IdempotencyReplayedHeader))
+	assert.JSONEq(t, `{"call": 1}`, w.Body.String())
+}
+
+func TestGinIdempotencyInFlight(t *testing.T) {
+	var calls int32
+	block := make(chan struct{})
+	router := idempotentRouter(inmemory.NewRepository(), &calls, block)
+
+	first := make(chan *httptest.ResponseRecorder)
+	go func() { first <- idempotentRequest(router, "bill", "k1", "{}") }()
+
+	// Wait for the first request to reach the handler
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&calls) == 1 }, time.Second, time.Millisecond)
+
+	w := idempotentRequest(router, "bill", "k1", "{}")
+	assert.Equal(t, 409, w.Code)
+
+	close(block)
+	assert.Equal(t, 201, (<-first).Code)
+
+	w = idempotentRequest(router, "bill", "k1", "{}")
+	assert.Equal(t, 201, w.Code)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+}
@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
+)
+
+// Headers of the requests signed with an API key.
+const (
+	KeyIDHeader     = "X-Pgw-Key-Id"
+	TimestampHeader = "X-Pgw-Timestamp"
+	NonceHeader     = "X-Pgw-Nonce"
+	SignatureHeader = "X-Pgw-Signature"
+)
+
+// maxNonceLength matches the size of the nonce column in the database.
+const maxNonceLength = 64
+
+// MaxSignedBodyBytes is the largest body of a signed request, which has to be read into memory to check its signature.
+// Payment requests are a few hundred bytes, so this is plenty.
+const MaxSignedBodyBytes = 1 << 20
+
+// GinSignatureAuth returns a gin.HandlerFunc (middleware) that authenticates requests signed with an API key.
+//
+// The signature is the hex encoded HMAC-SHA256, keyed with the API key secret, of StringToSign.
+// Requests whose timestamp is more than window away from now are rejected, and so are requests whose nonce was
+// already seen within the window, so a signed request cannot be replayed.
+// Requests whose body is larger than MaxSignedBodyBytes are rejected.
+func GinSignatureAuth(logger log.Logger, repo core.Repository, keyVault *vault.Vault,
+	window time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keyID := c.Request.Header.Get(KeyIDHeader)
+		timestamp := c.Request.Header.Get(TimestampHeader)
+		nonce := c.Request.Header.Get(NonceHeader)
+		signature := c.Request.Header.Get(SignatureHeader)
+		if keyID == "" || timestamp == "" || nonce == "" || signature == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"message": fmt.Sprintf("signed requests require the %s, %s, %s and %s headers",
+				KeyIDHeader, TimestampHeader, NonceHeader, SignatureHeader)})
+			c.Abort()
+			return
+		}
+
+		if len(nonce) > maxNonceLength {
+			c.JSON(http.StatusBadRequest, gin.H{"message": fmt.Sprintf("nonce cannot be longer than %d characters",
+				maxNonceLength)})
+			c.Abort()
+			return
+		}
+
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			c.JSON(http.StatusForbidden, gin.H{"message": "timestamp must be the number of seconds since the Unix epoch"})
+			c.Abort()
+			return
+		}
+
+		now := time.Now()
+		signedAt := time.Unix(seconds, 0)
+		if signedAt.Before(now.Add(-window)) || signedAt.After(now.Add(window)) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "request timestamp is outside the allowed window"})
+			c.Abort()
+			return
+		}
+
+		key, err := repo.GetAPIKey(c.Request.Context(), keyID)
+		var dbErr *repository.DBServiceError
+		if errors.As(err, &dbErr) && dbErr.NotFound {
+			c.JSON(http.StatusForbidden, gin.H{"message": "provided credentials are not valid"})
+			c.Abort()
+			return
+		} else if err != nil {
+			logger.Error(fmt.Sprintf("signature middleware error: %s", err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "internal error"})
+			c.Abort()
+			return
+		}
+
+		if key.Revoked() {
+			c.JSON(http.StatusForbidden, gin.H{"message": "provided credentials are not valid"})
+			c.Abort()
+			return
+		}
+
+		secret, err := keyVault.Open(key.EncryptedSecret, key.EncryptedKey, key.ID)
+		if err != nil {
+			logger.Error(fmt.Sprintf("signature middleware error: %s", err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "internal error"})
+			c.Abort()
+			return
+		}
+
+		requestBody, err := ioutil.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, MaxSignedBodyBytes))
+		if err != nil && len(requestBody) >= MaxSignedBodyBytes {
+			c.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": fmt.Sprintf("body cannot be larger than %d bytes",
+				MaxSignedBodyBytes)})
+			c.Abort()
+			return
+		} else if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"message": "error reading body"})
+			c.Abort()
+			return
+		}
+		c.Request.Body = ioutil.NopCloser(bytes.NewReader(requestBody))
+
+		decodedSignature, err := hex.DecodeString(signature)
+		expectedSignature := Sign(secret, StringToSign(c.Request.Method, c.Request.URL.RequestURI(), timestamp, nonce,
+			requestBody))
+		if err != nil || !hmac.Equal(decodedSignature, expectedSignature) {
+			c.JSON(http.StatusForbidden, gin.H{"message": "provided credentials are not valid"})
+			c.Abort()
+			return
+		}
+
+		// Only genuine requests record their nonce, so nobody can burn the nonces of others
+		fresh, err := repo.RecordAPIKeyNonce(c.Request.Context(), keyID, nonce, now.Add(-2*window))
+		if err != nil {
+			logger.Error(fmt.Sprintf("signature middleware error: %s", err.Error()))
+			c.JSON(http.StatusInternalServerError, gin.H{"message": "internal error"})
+			c.Abort()
+			return
+		}
+
+		if !fresh {
+			c.JSON(http.StatusForbidden, gin.H{"message": "request already received (nonce reused)"})
+			c.Abort()
+			return
+		}
+
+		c.Set(AuthUserKey, key.MerchantName)
+	}
+}
+
+// GinMerchantAuth returns a gin.HandlerFunc (middleware) that authenticates requests with signatureAuth if they are
+// signed with an API key (i.e. have the X-Pgw-Key-Id header), or with basicAuth otherwise.
+func GinMerchantAuth(signatureAuth gin.HandlerFunc, basicAuth gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.Header.Get(KeyIDHeader) != "" {
+			signatureAuth(c)
+		} else {
+			basicAuth(c)
+		}
+	}
+}
+
+// StringToSign returns what merchants sign: the method, the path (with the query string, if any), the timestamp,
+// the nonce and the hex encoded SHA-256 digest of the body, one per line.
+func StringToSign(method string, path string, timestamp string, nonce string, body []byte) string {
+	bodyDigest := sha256.Sum256(body)
+	return method + "\n" + path + "\n" + timestamp + "\n" + nonce + "\n" + hex.EncodeToString(bodyDigest[:])
+}
+
+// Sign returns the HMAC-SHA256 of the string to sign, keyed with the API key secret.
+func Sign(secret string, stringToSign string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return mac.Sum(nil)
+}
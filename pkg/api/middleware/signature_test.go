@@ -0,0 +1,204 @@
+package middleware_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/inmemory"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSecret = "0123456789abcdef0123456789abcdef"
+
+// setupSignatureRouter returns a router echoing the authenticated merchant and the body of requests signed with
+// key_bill (valid) or key_revoked.
+func setupSignatureRouter(t *testing.T) *gin.Engine {
+	keyVault, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	repo := inmemory.NewRepository("EUR")
+	for _, keyID := range []string{"key_bill", "key_revoked"} {
+		encryptedSecret, encryptedKey, err := keyVault.Seal(testSecret, keyID)
+		require.NoError(t, err)
+		err = repo.AddAPIKey(context.Background(), entities.APIKey{ID: keyID, MerchantName: "bill",
+			CreatedAt: time.Now(), EncryptedSecret: encryptedSecret, EncryptedKey: encryptedKey})
+		require.NoError(t, err)
+	}
+	require.NoError(t, repo.RevokeAPIKey(context.Background(), "key_revoked"))
+
+	router := gin.New()
+	router.POST("/api/v1/capture", middleware.GinMerchantAuth(
+		middleware.GinSignatureAuth(log.NullLogger{}, repo, keyVault, time.Minute),
+		middleware.GinBasicAuth(log.NullLogger{}, credentials.NewStaticVerifier(map[string]string{"mary": "secret"})),
+	), func(c *gin.Context) {
+		body, _ := ioutil.ReadAll(c.Request.Body)
+		c.String(200, c.GetString(middleware.AuthUserKey)+" "+string(body))
+	})
+
+	return router
+}
+
+// signedRequest returns a request signed with the key, as merchants would sign it.
+func signedRequest(keyID string, secret string, timestamp time.Time, nonce string, body string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/capture", strings.NewReader(body))
+	ts := strconv.FormatInt(timestamp.Unix(), 10)
+	signature := middleware.Sign(secret, middleware.StringToSign(http.MethodPost, "/api/v1/capture", ts, nonce,
+		[]byte(body)))
+
+	req.Header.Set(middleware.KeyIDHeader, keyID)
+	req.Header.Set(middleware.TimestampHeader, ts)
+	req.Header.Set(middleware.NonceHeader, nonce)
+	req.Header.Set(middleware.SignatureHeader, hex.EncodeToString(signature))
+	return req
+}
+
+func TestGinSignatureAuth(t *testing.T) {
+	tests := map[string]struct {
+		request            func() *http.Request
+		expectedStatusCode int
+	}{
+		"valid": {
+			request:            func() *http.Request { return signedRequest("key_bill", testSecret, time.Now(), "n1", `{"a":1}`) },
+			expectedStatusCode: 200,
+		},
+		"missing signature": {
+			request: func() *http.Request {
+				req := signedRequest("key_bill", testSecret, time.Now(), "n1", `{"a":1}`)
+				req.Header.Del(middleware.SignatureHeader)
+				return req
+			},
+			expectedStatusCode: 401,
+		},
+		"wrong secret": {
+			request:            func() *http.Request { return signedRequest("key_bill", "guess", time.Now(), "n1", `{"a":1}`) },
+			expectedStatusCode: 403,
+		},
+		"tampered body": {
+			request: func() *http.Request {
+				req := signedRequest("key_bill", testSecret, time.Now(), "n1", `{"a":1}`)
+				req.Body = ioutil.NopCloser(strings.NewReader(`{"a":2}`))
+				return req
+			},
+			expectedStatusCode: 403,
+		},
+		"signature not hex": {
+			request: func() *http.Request {
+				req := signedRequest("key_bill", testSecret, time.Now(), "n1", `{"a":1}`)
+				req.Header.Set(middleware.SignatureHeader, "not hex")
+				return req
+			},
+			expectedStatusCode: 403,
+		},
+		"timestamp too old": {
+			request: func() *http.Request {
+				return signedRequest("key_bill", testSecret, time.Now().Add(-2*time.Minute), "n1", `{"a":1}`)
+			},
+			expectedStatusCode: 403,
+		},
+		"timestamp in the future": {
+			request: func() *http.Request {
+				return signedRequest("key_bill", testSecret, time.Now().Add(2*time.Minute), "n1", `{"a":1}`)
+			},
+			expectedStatusCode: 403,
+		},
+		"timestamp not a number": {
+			request: func() *http.Request {
+				req := signedRequest("key_bill", testSecret, time.Now(), "n1", `{"a":1}`)
+				req.Header.Set(middleware.TimestampHeader, time.Now().Format(time.RFC3339))
+				return req
+			},
+			expectedStatusCode: 403,
+		},
+		"nonce too long": {
+			request: func() *http.Request {
+				return signedRequest("key_bill", testSecret, time.Now(), strings.Repeat("n", 65), `{"a":1}`)
+			},
+			expectedStatusCode: 400,
+		},
+		"body too large": {
+			request: func() *http.Request {
+				body := `{"a":"` + strings.Repeat("a", middleware.MaxSignedBodyBytes) + `"}`
+				return signedRequest("key_bill", testSecret, time.Now(), "n1", body)
+			},
+			expectedStatusCode: 413,
+		},
+		"unknown key": {
+			request:            func() *http.Request { return signedRequest("key_mary", testSecret, time.Now(), "n1", `{"a":1}`) },
+			expectedStatusCode: 403,
+		},
+		"revoked key": {
+			request: func() *http.Request {
+				return signedRequest("key_revoked", testSecret, time.Now(), "n1", `{"a":1}`)
+			},
+			expectedStatusCode: 403,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			router := setupSignatureRouter(t)
+
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, test.request())
+
+			assert.Equal(t, test.expectedStatusCode, w.Code)
+			if test.expectedStatusCode == 200 {
+				// The body is still there for the handler
+				assert.Equal(t, `bill {"a":1}`, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestGinSignatureAuthReplay(t *testing.T) {
+	router := setupSignatureRouter(t)
+	now := time.Now()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("key_bill", testSecret, now, "n1", `{"a":1}`))
+	assert.Equal(t, 200, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("key_bill", testSecret, now, "n1", `{"a":1}`))
+	assert.Equal(t, 403, w.Code)
+
+	// A forged request cannot burn a nonce
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("key_bill", "guess", now, "n2", `{"a":1}`))
+	assert.Equal(t, 403, w.Code)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, signedRequest("key_bill", testSecret, now, "n2", `{"a":1}`))
+	assert.Equal(t, 200, w.Code)
+}
+
+func TestGinMerchantAuthBasicFallback(t *testing.T) {
+	router := setupSignatureRouter(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/capture", strings.NewReader(`{}`))
+	req.SetBasicAuth("mary", "secret")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "mary {}", w.Body.String())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/v1/capture", strings.NewReader(`{}`))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 401, w.Code)
+}
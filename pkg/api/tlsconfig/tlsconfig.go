@@ -0,0 +1,105 @@
+// Package tlsconfig builds the TLS configuration of the webservers, whose certificates can be reloaded while serving.
+package tlsconfig
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+)
+
+// Reloader holds the certificate (and client CAs, if any) of a webserver, as last loaded from their files.
+// Handshakes always use the latest ones, so certificates can be renewed without restarting the webserver.
+// It is safe for concurrent use.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// NewReloader returns a reloader of the certificate and key files (and client CAs file, if not empty), which are
+// loaded straight away.
+func NewReloader(certFile string, keyFile string, clientCAFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile, clientCAFile: clientCAFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the files again. If any of them is invalid, the previous certificate and client CAs are kept.
+func (r *Reloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.clientCAFile != "" {
+		pemCerts, err := ioutil.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("error loading client CAs: %w", err)
+		}
+
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pemCerts) {
+			return fmt.Errorf("error loading client CAs: no certificates found in %s", r.clientCAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cert = &cert
+	r.clientCAs = clientCAs
+
+	return nil
+}
+
+// GetCertificate returns the current certificate, as used by tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// ClientCAs returns the current client CAs, or nil if client certificates are not required.
+func (r *Reloader) ClientCAs() *x509.CertPool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clientCAs
+}
+
+// New returns the TLS configuration of a webserver, along with the reloader of its certificates.
+// If client CAs are configured, clients must present a certificate signed by one of them.
+func New(tlsConfig core.TLSConfiguration) (*tls.Config, *Reloader, error) {
+	reloader, err := NewReloader(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config := &tls.Config{
+		MinVersion:     tlsConfig.MinVersion,
+		CipherSuites:   tlsConfig.CipherSuites,
+		GetCertificate: reloader.GetCertificate,
+	}
+
+	if tlsConfig.ClientCAFile != "" {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		// Each handshake gets the client CAs current at the time
+		config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			clientConfig := config.Clone()
+			clientConfig.GetConfigForClient = nil
+			clientConfig.ClientCAs = reloader.ClientCAs()
+			return clientConfig, nil
+		}
+	}
+
+	return config, reloader, nil
+}
@@ -0,0 +1,223 @@
+package tlsconfig_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/tlsconfig"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCert is a certificate with its key, signed by a CA (or self-signed if it is a CA).
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+var serial int64
+
+func newCert(t *testing.T, commonName string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signerCert, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+func (c *testCert) tlsCertificate(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	require.NoError(t, err)
+	return cert
+}
+
+// write writes the certificate and key files.
+func (c *testCert) write(t *testing.T, certFile string, keyFile string) {
+	require.NoError(t, os.WriteFile(certFile, c.certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, c.keyPEM, 0600))
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	ca := newCert(t, "CA", nil)
+	first := newCert(t, "first", ca)
+	first.write(t, certFile, keyFile)
+
+	reloader, err := tlsconfig.NewReloader(certFile, keyFile, "")
+	require.NoError(t, err)
+	assert.Nil(t, reloader.ClientCAs())
+
+	cert, err := reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, first.tlsCertificate(t).Certificate, cert.Certificate)
+
+	// Renewed certificate
+	second := newCert(t, "second", ca)
+	second.write(t, certFile, keyFile)
+	require.NoError(t, reloader.Reload())
+
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.tlsCertificate(t).Certificate, cert.Certificate)
+
+	// A key not matching the certificate is rejected, the previous certificate being kept
+	require.NoError(t, os.WriteFile(keyFile, first.keyPEM, 0600))
+	assert.Error(t, reloader.Reload())
+
+	cert, err = reloader.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Equal(t, second.tlsCertificate(t).Certificate, cert.Certificate)
+
+	_, err = tlsconfig.NewReloader(filepath.Join(dir, "missing.pem"), keyFile, "")
+	assert.Error(t, err)
+
+	_, err = tlsconfig.NewReloader(certFile, keyFile, keyFile)
+	assert.Error(t, err, "client CAs file without certificates")
+}
+
+// serve serves HTTPS with the configuration until the test ends, and returns the server URL.
+func serve(t *testing.T, config *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	server := &http.Server{
+		TLSConfig: config,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}),
+	}
+	go func() { _ = server.ServeTLS(listener, "", "") }()
+	t.Cleanup(func() { _ = server.Close() })
+
+	return "https://" + listener.Addr().String()
+}
+
+// get makes a request on a new connection, presenting the client certificate (if any).
+func get(serverURL string, serverCA *testCert, clientCert *tls.Certificate) (*http.Response, error) {
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCA.cert)
+
+	clientConfig := &tls.Config{RootCAs: rootCAs}
+	if clientCert != nil {
+		clientConfig.Certificates = []tls.Certificate{*clientCert}
+	}
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig, DisableKeepAlives: true}}
+	resp, err := client.Get(serverURL)
+	if err == nil {
+		_ = resp.Body.Close()
+	}
+	return resp, err
+}
+
+func TestClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	clientCAFile := filepath.Join(dir, "clientca.pem")
+
+	serverCA := newCert(t, "server CA", nil)
+	newCert(t, "server", serverCA).write(t, certFile, keyFile)
+
+	clientCA := newCert(t, "client CA", nil)
+	otherCA := newCert(t, "other CA", nil)
+	require.NoError(t, os.WriteFile(clientCAFile, clientCA.certPEM, 0600))
+
+	config, reloader, err := tlsconfig.New(core.TLSConfiguration{CertFile: certFile, KeyFile: keyFile,
+		MinVersion: tls.VersionTLS12, ClientCAFile: clientCAFile})
+	require.NoError(t, err)
+	serverURL := serve(t, config)
+
+	operator := newCert(t, "operator", clientCA).tlsCertificate(t)
+	intruder := newCert(t, "intruder", otherCA).tlsCertificate(t)
+
+	resp, err := get(serverURL, serverCA, &operator)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	_, err = get(serverURL, serverCA, nil)
+	assert.Error(t, err, "no client certificate")
+
+	_, err = get(serverURL, serverCA, &intruder)
+	assert.Error(t, err, "client certificate signed by another CA")
+
+	// Once the client CAs are reloaded, only the new CA is trusted
+	require.NoError(t, os.WriteFile(clientCAFile, otherCA.certPEM, 0600))
+	require.NoError(t, reloader.Reload())
+
+	resp, err = get(serverURL, serverCA, &intruder)
+	require.NoError(t, err)
+	assert.Equal(t, 200, resp.StatusCode)
+
+	_, err = get(serverURL, serverCA, &operator)
+	assert.Error(t, err)
+}
+
+func TestMinVersion(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	serverCA := newCert(t, "server CA", nil)
+	newCert(t, "server", serverCA).write(t, certFile, keyFile)
+
+	config, _, err := tlsconfig.New(core.TLSConfiguration{CertFile: certFile, KeyFile: keyFile,
+		MinVersion: tls.VersionTLS13})
+	require.NoError(t, err)
+	assert.Equal(t, tls.NoClientCert, config.ClientAuth)
+	serverURL := serve(t, config)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverCA.cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{RootCAs: rootCAs, MaxVersion: tls.VersionTLS12}}}
+
+	_, err = client.Get(serverURL)
+	assert.Error(t, err)
+}
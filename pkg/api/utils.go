@@ -13,3 +13,15 @@ func NoRoute(c *gin.Context) {
 func RespondWithError(c *gin.Context, httpCode int, message string) {
 	c.JSON(httpCode, gin.H{"message": message})
 }
+
+// FieldError describes why a field of a request is invalid.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// RespondWithValidationErrors is a helper function to return all the invalid fields of a request at once, according
+// to the API specification.
+func RespondWithValidationErrors(c *gin.Context, fieldErrors []FieldError) {
+	c.JSON(400, gin.H{"message": "invalid request", "errors": fieldErrors})
+}
@@ -47,11 +47,17 @@ func (l AppLogger) logGeneric(level log.Level, msg string, fields ...log.FieldFu
 	}
 
 	if l.Level <= level {
+		// Never let card data reach the logs
+		msg = ScrubString(msg)
+
 		if len(fields) != 0 {
-			newFields := make(map[string]interface{})
+			newFields := make(log.FieldsMap)
 			for _, f := range fields {
-				f(newFields)
+				if f != nil {
+					f(newFields)
+				}
 			}
+			newFields = ScrubFields(newFields)
 			if len(newFields) != 0 {
 				// Log with appropriate level
 				if level == log.DEBUG {
@@ -0,0 +1,162 @@
+// Package breaker provides a circuit breaker to fail fast while a downstream service is down.
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned while the circuit is open, i.e. the downstream service is considered down.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is the state of a circuit breaker.
+type State string
+
+const (
+	// Closed lets every call through.
+	Closed State = "closed"
+	// Open rejects every call until the open timeout expires.
+	Open State = "open"
+	// HalfOpen lets a limited number of trial calls through, to find out whether the downstream service recovered.
+	HalfOpen State = "half-open"
+)
+
+// Settings holds the thresholds of a circuit breaker.
+type Settings struct {
+	// FailureThreshold is the number of consecutive failures that opens the circuit.
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before letting trial calls through.
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests is the maximum number of concurrent trial calls while half-open.
+	HalfOpenMaxRequests int
+}
+
+// Breaker is a circuit breaker protecting calls to a downstream service. It is safe for concurrent use.
+//
+// Every call allowed by Allow must be followed by exactly one call to Success, Failure or Cancel.
+// All methods can be called on a nil Breaker, which lets every call through.
+type Breaker struct {
+	name     string
+	settings Settings
+
+	mu                  sync.Mutex
+	state               State
+	consecutiveFailures int
+	openedAt            time.Time
+	halfOpenRequests    int
+}
+
+// New returns a closed circuit breaker.
+func New(name string, settings Settings) *Breaker {
+	if settings.FailureThreshold <= 0 {
+		settings.FailureThreshold = 1
+	}
+	if settings.HalfOpenMaxRequests <= 0 {
+		settings.HalfOpenMaxRequests = 1
+	}
+
+	return &Breaker{name: name, settings: settings, state: Closed}
+}
+
+// Name returns the name of the downstream service protected by the breaker.
+func (b *Breaker) Name() string {
+	if b == nil {
+		return ""
+	}
+	return b.name
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	if b == nil {
+		return Closed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refreshState()
+	return b.state
+}
+
+// Allow returns ErrOpen if the call must not be made.
+func (b *Breaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refreshState()
+
+	switch b.state {
+	case Open:
+		return ErrOpen
+	case HalfOpen:
+		if b.halfOpenRequests >= b.settings.HalfOpenMaxRequests {
+			return ErrOpen
+		}
+		b.halfOpenRequests++
+	}
+
+	return nil
+}
+
+// Success records a successful call. A successful trial call closes the circuit.
+func (b *Breaker) Success() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutiveFailures = 0
+	if b.state == HalfOpen {
+		b.state = Closed
+		b.halfOpenRequests = 0
+	}
+}
+
+// Failure records a failed call. A failed trial call opens the circuit again.
+func (b *Breaker) Failure() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.consecutiveFailures++
+	if b.state == HalfOpen || b.consecutiveFailures >= b.settings.FailureThreshold {
+		b.state = Open
+		b.openedAt = time.Now()
+		b.halfOpenRequests = 0
+	}
+}
+
+// Cancel records a call whose outcome says nothing about the health of the downstream service,
+// e.g. a call cancelled by the caller.
+func (b *Breaker) Cancel() {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == HalfOpen && b.halfOpenRequests > 0 {
+		b.halfOpenRequests--
+	}
+}
+
+// refreshState moves an open circuit to half-open once the open timeout expires.
+// Must be called with the lock held.
+func (b *Breaker) refreshState() {
+	if b.state == Open && time.Since(b.openedAt) >= b.settings.OpenTimeout {
+		b.state = HalfOpen
+		b.halfOpenRequests = 0
+	}
+}
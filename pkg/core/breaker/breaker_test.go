@@ -0,0 +1,70 @@
+package breaker_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := breaker.New("test", breaker.Settings{FailureThreshold: 3, OpenTimeout: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, b.Allow())
+		b.Failure()
+	}
+	// a success resets the count
+	assert.NoError(t, b.Allow())
+	b.Success()
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, breaker.Closed, b.State())
+		assert.NoError(t, b.Allow())
+		b.Failure()
+	}
+
+	assert.Equal(t, breaker.Open, b.State())
+	assert.Equal(t, breaker.ErrOpen, b.Allow())
+}
+
+func TestBreakerHalfOpen(t *testing.T) {
+	tests := map[string]struct {
+		outcome       func(b *breaker.Breaker)
+		expectedState breaker.State
+	}{
+		"trial success closes":   {outcome: (*breaker.Breaker).Success, expectedState: breaker.Closed},
+		"trial failure reopens":  {outcome: (*breaker.Breaker).Failure, expectedState: breaker.Open},
+		"trial cancel stays put": {outcome: (*breaker.Breaker).Cancel, expectedState: breaker.HalfOpen},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			b := breaker.New("test", breaker.Settings{FailureThreshold: 1, OpenTimeout: 10 * time.Millisecond,
+				HalfOpenMaxRequests: 1})
+			assert.NoError(t, b.Allow())
+			b.Failure()
+			assert.Equal(t, breaker.Open, b.State())
+
+			time.Sleep(15 * time.Millisecond)
+			assert.Equal(t, breaker.HalfOpen, b.State())
+
+			assert.NoError(t, b.Allow())
+			// only one trial request at a time
+			assert.Equal(t, breaker.ErrOpen, b.Allow())
+
+			test.outcome(b)
+			assert.Equal(t, test.expectedState, b.State())
+		})
+	}
+}
+
+func TestNilBreakerLetsEverythingThrough(t *testing.T) {
+	var b *breaker.Breaker
+
+	assert.NoError(t, b.Allow())
+	b.Failure()
+	assert.NoError(t, b.Allow())
+	assert.Equal(t, breaker.Closed, b.State())
+}
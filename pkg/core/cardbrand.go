@@ -0,0 +1,131 @@
+package core
+
+import (
+	"strconv"
+)
+
+// CardBrand is a card brand (scheme).
+type CardBrand string
+
+// Card brands detected from the card number.
+const (
+	BrandVisa       CardBrand = "Visa"
+	BrandMastercard CardBrand = "Mastercard"
+	BrandAmex       CardBrand = "Amex"
+	BrandDiscover   CardBrand = "Discover"
+	BrandJCB        CardBrand = "JCB"
+	BrandUnionPay   CardBrand = "UnionPay"
+	BrandMaestro    CardBrand = "Maestro"
+	BrandDiners     CardBrand = "Diners"
+	BrandUnknown    CardBrand = "Unknown"
+)
+
+// binRange is a range of card number prefixes (IINs) of the same length issued by a brand.
+type binRange struct {
+	low   int
+	high  int
+	brand CardBrand
+}
+
+// binTable holds the IIN ranges of each brand. Ranges overlap, in which case the longest prefix wins,
+// e.g. 622126 is Discover although 62 is UnionPay.
+var binTable = []binRange{
+	{low: 4, high: 4, brand: BrandVisa},
+	{low: 51, high: 55, brand: BrandMastercard},
+	{low: 2221, high: 2720, brand: BrandMastercard},
+	{low: 34, high: 34, brand: BrandAmex},
+	{low: 37, high: 37, brand: BrandAmex},
+	{low: 6011, high: 6011, brand: BrandDiscover},
+	{low: 644, high: 649, brand: BrandDiscover},
+	{low: 65, high: 65, brand: BrandDiscover},
+	{low: 622126, high: 622925, brand: BrandDiscover},
+	{low: 3528, high: 3589, brand: BrandJCB},
+	{low: 62, high: 62, brand: BrandUnionPay},
+	{low: 81, high: 81, brand: BrandUnionPay},
+	{low: 5018, high: 5018, brand: BrandMaestro},
+	{low: 5020, high: 5020, brand: BrandMaestro},
+	{low: 5038, high: 5038, brand: BrandMaestro},
+	{low: 5893, high: 5893, brand: BrandMaestro},
+	{low: 6304, high: 6304, brand: BrandMaestro},
+	{low: 6759, high: 6759, brand: BrandMaestro},
+	{low: 6761, high: 6763, brand: BrandMaestro},
+	{low: 300, high: 305, brand: BrandDiners},
+	{low: 3095, high: 3095, brand: BrandDiners},
+	{low: 36, high: 36, brand: BrandDiners},
+	{low: 38, high: 39, brand: BrandDiners},
+}
+
+// brandRules holds the card number lengths and the CVV length of a brand.
+type brandRules struct {
+	minLength int
+	maxLength int
+	// lengths lists the allowed card number lengths when they are not a continuous range
+	lengths   []int
+	cvvLength int
+}
+
+var brandRulesTable = map[CardBrand]brandRules{
+	BrandVisa:       {lengths: []int{13, 16, 19}, cvvLength: 3},
+	BrandMastercard: {minLength: 16, maxLength: 16, cvvLength: 3},
+	BrandAmex:       {minLength: 15, maxLength: 15, cvvLength: 4},
+	BrandDiscover:   {minLength: 16, maxLength: 19, cvvLength: 3},
+	BrandJCB:        {minLength: 16, maxLength: 19, cvvLength: 3},
+	BrandUnionPay:   {minLength: 16, maxLength: 19, cvvLength: 3},
+	BrandMaestro:    {minLength: 12, maxLength: 19, cvvLength: 3},
+	BrandDiners:     {minLength: 14, maxLength: 19, cvvLength: 3},
+	BrandUnknown:    {minLength: 12, maxLength: 19, cvvLength: 3},
+}
+
+// DetectCardBrand returns the card brand based on the first digits of the card number (or of its BIN).
+func DetectCardBrand(number string) CardBrand {
+	brand := BrandUnknown
+	longestPrefix := 0
+
+	for _, r := range binTable {
+		length := len(strconv.Itoa(r.low))
+		if length <= longestPrefix || len(number) < length {
+			continue
+		}
+
+		prefix, err := strconv.Atoi(number[:length])
+		if err != nil {
+			continue
+		}
+
+		if prefix >= r.low && prefix <= r.high {
+			brand = r.brand
+			longestPrefix = length
+		}
+	}
+
+	return brand
+}
+
+// ValidCardNumberLength checks the card number length is one issued by the brand.
+func ValidCardNumberLength(brand CardBrand, length int) bool {
+	rules, ok := brandRulesTable[brand]
+	if !ok {
+		rules = brandRulesTable[BrandUnknown]
+	}
+
+	if len(rules.lengths) != 0 {
+		for _, l := range rules.lengths {
+			if l == length {
+				return true
+			}
+		}
+		return false
+	}
+
+	return length >= rules.minLength && length <= rules.maxLength
+}
+
+// CVVLength returns the number of digits of the card verification value of the brand.
+func CVVLength(brand CardBrand) int {
+	rules, ok := brandRulesTable[brand]
+	if !ok {
+		rules = brandRulesTable[BrandUnknown]
+	}
+
+	return rules.cvvLength
+}
@@ -0,0 +1,41 @@
+package core
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+)
+
+// CompensationRequestID returns the request ID of the void compensating the authorisation request with the given
+// reference, so retried voids are processed only once by the payment processor.
+func CompensationRequestID(reference string) string {
+	return reference + "-void"
+}
+
+// CompensateAuthorisation voids at the payment processor an authorisation the gateway could not store, so the funds
+// are not held on the card, and records the outcome.
+// The journal entry of the authorisation request must have been marked with StartCompensation beforehand, so a failed
+// void is retried by the reconciler.
+func CompensateAuthorisation(ctx context.Context, repo Repository, pproc PaymentProcessor, reference string,
+	authID string) error {
+	voidReq := pprocessor.VoidRequest{
+		AuthorisationID: authID,
+		RequestID:       CompensationRequestID(reference),
+	}
+
+	ppErr := pproc.VoidPayment(ctx, voidReq)
+	if ppErr != nil {
+		if err := repo.RecordAuthorisationJournalAttempt(ctx, reference); err != nil {
+			return fmt.Errorf("failed to void authorisation '%s': %w (and to record the attempt: %s)",
+				authID, ppErr, err.Error())
+		}
+		return fmt.Errorf("failed to void authorisation '%s': %w", authID, ppErr)
+	}
+
+	if err := repo.CompleteCompensation(ctx, reference); err != nil {
+		return fmt.Errorf("authorisation '%s' voided but failed to record it: %w", authID, err)
+	}
+
+	return nil
+}
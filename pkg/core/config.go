@@ -1,18 +1,25 @@
 package core
 
 import (
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
 )
 
 // NOTE: We would replace this with a proper config library like Viper
 
 const AppPrefix = "PGW_PAYMENT_GATEWAY_APP"
 
+// MaxRequestDuration is the write timeout of the webservers, i.e. how long a request can take at most.
+const MaxRequestDuration = 10 * time.Second
+
 // Configuration holds the entire configuration
 type Configuration struct {
 	WebserverMerchant WebserverConfiguration
@@ -21,12 +28,46 @@ type Configuration struct {
 	Database          DatabaseConfiguration
 	AuthService       AuthServiceConfiguration
 	PProcessorService PaymentProcessorServiceConfiguration
+	Vault             VaultConfiguration
+	CardReveal        CardRevealConfiguration
+	Admin             AdminConfiguration
+	APIKeys           APIKeysConfiguration
+	Timeouts          TimeoutsConfiguration
+	Reconciler        ReconcilerConfiguration
+	MerchantLimits    MerchantLimitsConfiguration
 }
 
 // WebserverConfiguration holds configuration related to the webserver
 type WebserverConfiguration struct {
 	Host string
 	Port int
+
+	// TLS (if enabled) makes the webserver serve HTTPS
+	TLS TLSConfiguration
+}
+
+// TLSConfiguration holds the TLS configuration of a webserver.
+// The certificate and key (and client CAs) are reloaded from their files on SIGHUP.
+type TLSConfiguration struct {
+	// CertFile and KeyFile are the paths of the PEM encoded certificate (chain) and private key.
+	// TLS is disabled if they are empty.
+	CertFile string
+	KeyFile  string
+
+	// MinVersion is the minimum TLS version accepted (tls.VersionTLS12 or tls.VersionTLS13)
+	MinVersion uint16
+	// CipherSuites are the TLS 1.2 cipher suites accepted, Go's defaults being used if empty (TLS 1.3 suites are not
+	// configurable)
+	CipherSuites []uint16
+
+	// ClientCAFile is the path of the PEM encoded CAs client certificates must be signed by.
+	// Clients are not asked for certificates if empty. It is only supported on the management webserver.
+	ClientCAFile string
+}
+
+// Enabled returns true if the webserver serves HTTPS.
+func (tlsConfig TLSConfiguration) Enabled() bool {
+	return tlsConfig.CertFile != ""
 }
 
 // OptionsConfiguration holds general configuration
@@ -39,25 +80,177 @@ type OptionsConfiguration struct {
 	HTTPClientTimeout int
 }
 
+// Database drivers supported.
+const (
+	DriverMySQL    = "mysql"
+	DriverPostgres = "postgres"
+	// DriverSQLite is meant for local development and tests, the database being a single file (DBName).
+	DriverSQLite = "sqlite"
+)
+
 // DatabaseConfiguration holds configuration related to the database holding users credentials
 type DatabaseConfiguration struct {
+	Driver   string
 	Host     string
 	Port     int
 	Username string
 	Password string
-	DBName   string
+	// DBName is the name of the database, or the path of the database file with SQLite
+	DBName string
+	// SSLMode is the PostgreSQL sslmode (e.g. disable, prefer, require, verify-full)
+	SSLMode string
 }
 
+// Credential backends supported.
+const (
+	// AuthBackendRemote checks merchants' credentials against the auth service (Host and Port).
+	AuthBackendRemote = "remote"
+	// AuthBackendFile checks merchants' credentials against a file of bcrypt hashed passwords (CredentialsFile).
+	AuthBackendFile = "file"
+	// AuthBackendStatic checks merchants' credentials against a fixed set of accounts (Accounts), e.g. for tests.
+	AuthBackendStatic = "static"
+)
+
 // AuthServiceConfiguration holds configuration related to the authentication system
 type AuthServiceConfiguration struct {
+	// Backend is where merchants' credentials are checked (AuthBackendRemote, AuthBackendFile or AuthBackendStatic)
+	Backend string
+
 	Host string
 	Port int
+
+	// CredentialsFile is the path of the file holding "username:bcrypt hash" lines
+	CredentialsFile string
+	// Accounts maps usernames to passwords
+	Accounts map[string]string
+
+	// Valid credentials are cached for CacheTTL and invalid ones for CacheNegativeTTL, up to CacheMaxEntries
+	// credentials. A zero CacheTTL disables the cache and a zero CacheNegativeTTL disables negative caching.
+	CacheTTL         time.Duration
+	CacheNegativeTTL time.Duration
+	CacheMaxEntries  int
+
+	Breaker CircuitBreakerConfiguration
 }
 
 // PaymentProcessorServiceConfiguration holds configuration related to the payment processor system
 type PaymentProcessorServiceConfiguration struct {
 	Host string
 	Port int
+
+	// Captures, refunds and voids are retried up to RetryMaxAttempts times (including the first attempt),
+	// waiting a random time up to RetryInitialBackoff (doubling on each retry, capped at RetryMaxBackoff)
+	// between attempts, and giving up once RetryBudget is spent.
+	// RetryBudget must leave enough time to answer the merchant before the webserver write timeout.
+	RetryMaxAttempts    int
+	RetryInitialBackoff time.Duration
+	RetryMaxBackoff     time.Duration
+	RetryBudget         time.Duration
+
+	Breaker CircuitBreakerConfiguration
+}
+
+// CircuitBreakerConfiguration holds the thresholds of the circuit breaker of a downstream service
+type CircuitBreakerConfiguration struct {
+	// FailureThreshold consecutive failures open the circuit, failing requests straight away
+	FailureThreshold int
+	// OpenTimeout is how long the circuit stays open before trying the downstream service again
+	OpenTimeout time.Duration
+	// HalfOpenMaxRequests is the number of concurrent trial requests allowed after OpenTimeout
+	HalfOpenMaxRequests int
+}
+
+// VaultConfiguration holds configuration related to the card vault
+type VaultConfiguration struct {
+	// KeyEncryptionKey wraps the per card data encryption keys (AES-256, so it must be 32 bytes long)
+	KeyEncryptionKey []byte
+}
+
+// CardRevealConfiguration holds configuration related to revealing card numbers on the management API
+type CardRevealConfiguration struct {
+	// Accounts maps usernames to passwords of the operators allowed to reveal card numbers.
+	// Revealing card numbers is disabled if empty.
+	Accounts map[string]string
+}
+
+// AdminConfiguration holds configuration related to the administration endpoints of the management API
+type AdminConfiguration struct {
+	// Accounts maps usernames to passwords of the operators allowed to manage merchants' API keys.
+	// The administration endpoints are disabled if empty.
+	Accounts map[string]string
+}
+
+// APIKeysConfiguration holds configuration related to the requests merchants sign with their API keys
+type APIKeysConfiguration struct {
+	// SignatureWindow is how far from now the timestamp of a signed request can be.
+	// Nonces are remembered for twice as long, so a signed request can never be replayed.
+	SignatureWindow time.Duration
+}
+
+// TimeoutsConfiguration holds the deadline of each operation on external systems.
+// A request is cancelled when its deadline expires or when the client making the request goes away.
+type TimeoutsConfiguration struct {
+	AuthService time.Duration
+	Database    time.Duration
+
+	PProcessorAuthorise time.Duration
+	PProcessorCapture   time.Duration
+	PProcessorRefund    time.Duration
+	PProcessorVoid      time.Duration
+	PProcessorQuery     time.Duration
+}
+
+// MerchantLimitsConfiguration holds the limits applied to merchants' requests
+type MerchantLimitsConfiguration struct {
+	// MaxAmount is the maximum amount of a single authorisation
+	MaxAmount MerchantLimits
+	// AcceptedBrands are the card brands merchants accept
+	AcceptedBrands MerchantBrands
+}
+
+// MerchantLimits holds an amount limit per merchant and currency.
+// The limits of the merchant named "*" apply to merchants without limits of their own.
+type MerchantLimits map[string]map[string]money.Money
+
+// Limit returns the limit of the merchant in the given currency, if any.
+func (limits MerchantLimits) Limit(merchantName string, currency string) (limit money.Money, ok bool) {
+	merchantLimits, ok := limits[merchantName]
+	if !ok {
+		merchantLimits = limits["*"]
+	}
+
+	limit, ok = merchantLimits[currency]
+	return limit, ok
+}
+
+// MerchantBrands holds the card brands accepted per merchant.
+// The brands of the merchant named "*" apply to merchants without brands of their own.
+// Merchants without brands configured accept all brands.
+type MerchantBrands map[string]map[CardBrand]bool
+
+// Accepts returns true if the merchant accepts cards of the brand.
+func (brands MerchantBrands) Accepts(merchantName string, brand CardBrand) bool {
+	merchantBrands, ok := brands[merchantName]
+	if !ok {
+		merchantBrands, ok = brands["*"]
+	}
+
+	return !ok || merchantBrands[brand]
+}
+
+// ReconcilerConfiguration holds configuration related to the reconciliation of operations whose outcome at the
+// payment processor is unknown
+type ReconcilerConfiguration struct {
+	// Interval is how often the reconciler looks for operations to resolve
+	Interval time.Duration
+	// MinAge is how old an operation must be before being reconciled.
+	// It must be longer than MaxRequestDuration, so in-flight requests are never reconciled.
+	MinAge time.Duration
+	// MaxAttempts is how many times resolving an operation can fail before the reconciler gives up
+	MaxAttempts int
+	// AuthorisationValidity is how long authorisations can be captured for, before the reconciler expires them.
+	// It must not be longer than the payment processor holds the funds for.
+	AuthorisationValidity time.Duration
 }
 
 // NewConfig returns new default configuration
@@ -91,6 +284,27 @@ func (config *Configuration) LoadConfig() (err error) {
 		}
 	}
 
+	err = config.WebserverMerchant.TLS.load("_WEBSERVERMERCHANT", "webservermerchant")
+	if err != nil {
+		return err
+	}
+
+	err = config.WebserverMgmt.TLS.load("_WEBSERVERMGMT", "webservermgmt")
+	if err != nil {
+		return err
+	}
+
+	if _, ok := os.LookupEnv(AppPrefix + "_WEBSERVERMERCHANT_TLSCLIENTCAFILE"); ok {
+		return fmt.Errorf("configuration error: [webservermerchant tlsclientcafile] only supported on the management webserver")
+	}
+
+	if clientCAFile, ok := os.LookupEnv(AppPrefix + "_WEBSERVERMGMT_TLSCLIENTCAFILE"); ok {
+		config.WebserverMgmt.TLS.ClientCAFile = clientCAFile
+		if !config.WebserverMgmt.TLS.Enabled() {
+			return fmt.Errorf("configuration error: [webservermgmt tlsclientcafile] requires tlscertfile and tlskeyfile")
+		}
+	}
+
 	if devMode, ok := os.LookupEnv(AppPrefix + "_OPTIONS_DEV_MODE"); ok {
 		config.Options.DevMode, err = strconv.ParseBool(devMode)
 		if err != nil {
@@ -112,6 +326,172 @@ func (config *Configuration) LoadConfig() (err error) {
 		}
 	}
 
+	if err := config.LoadDatabaseConfig(); err != nil {
+		return err
+	}
+
+	if err := config.loadAuthServiceConfig(); err != nil {
+		return err
+	}
+
+	if pprocessorHost, ok := os.LookupEnv(AppPrefix + "_PPROCESSORSERVICE_HOST"); ok {
+		config.PProcessorService.Host = pprocessorHost
+	} else {
+		return fmt.Errorf("configuration error: [pprocessor host] mandatory config parameter missing")
+	}
+
+	if pprocessorPort, ok := os.LookupEnv(AppPrefix + "_PPROCESSORSERVICE_PORT"); ok {
+		config.PProcessorService.Port, err = strconv.Atoi(pprocessorPort)
+		if err != nil || config.PProcessorService.Port <= 0 || config.PProcessorService.Port > 1<<16-1 {
+			return fmt.Errorf("configuration error: [pprocessor port] input not allowed <%s>", pprocessorPort)
+		}
+	}
+
+	if retryMaxAttempts, ok := os.LookupEnv(AppPrefix + "_PPROCESSORSERVICE_RETRYMAXATTEMPTS"); ok {
+		config.PProcessorService.RetryMaxAttempts, err = strconv.Atoi(retryMaxAttempts)
+		if err != nil || config.PProcessorService.RetryMaxAttempts <= 0 {
+			return fmt.Errorf("configuration error: [pprocessor retrymaxattempts] input not allowed <%s>", retryMaxAttempts)
+		}
+	}
+
+	retryDurations := []struct {
+		envVar   string
+		name     string
+		duration *time.Duration
+	}{
+		{envVar: "_PPROCESSORSERVICE_RETRYINITIALBACKOFF", name: "pprocessor retryinitialbackoff",
+			duration: &config.PProcessorService.RetryInitialBackoff},
+		{envVar: "_PPROCESSORSERVICE_RETRYMAXBACKOFF", name: "pprocessor retrymaxbackoff",
+			duration: &config.PProcessorService.RetryMaxBackoff},
+		{envVar: "_PPROCESSORSERVICE_RETRYBUDGET", name: "pprocessor retrybudget",
+			duration: &config.PProcessorService.RetryBudget},
+	}
+
+	for _, d := range retryDurations {
+		if duration, ok := os.LookupEnv(AppPrefix + d.envVar); ok {
+			*d.duration, err = time.ParseDuration(duration)
+			if err != nil || *d.duration <= 0 {
+				return fmt.Errorf("configuration error: [%s] input not allowed <%s>", d.name, duration)
+			}
+		}
+	}
+
+	if config.PProcessorService.RetryBudget >= MaxRequestDuration {
+		return fmt.Errorf("configuration error: [pprocessor retrybudget] must be lower than %s", MaxRequestDuration)
+	}
+
+	err = config.AuthService.Breaker.load("_AUTHSERVICE", "authservice")
+	if err != nil {
+		return err
+	}
+
+	err = config.PProcessorService.Breaker.load("_PPROCESSORSERVICE", "pprocessor")
+	if err != nil {
+		return err
+	}
+
+	if vaultKEK, ok := os.LookupEnv(AppPrefix + "_VAULT_KEK"); ok {
+		config.Vault.KeyEncryptionKey, err = base64.StdEncoding.DecodeString(vaultKEK)
+		if err != nil || len(config.Vault.KeyEncryptionKey) != 32 {
+			return fmt.Errorf("configuration error: [vault kek] must be 32 bytes encoded in base64")
+		}
+	} else {
+		return fmt.Errorf("configuration error: [vault kek] mandatory config parameter missing")
+	}
+
+	if revealAccounts, ok := os.LookupEnv(AppPrefix + "_CARDREVEAL_ACCOUNTS"); ok {
+		config.CardReveal.Accounts, err = ParseAccounts(revealAccounts)
+		if err != nil {
+			return fmt.Errorf("configuration error: [cardreveal accounts] %s", err.Error())
+		}
+	}
+
+	if adminAccounts, ok := os.LookupEnv(AppPrefix + "_ADMIN_ACCOUNTS"); ok {
+		config.Admin.Accounts, err = ParseAccounts(adminAccounts)
+		if err != nil {
+			return fmt.Errorf("configuration error: [admin accounts] %s", err.Error())
+		}
+	}
+
+	timeouts := []struct {
+		envVar  string
+		name    string
+		timeout *time.Duration
+	}{
+		{envVar: "_TIMEOUTS_AUTHSERVICE", name: "timeouts authservice", timeout: &config.Timeouts.AuthService},
+		{envVar: "_TIMEOUTS_DATABASE", name: "timeouts database", timeout: &config.Timeouts.Database},
+		{envVar: "_TIMEOUTS_PPROCESSORAUTHORISE", name: "timeouts pprocessorauthorise",
+			timeout: &config.Timeouts.PProcessorAuthorise},
+		{envVar: "_TIMEOUTS_PPROCESSORCAPTURE", name: "timeouts pprocessorcapture",
+			timeout: &config.Timeouts.PProcessorCapture},
+		{envVar: "_TIMEOUTS_PPROCESSORREFUND", name: "timeouts pprocessorrefund",
+			timeout: &config.Timeouts.PProcessorRefund},
+		{envVar: "_TIMEOUTS_PPROCESSORVOID", name: "timeouts pprocessorvoid", timeout: &config.Timeouts.PProcessorVoid},
+		{envVar: "_TIMEOUTS_PPROCESSORQUERY", name: "timeouts pprocessorquery",
+			timeout: &config.Timeouts.PProcessorQuery},
+		{envVar: "_RECONCILER_INTERVAL", name: "reconciler interval", timeout: &config.Reconciler.Interval},
+		{envVar: "_RECONCILER_MINAGE", name: "reconciler minage", timeout: &config.Reconciler.MinAge},
+		{envVar: "_RECONCILER_AUTHORISATIONVALIDITY", name: "reconciler authorisationvalidity",
+			timeout: &config.Reconciler.AuthorisationValidity},
+		{envVar: "_APIKEYS_SIGNATUREWINDOW", name: "apikeys signaturewindow", timeout: &config.APIKeys.SignatureWindow},
+	}
+
+	for _, t := range timeouts {
+		if timeout, ok := os.LookupEnv(AppPrefix + t.envVar); ok {
+			*t.timeout, err = time.ParseDuration(timeout)
+			if err != nil || *t.timeout <= 0 {
+				return fmt.Errorf("configuration error: [%s] input not allowed <%s>", t.name, timeout)
+			}
+		}
+	}
+
+	if maxAmount, ok := os.LookupEnv(AppPrefix + "_MERCHANTLIMITS_MAXAMOUNT"); ok {
+		config.MerchantLimits.MaxAmount, err = ParseMerchantLimits(maxAmount)
+		if err != nil {
+			return fmt.Errorf("configuration error: [merchantlimits maxamount] %s", err.Error())
+		}
+	}
+
+	if acceptedBrands, ok := os.LookupEnv(AppPrefix + "_MERCHANTLIMITS_ACCEPTEDBRANDS"); ok {
+		config.MerchantLimits.AcceptedBrands, err = ParseMerchantBrands(acceptedBrands)
+		if err != nil {
+			return fmt.Errorf("configuration error: [merchantlimits acceptedbrands] %s", err.Error())
+		}
+	}
+
+	if maxAttempts, ok := os.LookupEnv(AppPrefix + "_RECONCILER_MAXATTEMPTS"); ok {
+		config.Reconciler.MaxAttempts, err = strconv.Atoi(maxAttempts)
+		if err != nil || config.Reconciler.MaxAttempts <= 0 {
+			return fmt.Errorf("configuration error: [reconciler maxattempts] input not allowed <%s>", maxAttempts)
+		}
+	}
+
+	if config.Reconciler.MinAge <= MaxRequestDuration {
+		return fmt.Errorf("configuration error: [reconciler minage] must be greater than %s", MaxRequestDuration)
+	}
+
+	return nil
+}
+
+// LoadDatabaseConfig loads and validates the database config (from env vars), which is all the migrations need.
+func (config *Configuration) LoadDatabaseConfig() (err error) {
+	if driver, ok := os.LookupEnv(AppPrefix + "_DATABASE_DRIVER"); ok {
+		config.Database.Driver = driver
+	}
+
+	switch config.Database.Driver {
+	case DriverMySQL, DriverPostgres:
+	case DriverSQLite:
+		// The database is a local file, only its path is needed
+		if dbName, ok := os.LookupEnv(AppPrefix + "_DATABASE_DBNAME"); ok {
+			config.Database.DBName = dbName
+			return nil
+		}
+		return fmt.Errorf("configuration error: [database dbname] mandatory config parameter missing")
+	default:
+		return fmt.Errorf("configuration error: [database driver] input not allowed <%s>", config.Database.Driver)
+	}
+
 	if dbHost, ok := os.LookupEnv(AppPrefix + "_DATABASE_HOST"); ok {
 		config.Database.Host = dbHost
 	} else {
@@ -123,6 +503,8 @@ func (config *Configuration) LoadConfig() (err error) {
 		if err != nil || config.Database.Port <= 0 || config.Database.Port > 1<<16-1 {
 			return fmt.Errorf("configuration error: [database port] input not allowed <%s>", dbPort)
 		}
+	} else if config.Database.Driver == DriverPostgres {
+		config.Database.Port = 5432
 	}
 
 	if dbUsername, ok := os.LookupEnv(AppPrefix + "_DATABASE_USERNAME"); ok {
@@ -137,35 +519,140 @@ func (config *Configuration) LoadConfig() (err error) {
 		return fmt.Errorf("configuration error: [database password] mandatory config parameter missing")
 	}
 
+	if sslMode, ok := os.LookupEnv(AppPrefix + "_DATABASE_SSLMODE"); ok {
+		config.Database.SSLMode = sslMode
+	}
+
 	if dbName, ok := os.LookupEnv(AppPrefix + "_DATABASE_DBNAME"); ok {
 		config.Database.DBName = dbName
 	} else {
 		return fmt.Errorf("configuration error: [database dbname] mandatory config parameter missing")
 	}
 
-	if authHost, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_HOST"); ok {
-		config.AuthService.Host = authHost
-	} else {
-		return fmt.Errorf("configuration error: [authservice host] mandatory config parameter missing")
+	return nil
+}
+
+// loadAuthServiceConfig loads and validates the config of the credential backend (from env vars).
+func (config *Configuration) loadAuthServiceConfig() (err error) {
+	if backend, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_BACKEND"); ok {
+		config.AuthService.Backend = backend
 	}
 
-	if authPort, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_PORT"); ok {
-		config.AuthService.Port, err = strconv.Atoi(authPort)
-		if err != nil || config.AuthService.Port <= 0 || config.AuthService.Port > 1<<16-1 {
-			return fmt.Errorf("configuration error: [authservice port] input not allowed <%s>", authPort)
+	switch config.AuthService.Backend {
+	case AuthBackendRemote:
+		if authHost, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_HOST"); ok {
+			config.AuthService.Host = authHost
+		} else {
+			return fmt.Errorf("configuration error: [authservice host] mandatory config parameter missing")
+		}
+
+		if authPort, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_PORT"); ok {
+			config.AuthService.Port, err = strconv.Atoi(authPort)
+			if err != nil || config.AuthService.Port <= 0 || config.AuthService.Port > 1<<16-1 {
+				return fmt.Errorf("configuration error: [authservice port] input not allowed <%s>", authPort)
+			}
+		}
+	case AuthBackendFile:
+		if credentialsFile, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_CREDENTIALSFILE"); ok {
+			config.AuthService.CredentialsFile = credentialsFile
+		} else {
+			return fmt.Errorf("configuration error: [authservice credentialsfile] mandatory config parameter missing")
+		}
+	case AuthBackendStatic:
+		accounts, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_ACCOUNTS")
+		if !ok {
+			return fmt.Errorf("configuration error: [authservice accounts] mandatory config parameter missing")
+		}
+		config.AuthService.Accounts, err = ParseAccounts(accounts)
+		if err != nil {
+			return fmt.Errorf("configuration error: [authservice accounts] %s", err.Error())
 		}
+	default:
+		return fmt.Errorf("configuration error: [authservice backend] input not allowed <%s>",
+			config.AuthService.Backend)
 	}
 
-	if pprocessorHost, ok := os.LookupEnv(AppPrefix + "_PPROCESSORSERVICE_HOST"); ok {
-		config.PProcessorService.Host = pprocessorHost
-	} else {
-		return fmt.Errorf("configuration error: [pprocessor host] mandatory config parameter missing")
+	cacheTTLs := []struct {
+		envVar string
+		name   string
+		ttl    *time.Duration
+	}{
+		{envVar: "_AUTHSERVICE_CACHETTL", name: "authservice cachettl", ttl: &config.AuthService.CacheTTL},
+		{envVar: "_AUTHSERVICE_CACHENEGATIVETTL", name: "authservice cachenegativettl",
+			ttl: &config.AuthService.CacheNegativeTTL},
 	}
 
-	if pprocessorPort, ok := os.LookupEnv(AppPrefix + "_PPROCESSORSERVICE_PORT"); ok {
-		config.PProcessorService.Port, err = strconv.Atoi(pprocessorPort)
-		if err != nil || config.PProcessorService.Port <= 0 || config.PProcessorService.Port > 1<<16-1 {
-			return fmt.Errorf("configuration error: [pprocessor port] input not allowed <%s>", pprocessorPort)
+	for _, c := range cacheTTLs {
+		if ttl, ok := os.LookupEnv(AppPrefix + c.envVar); ok {
+			*c.ttl, err = time.ParseDuration(ttl)
+			if err != nil || *c.ttl < 0 {
+				return fmt.Errorf("configuration error: [%s] input not allowed <%s>", c.name, ttl)
+			}
+		}
+	}
+
+	if maxEntries, ok := os.LookupEnv(AppPrefix + "_AUTHSERVICE_CACHEMAXENTRIES"); ok {
+		config.AuthService.CacheMaxEntries, err = strconv.Atoi(maxEntries)
+		if err != nil || config.AuthService.CacheMaxEntries <= 0 {
+			return fmt.Errorf("configuration error: [authservice cachemaxentries] input not allowed <%s>", maxEntries)
+		}
+	}
+
+	return nil
+}
+
+// load loads the TLS configuration of a webserver (from env vars), apart from the client CAs.
+func (tlsConfig *TLSConfiguration) load(envPrefix string, name string) (err error) {
+	if certFile, ok := os.LookupEnv(AppPrefix + envPrefix + "_TLSCERTFILE"); ok {
+		tlsConfig.CertFile = certFile
+	}
+
+	if keyFile, ok := os.LookupEnv(AppPrefix + envPrefix + "_TLSKEYFILE"); ok {
+		tlsConfig.KeyFile = keyFile
+	}
+
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return fmt.Errorf("configuration error: [%s tlscertfile tlskeyfile] must be set together", name)
+	}
+
+	if minVersion, ok := os.LookupEnv(AppPrefix + envPrefix + "_TLSMINVERSION"); ok {
+		tlsConfig.MinVersion, err = ParseTLSVersion(minVersion)
+		if err != nil {
+			return fmt.Errorf("configuration error: [%s tlsminversion] %s", name, err.Error())
+		}
+	}
+
+	if cipherSuites, ok := os.LookupEnv(AppPrefix + envPrefix + "_TLSCIPHERSUITES"); ok {
+		tlsConfig.CipherSuites, err = ParseCipherSuites(cipherSuites)
+		if err != nil {
+			return fmt.Errorf("configuration error: [%s tlsciphersuites] %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// load loads the circuit breaker configuration of a downstream service (from env vars).
+func (breakerConfig *CircuitBreakerConfiguration) load(envPrefix string, name string) (err error) {
+	if threshold, ok := os.LookupEnv(AppPrefix + envPrefix + "_BREAKERFAILURETHRESHOLD"); ok {
+		breakerConfig.FailureThreshold, err = strconv.Atoi(threshold)
+		if err != nil || breakerConfig.FailureThreshold <= 0 {
+			return fmt.Errorf("configuration error: [%s breakerfailurethreshold] input not allowed <%s>", name, threshold)
+		}
+	}
+
+	if openTimeout, ok := os.LookupEnv(AppPrefix + envPrefix + "_BREAKEROPENTIMEOUT"); ok {
+		breakerConfig.OpenTimeout, err = time.ParseDuration(openTimeout)
+		if err != nil || breakerConfig.OpenTimeout <= 0 {
+			return fmt.Errorf("configuration error: [%s breakeropentimeout] input not allowed <%s>", name, openTimeout)
+		}
+	}
+
+	if halfOpenRequests, ok := os.LookupEnv(AppPrefix + envPrefix + "_BREAKERHALFOPENREQUESTS"); ok {
+		breakerConfig.HalfOpenMaxRequests, err = strconv.Atoi(halfOpenRequests)
+		if err != nil || breakerConfig.HalfOpenMaxRequests <= 0 {
+			return fmt.Errorf("configuration error: [%s breakerhalfopenrequests] input not allowed <%s>",
+				name, halfOpenRequests)
 		}
 	}
 
@@ -182,19 +669,55 @@ func (config *Configuration) setDefaults() {
 	config.WebserverMgmt.Host = "127.0.0.1"
 	config.WebserverMgmt.Port = 8081
 
+	// TLS (disabled unless certificates are configured)
+	config.WebserverMerchant.TLS.MinVersion = tls.VersionTLS12
+	config.WebserverMgmt.TLS.MinVersion = tls.VersionTLS12
+
 	// Options
 	config.Options.DevMode = false
 	config.Options.LogLevel = log.INFO
 	config.Options.HTTPClientTimeout = 5
 
 	// Database
+	config.Database.Driver = DriverMySQL
 	config.Database.Port = 3306
+	config.Database.SSLMode = "prefer"
 
 	//AuthService
+	config.AuthService.Backend = AuthBackendRemote
 	config.AuthService.Port = 8080
+	config.AuthService.CacheTTL = time.Minute
+	config.AuthService.CacheNegativeTTL = 5 * time.Second
+	config.AuthService.CacheMaxEntries = 10000
+	config.AuthService.Breaker = CircuitBreakerConfiguration{FailureThreshold: 5, OpenTimeout: 30 * time.Second,
+		HalfOpenMaxRequests: 1}
 
 	//PaymentProcessorService
 	config.PProcessorService.Port = 8080
+	config.PProcessorService.RetryMaxAttempts = 3
+	config.PProcessorService.RetryInitialBackoff = 100 * time.Millisecond
+	config.PProcessorService.RetryMaxBackoff = time.Second
+	config.PProcessorService.RetryBudget = 8 * time.Second
+	config.PProcessorService.Breaker = CircuitBreakerConfiguration{FailureThreshold: 5, OpenTimeout: 30 * time.Second,
+		HalfOpenMaxRequests: 1}
+
+	// APIKeys
+	config.APIKeys.SignatureWindow = 5 * time.Minute
+
+	// Timeouts
+	config.Timeouts.AuthService = 2 * time.Second
+	config.Timeouts.Database = 3 * time.Second
+	config.Timeouts.PProcessorAuthorise = 5 * time.Second
+	config.Timeouts.PProcessorCapture = 5 * time.Second
+	config.Timeouts.PProcessorRefund = 5 * time.Second
+	config.Timeouts.PProcessorVoid = 5 * time.Second
+	config.Timeouts.PProcessorQuery = 5 * time.Second
+
+	// Reconciler
+	config.Reconciler.Interval = 30 * time.Second
+	config.Reconciler.MinAge = time.Minute
+	config.Reconciler.MaxAttempts = 20
+	config.Reconciler.AuthorisationValidity = 7 * 24 * time.Hour
 }
 
 // ParseLogLevel parses a string and returns a log level enum.
@@ -216,3 +739,126 @@ func ParseLogLevel(level string) (logLevel log.Level, err error) {
 
 	return logLevel, nil
 }
+
+// ParseAccounts parses a comma separated list of "username:password" pairs.
+func ParseAccounts(accounts string) (map[string]string, error) {
+	accountsMap := make(map[string]string)
+
+	for _, account := range strings.Split(accounts, ",") {
+		if account == "" {
+			continue
+		}
+
+		credentials := strings.SplitN(account, ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" || credentials[1] == "" {
+			return nil, fmt.Errorf("accounts must be in the format user1:password1,user2:password2")
+		}
+
+		accountsMap[credentials[0]] = credentials[1]
+	}
+
+	return accountsMap, nil
+}
+
+// ParseMerchantLimits parses a comma separated list of "merchant:currency:amount" limits, e.g. "bill:EUR:500.00".
+// The merchant "*" sets the limits of all merchants without limits of their own.
+func ParseMerchantLimits(limits string) (MerchantLimits, error) {
+	limitsMap := make(MerchantLimits)
+
+	for _, limit := range strings.Split(limits, ",") {
+		if limit == "" {
+			continue
+		}
+
+		parts := strings.Split(limit, ":")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("limits must be in the format merchant1:EUR:500.00,merchant2:USD:100")
+		}
+
+		amount, err := money.Parse(parts[2], parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid limit <%s>: %w", limit, err)
+		}
+		if !amount.IsPositive() {
+			return nil, fmt.Errorf("invalid limit <%s>: must be greater than zero", limit)
+		}
+
+		if limitsMap[parts[0]] == nil {
+			limitsMap[parts[0]] = make(map[string]money.Money)
+		}
+		limitsMap[parts[0]][parts[1]] = amount
+	}
+
+	return limitsMap, nil
+}
+
+// ParseMerchantBrands parses a comma separated list of "merchant:brand" pairs, e.g. "bill:Visa,bill:Mastercard".
+// The merchant "*" sets the brands of all merchants without brands of their own.
+func ParseMerchantBrands(brands string) (MerchantBrands, error) {
+	brandsMap := make(MerchantBrands)
+
+	for _, merchantBrand := range strings.Split(brands, ",") {
+		if merchantBrand == "" {
+			continue
+		}
+
+		parts := strings.Split(merchantBrand, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("brands must be in the format merchant1:Visa,merchant1:Amex,merchant2:Visa")
+		}
+
+		brand := CardBrand(parts[1])
+		if _, ok := brandRulesTable[brand]; !ok || brand == BrandUnknown {
+			return nil, fmt.Errorf("unknown card brand <%s>", parts[1])
+		}
+
+		if brandsMap[parts[0]] == nil {
+			brandsMap[parts[0]] = make(map[CardBrand]bool)
+		}
+		brandsMap[parts[0]][brand] = true
+	}
+
+	return brandsMap, nil
+}
+
+// ParseTLSVersion parses a TLS version, either "1.2" or "1.3" (older versions are not secure).
+func ParseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("TLS version must be 1.2 or 1.3")
+	}
+}
+
+// ParseCipherSuites parses a comma separated list of TLS 1.2 cipher suites, named as in the crypto/tls package,
+// e.g. "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256".
+// Cipher suites with known security issues are rejected.
+func ParseCipherSuites(cipherSuites string) ([]uint16, error) {
+	supported := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		for _, version := range suite.SupportedVersions {
+			if version == tls.VersionTLS12 {
+				supported[suite.Name] = suite.ID
+			}
+		}
+	}
+
+	suites := []uint16{}
+	for _, name := range strings.Split(cipherSuites, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		id, ok := supported[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown, insecure or TLS 1.3 cipher suite <%s>", name)
+		}
+		suites = append(suites, id)
+	}
+
+	return suites, nil
+}
@@ -1,16 +1,25 @@
 package core
 
-import "time"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"strings"
+	"time"
+)
 
 // LuhnValid checks credit card number is valid.
-func LuhnValid(creditCardNumber uint64) bool {
-	var checksum uint64
-	remainingDigits := creditCardNumber
+// The card number must be a string of digits, so leading zeros and numbers too long for an integer are kept.
+func LuhnValid(creditCardNumber string) bool {
+	var checksum int
 
-	for i := 1; remainingDigits > 0; i++ {
-		currentDigit := remainingDigits % 10
+	for i := len(creditCardNumber) - 1; i >= 0; i-- {
+		currentDigit := int(creditCardNumber[i]) - '0'
+		if currentDigit < 0 || currentDigit > 9 {
+			return false
+		}
 
-		if i%2 == 0 {
+		if (len(creditCardNumber)-i)%2 == 0 {
 			currentDigit = currentDigit * 2
 			if currentDigit > 9 {
 				currentDigit = currentDigit%10 + currentDigit/10
@@ -18,20 +27,35 @@ func LuhnValid(creditCardNumber uint64) bool {
 		}
 
 		checksum += currentDigit
-		remainingDigits /= 10
 	}
 
-	return (checksum % 10) == 0
+	return len(creditCardNumber) > 0 && checksum%10 == 0
+}
+
+// OnlyDigits checks the string is made of ASCII digits only, e.g. a card number or a CVV.
+func OnlyDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+
+	return true
 }
 
-func CardExpiryValid(year uint, month uint) bool {
-	if month > 12 {
+// CardExpiryValid checks credit card has not expired yet.
+func CardExpiryValid(year int, month int) bool {
+	if month < 1 || month > 12 {
 		return false
 	}
 
 	now := time.Now()
-	nowYear := uint(now.Year())
-	nowMonth := uint(now.Month())
+	nowYear := now.Year()
+	nowMonth := int(now.Month())
 
 	if year < nowYear {
 		return false
@@ -45,3 +69,32 @@ func CardExpiryValid(year uint, month uint) bool {
 		}
 	}
 }
+
+// MaskCardNumber returns a masked card number that only shows its first 6 and last 4 digits.
+func MaskCardNumber(bin string, lastFour string) string {
+	return bin + "******" + lastFour
+}
+
+// MaskPAN returns the card number with all but its first 6 and last 4 digits masked, each by an asterisk.
+// Numbers shorter than 16 digits show fewer leading digits, so at least 6 digits are always masked.
+func MaskPAN(number string) string {
+	if len(number) < 10 {
+		return strings.Repeat("*", len(number))
+	}
+
+	leading := len(number) - 10
+	if leading > 6 {
+		leading = 6
+	}
+	return number[:leading] + strings.Repeat("*", len(number)-leading-4) + number[len(number)-4:]
+}
+
+// NewReference returns a new random reference, identifying an authorisation request sent to the payment processor.
+func NewReference() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
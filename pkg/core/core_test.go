@@ -1,21 +1,30 @@
 package core_test
 
 import (
+	"crypto/tls"
 	"testing"
 
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestLuhnValid(t *testing.T) {
 	tests := map[string]struct {
-		creditCardNumber int64
+		creditCardNumber string
 		expectedOutput   bool
 	}{
-		"valid credit card 1":   {creditCardNumber: 4000000000000119, expectedOutput: true},
-		"valid credit card 2":   {creditCardNumber: 4000000000000259, expectedOutput: true},
-		"valid credit card 3":   {creditCardNumber: 4000000000003238, expectedOutput: true},
-		"invalid credit card 1": {creditCardNumber: 4000000000000009, expectedOutput: false},
+		"valid credit card 1":      {creditCardNumber: "4000000000000119", expectedOutput: true},
+		"valid credit card 2":      {creditCardNumber: "4000000000000259", expectedOutput: true},
+		"valid credit card 3":      {creditCardNumber: "4000000000003238", expectedOutput: true},
+		"valid 19 digits":          {creditCardNumber: "4242424242424242428", expectedOutput: true},
+		"valid leading zero":       {creditCardNumber: "04000000000000119", expectedOutput: true},
+		"invalid credit card 1":    {creditCardNumber: "4000000000000009", expectedOutput: false},
+		"invalid not digits":       {creditCardNumber: "4000 0000 0000 0119", expectedOutput: false},
+		"invalid empty":            {creditCardNumber: "", expectedOutput: false},
+		"invalid negative integer": {creditCardNumber: "-4000000000000119", expectedOutput: false},
 	}
 
 	for name, test := range tests {
@@ -26,6 +35,25 @@ func TestLuhnValid(t *testing.T) {
 	}
 }
 
+func TestOnlyDigits(t *testing.T) {
+	tests := map[string]struct {
+		value          string
+		expectedOutput bool
+	}{
+		"digits":          {value: "012", expectedOutput: true},
+		"empty":           {value: "", expectedOutput: false},
+		"exponent":        {value: "1e3", expectedOutput: false},
+		"decimal":         {value: "12.0", expectedOutput: false},
+		"non-ASCII digit": {value: "١٢٣", expectedOutput: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expectedOutput, core.OnlyDigits(test.value))
+		})
+	}
+}
+
 func TestCardExpiryValid(t *testing.T) {
 	tests := map[string]struct {
 		year           int
@@ -46,3 +74,199 @@ func TestCardExpiryValid(t *testing.T) {
 		})
 	}
 }
+
+func TestMaskCardNumber(t *testing.T) {
+	value := core.MaskCardNumber("400000", "0119")
+	assert.Equal(t, "400000******0119", value)
+}
+
+func TestMaskPAN(t *testing.T) {
+	tests := map[string]struct {
+		number         string
+		expectedOutput string
+	}{
+		"16 digits": {number: "4000000000000119", expectedOutput: "400000******0119"},
+		"19 digits": {number: "4242424242424242428", expectedOutput: "424242*********2428"},
+		"15 digits": {number: "378282246310005", expectedOutput: "37828******0005"},
+		"12 digits": {number: "400000000002", expectedOutput: "40******0002"},
+		"too short": {number: "123456789", expectedOutput: "*********"},
+		"empty":     {number: "", expectedOutput: ""},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := core.MaskPAN(test.number)
+			assert.Equal(t, test.expectedOutput, value)
+		})
+	}
+}
+
+func TestDetectCardBrand(t *testing.T) {
+	tests := map[string]struct {
+		number         string
+		expectedOutput core.CardBrand
+	}{
+		"visa":                {number: "400000", expectedOutput: core.BrandVisa},
+		"mastercard 5":        {number: "510510", expectedOutput: core.BrandMastercard},
+		"mastercard 2":        {number: "222100", expectedOutput: core.BrandMastercard},
+		"amex":                {number: "378282", expectedOutput: core.BrandAmex},
+		"discover":            {number: "601111", expectedOutput: core.BrandDiscover},
+		"discover co-branded": {number: "622126", expectedOutput: core.BrandDiscover},
+		"unionpay":            {number: "620000", expectedOutput: core.BrandUnionPay},
+		"jcb":                 {number: "353011", expectedOutput: core.BrandJCB},
+		"maestro":             {number: "675964", expectedOutput: core.BrandMaestro},
+		"diners 36":           {number: "361234", expectedOutput: core.BrandDiners},
+		"diners 300":          {number: "300012", expectedOutput: core.BrandDiners},
+		"full card number":    {number: "4242424242424242", expectedOutput: core.BrandVisa},
+		"unknown":             {number: "999999", expectedOutput: core.BrandUnknown},
+		"not enough digits":   {number: "", expectedOutput: core.BrandUnknown},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := core.DetectCardBrand(test.number)
+			assert.Equal(t, test.expectedOutput, value)
+		})
+	}
+}
+
+func TestValidCardNumberLength(t *testing.T) {
+	tests := map[string]struct {
+		brand          core.CardBrand
+		length         int
+		expectedOutput bool
+	}{
+		"visa 16":       {brand: core.BrandVisa, length: 16, expectedOutput: true},
+		"visa 13":       {brand: core.BrandVisa, length: 13, expectedOutput: true},
+		"visa 15":       {brand: core.BrandVisa, length: 15, expectedOutput: false},
+		"amex 15":       {brand: core.BrandAmex, length: 15, expectedOutput: true},
+		"amex 16":       {brand: core.BrandAmex, length: 16, expectedOutput: false},
+		"mastercard 16": {brand: core.BrandMastercard, length: 16, expectedOutput: true},
+		"maestro 12":    {brand: core.BrandMaestro, length: 12, expectedOutput: true},
+		"unknown 11":    {brand: core.BrandUnknown, length: 11, expectedOutput: false},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expectedOutput, core.ValidCardNumberLength(test.brand, test.length))
+		})
+	}
+
+	assert.Equal(t, 4, core.CVVLength(core.BrandAmex))
+	assert.Equal(t, 3, core.CVVLength(core.BrandVisa))
+}
+
+func TestMerchantBrands(t *testing.T) {
+	brands, err := core.ParseMerchantBrands("bill:Visa,bill:Amex,*:Visa")
+	require.NoError(t, err)
+
+	assert.True(t, brands.Accepts("bill", core.BrandAmex))
+	assert.False(t, brands.Accepts("bill", core.BrandMastercard))
+	assert.True(t, brands.Accepts("ted", core.BrandVisa))
+	assert.False(t, brands.Accepts("ted", core.BrandAmex))
+	assert.True(t, core.MerchantBrands{}.Accepts("bill", core.BrandUnknown))
+
+	_, err = core.ParseMerchantBrands("bill:Visa,bill:Bogus")
+	assert.Error(t, err)
+}
+
+func TestScrubString(t *testing.T) {
+	tests := map[string]struct {
+		input          string
+		expectedOutput string
+	}{
+		"pan":                 {input: "card 4000000000000119 declined", expectedOutput: "card 400000******0119 declined"},
+		"pan with spaces":     {input: "card 4000 0000 0000 0119", expectedOutput: "card 400000******0119"},
+		"19 digit pan":        {input: "card 4242424242424242428", expectedOutput: "card 424242*********2428"},
+		"12 digit pan":        {input: "card 400000000002", expectedOutput: "card 40******0002"},
+		"not passing luhn":    {input: "order 4000000000000009", expectedOutput: "order 4000000000000009"},
+		"short number":        {input: "amount 1050", expectedOutput: "amount 1050"},
+		"cvv in json":         {input: `{"cvv":123,"name":"x"}`, expectedOutput: `{"cvv":***,"name":"x"}`},
+		"cvc key value":       {input: "cvc=0123", expectedOutput: "cvc=***"},
+		"json with pan field": {input: `{"number": 4000000000000119}`, expectedOutput: `{"number": 400000******0119}`},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := core.ScrubString(test.input)
+			assert.Equal(t, test.expectedOutput, value)
+		})
+	}
+}
+
+func TestScrubFields(t *testing.T) {
+	fields := log.FieldsMap{
+		"cvv":    123,
+		"number": uint64(4000000000000119),
+		"path":   "/api/v1/authorise",
+		"status": 200,
+		"nested": map[string]interface{}{"CVV": "123", "msg": "card 4000000000000119"},
+	}
+
+	value := core.ScrubFields(fields)
+
+	assert.Equal(t, core.RedactedValue, value["cvv"])
+	assert.Equal(t, "400000******0119", value["number"])
+	assert.Equal(t, "/api/v1/authorise", value["path"])
+	assert.Equal(t, 200, value["status"])
+	assert.Equal(t, map[string]interface{}{"CVV": core.RedactedValue, "msg": "card 400000******0119"}, value["nested"])
+}
+
+func TestParseMerchantLimits(t *testing.T) {
+	limits, err := core.ParseMerchantLimits("bill:EUR:500.00,bill:JPY:1000,*:EUR:100")
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		merchantName  string
+		currency      string
+		expectedLimit money.Money
+		expectedOK    bool
+	}{
+		"merchant limit": {merchantName: "bill", currency: "EUR",
+			expectedLimit: money.Money{MinorUnits: 50000, Currency: "EUR"}, expectedOK: true},
+		"zero decimals currency": {merchantName: "bill", currency: "JPY",
+			expectedLimit: money.Money{MinorUnits: 1000, Currency: "JPY"}, expectedOK: true},
+		"no merchant limit": {merchantName: "bill", currency: "USD", expectedOK: false},
+		"default limit": {merchantName: "ted", currency: "EUR",
+			expectedLimit: money.Money{MinorUnits: 10000, Currency: "EUR"}, expectedOK: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			limit, ok := limits.Limit(test.merchantName, test.currency)
+			assert.Equal(t, test.expectedOK, ok)
+			assert.Equal(t, test.expectedLimit, limit)
+		})
+	}
+
+	for _, invalid := range []string{"bill:EUR", "bill:EURO:10", "bill:EUR:-1", ":EUR:10", "bill:EUR:1.001"} {
+		_, err := core.ParseMerchantLimits(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := core.ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+	require.NoError(t, err)
+	assert.Equal(t, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, suites)
+
+	tests := map[string]string{
+		"unknown":  "TLS_MADE_UP",
+		"insecure": "TLS_RSA_WITH_RC4_128_SHA",
+		"TLS 1.3":  "TLS_AES_128_GCM_SHA256",
+	}
+
+	for name, cipherSuites := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := core.ParseCipherSuites(cipherSuites)
+			assert.Error(t, err)
+		})
+	}
+
+	version, err := core.ParseTLSVersion("1.3")
+	require.NoError(t, err)
+	assert.Equal(t, uint16(tls.VersionTLS13), version)
+
+	_, err = core.ParseTLSVersion("1.1")
+	assert.Error(t, err)
+}
@@ -0,0 +1,193 @@
+package credentials
+
+import (
+	"container/list"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+)
+
+// CachingVerifier caches the results of another verifier, so merchants' requests do not all wait for it.
+//
+// Valid credentials are cached for ttl and invalid ones for negativeTTL (errors are never cached).
+// Entries are keyed by an HMAC of the credentials with a random key, so passwords are never kept in memory.
+// Once the cache holds maxEntries, the least recently used entry is evicted. It is safe for concurrent use.
+type CachingVerifier struct {
+	// Accessed atomically, so first in the struct to be 64-bit aligned on 32-bit platforms
+	hits   uint64
+	misses uint64
+
+	verifier    core.CredentialVerifier
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	salt        []byte
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds the entries, most recently used first
+	lru *list.List
+	// generation is incremented on every invalidation, so results obtained before it are not cached after it
+	generation uint64
+}
+
+type cacheEntry struct {
+	key       string
+	username  string
+	valid     bool
+	expiresAt time.Time
+}
+
+// CacheStats holds the counters of a cache.
+type CacheStats struct {
+	Entries  int     `json:"entries"`
+	Hits     uint64  `json:"hits"`
+	Misses   uint64  `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+}
+
+// NewCachingVerifier returns a verifier caching the results of verifier. A zero negativeTTL disables negative caching.
+func NewCachingVerifier(verifier core.CredentialVerifier, ttl time.Duration, negativeTTL time.Duration,
+	maxEntries int) (*CachingVerifier, error) {
+	salt := make([]byte, sha256.Size)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return &CachingVerifier{verifier: verifier, ttl: ttl, negativeTTL: negativeTTL, maxEntries: maxEntries,
+		salt: salt, entries: make(map[string]*list.Element), lru: list.New()}, nil
+}
+
+// VerifyCredentials returns the cached result for the credentials, if any, or asks the underlying verifier.
+func (v *CachingVerifier) VerifyCredentials(ctx context.Context, username string, password string) (bool, error) {
+	key := v.key(username, password)
+
+	valid, ok, generation := v.get(key)
+	if ok {
+		atomic.AddUint64(&v.hits, 1)
+		return valid, nil
+	}
+	atomic.AddUint64(&v.misses, 1)
+
+	valid, err := v.verifier.VerifyCredentials(ctx, username, password)
+	if err != nil {
+		return false, err
+	}
+
+	if valid {
+		v.put(key, username, valid, v.ttl, generation)
+	} else if v.negativeTTL > 0 {
+		v.put(key, username, valid, v.negativeTTL, generation)
+	}
+
+	return valid, nil
+}
+
+// Invalidate removes the cached results of the user, e.g. once their password changed.
+func (v *CachingVerifier) Invalidate(username string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.generation++
+	for e := v.lru.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*cacheEntry); entry.username == username {
+			v.remove(e)
+		}
+		e = next
+	}
+}
+
+// InvalidateAll empties the cache.
+func (v *CachingVerifier) InvalidateAll() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.generation++
+	v.entries = make(map[string]*list.Element)
+	v.lru.Init()
+}
+
+// Stats returns the number of entries cached, and how many lookups were answered from the cache (hits) or not.
+func (v *CachingVerifier) Stats() CacheStats {
+	v.mu.Lock()
+	entries := v.lru.Len()
+	v.mu.Unlock()
+
+	stats := CacheStats{Entries: entries, Hits: atomic.LoadUint64(&v.hits), Misses: atomic.LoadUint64(&v.misses)}
+	if lookups := stats.Hits + stats.Misses; lookups > 0 {
+		stats.HitRatio = float64(stats.Hits) / float64(lookups)
+	}
+
+	return stats
+}
+
+// key returns the cache key of the credentials.
+func (v *CachingVerifier) key(username string, password string) string {
+	mac := hmac.New(sha256.New, v.salt)
+	// The username is prefixed with its length, so distinct credentials never write the same bytes
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(username)))
+	mac.Write(length[:])
+	mac.Write([]byte(username))
+	mac.Write([]byte(password))
+	return string(mac.Sum(nil))
+}
+
+// get returns the cached result, if any and not expired, along with the current generation.
+func (v *CachingVerifier) get(key string) (valid bool, ok bool, generation uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	e, ok := v.entries[key]
+	if !ok {
+		return false, false, v.generation
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expiresAt) {
+		v.remove(e)
+		return false, false, v.generation
+	}
+
+	v.lru.MoveToFront(e)
+	return entry.valid, true, v.generation
+}
+
+// put caches the result for ttl, evicting the least recently used entry if the cache is full.
+// Results obtained before an invalidation (i.e. in an older generation) are not cached.
+func (v *CachingVerifier) put(key string, username string, valid bool, ttl time.Duration, generation uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if generation != v.generation {
+		return
+	}
+
+	entry := &cacheEntry{key: key, username: username, valid: valid, expiresAt: time.Now().Add(ttl)}
+
+	if e, ok := v.entries[key]; ok {
+		e.Value = entry
+		v.lru.MoveToFront(e)
+		return
+	}
+
+	if v.maxEntries > 0 && v.lru.Len() >= v.maxEntries {
+		v.remove(v.lru.Back())
+	}
+
+	v.entries[key] = v.lru.PushFront(entry)
+}
+
+// remove removes the entry. It must be called with mu held.
+func (v *CachingVerifier) remove(e *list.Element) {
+	v.lru.Remove(e)
+	delete(v.entries, e.Value.(*cacheEntry).key)
+}
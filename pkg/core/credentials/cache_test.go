@@ -0,0 +1,150 @@
+package credentials_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingVerifier counts the credentials checked, failing with err (if set).
+type countingVerifier struct {
+	mu    sync.Mutex
+	calls int
+	err   error
+	valid map[string]string
+}
+
+func (v *countingVerifier) VerifyCredentials(ctx context.Context, username string, password string) (bool, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.calls++
+	if v.err != nil {
+		return false, v.err
+	}
+	expected, ok := v.valid[username]
+	return ok && expected == password, nil
+}
+
+func (v *countingVerifier) Calls() int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.calls
+}
+
+func newCountingVerifier() *countingVerifier {
+	return &countingVerifier{valid: map[string]string{"bill": "secret", "mary": "secret"}}
+}
+
+func verify(t *testing.T, v *credentials.CachingVerifier, username string, password string) bool {
+	valid, err := v.VerifyCredentials(context.Background(), username, password)
+	require.NoError(t, err)
+	return valid
+}
+
+func TestCachingVerifier(t *testing.T) {
+	backend := newCountingVerifier()
+	cache, err := credentials.NewCachingVerifier(backend, time.Minute, time.Minute, 10)
+	require.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		assert.True(t, verify(t, cache, "bill", "secret"))
+		assert.False(t, verify(t, cache, "bill", "guess"))
+	}
+	assert.Equal(t, 2, backend.Calls())
+
+	// A colon cannot make distinct credentials share an entry
+	assert.False(t, verify(t, cache, "bill:secret", ""))
+	assert.Equal(t, 3, backend.Calls())
+
+	assert.Equal(t, credentials.CacheStats{Entries: 3, Hits: 4, Misses: 3, HitRatio: 4.0 / 7}, cache.Stats())
+}
+
+func TestCachingVerifierExpiry(t *testing.T) {
+	backend := newCountingVerifier()
+	cache, err := credentials.NewCachingVerifier(backend, 500*time.Millisecond, 10*time.Millisecond, 10)
+	require.NoError(t, err)
+
+	assert.True(t, verify(t, cache, "bill", "secret"))
+	assert.False(t, verify(t, cache, "bill", "guess"))
+	time.Sleep(20 * time.Millisecond)
+
+	// Only the negative entry expired
+	assert.True(t, verify(t, cache, "bill", "secret"))
+	assert.False(t, verify(t, cache, "bill", "guess"))
+	assert.Equal(t, 3, backend.Calls())
+
+	time.Sleep(500 * time.Millisecond)
+	assert.True(t, verify(t, cache, "bill", "secret"))
+	assert.Equal(t, 4, backend.Calls())
+}
+
+func TestCachingVerifierNoNegativeCaching(t *testing.T) {
+	backend := newCountingVerifier()
+	cache, err := credentials.NewCachingVerifier(backend, time.Minute, 0, 10)
+	require.NoError(t, err)
+
+	assert.False(t, verify(t, cache, "bill", "guess"))
+	assert.False(t, verify(t, cache, "bill", "guess"))
+	assert.Equal(t, 2, backend.Calls())
+}
+
+func TestCachingVerifierErrorsNotCached(t *testing.T) {
+	backend := newCountingVerifier()
+	backend.err = errors.New("connection refused")
+	cache, err := credentials.NewCachingVerifier(backend, time.Minute, time.Minute, 10)
+	require.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := cache.VerifyCredentials(context.Background(), "bill", "secret")
+		assert.Error(t, err)
+	}
+	assert.Equal(t, 2, backend.Calls())
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestCachingVerifierEviction(t *testing.T) {
+	backend := newCountingVerifier()
+	cache, err := credentials.NewCachingVerifier(backend, time.Minute, time.Minute, 2)
+	require.NoError(t, err)
+
+	verify(t, cache, "bill", "secret")
+	verify(t, cache, "mary", "secret")
+	// bill is now the most recently used, so mary is evicted
+	verify(t, cache, "bill", "secret")
+	verify(t, cache, "john", "secret")
+	assert.Equal(t, 3, backend.Calls())
+	assert.Equal(t, 2, cache.Stats().Entries)
+
+	verify(t, cache, "bill", "secret")
+	assert.Equal(t, 3, backend.Calls())
+	verify(t, cache, "mary", "secret")
+	assert.Equal(t, 4, backend.Calls())
+}
+
+func TestCachingVerifierInvalidate(t *testing.T) {
+	backend := newCountingVerifier()
+	cache, err := credentials.NewCachingVerifier(backend, time.Minute, time.Minute, 10)
+	require.NoError(t, err)
+
+	verify(t, cache, "bill", "secret")
+	verify(t, cache, "bill", "guess")
+	verify(t, cache, "mary", "secret")
+
+	cache.Invalidate("bill")
+	assert.Equal(t, 1, cache.Stats().Entries)
+	verify(t, cache, "bill", "secret")
+	verify(t, cache, "mary", "secret")
+	assert.Equal(t, 4, backend.Calls())
+
+	cache.InvalidateAll()
+	assert.Equal(t, 0, cache.Stats().Entries)
+	verify(t, cache, "mary", "secret")
+	assert.Equal(t, 5, backend.Calls())
+}
@@ -0,0 +1,172 @@
+package credentials_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/credentials"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func hash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	require.NoError(t, err)
+	return string(h)
+}
+
+func TestVerifiers(t *testing.T) {
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	content := "# merchants\nbill:" + hash(t, "secret") + "\n\nmary:" + hash(t, "p4ss:word") + "\n"
+	require.NoError(t, os.WriteFile(credentialsFile, []byte(content), 0600))
+
+	fileVerifier, err := credentials.NewFileVerifier(credentialsFile)
+	require.NoError(t, err)
+
+	verifiers := map[string]core.CredentialVerifier{
+		"file":   fileVerifier,
+		"static": credentials.NewStaticVerifier(map[string]string{"bill": "secret", "mary": "p4ss:word"}),
+	}
+
+	tests := map[string]struct {
+		username      string
+		password      string
+		expectedValid bool
+	}{
+		"valid":                   {username: "bill", password: "secret", expectedValid: true},
+		"valid with colon":        {username: "mary", password: "p4ss:word", expectedValid: true},
+		"wrong password":          {username: "bill", password: "guess", expectedValid: false},
+		"another user's password": {username: "mary", password: "secret", expectedValid: false},
+		"unknown user":            {username: "john", password: "secret", expectedValid: false},
+		"empty password":          {username: "bill", password: "", expectedValid: false},
+	}
+
+	for verifierName, verifier := range verifiers {
+		for name, test := range tests {
+			t.Run(verifierName+"/"+name, func(t *testing.T) {
+				valid, err := verifier.VerifyCredentials(context.Background(), test.username, test.password)
+				require.NoError(t, err)
+				assert.Equal(t, test.expectedValid, valid)
+			})
+		}
+
+		t.Run(verifierName+"/merchants", func(t *testing.T) {
+			merchants, ok := verifier.(core.MerchantDirectory)
+			require.True(t, ok)
+			for merchantName, expectedExists := range map[string]bool{"bill": true, "mary": true, "john": false} {
+				exists, err := merchants.MerchantExists(context.Background(), merchantName)
+				require.NoError(t, err)
+				assert.Equal(t, expectedExists, exists, merchantName)
+			}
+		})
+	}
+}
+
+func TestParseCredentialsErrors(t *testing.T) {
+	tests := map[string]string{
+		"missing hash":       "bill\n",
+		"missing username":   ":" + hash(t, "secret") + "\n",
+		"not a bcrypt hash":  "bill:secret\n",
+		"duplicate username": "bill:" + hash(t, "secret") + "\nbill:" + hash(t, "other") + "\n",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := credentials.ParseCredentials(strings.NewReader(content))
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := credentials.NewFileVerifier(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func newRemoteVerifier(t *testing.T, handler http.HandlerFunc) *credentials.RemoteVerifier {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	require.NoError(t, err)
+
+	return credentials.NewRemoteVerifier(serverURL.Hostname(), port, &http.Client{})
+}
+
+func TestRemoteVerifier(t *testing.T) {
+	tests := map[string]struct {
+		statusCode    int
+		body          string
+		expectedValid bool
+		expectedErr   bool
+	}{
+		"valid":              {statusCode: 200, body: `{"valid": true}`, expectedValid: true},
+		"invalid":            {statusCode: 200, body: `{"valid": false}`, expectedValid: false},
+		"unauthorised":       {statusCode: 401, expectedValid: false},
+		"service down":       {statusCode: 503, expectedErr: true},
+		"malformed response": {statusCode: 200, body: `{"valid":`, expectedErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			verifier := newRemoteVerifier(t, func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, "/api/v1/auth", r.URL.Path)
+				w.WriteHeader(test.statusCode)
+				_, _ = w.Write([]byte(test.body))
+			})
+
+			valid, err := verifier.VerifyCredentials(context.Background(), "bill", "secret")
+			if test.expectedErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedValid, valid)
+		})
+	}
+}
+
+func TestRemoteVerifierTimeout(t *testing.T) {
+	verifier := newRemoteVerifier(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	verifier.Timeout = 10 * time.Millisecond
+
+	_, err := verifier.VerifyCredentials(context.Background(), "bill", "secret")
+	assert.True(t, errors.Is(err, context.DeadlineExceeded), "unexpected error: %v", err)
+}
+
+func TestRemoteVerifierBreaker(t *testing.T) {
+	var calls int32
+	verifier := newRemoteVerifier(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(503)
+	})
+	verifier.Breaker = breaker.New("authservice", breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Minute})
+
+	for i := 0; i < 2; i++ {
+		_, err := verifier.VerifyCredentials(context.Background(), "bill", "secret")
+		require.Error(t, err)
+		assert.False(t, errors.Is(err, breaker.ErrOpen))
+	}
+
+	_, err := verifier.VerifyCredentials(context.Background(), "bill", "secret")
+	assert.True(t, errors.Is(err, breaker.ErrOpen), "unexpected error: %v", err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
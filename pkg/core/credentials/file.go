@@ -0,0 +1,98 @@
+package credentials
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// FileVerifier checks credentials against bcrypt hashed passwords, loaded from a file with one "username:hash" per
+// line (as written by htpasswd -B). Empty lines and lines starting with # are ignored.
+type FileVerifier struct {
+	hashes map[string][]byte
+	// unknownUserHash is compared against the passwords of unknown users, so they take as long to check as
+	// known ones and usernames cannot be guessed from response times.
+	unknownUserHash []byte
+}
+
+// NewFileVerifier loads the credentials file.
+func NewFileVerifier(path string) (*FileVerifier, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ParseCredentials(f)
+}
+
+// ParseCredentials reads credentials in the format of the credentials file.
+func ParseCredentials(r io.Reader) (*FileVerifier, error) {
+	v := &FileVerifier{hashes: make(map[string][]byte)}
+	cost := bcrypt.DefaultCost
+
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		credentials := strings.SplitN(line, ":", 2)
+		if len(credentials) != 2 || credentials[0] == "" {
+			return nil, fmt.Errorf("line %d: credentials must be in the format username:hash", lineNumber)
+		}
+
+		hash := []byte(credentials[1])
+		hashCost, err := bcrypt.Cost(hash)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid bcrypt hash: %w", lineNumber, err)
+		}
+		if _, ok := v.hashes[credentials[0]]; ok {
+			return nil, fmt.Errorf("line %d: duplicate username %q", lineNumber, credentials[0])
+		}
+
+		v.hashes[credentials[0]] = hash
+		cost = hashCost
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	v.unknownUserHash, err = bcrypt.GenerateFromPassword([]byte("unknown user"), cost)
+	if err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+// VerifyCredentials checks the password against the user's hash.
+func (v *FileVerifier) VerifyCredentials(ctx context.Context, username string, password string) (bool, error) {
+	hash, ok := v.hashes[username]
+	if !ok {
+		hash = v.unknownUserHash
+	}
+
+	err := bcrypt.CompareHashAndPassword(hash, []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return ok, nil
+}
+
+// MerchantExists returns whether the merchant is in the credentials file.
+func (v *FileVerifier) MerchantExists(ctx context.Context, merchantName string) (bool, error) {
+	_, ok := v.hashes[merchantName]
+	return ok, nil
+}
@@ -0,0 +1,105 @@
+// Package credentials provides the backends checking merchants' credentials: the auth service, a file of bcrypt
+// hashed passwords and a fixed set of accounts.
+package credentials
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+)
+
+// RemoteVerifier asks the auth service whether credentials are valid.
+type RemoteVerifier struct {
+	httpClient *http.Client
+	url        string
+
+	// Timeout (if not zero) is how long the auth service has to answer.
+	Timeout time.Duration
+	// Breaker (if set) stops requests from being sent while the auth service is down.
+	// Requests are then failed with an error wrapping breaker.ErrOpen.
+	Breaker *breaker.Breaker
+}
+
+// NewRemoteVerifier returns a verifier asking the auth service listening on host:port.
+func NewRemoteVerifier(host string, port int, httpClient *http.Client) *RemoteVerifier {
+	return &RemoteVerifier{httpClient: httpClient, url: fmt.Sprintf("http://%s:%d/api/v1/auth", host, port)}
+}
+
+// VerifyCredentials asks the auth service whether the credentials are valid.
+// The request is cancelled when ctx is done.
+func (v *RemoteVerifier) VerifyCredentials(ctx context.Context, username string, password string) (bool, error) {
+	if err := v.Breaker.Allow(); err != nil {
+		return false, fmt.Errorf("auth service: %w", err)
+	}
+
+	if v.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, v.Timeout)
+		defer cancel()
+	}
+
+	valid, err := v.checkCredentials(ctx, username, password)
+	if errors.Is(err, context.Canceled) {
+		v.Breaker.Cancel()
+	} else if err != nil {
+		v.Breaker.Failure()
+	} else {
+		v.Breaker.Success()
+	}
+
+	return valid, err
+}
+
+// checkCredentials makes the request to the auth service.
+func (v *RemoteVerifier) checkCredentials(ctx context.Context, username string, password string) (bool, error) {
+	requestBodyData := struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}{Username: username, Password: password}
+
+	requestBody, err := json.Marshal(requestBodyData)
+	if err != nil {
+		return false, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", v.url, bytes.NewBuffer(requestBody))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return false, fmt.Errorf("auth service answered with status code %d", resp.StatusCode)
+	} else if resp.StatusCode != 200 {
+		return false, nil
+	}
+
+	responseBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return false, err
+	}
+
+	responseBodyData := struct {
+		Valid bool `json:"valid"`
+	}{}
+
+	err = json.Unmarshal(responseBody, &responseBodyData)
+	if err != nil {
+		return false, err
+	}
+
+	return responseBodyData.Valid, nil
+}
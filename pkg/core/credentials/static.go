@@ -0,0 +1,32 @@
+package credentials
+
+import (
+	"context"
+	"crypto/subtle"
+)
+
+// StaticVerifier checks credentials against a fixed set of accounts, e.g. for tests and local development.
+type StaticVerifier struct {
+	accounts map[string]string
+}
+
+// NewStaticVerifier returns a verifier accepting the accounts, which map usernames to passwords.
+func NewStaticVerifier(accounts map[string]string) *StaticVerifier {
+	return &StaticVerifier{accounts: accounts}
+}
+
+// VerifyCredentials checks the password against the user's.
+func (v *StaticVerifier) VerifyCredentials(ctx context.Context, username string, password string) (bool, error) {
+	expected, ok := v.accounts[username]
+	if !ok {
+		return false, nil
+	}
+
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1, nil
+}
+
+// MerchantExists returns whether the merchant has an account.
+func (v *StaticVerifier) MerchantExists(ctx context.Context, merchantName string) (bool, error) {
+	_, ok := v.accounts[merchantName]
+	return ok, nil
+}
@@ -1,27 +1,145 @@
 package entities
 
-// State should be an ENUM
+import (
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+)
+
+// PaymentState is the state of an authorisation.
+// The legal transitions between states are owned by core.PaymentStateMachine.
+type PaymentState string
+
+const (
+	StateAuthorised        PaymentState = "Authorised"
+	StatePartiallyCaptured PaymentState = "PartiallyCaptured"
+	StateCaptured          PaymentState = "Captured"
+	StatePartiallyRefunded PaymentState = "PartiallyRefunded"
+	StateRefunded          PaymentState = "Refunded"
+	StateVoided            PaymentState = "Voided"
+	// StateExpired means the authorisation was not captured within its validity window, so the funds were released.
+	StateExpired PaymentState = "Expired"
+	// StateFailed means the payment processor no longer holds the authorisation.
+	StateFailed PaymentState = "Failed"
+)
+
+// TransactionType is the kind of operation performed on an authorisation.
+type TransactionType string
+
+const (
+	TransactionCapture TransactionType = "Capture"
+	TransactionRefund  TransactionType = "Refund"
+	TransactionVoid    TransactionType = "Void"
+)
+
+// TransactionStatus is the status of a transaction.
+type TransactionStatus string
+
+const (
+	TransactionPending   TransactionStatus = "Pending"
+	TransactionCompleted TransactionStatus = "Completed"
+	TransactionFailed    TransactionStatus = "Failed"
+)
+
 type Authorisation struct {
 	ID           string        `json:"id"`
-	State        string        `json:"state"`
-	Currency     string        `json:"currency"`
-	Amount       float64       `json:"amount"`
+	State        PaymentState  `json:"state"`
+	Amount       money.Money   `json:"amount"`
 	MerchantName string        `json:"merchant_name"`
 	CreditCard   *CreditCard   `json:"credit_card,omitempty"`
 	Transaction  []Transaction `json:"transactions,omitempty"`
+
+	// Reference is the reference of the journal entry written before asking the payment processor
+	// for the authorisation. The entry is completed when the authorisation is stored.
+	Reference string    `json:"-"`
+	CreatedAt time.Time `json:"-"`
 }
 
+// CreditCard is a tokenised credit card.
+// The card number is only ever kept encrypted and the CVV is not kept at all.
 type CreditCard struct {
-	Number      uint64 `json:"number"`
+	Token       string `json:"token"`
+	BIN         string `json:"bin"`
+	LastFour    string `json:"last4"`
+	Brand       string `json:"brand"`
 	Name        string `json:"name"`
 	ExpiryMonth uint   `json:"expiry_month"`
 	ExpiryYear  uint   `json:"expiry_year"`
-	CVV         uint   `json:"cvv"`
+
+	// Fields managed by the vault, never to be exposed
+	Fingerprint     string `json:"-"`
+	EncryptedNumber []byte `json:"-"`
+	EncryptedKey    []byte `json:"-"`
 }
 
-// Type should be an ENUM
+// Transactions are first recorded as "Pending", before the payment processor is asked to perform them,
+// and then marked "Completed" or "Failed" according to the processor's answer.
 type Transaction struct {
-	ID     string  `json:"id"`
-	Type   string  `json:"type"`
-	Amount float64 `json:"amount"`
+	ID     string            `json:"id"`
+	Type   TransactionType   `json:"type"`
+	Status TransactionStatus `json:"status"`
+	Amount money.Money       `json:"amount"`
+
+	AuthorisationID string    `json:"-"`
+	Attempts        int       `json:"-"` // Failed attempts at resolving the transaction while its outcome is unknown
+	CreatedAt       time.Time `json:"-"`
+}
+
+// JournalStatus is the status of an authorisation journal entry.
+type JournalStatus string
+
+const (
+	JournalPending   JournalStatus = "Pending"
+	JournalCompleted JournalStatus = "Completed"
+	JournalFailed    JournalStatus = "Failed"
+	// JournalCompensating means the payment processor granted the authorisation but the gateway could not store it,
+	// so it must be voided at the payment processor.
+	JournalCompensating JournalStatus = "Compensating"
+	// JournalVoided means the authorisation the gateway could not store was voided at the payment processor.
+	JournalVoided JournalStatus = "Voided"
+)
+
+// AuthorisationJournalEntry records an authorisation request before it is sent to the payment processor.
+// Entries still "Pending" after a while are authorisations whose outcome is unknown to the gateway (e.g. the payment
+// processor timed out, or the authorisation could not be stored), and are resolved by the reconciler.
+// Entries "Compensating" are voided by the reconciler until the payment processor accepts the void.
+// Entries the reconciler gives up on are marked "Failed", keeping their authorisation ID (if any) for manual follow-up.
+type AuthorisationJournalEntry struct {
+	Reference       string
+	MerchantName    string
+	Amount          money.Money
+	CreditCardToken string
+	Status          JournalStatus
+	AuthorisationID string
+	Attempts        int
+	CreatedAt       time.Time
+}
+
+// IdempotencyKey holds the outcome of a request made with an Idempotency-Key header.
+// A record that is not Completed yet belongs to a request still being processed.
+type IdempotencyKey struct {
+	Key          string
+	MerchantName string
+	RequestHash  string
+	Completed    bool
+	StatusCode   int
+	ResponseBody []byte
+}
+
+// APIKey lets a merchant authenticate by signing requests with its secret.
+// The secret is only ever kept encrypted by the vault, merchants being shown it once when the key is created.
+type APIKey struct {
+	ID           string     `json:"id"`
+	MerchantName string     `json:"merchant_name"`
+	CreatedAt    time.Time  `json:"created_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+
+	// Fields managed by the vault, never to be exposed
+	EncryptedSecret []byte `json:"-"`
+	EncryptedKey    []byte `json:"-"`
+}
+
+// Revoked returns true if the key can no longer be used.
+func (k APIKey) Revoked() bool {
+	return k.RevokedAt != nil
 }
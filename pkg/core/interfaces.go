@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"time"
 
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
@@ -9,24 +10,75 @@ import (
 
 // Repository represents a database holding the data
 type Repository interface {
-	HealthCheck() error
-	CurrencyExists(currency string) (bool, error)
-	AddAuthorisation(auth entities.Authorisation) error
-	AddTransaction(authID string, transaction entities.Transaction) error
-	UpdateAuthorisationState(authID string, state string) error
-	GetAllAuthorisations() ([]entities.Authorisation, error)
-	GetAuthorisationDetails(authID string) (entities.Authorisation, error)
+	HealthCheck(ctx context.Context) error
+	CurrencyExists(ctx context.Context, currency string) (bool, error)
+	SaveCreditCard(ctx context.Context, merchantName string, card entities.CreditCard) (entities.CreditCard, error)
+	GetCreditCard(ctx context.Context, merchantName string, token string) (entities.CreditCard, error)
+	AddAuthorisation(ctx context.Context, auth entities.Authorisation) error
+	ReserveTransaction(ctx context.Context, authID string, transaction entities.Transaction) (transID string, err error)
+	CompleteTransaction(ctx context.Context, authID string, transID string, success bool) error
+	UpdateAuthorisationState(ctx context.Context, authID string, state entities.PaymentState) error
+	GetAllAuthorisations(ctx context.Context) ([]entities.Authorisation, error)
+	GetAuthorisationDetails(ctx context.Context, authID string) (entities.Authorisation, error)
+	// StartIdempotentRequest takes over requests still in progress since before staleBefore, whose process died.
+	StartIdempotentRequest(ctx context.Context, merchantName string, key string, requestHash string,
+		staleBefore time.Time) (keyItem entities.IdempotencyKey, created bool, err error)
+	CompleteIdempotentRequest(ctx context.Context, merchantName string, key string, statusCode int,
+		responseBody []byte) error
+	ReleaseIdempotentRequest(ctx context.Context, merchantName string, key string) error
+
+	// Reconciliation of operations whose outcome at the payment processor is unknown
+	GetPendingTransactions(ctx context.Context, createdBefore time.Time) ([]entities.Transaction, error)
+	GetAuthorisationsByState(ctx context.Context, state entities.PaymentState, createdBefore time.Time) (
+		[]entities.Authorisation, error)
+	RecordTransactionAttempt(ctx context.Context, authID string, transID string) error
+	JournalAuthorisation(ctx context.Context, entry entities.AuthorisationJournalEntry) error
+	FailAuthorisationJournalEntry(ctx context.Context, reference string) error
+	StartCompensation(ctx context.Context, reference string, authID string) error
+	CompleteCompensation(ctx context.Context, reference string) error
+	GetAuthorisationJournal(ctx context.Context, status entities.JournalStatus, createdBefore time.Time) (
+		[]entities.AuthorisationJournalEntry, error)
+	RecordAuthorisationJournalAttempt(ctx context.Context, reference string) error
+
+	// Merchants' API keys, and the nonces of their signed requests
+	AddAPIKey(ctx context.Context, key entities.APIKey) error
+	GetAPIKey(ctx context.Context, keyID string) (entities.APIKey, error)
+	GetAPIKeys(ctx context.Context, merchantName string) ([]entities.APIKey, error)
+	RevokeAPIKey(ctx context.Context, keyID string) error
+	// RecordAPIKeyNonce records the nonce of a signed request, returning false if it was already recorded.
+	// Nonces recorded before expiredBefore are forgotten.
+	RecordAPIKeyNonce(ctx context.Context, keyID string, nonce string, expiredBefore time.Time) (fresh bool, err error)
 }
 
-// PaymentProcessor represents a payment processor service
+// PaymentProcessor represents a payment processor service.
+// Errors returned are either a *pprocessor.DeclineError or a *pprocessor.Error.
 type PaymentProcessor interface {
-	AuthorisePayment(pprocessor.AuthorisationRequest) (authID string, success bool)
-	CaptureTransaction(pprocessor.CaptureRequest) (success bool)
-	RefundTransaction(pprocessor.RefundRequest) (success bool)
-	VoidPayment(pprocessor.VoidRequest) (success bool)
+	AuthorisePayment(context.Context, pprocessor.AuthorisationRequest) (authID string, err error)
+	CaptureTransaction(context.Context, pprocessor.CaptureRequest) error
+	RefundTransaction(context.Context, pprocessor.RefundRequest) error
+	VoidPayment(context.Context, pprocessor.VoidRequest) error
+	// QueryOperation returns what happened to an authorisation (by reference) or a transaction (by request ID).
+	QueryOperation(context.Context, pprocessor.QueryRequest) (pprocessor.QueryResponse, error)
+}
+
+// CredentialVerifier represents where merchants' credentials are checked.
+type CredentialVerifier interface {
+	// VerifyCredentials returns whether the credentials are valid, or an error if they could not be checked.
+	VerifyCredentials(ctx context.Context, username string, password string) (bool, error)
+}
+
+// MerchantDirectory represents where the merchants served by the gateway are listed.
+type MerchantDirectory interface {
+	// MerchantExists returns whether the merchant is known, or an error if it could not be checked.
+	MerchantExists(ctx context.Context, merchantName string) (bool, error)
 }
 
 // ShutDowner represents anything that can be shutdown like an HTTP server.
 type ShutDowner interface {
 	ShutDown(ctx context.Context) error
 }
+
+// Reloader represents anything that can reload its configuration while running, like TLS certificates.
+type Reloader interface {
+	Reload() error
+}
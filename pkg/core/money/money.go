@@ -0,0 +1,232 @@
+// Package money provides an exact representation of amounts of money.
+//
+// Amounts are kept as an integer number of minor units of an ISO 4217 currency (e.g. cents for EUR),
+// so adding and subtracting amounts never drifts like it would with floating point numbers.
+package money
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidCurrency is returned when the currency is not an ISO 4217 alphabetic code.
+	ErrInvalidCurrency = errors.New("currency must be a 3 letter ISO 4217 code")
+	// ErrInvalidAmount is returned when the amount is not a plain decimal number.
+	ErrInvalidAmount = errors.New("amount must be a plain decimal number")
+	// ErrTooManyDecimals is returned when the amount has more decimal places than the currency allows.
+	ErrTooManyDecimals = errors.New("amount has too many decimal places")
+	// ErrOverflow is returned when the amount does not fit in the range supported.
+	ErrOverflow = errors.New("amount out of range")
+	// ErrCurrencyMismatch is returned when operating on amounts in different currencies.
+	ErrCurrencyMismatch = errors.New("currencies do not match")
+)
+
+// exponents holds the ISO 4217 currencies whose minor unit is not the usual 1/100.
+var exponents = map[string]int{
+	// No minor unit
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0, "PYG": 0,
+	"RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	// 1/1000
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	// 1/10000
+	"CLF": 4, "UYW": 4,
+}
+
+// defaultExponent is the exponent of every currency not listed in exponents.
+const defaultExponent = 2
+
+// Exponent returns the number of decimal places used by the currency's minor unit.
+func Exponent(currency string) (int, error) {
+	if !validCurrencyCode(currency) {
+		return 0, ErrInvalidCurrency
+	}
+
+	if exp, ok := exponents[currency]; ok {
+		return exp, nil
+	}
+
+	return defaultExponent, nil
+}
+
+// Money represents an amount of money in minor units of its currency.
+type Money struct {
+	MinorUnits int64  `json:"minor_units"`
+	Currency   string `json:"currency"`
+}
+
+// New returns an amount of money given in minor units.
+func New(minorUnits int64, currency string) (Money, error) {
+	if !validCurrencyCode(currency) {
+		return Money{}, ErrInvalidCurrency
+	}
+
+	return Money{MinorUnits: minorUnits, Currency: currency}, nil
+}
+
+// Zero returns a zero amount of money in the given currency.
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+// Parse parses a decimal amount (in major units, e.g. "10.50") in the given currency.
+//
+// Amounts with more decimal places than the currency's minor unit allows are rejected.
+func Parse(amount string, currency string) (Money, error) {
+	exp, err := Exponent(currency)
+	if err != nil {
+		return Money{}, err
+	}
+
+	digits := amount
+	negative := false
+	if strings.HasPrefix(digits, "-") {
+		negative = true
+		digits = digits[1:]
+	}
+
+	intPart := digits
+	fracPart := ""
+	if i := strings.IndexByte(digits, '.'); i >= 0 {
+		intPart = digits[:i]
+		fracPart = digits[i+1:]
+		if fracPart == "" {
+			return Money{}, ErrInvalidAmount
+		}
+	}
+
+	if intPart == "" || !allDigits(intPart) || !allDigits(fracPart) {
+		return Money{}, ErrInvalidAmount
+	}
+
+	// Trailing zeros do not add precision (e.g. "10.500" EUR is fine)
+	fracPart = strings.TrimRight(fracPart, "0")
+	if len(fracPart) > exp {
+		return Money{}, fmt.Errorf("%w: %s allows at most %d", ErrTooManyDecimals, currency, exp)
+	}
+
+	fracPart += strings.Repeat("0", exp-len(fracPart))
+
+	minorUnits, err := strconv.ParseInt(intPart+fracPart, 10, 64)
+	if err != nil {
+		return Money{}, ErrOverflow
+	}
+
+	if negative {
+		minorUnits = -minorUnits
+	}
+
+	return Money{MinorUnits: minorUnits, Currency: currency}, nil
+}
+
+// Decimal returns the amount in major units as a decimal string, e.g. "10.50".
+func (m Money) Decimal() string {
+	exp, err := Exponent(m.Currency)
+	if err != nil {
+		exp = defaultExponent
+	}
+
+	sign := ""
+	units := m.MinorUnits
+	if units < 0 {
+		sign = "-"
+	}
+
+	digits := strconv.FormatUint(absUint64(units), 10)
+	if exp == 0 {
+		return sign + digits
+	}
+
+	if len(digits) <= exp {
+		digits = strings.Repeat("0", exp-len(digits)+1) + digits
+	}
+
+	return sign + digits[:len(digits)-exp] + "." + digits[len(digits)-exp:]
+}
+
+// String returns the amount followed by its currency, e.g. "10.50 EUR".
+func (m Money) String() string {
+	return m.Decimal() + " " + m.Currency
+}
+
+// IsPositive returns true if the amount is greater than zero.
+func (m Money) IsPositive() bool {
+	return m.MinorUnits > 0
+}
+
+// IsZero returns true if the amount is zero.
+func (m Money) IsZero() bool {
+	return m.MinorUnits == 0
+}
+
+// Add returns the sum of both amounts.
+func (m Money) Add(other Money) (Money, error) {
+	if m.Currency != other.Currency {
+		return Money{}, ErrCurrencyMismatch
+	}
+
+	if (other.MinorUnits > 0 && m.MinorUnits > math.MaxInt64-other.MinorUnits) ||
+		(other.MinorUnits < 0 && m.MinorUnits < math.MinInt64-other.MinorUnits) {
+		return Money{}, ErrOverflow
+	}
+
+	return Money{MinorUnits: m.MinorUnits + other.MinorUnits, Currency: m.Currency}, nil
+}
+
+// Sub returns the difference between both amounts.
+func (m Money) Sub(other Money) (Money, error) {
+	if other.MinorUnits == math.MinInt64 {
+		return Money{}, ErrOverflow
+	}
+
+	return m.Add(Money{MinorUnits: -other.MinorUnits, Currency: other.Currency})
+}
+
+// Cmp compares both amounts and returns -1, 0 or +1 if m is less than, equal to or greater than other.
+func (m Money) Cmp(other Money) (int, error) {
+	if m.Currency != other.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+
+	if m.MinorUnits < other.MinorUnits {
+		return -1, nil
+	} else if m.MinorUnits > other.MinorUnits {
+		return 1, nil
+	}
+
+	return 0, nil
+}
+
+func validCurrencyCode(currency string) bool {
+	if len(currency) != 3 {
+		return false
+	}
+
+	for _, r := range currency {
+		if r < 'A' || r > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func allDigits(s string) bool {
+	for _, r := range s {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func absUint64(n int64) uint64 {
+	if n < 0 {
+		return uint64(-(n + 1)) + 1
+	}
+	return uint64(n)
+}
@@ -0,0 +1,96 @@
+package money_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	tests := map[string]struct {
+		amount        string
+		currency      string
+		expectedUnits int64
+		expectedErr   error
+	}{
+		"two decimals":             {amount: "10.50", currency: "EUR", expectedUnits: 1050},
+		"one decimal":              {amount: "10.5", currency: "EUR", expectedUnits: 1050},
+		"no decimals":              {amount: "10", currency: "EUR", expectedUnits: 1000},
+		"trailing zeros":           {amount: "10.500", currency: "EUR", expectedUnits: 1050},
+		"negative":                 {amount: "-0.01", currency: "EUR", expectedUnits: -1},
+		"zero exponent":            {amount: "1050", currency: "JPY", expectedUnits: 1050},
+		"three decimals":           {amount: "1.005", currency: "KWD", expectedUnits: 1005},
+		"too many decimals":        {amount: "10.505", currency: "EUR", expectedErr: money.ErrTooManyDecimals},
+		"decimals on zero exp":     {amount: "10.5", currency: "JPY", expectedErr: money.ErrTooManyDecimals},
+		"exponent notation":        {amount: "1e2", currency: "EUR", expectedErr: money.ErrInvalidAmount},
+		"missing fraction":         {amount: "10.", currency: "EUR", expectedErr: money.ErrInvalidAmount},
+		"missing integer part":     {amount: ".5", currency: "EUR", expectedErr: money.ErrInvalidAmount},
+		"empty amount":             {amount: "", currency: "EUR", expectedErr: money.ErrInvalidAmount},
+		"overflow":                 {amount: "999999999999999999999", currency: "EUR", expectedErr: money.ErrOverflow},
+		"lowercase currency":       {amount: "10", currency: "eur", expectedErr: money.ErrInvalidCurrency},
+		"currency wrong length":    {amount: "10", currency: "EURO", expectedErr: money.ErrInvalidCurrency},
+		"non numeric amount chars": {amount: "1O.5", currency: "EUR", expectedErr: money.ErrInvalidAmount},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value, err := money.Parse(test.amount, test.currency)
+			if test.expectedErr != nil {
+				assert.True(t, errors.Is(err, test.expectedErr))
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedUnits, value.MinorUnits)
+			assert.Equal(t, test.currency, value.Currency)
+		})
+	}
+}
+
+func TestDecimal(t *testing.T) {
+	tests := map[string]struct {
+		money          money.Money
+		expectedOutput string
+	}{
+		"two decimals":     {money: money.Money{MinorUnits: 1050, Currency: "EUR"}, expectedOutput: "10.50"},
+		"under one unit":   {money: money.Money{MinorUnits: 5, Currency: "EUR"}, expectedOutput: "0.05"},
+		"zero":             {money: money.Money{MinorUnits: 0, Currency: "EUR"}, expectedOutput: "0.00"},
+		"negative":         {money: money.Money{MinorUnits: -1050, Currency: "EUR"}, expectedOutput: "-10.50"},
+		"zero exponent":    {money: money.Money{MinorUnits: 1050, Currency: "JPY"}, expectedOutput: "1050"},
+		"three decimals":   {money: money.Money{MinorUnits: 1005, Currency: "KWD"}, expectedOutput: "1.005"},
+		"minimum int64":    {money: money.Money{MinorUnits: math.MinInt64, Currency: "JPY"}, expectedOutput: "-9223372036854775808"},
+		"large two digits": {money: money.Money{MinorUnits: 123456789, Currency: "USD"}, expectedOutput: "1234567.89"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expectedOutput, test.money.Decimal())
+		})
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	a, err := money.Parse("10.10", "EUR")
+	require.NoError(t, err)
+	b, err := money.Parse("0.20", "EUR")
+	require.NoError(t, err)
+
+	sum, err := a.Add(b)
+	require.NoError(t, err)
+	assert.Equal(t, "10.30", sum.Decimal())
+
+	diff, err := sum.Sub(a)
+	require.NoError(t, err)
+	cmp, err := diff.Cmp(b)
+	require.NoError(t, err)
+	assert.Equal(t, 0, cmp)
+
+	_, err = a.Add(money.Zero("USD"))
+	assert.True(t, errors.Is(err, money.ErrCurrencyMismatch))
+
+	_, err = money.Money{MinorUnits: math.MaxInt64, Currency: "EUR"}.Add(b)
+	assert.True(t, errors.Is(err, money.ErrOverflow))
+}
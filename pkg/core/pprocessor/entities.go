@@ -1,46 +1,117 @@
 package pprocessor
 
+import (
+	"encoding/json"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+)
+
+// CreditCard is the card sent to the payment processor.
+// The card number and CVV are strings of digits, so leading zeros are kept.
 type CreditCard struct {
 	Name        string `json:"name"`
-	Number      uint64 `json:"number"`
+	Number      string `json:"number"`
 	ExpiryMonth uint   `json:"expiry_month"`
 	ExpiryYear  uint   `json:"expiry_year"`
-	CVV         uint   `json:"cvv"`
+	CVV         string `json:"cvv,omitempty"` // Not available when paying with a card token
 }
 
 type AuthorisationRequest struct {
-	CreditCard CreditCard `json:"credit_card"`
-	Currency   string     `json:"currency"`
-	Amount     float64    `json:"amount"`
+	CreditCard CreditCard
+	Amount     money.Money
+	// Reference identifies the authorisation request, so its outcome can be queried if it is unknown.
+	Reference string
+}
+
+// MarshalJSON encodes the request using the payment processor protocol, where amounts are decimal numbers.
+func (r AuthorisationRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		CreditCard CreditCard  `json:"credit_card"`
+		Currency   string      `json:"currency"`
+		Amount     json.Number `json:"amount"`
+		Reference  string      `json:"reference,omitempty"`
+	}{CreditCard: r.CreditCard, Currency: r.Amount.Currency, Amount: json.Number(r.Amount.Decimal()),
+		Reference: r.Reference})
 }
 
 type AuthorisationResponse struct {
 	Code            uint   `json:"code"`
+	Reason          string `json:"reason,omitempty"`
 	AuthorisationID string `json:"authorisation_id,omitempty"`
 }
 
 type CaptureRequest struct {
-	AuthorisationID string  `json:"authorisation_id"`
-	Amount          float64 `json:"amount"`
+	AuthorisationID string
+	Amount          money.Money
+	// RequestID identifies the capture, so it is safe to retry: the payment processor only processes it once.
+	RequestID string
+}
+
+// MarshalJSON encodes the request using the payment processor protocol, where amounts are decimal numbers.
+func (r CaptureRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(amountRequest{AuthorisationID: r.AuthorisationID, Amount: json.Number(r.Amount.Decimal())})
 }
 
 type CaptureResponse struct {
-	Code uint `json:"code"`
+	Code   uint   `json:"code"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type RefundRequest struct {
-	AuthorisationID string  `json:"authorisation_id"`
-	Amount          float64 `json:"amount"`
+	AuthorisationID string
+	Amount          money.Money
+	// RequestID identifies the refund, so it is safe to retry: the payment processor only processes it once.
+	RequestID string
+}
+
+// MarshalJSON encodes the request using the payment processor protocol, where amounts are decimal numbers.
+func (r RefundRequest) MarshalJSON() ([]byte, error) {
+	return json.Marshal(amountRequest{AuthorisationID: r.AuthorisationID, Amount: json.Number(r.Amount.Decimal())})
 }
 
 type RefundResponse struct {
-	Code uint `json:"code"`
+	Code   uint   `json:"code"`
+	Reason string `json:"reason,omitempty"`
 }
 
 type VoidRequest struct {
 	AuthorisationID string `json:"authorisation_id"`
+	// RequestID identifies the void, so it is safe to retry: the payment processor only processes it once.
+	RequestID string `json:"-"`
 }
 
 type VoidResponse struct {
-	Code uint `json:"code"`
+	Code   uint   `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// QueryStatus is the outcome of an operation, as known by the payment processor.
+type QueryStatus string
+
+const (
+	// QuerySucceeded means the operation was processed successfully.
+	QuerySucceeded QueryStatus = "succeeded"
+	// QueryDeclined means the operation was processed and refused.
+	QueryDeclined QueryStatus = "declined"
+	// QueryNotFound means the payment processor never received the operation.
+	QueryNotFound QueryStatus = "not_found"
+)
+
+type QueryRequest struct {
+	// Reference is the reference of an authorisation request or the request ID of a capture, refund or void.
+	Reference string `json:"reference"`
+}
+
+type QueryResponse struct {
+	Code   uint        `json:"code"`
+	Reason string      `json:"reason,omitempty"`
+	Status QueryStatus `json:"status"`
+	// AuthorisationID is set when a queried authorisation succeeded.
+	AuthorisationID string `json:"authorisation_id,omitempty"`
+}
+
+// amountRequest is the wire format shared by capture and refund requests.
+type amountRequest struct {
+	AuthorisationID string      `json:"authorisation_id"`
+	Amount          json.Number `json:"amount"`
 }
@@ -0,0 +1,98 @@
+package pprocessor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Kinds of errors returned by the payment processor client.
+// Use errors.Is to check the kind of an error, e.g. errors.Is(err, pprocessor.ErrDeclined).
+var (
+	// ErrDeclined means the payment processor processed the request and refused it.
+	ErrDeclined = errors.New("declined by payment processor")
+	// ErrUnavailable means the payment processor could not be reached or failed to process the request.
+	ErrUnavailable = errors.New("payment processor unavailable")
+	// ErrTimeout means the payment processor did not answer in time. The outcome of the request is unknown.
+	ErrTimeout = errors.New("payment processor timed out")
+	// ErrProtocol means the request or the response did not follow the payment processor protocol.
+	ErrProtocol = errors.New("payment processor protocol error")
+	// ErrCanceled means the caller gave up on the request. The outcome of the request is unknown.
+	ErrCanceled = errors.New("payment processor request canceled")
+	// ErrCircuitOpen means the request was not sent, as the payment processor is considered down.
+	ErrCircuitOpen = errors.New("payment processor temporarily unavailable")
+)
+
+// DeclineCodeAuthorisationNotFound is the decline code of captures, refunds and voids of an authorisation the payment
+// processor does not hold (anymore).
+const DeclineCodeAuthorisationNotFound = 4
+
+// DeclineError is returned when the payment processor declines a request.
+type DeclineError struct {
+	// Code is the decline reason code sent by the payment processor.
+	Code uint
+	// Reason is the human readable decline reason, if the payment processor sent one.
+	Reason string
+}
+
+func (e *DeclineError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%s (code %d): %s", ErrDeclined.Error(), e.Code, e.Reason)
+	}
+	return fmt.Sprintf("%s (code %d)", ErrDeclined.Error(), e.Code)
+}
+
+func (e *DeclineError) Is(target error) bool {
+	return target == ErrDeclined
+}
+
+// Error is returned when a request to the payment processor fails for reasons other than a decline.
+type Error struct {
+	// Kind is one of ErrUnavailable, ErrTimeout, ErrProtocol, ErrCanceled or ErrCircuitOpen.
+	Kind error
+	// Op is the operation being performed, e.g. "capture".
+	Op  string
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %s", e.Op, e.Kind.Error(), e.Err.Error())
+	}
+	return fmt.Sprintf("%s: %s", e.Op, e.Kind.Error())
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// transportError classifies an error returned by the HTTP client.
+func transportError(op string, err error) *Error {
+	var netErr net.Error
+	if errors.Is(err, context.Canceled) {
+		return &Error{Kind: ErrCanceled, Op: op, Err: err}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return &Error{Kind: ErrTimeout, Op: op, Err: err}
+	}
+	return &Error{Kind: ErrUnavailable, Op: op, Err: err}
+}
+
+// statusCodeError classifies a non 200 HTTP response.
+func statusCodeError(op string, statusCode int) *Error {
+	err := fmt.Errorf("unexpected status code %d", statusCode)
+
+	switch {
+	case statusCode == 504 || statusCode == 408:
+		return &Error{Kind: ErrTimeout, Op: op, Err: err}
+	case statusCode >= 500 || statusCode == 429:
+		return &Error{Kind: ErrUnavailable, Op: op, Err: err}
+	default:
+		return &Error{Kind: ErrProtocol, Op: op, Err: err}
+	}
+}
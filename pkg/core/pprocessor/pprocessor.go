@@ -1,18 +1,54 @@
+// Package pprocessor is the client of the payment processor JSON protocol (POST /api/v1/authorise, /capture,
+// /refund and /void).
+//
+// The gateway relies on an extension of the protocol to resolve operations whose outcome is unknown, which the
+// payment processor must support:
+//   - captures, refunds and voids carry a request ID in the Idempotency-Key header, and are processed once per ID.
+//   - authorisations carry a "reference" field, identifying the authorisation request.
+//   - POST /api/v1/query returns the outcome of an authorisation (by reference) or of a capture, refund or void
+//     (by request ID), see QueryRequest and QueryResponse.
+//
+// Payment processors without the extension ignore the header and the field, but answer queries with a 404, so the
+// reconciler cannot resolve anything and gives up on authorisation requests, captures, refunds and voids after its
+// maximum number of attempts.
 package pprocessor
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
 )
 
-// NOTE: This client (SDK) needs improvement, like better error reporting in logs and what not
+// codeSuccess is the response code of a successful request, any other code is a decline.
+const codeSuccess = 1
+
+// IdempotencyKeyHeader carries the request ID, so the payment processor processes retried requests only once.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// Timeouts holds the deadline of each payment processor operation. Zero means no deadline other than the caller's.
+type Timeouts struct {
+	Authorise time.Duration
+	Capture   time.Duration
+	Refund    time.Duration
+	Void      time.Duration
+	Query     time.Duration
+}
 
 type Client struct {
 	httpClient *http.Client
 	baseURL    string
+
+	Timeouts Timeouts
+	Retry    RetryPolicy
+	// Breaker (if set) stops requests from being sent while the payment processor is down.
+	Breaker *breaker.Breaker
 }
 
 func NewClient(host string, port int, httpClient *http.Client) *Client {
@@ -20,174 +56,200 @@ func NewClient(host string, port int, httpClient *http.Client) *Client {
 	return c
 }
 
-func (c *Client) AuthorisePayment(authReq AuthorisationRequest) (authID string, success bool) {
-	requestBody, err := json.Marshal(authReq)
-	if err != nil {
-		return "", false
-	}
-
-	url := c.baseURL + "/authorise"
+// AuthorisePayment asks the payment processor to authorise a payment and returns the authorisation ID.
+// Errors are either a *DeclineError or an *Error.
+func (c *Client) AuthorisePayment(ctx context.Context, authReq AuthorisationRequest) (authID string, err error) {
+	var responseBodyData AuthorisationResponse
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	err = c.post(ctx, c.Timeouts.Authorise, "authorise", "/authorise", "", false, authReq, &responseBodyData)
 	if err != nil {
-		return "", false
+		return "", err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return "", false
+	if err := responseError(responseBodyData.Code, responseBodyData.Reason); err != nil {
+		return "", err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return "", false
+	if responseBodyData.AuthorisationID == "" {
+		return "", &Error{Kind: ErrProtocol, Op: "authorise", Err: fmt.Errorf("authorisation ID missing")}
 	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", false
-	}
+	return responseBodyData.AuthorisationID, nil
+}
 
-	var responseBodyData AuthorisationResponse
+// CaptureTransaction asks the payment processor to capture money from an authorisation.
+// Errors are either a *DeclineError or an *Error.
+func (c *Client) CaptureTransaction(ctx context.Context, capReq CaptureRequest) error {
+	var responseBodyData CaptureResponse
 
-	err = json.Unmarshal(responseBody, &responseBodyData)
+	err := c.post(ctx, c.Timeouts.Capture, "capture", "/capture", capReq.RequestID, capReq.RequestID != "", capReq, &responseBodyData)
 	if err != nil {
-		return "", false
-	}
-
-	if responseBodyData.Code != 1 {
-		return "", false
+		return err
 	}
 
-	return responseBodyData.AuthorisationID, true
+	return responseError(responseBodyData.Code, responseBodyData.Reason)
 }
 
-func (c *Client) CaptureTransaction(capReq CaptureRequest) (success bool) {
-	requestBody, err := json.Marshal(capReq)
-	if err != nil {
-		return false
-	}
-
-	url := c.baseURL + "/capture"
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
-	if err != nil {
-		return false
-	}
-	req.Header.Set("Content-Type", "application/json")
+// RefundTransaction asks the payment processor to refund money captured from an authorisation.
+// Errors are either a *DeclineError or an *Error.
+func (c *Client) RefundTransaction(ctx context.Context, refReq RefundRequest) error {
+	var responseBodyData RefundResponse
 
-	resp, err := c.httpClient.Do(req)
+	err := c.post(ctx, c.Timeouts.Refund, "refund", "/refund", refReq.RequestID, refReq.RequestID != "", refReq, &responseBodyData)
 	if err != nil {
-		return false
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != 200 {
-		return false
+		return err
 	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false
-	}
+	return responseError(responseBodyData.Code, responseBodyData.Reason)
+}
 
-	var responseBodyData CaptureResponse
+// VoidPayment asks the payment processor to void an authorisation.
+// Errors are either a *DeclineError or an *Error.
+func (c *Client) VoidPayment(ctx context.Context, voidReq VoidRequest) error {
+	var responseBodyData VoidResponse
 
-	err = json.Unmarshal(responseBody, &responseBodyData)
+	err := c.post(ctx, c.Timeouts.Void, "void", "/void", voidReq.RequestID, voidReq.RequestID != "", voidReq, &responseBodyData)
 	if err != nil {
-		return false
-	}
-
-	if responseBodyData.Code != 1 {
-		return false
+		return err
 	}
 
-	return true
+	return responseError(responseBodyData.Code, responseBodyData.Reason)
 }
 
-func (c *Client) RefundTransaction(refReq RefundRequest) (success bool) {
-	requestBody, err := json.Marshal(refReq)
-	if err != nil {
-		return false
-	}
+// QueryOperation asks the payment processor what happened to an authorisation (queried by reference) or to a
+// capture, refund or void (queried by request ID). It is used to resolve operations whose outcome is unknown.
+// Errors are either a *DeclineError or an *Error.
+func (c *Client) QueryOperation(ctx context.Context, queryReq QueryRequest) (QueryResponse, error) {
+	var responseBodyData QueryResponse
 
-	url := c.baseURL + "/refund"
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	// Queries have no side effects, so they are always safe to retry
+	err := c.post(ctx, c.Timeouts.Query, "query", "/query", "", true, queryReq, &responseBodyData)
 	if err != nil {
-		return false
+		return QueryResponse{}, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := c.httpClient.Do(req)
-	if err != nil {
-		return false
+	if err := responseError(responseBodyData.Code, responseBodyData.Reason); err != nil {
+		return QueryResponse{}, err
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != 200 {
-		return false
+	switch responseBodyData.Status {
+	case QuerySucceeded, QueryDeclined, QueryNotFound:
+	default:
+		return QueryResponse{}, &Error{Kind: ErrProtocol, Op: "query",
+			Err: fmt.Errorf("unknown status %q", responseBodyData.Status)}
 	}
 
-	responseBody, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return false
-	}
+	return responseBodyData, nil
+}
 
-	var responseBodyData RefundResponse
+// OutcomeUnknown returns true if, after the given error, it is unknown whether the payment processor processed
+// the request. Such requests must be resolved later with QueryOperation.
+func OutcomeUnknown(err error) bool {
+	return err != nil && !errors.Is(err, ErrDeclined) && !errors.Is(err, ErrCircuitOpen)
+}
 
-	err = json.Unmarshal(responseBody, &responseBodyData)
-	if err != nil {
-		return false
+// post sends the request to the payment processor and decodes its response.
+// Requests safe to retry are retried according to the retry policy, each attempt being cancelled once the
+// timeout (if any) expires. All attempts are cancelled when ctx is done or the retry budget is exhausted.
+func (c *Client) post(ctx context.Context, timeout time.Duration, op string, path string, requestID string,
+	safeToRetry bool, requestData interface{}, responseData interface{}) error {
+	requestBody, err := json.Marshal(requestData)
+	if err != nil {
+		return &Error{Kind: ErrProtocol, Op: op, Err: err}
+	}
+
+	if c.Retry.Budget > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Retry.Budget)
+		defer cancel()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if errOpen := c.Breaker.Allow(); errOpen != nil {
+			if err != nil {
+				return err
+			}
+			return &Error{Kind: ErrCircuitOpen, Op: op, Err: errOpen}
+		}
+
+		err = c.send(ctx, timeout, op, path, requestID, requestBody, responseData)
+		c.recordOutcome(err)
+		if err == nil || !safeToRetry || attempt >= c.Retry.MaxAttempts || !retryableError(err) || ctx.Err() != nil {
+			return err
+		}
+
+		backoff := c.Retry.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= backoff {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
 	}
+}
 
-	if responseBodyData.Code != 1 {
-		return false
+// recordOutcome tells the circuit breaker whether the payment processor answered.
+func (c *Client) recordOutcome(err error) {
+	switch {
+	case errors.Is(err, ErrCanceled):
+		c.Breaker.Cancel()
+	case errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout):
+		c.Breaker.Failure()
+	default:
+		c.Breaker.Success()
 	}
-
-	return true
 }
 
-func (c *Client) VoidPayment(voidReq VoidRequest) (success bool) {
-	requestBody, err := json.Marshal(voidReq)
-	if err != nil {
-		return false
+// send makes a single attempt at sending the request.
+func (c *Client) send(ctx context.Context, timeout time.Duration, op string, path string, requestID string,
+	requestBody []byte, responseData interface{}) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
 
-	url := c.baseURL + "/void"
-
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(requestBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+path, bytes.NewReader(requestBody))
 	if err != nil {
-		return false
+		return &Error{Kind: ErrProtocol, Op: op, Err: err}
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if requestID != "" {
+		req.Header.Set(IdempotencyKeyHeader, requestID)
+	}
 
 	resp, err := c.httpClient.Do(req)
 	if err != nil {
-		return false
+		return transportError(op, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return false
+		return statusCodeError(op, resp.StatusCode)
 	}
 
 	responseBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return false
+		return transportError(op, err)
 	}
 
-	var responseBodyData VoidResponse
-
-	err = json.Unmarshal(responseBody, &responseBodyData)
+	err = json.Unmarshal(responseBody, responseData)
 	if err != nil {
-		return false
+		return &Error{Kind: ErrProtocol, Op: op, Err: err}
 	}
 
-	if responseBodyData.Code != 1 {
-		return false
-	}
+	return nil
+}
 
-	return true
+// responseError returns a *DeclineError if the response code is not a success.
+func responseError(code uint, reason string) error {
+	if code != codeSuccess {
+		return &DeclineError{Code: code, Reason: reason}
+	}
+	return nil
 }
@@ -0,0 +1,323 @@
+package pprocessor_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/breaker"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) *pprocessor.Client {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	require.NoError(t, err)
+
+	return pprocessor.NewClient(serverURL.Hostname(), port, &http.Client{Timeout: 50 * time.Millisecond})
+}
+
+func respondWith(statusCode int, body string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statusCode)
+		_, _ = w.Write([]byte(body))
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	tests := map[string]struct {
+		handler      http.HandlerFunc
+		expectedKind error
+	}{
+		"success":           {handler: respondWith(200, `{"code": 1}`), expectedKind: nil},
+		"declined":          {handler: respondWith(200, `{"code": 5, "reason": "insufficient funds"}`), expectedKind: pprocessor.ErrDeclined},
+		"service down":      {handler: respondWith(503, ``), expectedKind: pprocessor.ErrUnavailable},
+		"gateway timeout":   {handler: respondWith(504, ``), expectedKind: pprocessor.ErrTimeout},
+		"bad request":       {handler: respondWith(400, ``), expectedKind: pprocessor.ErrProtocol},
+		"malformed body":    {handler: respondWith(200, `{"code":`), expectedKind: pprocessor.ErrProtocol},
+		"response too slow": {handler: func(w http.ResponseWriter, r *http.Request) { time.Sleep(200 * time.Millisecond) }, expectedKind: pprocessor.ErrTimeout},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, test.handler)
+
+			err := client.CaptureTransaction(context.Background(), pprocessor.CaptureRequest{AuthorisationID: "auth1",
+				Amount: money.Money{MinorUnits: 100, Currency: "EUR"}})
+
+			if test.expectedKind == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.True(t, errors.Is(err, test.expectedKind), "unexpected error: %v", err)
+		})
+	}
+}
+
+func TestClientDeclineReason(t *testing.T) {
+	client := newTestClient(t, respondWith(200, `{"code": 5, "reason": "insufficient funds"}`))
+
+	_, err := client.AuthorisePayment(context.Background(), pprocessor.AuthorisationRequest{Amount: money.Money{MinorUnits: 100, Currency: "EUR"}})
+
+	var declineErr *pprocessor.DeclineError
+	require.True(t, errors.As(err, &declineErr))
+	assert.Equal(t, uint(5), declineErr.Code)
+	assert.Equal(t, "insufficient funds", declineErr.Reason)
+}
+
+func TestClientUnreachable(t *testing.T) {
+	server := httptest.NewServer(respondWith(200, `{"code": 1}`))
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	require.NoError(t, err)
+	server.Close()
+
+	client := pprocessor.NewClient(serverURL.Hostname(), port, &http.Client{})
+	err = client.VoidPayment(context.Background(), pprocessor.VoidRequest{AuthorisationID: "auth1"})
+	assert.True(t, errors.Is(err, pprocessor.ErrUnavailable), "unexpected error: %v", err)
+}
+
+func TestClientMissingAuthorisationID(t *testing.T) {
+	client := newTestClient(t, respondWith(200, `{"code": 1}`))
+
+	_, err := client.AuthorisePayment(context.Background(), pprocessor.AuthorisationRequest{Amount: money.Money{MinorUnits: 100, Currency: "EUR"}})
+	assert.True(t, errors.Is(err, pprocessor.ErrProtocol), "unexpected error: %v", err)
+}
+
+func TestClientOperationTimeout(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	})
+	client.Timeouts.Refund = 10 * time.Millisecond
+
+	start := time.Now()
+	err := client.RefundTransaction(context.Background(), pprocessor.RefundRequest{AuthorisationID: "auth1",
+		Amount: money.Money{MinorUnits: 100, Currency: "EUR"}})
+
+	assert.True(t, errors.Is(err, pprocessor.ErrTimeout), "unexpected error: %v", err)
+	assert.Less(t, int64(time.Since(start)), int64(40*time.Millisecond))
+}
+
+func TestClientCanceled(t *testing.T) {
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(200 * time.Millisecond):
+		case <-r.Context().Done():
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
+
+	err := client.VoidPayment(ctx, pprocessor.VoidRequest{AuthorisationID: "auth1"})
+	assert.True(t, errors.Is(err, pprocessor.ErrCanceled), "unexpected error: %v", err)
+}
+
+// flakyHandler fails the first failures requests with the given status code, then succeeds.
+func flakyHandler(failures int, statusCode int, attempts *int32, requestIDs *[]string) http.HandlerFunc {
+	var mu sync.Mutex
+	return func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		*requestIDs = append(*requestIDs, r.Header.Get(pprocessor.IdempotencyKeyHeader))
+		if atomic.AddInt32(attempts, 1) <= int32(failures) {
+			w.WriteHeader(statusCode)
+			return
+		}
+		_, _ = w.Write([]byte(`{"code": 1, "authorisation_id": "auth1"}`))
+	}
+}
+
+func TestClientRetries(t *testing.T) {
+	eur := money.Money{MinorUnits: 100, Currency: "EUR"}
+
+	tests := map[string]struct {
+		failures         int
+		statusCode       int
+		call             func(c *pprocessor.Client) error
+		expectedAttempts int32
+		expectedKind     error
+	}{
+		"capture retried until success": {failures: 2, statusCode: 503, expectedAttempts: 3,
+			call: func(c *pprocessor.Client) error {
+				return c.CaptureTransaction(context.Background(), pprocessor.CaptureRequest{Amount: eur, RequestID: "1"})
+			}},
+		"void retried until max attempts": {failures: 5, statusCode: 502, expectedAttempts: 3,
+			expectedKind: pprocessor.ErrUnavailable,
+			call: func(c *pprocessor.Client) error {
+				return c.VoidPayment(context.Background(), pprocessor.VoidRequest{RequestID: "1"})
+			}},
+		"refund retried on gateway timeout": {failures: 1, statusCode: 504, expectedAttempts: 2,
+			call: func(c *pprocessor.Client) error {
+				return c.RefundTransaction(context.Background(), pprocessor.RefundRequest{Amount: eur, RequestID: "1"})
+			}},
+		"capture without request ID not retried": {failures: 1, statusCode: 503, expectedAttempts: 1,
+			expectedKind: pprocessor.ErrUnavailable,
+			call: func(c *pprocessor.Client) error {
+				return c.CaptureTransaction(context.Background(), pprocessor.CaptureRequest{Amount: eur})
+			}},
+		"authorisation never retried": {failures: 1, statusCode: 503, expectedAttempts: 1,
+			expectedKind: pprocessor.ErrUnavailable,
+			call: func(c *pprocessor.Client) error {
+				_, err := c.AuthorisePayment(context.Background(), pprocessor.AuthorisationRequest{Amount: eur})
+				return err
+			}},
+		"client errors not retried": {failures: 1, statusCode: 400, expectedAttempts: 1,
+			expectedKind: pprocessor.ErrProtocol,
+			call: func(c *pprocessor.Client) error {
+				return c.VoidPayment(context.Background(), pprocessor.VoidRequest{RequestID: "1"})
+			}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var attempts int32
+			var requestIDs []string
+			client := newTestClient(t, flakyHandler(test.failures, test.statusCode, &attempts, &requestIDs))
+			client.Retry = pprocessor.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond,
+				MaxBackoff: 5 * time.Millisecond}
+
+			err := test.call(client)
+
+			if test.expectedKind == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, test.expectedKind), "unexpected error: %v", err)
+			}
+			assert.Equal(t, test.expectedAttempts, atomic.LoadInt32(&attempts))
+			for _, requestID := range requestIDs[1:] {
+				assert.Equal(t, requestIDs[0], requestID)
+			}
+		})
+	}
+}
+
+func TestClientRetryBudget(t *testing.T) {
+	var attempts int32
+	var requestIDs []string
+	client := newTestClient(t, flakyHandler(100, 503, &attempts, &requestIDs))
+	client.Retry = pprocessor.RetryPolicy{MaxAttempts: 100, InitialBackoff: 20 * time.Millisecond,
+		MaxBackoff: 20 * time.Millisecond, Budget: 50 * time.Millisecond}
+
+	start := time.Now()
+	err := client.VoidPayment(context.Background(), pprocessor.VoidRequest{RequestID: "1"})
+
+	assert.True(t, errors.Is(err, pprocessor.ErrUnavailable), "unexpected error: %v", err)
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+	assert.Less(t, atomic.LoadInt32(&attempts), int32(100))
+}
+
+func TestClientCircuitBreaker(t *testing.T) {
+	var attempts int32
+	var requestIDs []string
+	client := newTestClient(t, flakyHandler(100, 503, &attempts, &requestIDs))
+	client.Breaker = breaker.New("pprocessor", breaker.Settings{FailureThreshold: 2, OpenTimeout: time.Hour})
+
+	for i := 0; i < 2; i++ {
+		err := client.VoidPayment(context.Background(), pprocessor.VoidRequest{AuthorisationID: "auth1"})
+		assert.True(t, errors.Is(err, pprocessor.ErrUnavailable), "unexpected error: %v", err)
+	}
+
+	// the circuit is now open: requests fail straight away without reaching the payment processor
+	_, err := client.AuthorisePayment(context.Background(), pprocessor.AuthorisationRequest{})
+	assert.True(t, errors.Is(err, pprocessor.ErrCircuitOpen), "unexpected error: %v", err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&attempts))
+}
+
+func TestClientDeclinesDoNotOpenCircuit(t *testing.T) {
+	client := newTestClient(t, respondWith(200, `{"code": 5}`))
+	client.Breaker = breaker.New("pprocessor", breaker.Settings{FailureThreshold: 1, OpenTimeout: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		err := client.VoidPayment(context.Background(), pprocessor.VoidRequest{AuthorisationID: "auth1"})
+		assert.True(t, errors.Is(err, pprocessor.ErrDeclined), "unexpected error: %v", err)
+	}
+	assert.Equal(t, breaker.Closed, client.Breaker.State())
+}
+
+func TestClientQueryOperation(t *testing.T) {
+	tests := map[string]struct {
+		handler          http.HandlerFunc
+		expectedResponse pprocessor.QueryResponse
+		expectedErr      error
+	}{
+		"succeeded": {handler: respondWith(200, `{"code": 1, "status": "succeeded", "authorisation_id": "auth1"}`),
+			expectedResponse: pprocessor.QueryResponse{Code: 1, Status: pprocessor.QuerySucceeded,
+				AuthorisationID: "auth1"}},
+		"not found": {handler: respondWith(200, `{"code": 1, "status": "not_found"}`),
+			expectedResponse: pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryNotFound}},
+		"unknown status": {handler: respondWith(200, `{"code": 1, "status": "maybe"}`),
+			expectedErr: pprocessor.ErrProtocol},
+		"query refused": {handler: respondWith(200, `{"code": 3}`), expectedErr: pprocessor.ErrDeclined},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t, test.handler)
+
+			queryResp, err := client.QueryOperation(context.Background(), pprocessor.QueryRequest{Reference: "ref1"})
+			if test.expectedErr != nil {
+				assert.True(t, errors.Is(err, test.expectedErr), "unexpected error: %v", err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedResponse, queryResp)
+		})
+	}
+}
+
+func TestClientQueryOperationRetries(t *testing.T) {
+	var attempts int32
+	client := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) <= 2 {
+			w.WriteHeader(503)
+			return
+		}
+		_, _ = w.Write([]byte(`{"code": 1, "status": "declined"}`))
+	})
+	client.Retry = pprocessor.RetryPolicy{MaxAttempts: 3}
+
+	// Queries have no side effects, so they are retried even without a request ID
+	queryResp, err := client.QueryOperation(context.Background(), pprocessor.QueryRequest{Reference: "ref1"})
+	require.NoError(t, err)
+	assert.Equal(t, pprocessor.QueryDeclined, queryResp.Status)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+}
+
+func TestOutcomeUnknown(t *testing.T) {
+	tests := map[string]struct {
+		err            error
+		expectedResult bool
+	}{
+		"success":      {err: nil, expectedResult: false},
+		"declined":     {err: &pprocessor.DeclineError{Code: 5}, expectedResult: false},
+		"circuit open": {err: &pprocessor.Error{Kind: pprocessor.ErrCircuitOpen}, expectedResult: false},
+		"timeout":      {err: &pprocessor.Error{Kind: pprocessor.ErrTimeout}, expectedResult: true},
+		"unavailable":  {err: &pprocessor.Error{Kind: pprocessor.ErrUnavailable}, expectedResult: true},
+		"canceled":     {err: &pprocessor.Error{Kind: pprocessor.ErrCanceled}, expectedResult: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expectedResult, pprocessor.OutcomeUnknown(test.err))
+		})
+	}
+}
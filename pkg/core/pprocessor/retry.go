@@ -0,0 +1,56 @@
+package pprocessor
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// RetryPolicy controls how requests that are safe to retry are retried.
+//
+// Only queries and captures, refunds and voids carrying a request ID are retried, as the payment processor uses the
+// request ID to process them only once. Authorisations are never retried: a retry after an ambiguous failure could
+// authorise twice.
+// Requests are retried on transport errors, timeouts and 5xx responses, never on declines.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one. Values below 2 disable retries.
+	MaxAttempts int
+	// InitialBackoff is the upper bound of the wait before the first retry, it doubles on every retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the upper bound of the wait between retries.
+	MaxBackoff time.Duration
+	// Budget is the maximum total time spent on a request, including all attempts and backoffs.
+	// Zero means no limit other than the caller's deadline.
+	Budget time.Duration
+}
+
+var (
+	jitterMu   sync.Mutex
+	jitterRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// backoff returns how long to wait before the given retry (starting at 1).
+// It uses "full jitter": a random duration between zero and the exponential backoff.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	if p.InitialBackoff <= 0 {
+		return 0
+	}
+
+	backoff := p.InitialBackoff
+	for i := 1; i < retry && (p.MaxBackoff <= 0 || backoff < p.MaxBackoff); i++ {
+		backoff *= 2
+	}
+	if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+		backoff = p.MaxBackoff
+	}
+
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitterRand.Int63n(int64(backoff) + 1))
+}
+
+// retryableError returns true if the request might succeed if sent again.
+func retryableError(err error) bool {
+	return errors.Is(err, ErrUnavailable) || errors.Is(err, ErrTimeout)
+}
@@ -1,31 +1,72 @@
 package repository
 
+import "time"
+
+// CreditCard is a tokenised card, unique per merchant and card number.
+// The card holder name and expiry date are the latest provided with the card, each authorisation keeps the ones it
+// was made with in its CardInstance.
 type CreditCard struct {
-	Number         uint64          `gorm:"primaryKey;not null"`
-	Name           string          `gorm:"type:varchar(50);not null"`
-	ExpiryMonth    uint            `gorm:"not null"`
-	ExpiryYear     uint            `gorm:"not null"`
-	CVV            uint            `gorm:"not null"`
-	Authorisations []Authorisation `gorm:"foreignKey:CreditCardNumber;not null"`
+	Token           string         `gorm:"primaryKey;type:varchar(50);not null"`
+	MerchantName    string         `gorm:"type:varchar(50);not null;uniqueIndex:idx_credit_card_fingerprint"`
+	Fingerprint     string         `gorm:"type:varchar(64);not null;uniqueIndex:idx_credit_card_fingerprint"`
+	EncryptedNumber []byte         `gorm:"type:varbinary(128);not null"`
+	EncryptedKey    []byte         `gorm:"type:varbinary(128);not null"`
+	BIN             string         `gorm:"type:varchar(6);not null"`
+	LastFour        string         `gorm:"type:varchar(4);not null"`
+	Brand           string         `gorm:"type:varchar(20);not null"`
+	Name            string         `gorm:"type:varchar(50);not null"`
+	ExpiryMonth     uint           `gorm:"not null"`
+	ExpiryYear      uint           `gorm:"not null"`
+	CardInstances   []CardInstance `gorm:"foreignKey:CreditCardToken;not null"`
+}
+
+// CardInstance records the card details an authorisation was made with, as the card holder name and expiry date of
+// a card can change between authorisations (e.g. a renewed card keeps its number).
+type CardInstance struct {
+	ID              uint64    `gorm:"primaryKey;autoIncrement;not null"`
+	CreditCardToken string    `gorm:"type:varchar(50);not null;index"` // ForeignKey to Credit Card
+	Name            string    `gorm:"type:varchar(50);not null"`
+	ExpiryMonth     uint      `gorm:"not null"`
+	ExpiryYear      uint      `gorm:"not null"`
+	CreatedAt       time.Time `gorm:"not null"`
 }
 
 type Authorisation struct {
-	ID               string `gorm:"primaryKey;type:varchar(50);not null"`
-	State            State
-	StateID          uint64 `gorm:"not null"` // Foreign Key
-	Currency         Currency
-	CurrencyID       uint64        `gorm:"not null"` // Foreign Key
-	Amount           float64       `gorm:"not null"`
-	MerchantName     string        `gorm:"type:varchar(50);not null"`
-	CreditCardNumber uint64        `gorm:"not null"` // ForeignKey to Credit Card
-	Transactions     []Transaction `gorm:"foreignKey:AuthorisationID"`
+	ID             string `gorm:"primaryKey;type:varchar(50);not null"`
+	State          State
+	StateID        uint64 `gorm:"not null"` // Foreign Key
+	Currency       Currency
+	CurrencyID     uint64 `gorm:"not null"` // Foreign Key
+	Amount         int64  `gorm:"not null"` // In minor units of the currency
+	MerchantName   string `gorm:"type:varchar(50);not null"`
+	CardInstance   CardInstance
+	CardInstanceID uint64        `gorm:"not null"` // Foreign Key
+	Transactions   []Transaction `gorm:"foreignKey:AuthorisationID"`
+	CreatedAt      time.Time     `gorm:"not null"`
 }
 
 type Transaction struct {
-	ID              uint64  `gorm:"primaryKey;autoIncrement;not null"`
-	Type            string  `gorm:"type:varchar(20);not null"`
-	Amount          float64 `gorm:"not null"`
-	AuthorisationID string  `gorm:"not null"` // ForeignKey to Authorisation
+	ID              uint64    `gorm:"primaryKey;autoIncrement;not null"`
+	Type            string    `gorm:"type:varchar(20);not null"`
+	Status          string    `gorm:"type:varchar(20);not null;index:idx_transaction_status"`
+	Amount          int64     `gorm:"not null"`                  // In minor units of the authorisation currency
+	AuthorisationID string    `gorm:"type:varchar(50);not null"` // ForeignKey to Authorisation
+	Attempts        int       `gorm:"not null"`
+	CreatedAt       time.Time `gorm:"not null;index:idx_transaction_status"`
+}
+
+// AuthorisationJournal records authorisation requests before they are sent to the payment processor
+type AuthorisationJournal struct {
+	Reference       string `gorm:"primaryKey;type:varchar(50);not null"`
+	MerchantName    string `gorm:"type:varchar(50);not null"`
+	Currency        Currency
+	CurrencyID      uint64    `gorm:"not null"` // Foreign Key
+	Amount          int64     `gorm:"not null"` // In minor units of the currency
+	CreditCardToken string    `gorm:"type:varchar(50);not null"`
+	Status          string    `gorm:"type:varchar(20);not null;index:idx_authorisation_journal_status"`
+	AuthorisationID string    `gorm:"type:varchar(50)"`
+	Attempts        int       `gorm:"not null"`
+	CreatedAt       time.Time `gorm:"not null;index:idx_authorisation_journal_status"`
 }
 
 type State struct {
@@ -37,3 +78,31 @@ type Currency struct {
 	ID   uint64 `gorm:"primaryKey;autoIncrement;not null"`
 	Name string `gorm:"type:varchar(20);not null"`
 }
+
+type IdempotencyKey struct {
+	ID           uint64    `gorm:"primaryKey;autoIncrement;not null"`
+	MerchantName string    `gorm:"type:varchar(50);not null;uniqueIndex:idx_idempotency_merchant_key"`
+	Key          string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_idempotency_merchant_key"`
+	RequestHash  string    `gorm:"type:varchar(64);not null"`
+	Completed    bool      `gorm:"not null"`
+	StatusCode   int       `gorm:"not null"`
+	ResponseBody []byte    `gorm:"type:blob"`
+	CreatedAt    time.Time `gorm:"not null"`
+}
+
+// APIKey is a merchant's API key, whose secret is encrypted like card numbers.
+type APIKey struct {
+	ID              string    `gorm:"primaryKey;type:varchar(50);not null"`
+	MerchantName    string    `gorm:"type:varchar(50);not null;index:idx_api_key_merchant"`
+	EncryptedSecret []byte    `gorm:"type:varbinary(128);not null"`
+	EncryptedKey    []byte    `gorm:"type:varbinary(128);not null"`
+	CreatedAt       time.Time `gorm:"not null"`
+	RevokedAt       *time.Time
+}
+
+// APIKeyNonce records a nonce of a signed request, so the request cannot be replayed.
+type APIKeyNonce struct {
+	APIKeyID  string    `gorm:"primaryKey;type:varchar(50);not null;index:idx_api_key_nonce_created_at"` // ForeignKey to APIKey
+	Nonce     string    `gorm:"primaryKey;type:varchar(64);not null"`
+	CreatedAt time.Time `gorm:"not null;index:idx_api_key_nonce_created_at"`
+}
@@ -0,0 +1,573 @@
+// Package inmemory provides an in-memory implementation of core.Repository, meant for tests and demos.
+package inmemory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+)
+
+// Repository is an in-memory repository.
+// It is safe for concurrent use and follows the same semantics as repository.DatabaseService, including the
+// repository.DBServiceError flags returned.
+type Repository struct {
+	mu sync.Mutex
+
+	currencies      map[string]bool
+	creditCards     map[string]creditCardRecord
+	authorisations  map[string]*authorisationRecord
+	authOrder       []string
+	idempotencyKeys map[idempotencyKeyID]*idempotencyKeyRecord
+	journal         map[string]*entities.AuthorisationJournalEntry
+	journalOrder    []string
+	lastTransID     uint64
+	apiKeys         map[string]entities.APIKey
+	apiKeyOrder     []string
+	// apiKeyNonces holds the time each nonce was recorded, by API key ID
+	apiKeyNonces map[string]map[string]time.Time
+}
+
+type creditCardRecord struct {
+	merchantName string
+	card         entities.CreditCard
+}
+
+type authorisationRecord struct {
+	auth entities.Authorisation
+	// cardInstance is the card the authorisation was made with
+	cardInstance entities.CreditCard
+}
+
+type idempotencyKeyID struct {
+	merchantName string
+	key          string
+}
+
+type idempotencyKeyRecord struct {
+	keyItem entities.IdempotencyKey
+	// startedAt is when the request was (last) started
+	startedAt time.Time
+}
+
+// NewRepository returns a new empty repository supporting the currencies given.
+func NewRepository(currencies ...string) *Repository {
+	r := &Repository{
+		currencies:      make(map[string]bool),
+		creditCards:     make(map[string]creditCardRecord),
+		authorisations:  make(map[string]*authorisationRecord),
+		idempotencyKeys: make(map[idempotencyKeyID]*idempotencyKeyRecord),
+		journal:         make(map[string]*entities.AuthorisationJournalEntry),
+		apiKeys:         make(map[string]entities.APIKey),
+		apiKeyNonces:    make(map[string]map[string]time.Time),
+	}
+
+	for _, currency := range currencies {
+		r.currencies[currency] = true
+	}
+
+	return r
+}
+
+func (r *Repository) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+func (r *Repository) CurrencyExists(ctx context.Context, currency string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.currencies[currency], nil
+}
+
+func (r *Repository) SaveCreditCard(ctx context.Context, merchantName string, card entities.CreditCard) (entities.CreditCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for token, cardRecord := range r.creditCards {
+		if cardRecord.merchantName == merchantName && cardRecord.card.Fingerprint == card.Fingerprint {
+			cardRecord.card.Name = card.Name
+			cardRecord.card.ExpiryMonth = card.ExpiryMonth
+			cardRecord.card.ExpiryYear = card.ExpiryYear
+			r.creditCards[token] = cardRecord
+			return cardRecord.card, nil
+		}
+	}
+
+	if _, ok := r.creditCards[card.Token]; ok {
+		return card, &repository.DBServiceError{Msg: "database error", Err: fmt.Errorf("duplicate credit card token")}
+	}
+
+	r.creditCards[card.Token] = creditCardRecord{merchantName: merchantName, card: card}
+	return card, nil
+}
+
+func (r *Repository) GetCreditCard(ctx context.Context, merchantName string, token string) (entities.CreditCard, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cardRecord, ok := r.creditCards[token]
+	if !ok || cardRecord.merchantName != merchantName {
+		return entities.CreditCard{}, &repository.DBServiceError{Msg: "credit card token not found", NotFound: true}
+	}
+
+	return cardRecord.card, nil
+}
+
+func (r *Repository) AddAuthorisation(ctx context.Context, auth entities.Authorisation) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if auth.CreditCard == nil {
+		return &repository.DBServiceError{Msg: "credit card missing", ValidationFail: true}
+	}
+
+	if !r.currencies[auth.Amount.Currency] {
+		return &repository.DBServiceError{Msg: "currency provided not supported", ValidationFail: true}
+	}
+
+	if _, ok := r.creditCards[auth.CreditCard.Token]; !ok {
+		return &repository.DBServiceError{Msg: "credit card token not found", ValidationFail: true}
+	}
+
+	if _, ok := r.authorisations[auth.ID]; ok {
+		return repository.ErrAuthorisationExists
+	}
+
+	r.authorisations[auth.ID] = &authorisationRecord{
+		auth: entities.Authorisation{
+			ID:           auth.ID,
+			State:        auth.State,
+			Amount:       auth.Amount,
+			MerchantName: auth.MerchantName,
+			CreatedAt:    time.Now(),
+		},
+		cardInstance: entities.CreditCard{
+			Token:       auth.CreditCard.Token,
+			Name:        auth.CreditCard.Name,
+			ExpiryMonth: auth.CreditCard.ExpiryMonth,
+			ExpiryYear:  auth.CreditCard.ExpiryYear,
+		},
+	}
+	r.authOrder = append(r.authOrder, auth.ID)
+
+	if entry, ok := r.journal[auth.Reference]; ok && auth.Reference != "" {
+		entry.Status = entities.JournalCompleted
+		entry.AuthorisationID = auth.ID
+	}
+
+	return nil
+}
+
+func (r *Repository) ReserveTransaction(ctx context.Context, authID string, transaction entities.Transaction) (transID string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authRecord, ok := r.authorisations[authID]
+	if !ok {
+		return "", &repository.DBServiceError{Msg: "authorisation record not found", NotFound: true}
+	}
+
+	if err := core.NewPaymentStateMachine(authRecord.auth).CheckTransaction(transaction); err != nil {
+		return "", repository.StateMachineError(err)
+	}
+
+	r.lastTransID++
+	transaction.ID = strconv.FormatUint(r.lastTransID, 10)
+	transaction.Status = entities.TransactionPending
+	transaction.AuthorisationID = authID
+	transaction.CreatedAt = time.Now()
+	if transaction.Type == entities.TransactionVoid {
+		transaction.Amount.MinorUnits = 0
+	}
+	authRecord.auth.Transaction = append(authRecord.auth.Transaction, transaction)
+
+	return transaction.ID, nil
+}
+
+func (r *Repository) CompleteTransaction(ctx context.Context, authID string, transID string, success bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authRecord, ok := r.authorisations[authID]
+	if !ok {
+		return &repository.DBServiceError{Msg: "authorisation record not found", NotFound: true}
+	}
+
+	for i, transItem := range authRecord.auth.Transaction {
+		if transItem.ID != transID {
+			continue
+		}
+
+		if transItem.Status != entities.TransactionPending {
+			return &repository.DBServiceError{Msg: fmt.Sprintf("transaction already '%s'", transItem.Status),
+				ValidationFail: true}
+		}
+
+		if !success {
+			authRecord.auth.Transaction[i].Status = entities.TransactionFailed
+			return nil
+		}
+
+		nextState, err := core.NewPaymentStateMachine(authRecord.auth).CompletedState(transItem)
+		if err != nil {
+			return repository.StateMachineError(err)
+		}
+
+		authRecord.auth.Transaction[i].Status = entities.TransactionCompleted
+		authRecord.auth.State = nextState
+		return nil
+	}
+
+	return &repository.DBServiceError{Msg: "transaction record not found", NotFound: true}
+}
+
+func (r *Repository) UpdateAuthorisationState(ctx context.Context, authID string, state entities.PaymentState) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authRecord, ok := r.authorisations[authID]
+	if !ok {
+		return &repository.DBServiceError{Msg: "authorisation record not found", NotFound: true}
+	}
+
+	if err := core.NewPaymentStateMachine(authRecord.auth).Transition(state); err != nil {
+		return repository.StateMachineError(err)
+	}
+
+	authRecord.auth.State = state
+	return nil
+}
+
+func (r *Repository) GetAuthorisationsByState(ctx context.Context, state entities.PaymentState,
+	createdBefore time.Time) ([]entities.Authorisation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authList := []entities.Authorisation{}
+	for _, authID := range r.authOrder {
+		auth := r.authorisations[authID].auth
+		if auth.State == state && auth.CreatedAt.Before(createdBefore) {
+			authList = append(authList, entities.Authorisation{
+				ID:           auth.ID,
+				State:        auth.State,
+				Amount:       auth.Amount,
+				MerchantName: auth.MerchantName,
+				CreatedAt:    auth.CreatedAt,
+			})
+		}
+	}
+
+	return authList, nil
+}
+
+func (r *Repository) GetAllAuthorisations(ctx context.Context) ([]entities.Authorisation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authList := make([]entities.Authorisation, 0, len(r.authOrder))
+
+	for _, authID := range r.authOrder {
+		auth := r.authorisations[authID].auth
+		authList = append(authList, entities.Authorisation{
+			ID:           auth.ID,
+			State:        auth.State,
+			Amount:       auth.Amount,
+			MerchantName: auth.MerchantName,
+		})
+	}
+
+	return authList, nil
+}
+
+func (r *Repository) GetAuthorisationDetails(ctx context.Context, authID string) (entities.Authorisation, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authRecord, ok := r.authorisations[authID]
+	if !ok {
+		return entities.Authorisation{}, &repository.DBServiceError{Msg: "authorisation record not found", NotFound: true}
+	}
+
+	authItem := authRecord.auth
+	card := r.creditCards[authRecord.cardInstance.Token].card
+	card.Name = authRecord.cardInstance.Name
+	card.ExpiryMonth = authRecord.cardInstance.ExpiryMonth
+	card.ExpiryYear = authRecord.cardInstance.ExpiryYear
+	authItem.CreditCard = &card
+	authItem.Transaction = append([]entities.Transaction{}, authRecord.auth.Transaction...)
+
+	return authItem, nil
+}
+
+func (r *Repository) StartIdempotentRequest(ctx context.Context, merchantName string, key string, requestHash string,
+	staleBefore time.Time) (keyItem entities.IdempotencyKey, created bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := idempotencyKeyID{merchantName: merchantName, key: key}
+	if keyRecord, ok := r.idempotencyKeys[id]; ok {
+		if keyRecord.keyItem.Completed || keyRecord.keyItem.RequestHash != requestHash ||
+			!keyRecord.startedAt.Before(staleBefore) {
+			return keyRecord.keyItem, false, nil
+		}
+
+		keyRecord.startedAt = time.Now()
+		return keyRecord.keyItem, true, nil
+	}
+
+	keyItem = entities.IdempotencyKey{Key: key, MerchantName: merchantName, RequestHash: requestHash}
+	r.idempotencyKeys[id] = &idempotencyKeyRecord{keyItem: keyItem, startedAt: time.Now()}
+
+	return keyItem, true, nil
+}
+
+func (r *Repository) CompleteIdempotentRequest(ctx context.Context, merchantName string, key string, statusCode int,
+	responseBody []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keyRecord, ok := r.idempotencyKeys[idempotencyKeyID{merchantName: merchantName, key: key}]
+	if !ok {
+		return nil
+	}
+
+	keyRecord.keyItem.Completed = true
+	keyRecord.keyItem.StatusCode = statusCode
+	keyRecord.keyItem.ResponseBody = append([]byte{}, responseBody...)
+
+	return nil
+}
+
+func (r *Repository) ReleaseIdempotentRequest(ctx context.Context, merchantName string, key string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	id := idempotencyKeyID{merchantName: merchantName, key: key}
+	if keyRecord, ok := r.idempotencyKeys[id]; ok && !keyRecord.keyItem.Completed {
+		delete(r.idempotencyKeys, id)
+	}
+
+	return nil
+}
+
+func (r *Repository) RecordTransactionAttempt(ctx context.Context, authID string, transID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	authRecord, ok := r.authorisations[authID]
+	if !ok {
+		return &repository.DBServiceError{Msg: "authorisation record not found", NotFound: true}
+	}
+
+	for i, transItem := range authRecord.auth.Transaction {
+		if transItem.ID == transID {
+			authRecord.auth.Transaction[i].Attempts++
+			return nil
+		}
+	}
+
+	return &repository.DBServiceError{Msg: "transaction record not found", NotFound: true}
+}
+
+func (r *Repository) GetPendingTransactions(ctx context.Context, createdBefore time.Time) ([]entities.Transaction, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	transactionsList := []entities.Transaction{}
+	for _, authID := range r.authOrder {
+		for _, transItem := range r.authorisations[authID].auth.Transaction {
+			if transItem.Status == entities.TransactionPending && transItem.CreatedAt.Before(createdBefore) {
+				transactionsList = append(transactionsList, transItem)
+			}
+		}
+	}
+
+	// Oldest first
+	sort.SliceStable(transactionsList, func(i, j int) bool {
+		return transactionsList[i].CreatedAt.Before(transactionsList[j].CreatedAt)
+	})
+
+	return transactionsList, nil
+}
+
+func (r *Repository) JournalAuthorisation(ctx context.Context, entry entities.AuthorisationJournalEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.currencies[entry.Amount.Currency] {
+		return &repository.DBServiceError{Msg: "currency provided not supported", ValidationFail: true}
+	}
+
+	if _, ok := r.journal[entry.Reference]; ok {
+		return &repository.DBServiceError{Msg: "database error", Err: fmt.Errorf("duplicate journal reference")}
+	}
+
+	if _, ok := r.creditCards[entry.CreditCardToken]; !ok {
+		return &repository.DBServiceError{Msg: "database error", Err: fmt.Errorf("credit card token not found")}
+	}
+
+	entry.Status = entities.JournalPending
+	entry.AuthorisationID = ""
+	entry.Attempts = 0
+	entry.CreatedAt = time.Now()
+	r.journal[entry.Reference] = &entry
+	r.journalOrder = append(r.journalOrder, entry.Reference)
+
+	return nil
+}
+
+func (r *Repository) FailAuthorisationJournalEntry(ctx context.Context, reference string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.journal[reference]; ok {
+		entry.Status = entities.JournalFailed
+	}
+
+	return nil
+}
+
+func (r *Repository) StartCompensation(ctx context.Context, reference string, authID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.journal[reference]; ok {
+		entry.Status = entities.JournalCompensating
+		entry.AuthorisationID = authID
+	}
+
+	return nil
+}
+
+func (r *Repository) CompleteCompensation(ctx context.Context, reference string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.journal[reference]; ok {
+		entry.Status = entities.JournalVoided
+	}
+
+	return nil
+}
+
+func (r *Repository) GetAuthorisationJournal(ctx context.Context, status entities.JournalStatus,
+	createdBefore time.Time) ([]entities.AuthorisationJournalEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := []entities.AuthorisationJournalEntry{}
+	for _, reference := range r.journalOrder {
+		entry := r.journal[reference]
+		if entry.Status == status && entry.CreatedAt.Before(createdBefore) {
+			entries = append(entries, *entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func (r *Repository) RecordAuthorisationJournalAttempt(ctx context.Context, reference string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if entry, ok := r.journal[reference]; ok {
+		entry.Attempts++
+	}
+
+	return nil
+}
+
+func (r *Repository) AddAPIKey(ctx context.Context, key entities.APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.apiKeys[key.ID]; ok {
+		return &repository.DBServiceError{Msg: "database error", Err: fmt.Errorf("duplicate api key ID")}
+	}
+
+	if key.CreatedAt.IsZero() {
+		key.CreatedAt = time.Now()
+	}
+	key.EncryptedSecret = append([]byte{}, key.EncryptedSecret...)
+	key.EncryptedKey = append([]byte{}, key.EncryptedKey...)
+	r.apiKeys[key.ID] = key
+	r.apiKeyOrder = append(r.apiKeyOrder, key.ID)
+
+	return nil
+}
+
+func (r *Repository) GetAPIKey(ctx context.Context, keyID string) (entities.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.apiKeys[keyID]
+	if !ok {
+		return entities.APIKey{}, &repository.DBServiceError{Msg: "api key not found", NotFound: true}
+	}
+
+	return key, nil
+}
+
+func (r *Repository) GetAPIKeys(ctx context.Context, merchantName string) ([]entities.APIKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := []entities.APIKey{}
+	for _, keyID := range r.apiKeyOrder {
+		if key := r.apiKeys[keyID]; key.MerchantName == merchantName {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+func (r *Repository) RevokeAPIKey(ctx context.Context, keyID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, ok := r.apiKeys[keyID]
+	if !ok {
+		return &repository.DBServiceError{Msg: "api key not found", NotFound: true}
+	}
+
+	if !key.Revoked() {
+		now := time.Now()
+		key.RevokedAt = &now
+		r.apiKeys[keyID] = key
+	}
+
+	return nil
+}
+
+func (r *Repository) RecordAPIKeyNonce(ctx context.Context, keyID string, nonce string,
+	expiredBefore time.Time) (fresh bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nonces, ok := r.apiKeyNonces[keyID]
+	if !ok {
+		nonces = make(map[string]time.Time)
+		r.apiKeyNonces[keyID] = nonces
+	}
+
+	for n, createdAt := range nonces {
+		if createdAt.Before(expiredBefore) {
+			delete(nonces, n)
+		}
+	}
+
+	if _, ok := nonces[nonce]; ok {
+		return false, nil
+	}
+
+	nonces[nonce] = time.Now()
+	return true, nil
+}
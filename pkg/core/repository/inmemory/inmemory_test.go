@@ -0,0 +1,13 @@
+package inmemory_test
+
+import (
+	"testing"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/inmemory"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/repotest"
+)
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) core.Repository { return inmemory.NewRepository("EUR") })
+}
@@ -0,0 +1,437 @@
+// Package migrations creates and upgrades the schema of the database, with versioned SQL migrations compiled into the
+// binary.
+//
+// Each database driver has its own migrations, in the sql/<driver> directory, which must all describe the same schema.
+// Each migration is a pair of files named <version>_<name>.up.sql and <version>_<name>.down.sql, where version is a
+// positive number. Migrations are applied in version order, and the versions applied are recorded in the
+// schema_migrations table.
+//
+// MySQL commits schema changes implicitly, so migrations never run in a transaction, whatever the driver. A migration
+// is recorded as dirty while it runs, and if it fails halfway, no other migration runs until the database is fixed by
+// hand and the migration is forced with Force.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+)
+
+//go:embed sql
+var files embed.FS
+
+// fileNameRegexp matches migration file names, e.g. 0001_create_schema.up.sql.
+var fileNameRegexp = regexp.MustCompile(`^(\d+)_([a-z0-9_]+)\.(up|down)\.sql$`)
+
+// ErrDirty is returned when a migration failed halfway, leaving the schema in an unknown state.
+var ErrDirty = errors.New("a migration failed halfway and must be fixed by hand")
+
+// Migration is a versioned change to the schema.
+type Migration struct {
+	Version uint64
+	Name    string
+	// Up applies the migration, and Down reverts it
+	Up   string
+	Down string
+}
+
+// Status is the status of a migration in a database.
+type Status struct {
+	Migration
+	Applied bool
+	// Dirty means the migration failed halfway
+	Dirty     bool
+	AppliedAt time.Time
+}
+
+// Load returns the migrations of the database driver compiled into the binary, in version order.
+func Load(driver string) ([]Migration, error) {
+	if _, err := fs.Stat(files, path.Join("sql", driver)); err != nil {
+		return nil, fmt.Errorf("no migrations for database driver '%s'", driver)
+	}
+
+	sqlFiles, err := fs.Sub(files, path.Join("sql", driver))
+	if err != nil {
+		return nil, err
+	}
+	return Parse(sqlFiles)
+}
+
+// Parse returns the migrations found at the root of fsys, in version order.
+// Every migration must have both an up and a down file.
+func Parse(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[uint64]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		match := fileNameRegexp.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("migration file name '%s' not allowed", entry.Name())
+		}
+
+		version, err := strconv.ParseUint(match[1], 10, 64)
+		if err != nil || version == 0 {
+			return nil, fmt.Errorf("migration file name '%s' has an invalid version", entry.Name())
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = migration
+		} else if migration.Name != match[2] {
+			return nil, fmt.Errorf("migration version %d used by '%s' and '%s'", version, migration.Name, match[2])
+		}
+
+		content, err := fs.ReadFile(fsys, path.Clean(entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		if match[3] == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down file", migration.Version,
+				migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// SplitStatements splits a migration script into its statements, which must end with a semicolon at the end of a
+// line. Comment lines are kept within the statements, but chunks made only of comments are dropped.
+func SplitStatements(script string) []string {
+	statements := []string{}
+	var current strings.Builder
+
+	flush := func() {
+		statement := strings.TrimSpace(current.String())
+		current.Reset()
+		if hasCode(statement) {
+			statements = append(statements, strings.TrimSuffix(statement, ";"))
+		}
+	}
+
+	for _, line := range strings.Split(script, "\n") {
+		current.WriteString(line)
+		current.WriteString("\n")
+		if strings.HasSuffix(strings.TrimSpace(line), ";") {
+			flush()
+		}
+	}
+	flush()
+
+	return statements
+}
+
+// hasCode returns true if the SQL has anything but blank lines and comments.
+func hasCode(sqlText string) bool {
+	for _, line := range strings.Split(sqlText, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "--") {
+			return true
+		}
+	}
+	return false
+}
+
+// Migrator applies and reverts migrations on a database.
+type Migrator struct {
+	DB         *sql.DB
+	Driver     string
+	Migrations []Migration
+}
+
+// NewMigrator returns a migrator of the database, with the migrations of its driver compiled into the binary.
+func NewMigrator(db *sql.DB, driver string) (*Migrator, error) {
+	migrations, err := Load(driver)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{DB: db, Driver: driver, Migrations: migrations}, nil
+}
+
+// Up applies all the migrations not applied yet, returning the ones applied.
+func (m *Migrator) Up(ctx context.Context) (applied []Migration, err error) {
+	records, err := m.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.checkRecords(records); err != nil {
+		return nil, err
+	}
+
+	for _, migration := range m.Migrations {
+		if _, ok := records[migration.Version]; ok {
+			continue
+		}
+
+		if err := m.run(ctx, migration, true); err != nil {
+			return applied, err
+		}
+		applied = append(applied, migration)
+	}
+
+	return applied, nil
+}
+
+// Down reverts the given number of migrations, latest first, returning the ones reverted.
+func (m *Migrator) Down(ctx context.Context, steps int) (reverted []Migration, err error) {
+	records, err := m.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m.checkRecords(records); err != nil {
+		return nil, err
+	}
+
+	for i := len(m.Migrations) - 1; i >= 0 && len(reverted) < steps; i-- {
+		migration := m.Migrations[i]
+		if _, ok := records[migration.Version]; !ok {
+			continue
+		}
+
+		if err := m.run(ctx, migration, false); err != nil {
+			return reverted, err
+		}
+		reverted = append(reverted, migration)
+	}
+
+	return reverted, nil
+}
+
+// Status returns the status of every migration, in version order.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	records, err := m.records(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]Status, 0, len(m.Migrations))
+	for _, migration := range m.Migrations {
+		status := Status{Migration: migration}
+		if record, ok := records[migration.Version]; ok {
+			status.Applied = true
+			status.Dirty = record.dirty
+			status.AppliedAt = record.appliedAt
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+// Pending returns the number of migrations not applied yet.
+func (m *Migrator) Pending(ctx context.Context) (int, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	pending := 0
+	for _, status := range statuses {
+		if !status.Applied || status.Dirty {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// Force records the migrations up to the given version as applied, and the ones after it as not applied, without
+// running them.
+// It is meant for databases created before migrations existed, and to recover from a migration failing halfway once
+// the database has been fixed by hand.
+func (m *Migrator) Force(ctx context.Context, version uint64) error {
+	if version != 0 && m.migration(version) == nil {
+		return fmt.Errorf("migration %d not found", version)
+	}
+
+	if err := m.createTable(ctx); err != nil {
+		return err
+	}
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations"); err != nil {
+		return err
+	}
+
+	for _, migration := range m.Migrations {
+		if migration.Version > version {
+			break
+		}
+		_, err := tx.ExecContext(ctx,
+			m.rebind("INSERT INTO schema_migrations (version, name, dirty, applied_at) VALUES (?, ?, ?, ?)"),
+			migration.Version, migration.Name, false, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// run applies (up) or reverts (down) a migration, keeping it dirty while its statements run.
+func (m *Migrator) run(ctx context.Context, migration Migration, up bool) error {
+	script := migration.Down
+	if up {
+		script = migration.Up
+		_, err := m.DB.ExecContext(ctx,
+			m.rebind("INSERT INTO schema_migrations (version, name, dirty, applied_at) VALUES (?, ?, ?, ?)"),
+			migration.Version, migration.Name, true, time.Now().UTC())
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	} else {
+		_, err := m.DB.ExecContext(ctx, m.rebind("UPDATE schema_migrations SET dirty = ? WHERE version = ?"), true,
+			migration.Version)
+		if err != nil {
+			return fmt.Errorf("failed to record migration %d_%s: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	for _, statement := range SplitStatements(script) {
+		if _, err := m.DB.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %w", migration.Version, migration.Name, err)
+		}
+	}
+
+	var err error
+	if up {
+		_, err = m.DB.ExecContext(ctx, m.rebind("UPDATE schema_migrations SET dirty = ?, applied_at = ? WHERE version = ?"),
+			false, time.Now().UTC(), migration.Version)
+	} else {
+		_, err = m.DB.ExecContext(ctx, m.rebind("DELETE FROM schema_migrations WHERE version = ?"), migration.Version)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d_%s: %w", migration.Version, migration.Name, err)
+	}
+
+	return nil
+}
+
+// record is a row of the schema_migrations table.
+type record struct {
+	dirty     bool
+	appliedAt time.Time
+}
+
+// records returns the migrations recorded in the database, by version.
+func (m *Migrator) records(ctx context.Context) (map[uint64]record, error) {
+	if err := m.createTable(ctx); err != nil {
+		return nil, err
+	}
+
+	rows, err := m.DB.QueryContext(ctx, "SELECT version, dirty, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := map[uint64]record{}
+	for rows.Next() {
+		var version uint64
+		var rec record
+		if err := rows.Scan(&version, &rec.dirty, &rec.appliedAt); err != nil {
+			return nil, err
+		}
+		records[version] = rec
+	}
+
+	return records, rows.Err()
+}
+
+// checkRecords checks no migration is dirty, and the database was not migrated by a newer version of the gateway.
+func (m *Migrator) checkRecords(records map[uint64]record) error {
+	for version, rec := range records {
+		if rec.dirty {
+			return fmt.Errorf("migration %d: %w", version, ErrDirty)
+		}
+		if m.migration(version) == nil {
+			return fmt.Errorf("database has migration %d, which is unknown to this version of the gateway", version)
+		}
+	}
+	return nil
+}
+
+// migration returns the migration with the given version, or nil if there is none.
+func (m *Migrator) migration(version uint64) *Migration {
+	for i := range m.Migrations {
+		if m.Migrations[i].Version == version {
+			return &m.Migrations[i]
+		}
+	}
+	return nil
+}
+
+// rebind replaces the ? placeholders of the query with the ones of the driver.
+func (m *Migrator) rebind(query string) string {
+	if m.Driver != core.DriverPostgres {
+		return query
+	}
+
+	var rebound strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+// createTable creates the schema_migrations table, if it does not exist yet.
+func (m *Migrator) createTable(ctx context.Context) error {
+	versionType, timeType := "bigint unsigned", "datetime(3)"
+	switch m.Driver {
+	case core.DriverPostgres:
+		versionType, timeType = "bigint", "timestamptz"
+	case core.DriverSQLite:
+		versionType, timeType = "integer", "datetime"
+	}
+
+	_, err := m.DB.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version `+versionType+` NOT NULL,
+		name varchar(255) NOT NULL,
+		dirty boolean NOT NULL,
+		applied_at `+timeType+` NOT NULL,
+		PRIMARY KEY (version)
+	)`)
+	return err
+}
@@ -0,0 +1,121 @@
+package migrations_test
+
+import (
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/migrations"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoad(t *testing.T) {
+	drivers := []string{core.DriverMySQL, core.DriverPostgres, core.DriverSQLite}
+
+	loaded := map[string][]migrations.Migration{}
+	for _, driver := range drivers {
+		t.Run(driver, func(t *testing.T) {
+			driverMigrations, err := migrations.Load(driver)
+			require.NoError(t, err)
+			require.NotEmpty(t, driverMigrations)
+			loaded[driver] = driverMigrations
+
+			// Versions are contiguous, so a missing migration is never silently skipped
+			for i, migration := range driverMigrations {
+				assert.Equal(t, uint64(i+1), migration.Version)
+				assert.NotEmpty(t, migrations.SplitStatements(migration.Up), "migration %d up", migration.Version)
+				assert.NotEmpty(t, migrations.SplitStatements(migration.Down), "migration %d down", migration.Version)
+			}
+		})
+	}
+
+	// Every driver has the same migrations, so the schema versions mean the same whatever the database
+	for _, driver := range drivers[1:] {
+		require.Equal(t, len(loaded[drivers[0]]), len(loaded[driver]), driver)
+		for i, migration := range loaded[driver] {
+			assert.Equal(t, loaded[drivers[0]][i].Name, migration.Name, driver)
+		}
+	}
+
+	_, err := migrations.Load("oracle")
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	file := func(content string) *fstest.MapFile { return &fstest.MapFile{Data: []byte(content)} }
+
+	tests := map[string]struct {
+		fsys             fstest.MapFS
+		expectedVersions []uint64
+		expectedErr      string
+	}{
+		"sorted by version": {fsys: fstest.MapFS{
+			"0010_second.up.sql":   file("UP 10;"),
+			"0010_second.down.sql": file("DOWN 10;"),
+			"0002_first.up.sql":    file("UP 2;"),
+			"0002_first.down.sql":  file("DOWN 2;"),
+		}, expectedVersions: []uint64{2, 10}},
+		"missing down": {fsys: fstest.MapFS{
+			"0001_first.up.sql": file("UP 1;"),
+		}, expectedErr: "must have both an up and a down file"},
+		"duplicate version": {fsys: fstest.MapFS{
+			"0001_first.up.sql":   file("UP 1;"),
+			"0001_first.down.sql": file("DOWN 1;"),
+			"0001_other.up.sql":   file("UP 1;"),
+			"0001_other.down.sql": file("DOWN 1;"),
+		}, expectedErr: "migration version 1 used by"},
+		"version zero": {fsys: fstest.MapFS{
+			"0000_first.up.sql":   file("UP 0;"),
+			"0000_first.down.sql": file("DOWN 0;"),
+		}, expectedErr: "invalid version"},
+		"bad file name": {fsys: fstest.MapFS{
+			"first.sql": file("UP;"),
+		}, expectedErr: "not allowed"},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := migrations.Parse(test.fsys)
+			if test.expectedErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), test.expectedErr)
+				return
+			}
+			require.NoError(t, err)
+
+			versions := []uint64{}
+			for _, migration := range parsed {
+				versions = append(versions, migration.Version)
+				assert.True(t, strings.HasPrefix(migration.Up, "UP"))
+				assert.True(t, strings.HasPrefix(migration.Down, "DOWN"))
+			}
+			assert.Equal(t, test.expectedVersions, versions)
+		})
+	}
+}
+
+func TestSplitStatements(t *testing.T) {
+	tests := map[string]struct {
+		script             string
+		expectedStatements []string
+	}{
+		"empty":         {script: "", expectedStatements: []string{}},
+		"comments only": {script: "-- nothing to do\n\n-- really\n", expectedStatements: []string{}},
+		"multi-line statements": {
+			script: "-- states\nCREATE TABLE a (\n  id int\n);\n\nINSERT INTO a VALUES\n  (1), (2);\n",
+			expectedStatements: []string{"-- states\nCREATE TABLE a (\n  id int\n)",
+				"INSERT INTO a VALUES\n  (1), (2)"}},
+		"semicolon within a line": {script: "INSERT INTO a VALUES ('x;y');\n",
+			expectedStatements: []string{"INSERT INTO a VALUES ('x;y')"}},
+		"no final semicolon": {script: "DROP TABLE a;\nDROP TABLE b",
+			expectedStatements: []string{"DROP TABLE a", "DROP TABLE b"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, test.expectedStatements, migrations.SplitStatements(test.script))
+		})
+	}
+}
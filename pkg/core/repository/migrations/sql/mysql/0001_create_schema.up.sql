@@ -0,0 +1,102 @@
+-- Tables of the payment gateway, as described by the models of the repository package.
+
+CREATE TABLE `states` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(20) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_states_name` (`name`)
+);
+
+CREATE TABLE `currencies` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `name` varchar(20) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_currencies_name` (`name`)
+);
+
+CREATE TABLE `credit_cards` (
+  `token` varchar(50) NOT NULL,
+  `merchant_name` varchar(50) NOT NULL,
+  `fingerprint` varchar(64) NOT NULL,
+  `encrypted_number` varbinary(128) NOT NULL,
+  `encrypted_key` varbinary(128) NOT NULL,
+  `bin` varchar(6) NOT NULL,
+  `last_four` varchar(4) NOT NULL,
+  `brand` varchar(20) NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `expiry_month` bigint unsigned NOT NULL,
+  `expiry_year` bigint unsigned NOT NULL,
+  PRIMARY KEY (`token`),
+  UNIQUE KEY `idx_credit_card_fingerprint` (`merchant_name`, `fingerprint`)
+);
+
+CREATE TABLE `card_instances` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `credit_card_token` varchar(50) NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `expiry_month` bigint unsigned NOT NULL,
+  `expiry_year` bigint unsigned NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_card_instances_credit_card_token` (`credit_card_token`),
+  CONSTRAINT `fk_credit_cards_card_instances` FOREIGN KEY (`credit_card_token`) REFERENCES `credit_cards` (`token`)
+);
+
+CREATE TABLE `authorisations` (
+  `id` varchar(50) NOT NULL,
+  `state_id` bigint unsigned NOT NULL,
+  `currency_id` bigint unsigned NOT NULL,
+  `amount` bigint NOT NULL,
+  `merchant_name` varchar(50) NOT NULL,
+  `card_instance_id` bigint unsigned NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_authorisations_merchant_name` (`merchant_name`),
+  KEY `idx_authorisation_state` (`state_id`, `created_at`),
+  CONSTRAINT `fk_authorisations_state` FOREIGN KEY (`state_id`) REFERENCES `states` (`id`),
+  CONSTRAINT `fk_authorisations_currency` FOREIGN KEY (`currency_id`) REFERENCES `currencies` (`id`),
+  CONSTRAINT `fk_authorisations_card_instance` FOREIGN KEY (`card_instance_id`) REFERENCES `card_instances` (`id`)
+);
+
+CREATE TABLE `transactions` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `type` varchar(20) NOT NULL,
+  `status` varchar(20) NOT NULL,
+  `amount` bigint NOT NULL,
+  `authorisation_id` varchar(50) NOT NULL,
+  `attempts` bigint NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_transaction_status` (`status`, `created_at`),
+  CONSTRAINT `fk_authorisations_transactions` FOREIGN KEY (`authorisation_id`) REFERENCES `authorisations` (`id`)
+);
+
+CREATE TABLE `authorisation_journals` (
+  `reference` varchar(50) NOT NULL,
+  `merchant_name` varchar(50) NOT NULL,
+  `currency_id` bigint unsigned NOT NULL,
+  `amount` bigint NOT NULL,
+  `credit_card_token` varchar(50) NOT NULL,
+  `status` varchar(20) NOT NULL,
+  `authorisation_id` varchar(50) DEFAULT NULL,
+  `attempts` bigint NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`reference`),
+  KEY `idx_authorisation_journal_status` (`status`, `created_at`),
+  CONSTRAINT `fk_authorisation_journals_currency` FOREIGN KEY (`currency_id`) REFERENCES `currencies` (`id`),
+  CONSTRAINT `fk_authorisation_journals_credit_card` FOREIGN KEY (`credit_card_token`)
+    REFERENCES `credit_cards` (`token`)
+);
+
+CREATE TABLE `idempotency_keys` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `merchant_name` varchar(50) NOT NULL,
+  `key` varchar(255) NOT NULL,
+  `request_hash` varchar(64) NOT NULL,
+  `completed` boolean NOT NULL,
+  `status_code` bigint NOT NULL,
+  `response_body` blob,
+  `created_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `idx_idempotency_merchant_key` (`merchant_name`, `key`)
+);
@@ -0,0 +1,2 @@
+DELETE FROM `currencies`;
+DELETE FROM `states`;
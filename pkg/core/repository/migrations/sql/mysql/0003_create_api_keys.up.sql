@@ -0,0 +1,21 @@
+-- Merchants' API keys, and the nonces of the signed requests recently received with them (replay protection).
+
+CREATE TABLE `api_keys` (
+  `id` varchar(50) NOT NULL,
+  `merchant_name` varchar(50) NOT NULL,
+  `encrypted_secret` varbinary(128) NOT NULL,
+  `encrypted_key` varbinary(128) NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  `revoked_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_api_key_merchant` (`merchant_name`)
+);
+
+CREATE TABLE `api_key_nonces` (
+  `api_key_id` varchar(50) NOT NULL,
+  `nonce` varchar(64) NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  PRIMARY KEY (`api_key_id`, `nonce`),
+  KEY `idx_api_key_nonce_created_at` (`api_key_id`, `created_at`),
+  CONSTRAINT `fk_api_key_nonces_api_key` FOREIGN KEY (`api_key_id`) REFERENCES `api_keys` (`id`)
+);
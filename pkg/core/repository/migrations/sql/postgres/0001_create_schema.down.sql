@@ -0,0 +1,8 @@
+DROP TABLE idempotency_keys;
+DROP TABLE authorisation_journals;
+DROP TABLE transactions;
+DROP TABLE authorisations;
+DROP TABLE card_instances;
+DROP TABLE credit_cards;
+DROP TABLE currencies;
+DROP TABLE states;
@@ -0,0 +1,21 @@
+-- Merchants' API keys, and the nonces of the signed requests recently received with them (replay protection).
+
+CREATE TABLE api_keys (
+  id varchar(50) PRIMARY KEY,
+  merchant_name varchar(50) NOT NULL,
+  encrypted_secret bytea NOT NULL,
+  encrypted_key bytea NOT NULL,
+  created_at timestamptz NOT NULL,
+  revoked_at timestamptz
+);
+
+CREATE INDEX idx_api_key_merchant ON api_keys (merchant_name);
+
+CREATE TABLE api_key_nonces (
+  api_key_id varchar(50) NOT NULL REFERENCES api_keys (id),
+  nonce varchar(64) NOT NULL,
+  created_at timestamptz NOT NULL,
+  PRIMARY KEY (api_key_id, nonce)
+);
+
+CREATE INDEX idx_api_key_nonce_created_at ON api_key_nonces (api_key_id, created_at);
@@ -0,0 +1,91 @@
+-- Tables of the payment gateway, as described by the models of the repository package.
+
+CREATE TABLE states (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(20) NOT NULL,
+  CONSTRAINT idx_states_name UNIQUE (name)
+);
+
+CREATE TABLE currencies (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  name varchar(20) NOT NULL,
+  CONSTRAINT idx_currencies_name UNIQUE (name)
+);
+
+CREATE TABLE credit_cards (
+  token varchar(50) PRIMARY KEY,
+  merchant_name varchar(50) NOT NULL,
+  fingerprint varchar(64) NOT NULL,
+  encrypted_number blob NOT NULL,
+  encrypted_key blob NOT NULL,
+  bin varchar(6) NOT NULL,
+  last_four varchar(4) NOT NULL,
+  brand varchar(20) NOT NULL,
+  name varchar(50) NOT NULL,
+  expiry_month integer NOT NULL,
+  expiry_year integer NOT NULL,
+  CONSTRAINT idx_credit_card_fingerprint UNIQUE (merchant_name, fingerprint)
+);
+
+CREATE TABLE card_instances (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  credit_card_token varchar(50) NOT NULL REFERENCES credit_cards (token),
+  name varchar(50) NOT NULL,
+  expiry_month integer NOT NULL,
+  expiry_year integer NOT NULL,
+  created_at datetime NOT NULL
+);
+
+CREATE INDEX idx_card_instances_credit_card_token ON card_instances (credit_card_token);
+
+CREATE TABLE authorisations (
+  id varchar(50) PRIMARY KEY,
+  state_id integer NOT NULL REFERENCES states (id),
+  currency_id integer NOT NULL REFERENCES currencies (id),
+  amount integer NOT NULL,
+  merchant_name varchar(50) NOT NULL,
+  card_instance_id integer NOT NULL REFERENCES card_instances (id),
+  created_at datetime NOT NULL
+);
+
+CREATE INDEX idx_authorisations_merchant_name ON authorisations (merchant_name);
+CREATE INDEX idx_authorisation_state ON authorisations (state_id, created_at);
+
+CREATE TABLE transactions (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  type varchar(20) NOT NULL,
+  status varchar(20) NOT NULL,
+  amount integer NOT NULL,
+  authorisation_id varchar(50) NOT NULL REFERENCES authorisations (id),
+  attempts integer NOT NULL,
+  created_at datetime NOT NULL
+);
+
+CREATE INDEX idx_transaction_status ON transactions (status, created_at);
+CREATE INDEX idx_transactions_authorisation_id ON transactions (authorisation_id);
+
+CREATE TABLE authorisation_journals (
+  reference varchar(50) PRIMARY KEY,
+  merchant_name varchar(50) NOT NULL,
+  currency_id integer NOT NULL REFERENCES currencies (id),
+  amount integer NOT NULL,
+  credit_card_token varchar(50) NOT NULL REFERENCES credit_cards (token),
+  status varchar(20) NOT NULL,
+  authorisation_id varchar(50),
+  attempts integer NOT NULL,
+  created_at datetime NOT NULL
+);
+
+CREATE INDEX idx_authorisation_journal_status ON authorisation_journals (status, created_at);
+
+CREATE TABLE idempotency_keys (
+  id integer PRIMARY KEY AUTOINCREMENT,
+  merchant_name varchar(50) NOT NULL,
+  "key" varchar(255) NOT NULL,
+  request_hash varchar(64) NOT NULL,
+  completed boolean NOT NULL,
+  status_code integer NOT NULL,
+  response_body blob,
+  created_at datetime NOT NULL,
+  CONSTRAINT idx_idempotency_merchant_key UNIQUE (merchant_name, "key")
+);
@@ -1,10 +1,20 @@
 package repository
 
 import (
+	"context"
+	"database/sql"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"gorm.io/gorm/logger"
 )
 
@@ -12,12 +22,15 @@ type Database struct {
 	conn *gorm.DB
 }
 
-func NewDatabase(host string, port int, username string, password string, dbname string) (*Database, error) {
-	dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
-		username, password, host, port, dbname)
+// NewDatabase opens the database with the configured driver.
+func NewDatabase(config core.DatabaseConfiguration) (*Database, error) {
+	dialector, err := Dialector(config)
+	if err != nil {
+		return nil, err
+	}
 
-	// dbconn, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
-	dbconn, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	// dbconn, err := gorm.Open(dialector, &gorm.Config{})
+	dbconn, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
 	if err != nil {
 		return nil, err
 	}
@@ -33,6 +46,36 @@ func NewDatabase(host string, port int, username string, password string, dbname
 	return &db, nil
 }
 
+// Dialector returns the gorm dialector of the configured driver, with its data source name.
+func Dialector(config core.DatabaseConfiguration) (gorm.Dialector, error) {
+	switch config.Driver {
+	case core.DriverMySQL:
+		dsn := fmt.Sprintf("%s:%s@tcp(%s:%d)/%s?charset=utf8mb4&parseTime=True&loc=Local",
+			config.Username, config.Password, config.Host, config.Port, config.DBName)
+		return mysql.Open(dsn), nil
+
+	case core.DriverPostgres:
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(config.Username, config.Password),
+			Host:     net.JoinHostPort(config.Host, strconv.Itoa(config.Port)),
+			Path:     "/" + config.DBName,
+			RawQuery: url.Values{"sslmode": []string{config.SSLMode}}.Encode(),
+		}
+		return postgres.Open(dsn.String()), nil
+
+	case core.DriverSQLite:
+		// Foreign keys are off by default in SQLite.
+		// Transactions take the write lock as they begin, so concurrent transactions queue up (for up to the busy
+		// timeout) instead of failing when they try to write.
+		dsn := fmt.Sprintf("file:%s?_foreign_keys=on&_busy_timeout=5000&_txlock=immediate", config.DBName)
+		return sqlite.Open(dsn), nil
+
+	default:
+		return nil, fmt.Errorf("database driver '%s' not supported", config.Driver)
+	}
+}
+
 func (db *Database) Close() error {
 	sqlDB, err := db.conn.DB()
 	if err != nil {
@@ -42,13 +85,23 @@ func (db *Database) Close() error {
 	return sqlDB.Close()
 }
 
-func (db *Database) HealthCheck() error {
+// SQLDB returns the connection pool of the database, e.g. to run migrations.
+func (db *Database) SQLDB() (*sql.DB, error) {
+	return db.conn.DB()
+}
+
+// WithContext returns a Database whose queries are bound to ctx, so they are cancelled along with it.
+func (db *Database) WithContext(ctx context.Context) *Database {
+	return &Database{conn: db.conn.WithContext(ctx)}
+}
+
+func (db *Database) HealthCheck(ctx context.Context) error {
 	sqlDB, err := db.conn.DB()
 	if err != nil {
 		return err
 	}
 
-	err = sqlDB.Ping()
+	err = sqlDB.PingContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -56,6 +109,14 @@ func (db *Database) HealthCheck() error {
 	return nil
 }
 
+// Transaction runs fn inside a database transaction, passing it a Database bound to that transaction.
+// The transaction is committed if fn returns nil and rolled back otherwise.
+func (db *Database) Transaction(fn func(txDB *Database) error) error {
+	return db.conn.Transaction(func(tx *gorm.DB) error {
+		return fn(&Database{conn: tx})
+	})
+}
+
 func (db *Database) GetCurrencyID(currency string) (uint64, error) {
 	var currencyResult Currency
 	result := db.conn.Where(&Currency{Name: currency}).Take(&currencyResult)
@@ -68,15 +129,30 @@ func (db *Database) GetStateID(state string) (uint64, error) {
 	return stateResult.ID, result.Error
 }
 
-func (db *Database) GetCreditCardDetails(number uint64) (CreditCard, error) {
+func (db *Database) GetCreditCardDetails(token string) (CreditCard, error) {
 	var creditcardResult CreditCard
-	result := db.conn.Where(&CreditCard{Number: number}).Take(&creditcardResult)
+	result := db.conn.Where(&CreditCard{Token: token}).Take(&creditcardResult)
+	return creditcardResult, result.Error
+}
+
+func (db *Database) GetCreditCardByFingerprint(merchantName string, fingerprint string) (CreditCard, error) {
+	var creditcardResult CreditCard
+	result := db.conn.Where(&CreditCard{MerchantName: merchantName, Fingerprint: fingerprint}).Take(&creditcardResult)
 	return creditcardResult, result.Error
 }
 
 func (db *Database) GetAuthorisationRecord(authID string) (Authorisation, error) {
 	var authResult Authorisation
-	result := db.conn.Preload("State").Preload("Currency").Where(&Authorisation{ID: authID}).Take(&authResult)
+	result := db.conn.Preload("State").Preload("Currency").Preload("CardInstance").Where(&Authorisation{ID: authID}).Take(&authResult)
+	return authResult, result.Error
+}
+
+// LockAuthorisationRecord gets the authorisation record and locks its row (SELECT ... FOR UPDATE)
+// until the end of the current transaction.
+func (db *Database) LockAuthorisationRecord(authID string) (Authorisation, error) {
+	var authResult Authorisation
+	result := db.conn.Clauses(clause.Locking{Strength: "UPDATE"}).
+		Preload("State").Preload("Currency").Where(&Authorisation{ID: authID}).Take(&authResult)
 	return authResult, result.Error
 }
 
@@ -91,6 +167,13 @@ func (db *Database) FindAllAuthorisationRecords() ([]Authorisation, error) {
 	return authResults, result.Error
 }
 
+func (db *Database) FindAuthorisationRecordsByState(stateID uint64, createdBefore time.Time) ([]Authorisation, error) {
+	var authResults []Authorisation
+	result := db.conn.Preload("State").Preload("Currency").
+		Where("state_id = ? AND created_at < ?", stateID, createdBefore).Order("created_at").Find(&authResults)
+	return authResults, result.Error
+}
+
 func (db *Database) InsertAuthorisationRecord(authRecord Authorisation) error {
 	result := db.conn.Create(&authRecord)
 	return result.Error
@@ -101,13 +184,157 @@ func (db *Database) InsertCreditCardRecord(ccRecord CreditCard) error {
 	return result.Error
 }
 
+// UpdateCreditCardDetails replaces the card holder name and expiry date kept with the card.
+func (db *Database) UpdateCreditCardDetails(token string, name string, expiryMonth uint, expiryYear uint) error {
+	result := db.conn.Model(&CreditCard{Token: token}).
+		Updates(map[string]interface{}{"name": name, "expiry_month": expiryMonth, "expiry_year": expiryYear})
+	return result.Error
+}
+
+func (db *Database) InsertCardInstanceRecord(instanceRecord CardInstance) (uint64, error) {
+	result := db.conn.Create(&instanceRecord)
+	return instanceRecord.ID, result.Error
+}
+
 func (db *Database) FindAllTransactionRecords(authID string) ([]Transaction, error) {
 	var transactionResults []Transaction
 	result := db.conn.Where(&Transaction{AuthorisationID: authID}).Find(&transactionResults)
 	return transactionResults, result.Error
 }
 
-func (db *Database) InsertTransactionRecord(transRecord Transaction) error {
+func (db *Database) GetTransactionRecord(authID string, transID uint64) (Transaction, error) {
+	var transResult Transaction
+	result := db.conn.Where(&Transaction{ID: transID, AuthorisationID: authID}).Take(&transResult)
+	return transResult, result.Error
+}
+
+func (db *Database) InsertTransactionRecord(transRecord Transaction) (uint64, error) {
 	result := db.conn.Create(&transRecord)
+	return transRecord.ID, result.Error
+}
+
+func (db *Database) UpdateTransactionStatus(transID uint64, status string) error {
+	result := db.conn.Model(&Transaction{ID: transID}).Update("status", status)
+	return result.Error
+}
+
+func (db *Database) IncrementTransactionAttempts(transID uint64) error {
+	result := db.conn.Model(&Transaction{ID: transID}).Update("attempts", gorm.Expr("attempts + 1"))
+	return result.Error
+}
+
+func (db *Database) FindPendingTransactionRecords(createdBefore time.Time) ([]Transaction, error) {
+	var transactionResults []Transaction
+	result := db.conn.Where("status = ? AND created_at < ?", "Pending", createdBefore).
+		Order("created_at").Find(&transactionResults)
+	return transactionResults, result.Error
+}
+
+func (db *Database) InsertAuthorisationJournalRecord(journalRecord AuthorisationJournal) error {
+	result := db.conn.Create(&journalRecord)
+	return result.Error
+}
+
+func (db *Database) GetAuthorisationJournalRecord(reference string) (AuthorisationJournal, error) {
+	var journalResult AuthorisationJournal
+	result := db.conn.Preload("Currency").Where(&AuthorisationJournal{Reference: reference}).Take(&journalResult)
+	return journalResult, result.Error
+}
+
+func (db *Database) FindAuthorisationJournalRecords(status string, createdBefore time.Time) (
+	[]AuthorisationJournal, error) {
+	var journalResults []AuthorisationJournal
+	result := db.conn.Preload("Currency").Where("status = ? AND created_at < ?", status, createdBefore).
+		Order("created_at").Find(&journalResults)
+	return journalResults, result.Error
+}
+
+// UpdateAuthorisationJournalStatus updates the status of the entry, and its authorisation ID unless empty.
+func (db *Database) UpdateAuthorisationJournalStatus(reference string, status string, authID string) error {
+	updates := map[string]interface{}{"status": status}
+	if authID != "" {
+		updates["authorisation_id"] = authID
+	}
+	result := db.conn.Model(&AuthorisationJournal{Reference: reference}).Updates(updates)
+	return result.Error
+}
+
+func (db *Database) IncrementAuthorisationJournalAttempts(reference string) error {
+	result := db.conn.Model(&AuthorisationJournal{Reference: reference}).
+		Update("attempts", gorm.Expr("attempts + 1"))
+	return result.Error
+}
+
+func (db *Database) GetIdempotencyKeyRecord(merchantName string, key string) (IdempotencyKey, error) {
+	var keyResult IdempotencyKey
+	result := db.conn.Where(&IdempotencyKey{MerchantName: merchantName, Key: key}).Take(&keyResult)
+	return keyResult, result.Error
+}
+
+func (db *Database) InsertIdempotencyKeyRecord(keyRecord IdempotencyKey) error {
+	result := db.conn.Create(&keyRecord)
+	return result.Error
+}
+
+func (db *Database) UpdateIdempotencyKeyResponse(merchantName string, key string, statusCode int, responseBody []byte) error {
+	result := db.conn.Model(&IdempotencyKey{}).
+		Where(&IdempotencyKey{MerchantName: merchantName, Key: key}).
+		Updates(map[string]interface{}{"completed": true, "status_code": statusCode, "response_body": responseBody})
+	return result.Error
+}
+
+// ClaimStaleIdempotencyKeyRecord restarts the in-progress request made with the key, if it started before
+// staleBefore with the same request hash.
+func (db *Database) ClaimStaleIdempotencyKeyRecord(merchantName string, key string, requestHash string,
+	staleBefore time.Time, now time.Time) (rowsAffected int64, err error) {
+	result := db.conn.Model(&IdempotencyKey{}).
+		Where(&IdempotencyKey{MerchantName: merchantName, Key: key, RequestHash: requestHash}).
+		Where("completed = ? AND created_at < ?", false, staleBefore).
+		Update("created_at", now)
+	return result.RowsAffected, result.Error
+}
+
+func (db *Database) DeleteInProgressIdempotencyKeyRecord(merchantName string, key string) error {
+	result := db.conn.Where(&IdempotencyKey{MerchantName: merchantName, Key: key}).
+		Where("completed = ?", false).
+		Delete(&IdempotencyKey{})
+	return result.Error
+}
+
+func (db *Database) InsertAPIKeyRecord(keyRecord APIKey) error {
+	result := db.conn.Create(&keyRecord)
+	return result.Error
+}
+
+func (db *Database) GetAPIKeyRecord(keyID string) (APIKey, error) {
+	var keyResult APIKey
+	result := db.conn.Where(&APIKey{ID: keyID}).Take(&keyResult)
+	return keyResult, result.Error
+}
+
+func (db *Database) FindAPIKeyRecords(merchantName string) ([]APIKey, error) {
+	var keysResult []APIKey
+	result := db.conn.Where(&APIKey{MerchantName: merchantName}).Order("created_at, id").Find(&keysResult)
+	return keysResult, result.Error
+}
+
+func (db *Database) RevokeAPIKeyRecord(keyID string, revokedAt time.Time) (int64, error) {
+	result := db.conn.Model(&APIKey{}).Where("id = ? AND revoked_at IS NULL", keyID).Update("revoked_at", revokedAt)
+	return result.RowsAffected, result.Error
+}
+
+func (db *Database) GetAPIKeyNonceRecord(keyID string, nonce string) (APIKeyNonce, error) {
+	var nonceResult APIKeyNonce
+	result := db.conn.Where(&APIKeyNonce{APIKeyID: keyID, Nonce: nonce}).Take(&nonceResult)
+	return nonceResult, result.Error
+}
+
+func (db *Database) InsertAPIKeyNonceRecord(nonceRecord APIKeyNonce) error {
+	result := db.conn.Create(&nonceRecord)
+	return result.Error
+}
+
+func (db *Database) DeleteAPIKeyNonceRecords(keyID string, createdBefore time.Time) error {
+	result := db.conn.Where("api_key_id = ? AND created_at < ?", keyID, createdBefore).Delete(&APIKeyNonce{})
 	return result.Error
 }
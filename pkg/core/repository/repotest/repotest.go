@@ -0,0 +1,747 @@
+// Package repotest provides the conformance test suite of core.Repository implementations, so they all behave the
+// same, down to the repository.DBServiceError flags returned.
+package repotest
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the conformance test suite against the repositories returned by newRepository.
+// Every repository returned must be empty and support the EUR currency (but not ZZZ, which is not an ISO 4217 code).
+func Run(t *testing.T, newRepository func(t *testing.T) core.Repository) {
+	tests := map[string]func(t *testing.T, repo core.Repository){
+		"currencies":                testCurrencies,
+		"credit cards":              testCreditCards,
+		"authorisations":            testAuthorisations,
+		"card instances":            testCardInstances,
+		"transactions":              testTransactions,
+		"failed transactions":       testFailedTransactions,
+		"state updates":             testStateUpdates,
+		"authorisations by state":   testAuthorisationsByState,
+		"pending transactions":      testPendingTransactions,
+		"authorisation journal":     testAuthorisationJournal,
+		"idempotent requests":       testIdempotentRequests,
+		"stale idempotent requests": testStaleIdempotentRequests,
+		"concurrent reservations":   testConcurrentReservations,
+		"api keys":                  testAPIKeys,
+		"api key nonces":            testAPIKeyNonces,
+	}
+
+	for name, test := range tests {
+		test := test
+		t.Run(name, func(t *testing.T) {
+			test(t, newRepository(t))
+		})
+	}
+}
+
+// Card returns a tokenised card, as the vault would.
+func Card(token string, fingerprint string) entities.CreditCard {
+	return entities.CreditCard{
+		Token:           token,
+		BIN:             "424242",
+		LastFour:        "4242",
+		Brand:           string(core.BrandVisa),
+		Name:            "John Smith",
+		ExpiryMonth:     9,
+		ExpiryYear:      2030,
+		Fingerprint:     fingerprint,
+		EncryptedNumber: []byte{1, 2, 3},
+		EncryptedKey:    []byte{4, 5, 6},
+	}
+}
+
+func eur(minorUnits int64) money.Money {
+	return money.Money{MinorUnits: minorUnits, Currency: "EUR"}
+}
+
+// requireDBServiceError checks err is a *repository.DBServiceError and returns it.
+func requireDBServiceError(t *testing.T, err error) *repository.DBServiceError {
+	t.Helper()
+
+	var dbErr *repository.DBServiceError
+	require.Error(t, err)
+	require.True(t, errors.As(err, &dbErr), "%T is not a *repository.DBServiceError", err)
+	return dbErr
+}
+
+// addAuthorisation stores an authorisation of the amount, made by merchant1 with a new card.
+func addAuthorisation(t *testing.T, repo core.Repository, authID string, amount money.Money) {
+	t.Helper()
+
+	card, err := repo.SaveCreditCard(context.Background(), "merchant1", Card("tok_"+authID, "fp_"+authID))
+	require.NoError(t, err)
+
+	err = repo.AddAuthorisation(context.Background(), entities.Authorisation{
+		ID:           authID,
+		State:        entities.StateAuthorised,
+		Amount:       amount,
+		MerchantName: "merchant1",
+		CreditCard:   &card,
+	})
+	require.NoError(t, err)
+}
+
+// reserve reserves a transaction of the given type and amount on the authorisation.
+func reserve(ctx context.Context, repo core.Repository, authID string, transactionType entities.TransactionType,
+	amount money.Money) (string, error) {
+	return repo.ReserveTransaction(ctx, authID, entities.Transaction{Type: transactionType, Amount: amount})
+}
+
+func testCurrencies(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+
+	exists, err := repo.CurrencyExists(ctx, "EUR")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, err = repo.CurrencyExists(ctx, "ZZZ")
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	assert.NoError(t, repo.HealthCheck(ctx))
+}
+
+func testCreditCards(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+
+	saved, err := repo.SaveCreditCard(ctx, "merchant1", Card("tok_1", "fp_1"))
+	require.NoError(t, err)
+	assert.Equal(t, Card("tok_1", "fp_1"), saved)
+
+	// The same card tokenised again keeps its token, with the latest details
+	again := Card("tok_2", "fp_1")
+	again.Name = "J Smith"
+	again.ExpiryYear = 2031
+	saved, err = repo.SaveCreditCard(ctx, "merchant1", again)
+	require.NoError(t, err)
+	assert.Equal(t, "tok_1", saved.Token)
+	assert.Equal(t, "J Smith", saved.Name)
+
+	card, err := repo.GetCreditCard(ctx, "merchant1", "tok_1")
+	require.NoError(t, err)
+	expectedCard := Card("tok_1", "fp_1")
+	expectedCard.Name = "J Smith"
+	expectedCard.ExpiryYear = 2031
+	assert.Equal(t, expectedCard, card)
+
+	_, err = repo.GetCreditCard(ctx, "merchant1", "tok_2")
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+
+	// The same card tokenised by another merchant gets its own token, and tokens are private to their merchant
+	saved, err = repo.SaveCreditCard(ctx, "merchant2", Card("tok_3", "fp_1"))
+	require.NoError(t, err)
+	assert.Equal(t, "tok_3", saved.Token)
+
+	_, err = repo.GetCreditCard(ctx, "merchant2", "tok_1")
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+
+	// Tokens are unique
+	_, err = repo.SaveCreditCard(ctx, "merchant1", Card("tok_1", "fp_2"))
+	dbErr := requireDBServiceError(t, err)
+	assert.False(t, dbErr.NotFound)
+	assert.False(t, dbErr.ValidationFail)
+}
+
+func testAuthorisations(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+
+	all, err := repo.GetAllAuthorisations(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all)
+
+	card, err := repo.SaveCreditCard(ctx, "merchant1", Card("tok_1", "fp_1"))
+	require.NoError(t, err)
+
+	auth := entities.Authorisation{
+		ID:           "auth_1",
+		State:        entities.StateAuthorised,
+		Amount:       eur(1000),
+		MerchantName: "merchant1",
+		CreditCard:   &card,
+	}
+	require.NoError(t, repo.AddAuthorisation(ctx, auth))
+
+	details, err := repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, "auth_1", details.ID)
+	assert.Equal(t, entities.StateAuthorised, details.State)
+	assert.Equal(t, eur(1000), details.Amount)
+	assert.Equal(t, "merchant1", details.MerchantName)
+	assert.Equal(t, &card, details.CreditCard)
+	assert.Empty(t, details.Transaction)
+
+	all, err = repo.GetAllAuthorisations(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []entities.Authorisation{{ID: "auth_1", State: entities.StateAuthorised, Amount: eur(1000),
+		MerchantName: "merchant1"}}, all)
+
+	_, err = repo.GetAuthorisationDetails(ctx, "auth_unknown")
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+
+	// An authorisation ID already stored is neither a validation failure nor missing
+	dbErr := requireDBServiceError(t, repo.AddAuthorisation(ctx, auth))
+	assert.False(t, dbErr.ValidationFail)
+	assert.False(t, dbErr.NotFound)
+
+	invalid := map[string]func(auth *entities.Authorisation){
+		"no card":              func(auth *entities.Authorisation) { auth.CreditCard = nil },
+		"unknown card":         func(auth *entities.Authorisation) { auth.CreditCard = &entities.CreditCard{Token: "tok_2"} },
+		"unsupported currency": func(auth *entities.Authorisation) { auth.Amount.Currency = "ZZZ" },
+	}
+	for name, invalidate := range invalid {
+		invalidAuth := auth
+		invalidAuth.ID = "auth_2"
+		invalidate(&invalidAuth)
+
+		dbErr := requireDBServiceError(t, repo.AddAuthorisation(ctx, invalidAuth))
+		assert.True(t, dbErr.ValidationFail, name)
+	}
+
+	_, err = repo.GetAuthorisationDetails(ctx, "auth_2")
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+}
+
+func testCardInstances(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+
+	// The same card is used twice, renewed in between
+	first, err := repo.SaveCreditCard(ctx, "merchant1", Card("tok_1", "fp_1"))
+	require.NoError(t, err)
+	require.NoError(t, repo.AddAuthorisation(ctx, entities.Authorisation{ID: "auth_1",
+		State: entities.StateAuthorised, Amount: eur(1000), MerchantName: "merchant1", CreditCard: &first}))
+
+	renewed := Card("tok_2", "fp_1")
+	renewed.Name = "Jane Smith"
+	renewed.ExpiryYear = 2033
+	second, err := repo.SaveCreditCard(ctx, "merchant1", renewed)
+	require.NoError(t, err)
+	require.NoError(t, repo.AddAuthorisation(ctx, entities.Authorisation{ID: "auth_2",
+		State: entities.StateAuthorised, Amount: eur(1000), MerchantName: "merchant1", CreditCard: &second}))
+
+	// Each authorisation keeps the details it was made with
+	details, err := repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, &first, details.CreditCard)
+
+	details, err = repo.GetAuthorisationDetails(ctx, "auth_2")
+	require.NoError(t, err)
+	assert.Equal(t, &second, details.CreditCard)
+	assert.Equal(t, "tok_1", details.CreditCard.Token)
+	assert.Equal(t, "Jane Smith", details.CreditCard.Name)
+	assert.Equal(t, uint(2033), details.CreditCard.ExpiryYear)
+}
+
+func testTransactions(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAuthorisation(t, repo, "auth_1", eur(1000))
+
+	captureID, err := reserve(ctx, repo, "auth_1", entities.TransactionCapture, eur(400))
+	require.NoError(t, err)
+
+	// Pending captures count towards the amount authorised
+	_, err = reserve(ctx, repo, "auth_1", entities.TransactionCapture, eur(700))
+	dbErr := requireDBServiceError(t, err)
+	assert.True(t, dbErr.ValidationFail)
+	var exceededErr *core.AmountExceededError
+	assert.True(t, errors.As(err, &exceededErr))
+
+	// The payment cannot be voided while a capture is pending
+	_, err = reserve(ctx, repo, "auth_1", entities.TransactionVoid, eur(0))
+	var inProgressErr *core.OperationInProgressError
+	assert.True(t, errors.As(err, &inProgressErr))
+
+	_, err = reserve(ctx, repo, "auth_unknown", entities.TransactionCapture, eur(100))
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+
+	_, err = reserve(ctx, repo, "auth_1", entities.TransactionCapture, money.Money{MinorUnits: 100, Currency: "USD"})
+	assert.True(t, requireDBServiceError(t, err).ValidationFail)
+
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_1", captureID, true))
+
+	// A transaction is only completed once
+	dbErr = requireDBServiceError(t, repo.CompleteTransaction(ctx, "auth_1", captureID, true))
+	assert.True(t, dbErr.ValidationFail)
+
+	for _, transID := range []string{"999", "not a number"} {
+		dbErr = requireDBServiceError(t, repo.CompleteTransaction(ctx, "auth_1", transID, true))
+		assert.True(t, dbErr.NotFound, transID)
+	}
+
+	// Transactions belong to their authorisation
+	addAuthorisation(t, repo, "auth_2", eur(1000))
+	dbErr = requireDBServiceError(t, repo.CompleteTransaction(ctx, "auth_2", captureID, true))
+	assert.True(t, dbErr.NotFound)
+
+	refundID, err := reserve(ctx, repo, "auth_1", entities.TransactionRefund, eur(400))
+	require.NoError(t, err)
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_1", refundID, true))
+
+	details, err := repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateRefunded, details.State)
+	require.Len(t, details.Transaction, 2)
+
+	expected := []entities.Transaction{
+		{ID: captureID, Type: entities.TransactionCapture, Status: entities.TransactionCompleted, Amount: eur(400),
+			AuthorisationID: "auth_1"},
+		{ID: refundID, Type: entities.TransactionRefund, Status: entities.TransactionCompleted, Amount: eur(400),
+			AuthorisationID: "auth_1"},
+	}
+	for i, transItem := range details.Transaction {
+		assert.False(t, transItem.CreatedAt.IsZero())
+		transItem.CreatedAt = time.Time{}
+		assert.Equal(t, expected[i], transItem)
+	}
+
+	// A refunded payment cannot be voided
+	_, err = reserve(ctx, repo, "auth_1", entities.TransactionVoid, eur(0))
+	assert.True(t, requireDBServiceError(t, err).ValidationFail)
+}
+
+func testFailedTransactions(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAuthorisation(t, repo, "auth_1", eur(1000))
+
+	captureID, err := reserve(ctx, repo, "auth_1", entities.TransactionCapture, eur(1000))
+	require.NoError(t, err)
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_1", captureID, false))
+
+	// A failed capture no longer counts towards the amount authorised, nor changes the state
+	details, err := repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateAuthorised, details.State)
+	require.Len(t, details.Transaction, 1)
+	assert.Equal(t, entities.TransactionFailed, details.Transaction[0].Status)
+
+	dbErr := requireDBServiceError(t, repo.CompleteTransaction(ctx, "auth_1", captureID, true))
+	assert.True(t, dbErr.ValidationFail)
+
+	voidID, err := reserve(ctx, repo, "auth_1", entities.TransactionVoid, eur(0))
+	require.NoError(t, err)
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_1", voidID, true))
+
+	details, err = repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateVoided, details.State)
+}
+
+func testStateUpdates(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAuthorisation(t, repo, "auth_1", eur(1000))
+
+	// No state change while an operation is in progress
+	voidID, err := reserve(ctx, repo, "auth_1", entities.TransactionVoid, eur(0))
+	require.NoError(t, err)
+	dbErr := requireDBServiceError(t, repo.UpdateAuthorisationState(ctx, "auth_1", entities.StateExpired))
+	assert.True(t, dbErr.ValidationFail)
+	var inProgressErr *core.OperationInProgressError
+	assert.True(t, errors.As(dbErr, &inProgressErr))
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_1", voidID, false))
+
+	require.NoError(t, repo.UpdateAuthorisationState(ctx, "auth_1", entities.StateExpired))
+
+	details, err := repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateExpired, details.State)
+
+	// Expired payments are final
+	dbErr = requireDBServiceError(t, repo.UpdateAuthorisationState(ctx, "auth_1", entities.StateAuthorised))
+	assert.True(t, dbErr.ValidationFail)
+	var illegalErr *core.IllegalTransitionError
+	assert.True(t, errors.As(dbErr, &illegalErr))
+
+	_, err = reserve(ctx, repo, "auth_1", entities.TransactionCapture, eur(100))
+	assert.True(t, requireDBServiceError(t, err).ValidationFail)
+
+	addAuthorisation(t, repo, "auth_2", eur(1000))
+	require.NoError(t, repo.UpdateAuthorisationState(ctx, "auth_2", entities.StateFailed))
+	details, err = repo.GetAuthorisationDetails(ctx, "auth_2")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateFailed, details.State)
+
+	dbErr = requireDBServiceError(t, repo.UpdateAuthorisationState(ctx, "auth_unknown", entities.StateExpired))
+	assert.True(t, dbErr.NotFound)
+}
+
+func testAuthorisationsByState(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAuthorisation(t, repo, "auth_1", eur(1000))
+	addAuthorisation(t, repo, "auth_2", eur(500))
+	addAuthorisation(t, repo, "auth_3", eur(1000))
+	captureID, err := reserve(ctx, repo, "auth_3", entities.TransactionCapture, eur(100))
+	require.NoError(t, err)
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_3", captureID, true))
+
+	auths, err := repo.GetAuthorisationsByState(ctx, entities.StateAuthorised, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, auths)
+
+	// Oldest first
+	auths, err = repo.GetAuthorisationsByState(ctx, entities.StateAuthorised, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, auths, 2)
+	assert.Equal(t, "auth_1", auths[0].ID)
+	assert.Equal(t, "auth_2", auths[1].ID)
+	assert.Equal(t, eur(500), auths[1].Amount)
+	assert.Equal(t, entities.StateAuthorised, auths[1].State)
+	assert.False(t, auths[1].CreatedAt.IsZero())
+
+	auths, err = repo.GetAuthorisationsByState(ctx, entities.StateExpired, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, auths)
+}
+
+func testPendingTransactions(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAuthorisation(t, repo, "auth_1", eur(1000))
+	addAuthorisation(t, repo, "auth_2", eur(1000))
+
+	firstID, err := reserve(ctx, repo, "auth_2", entities.TransactionCapture, eur(100))
+	require.NoError(t, err)
+	secondID, err := reserve(ctx, repo, "auth_1", entities.TransactionVoid, eur(0))
+	require.NoError(t, err)
+	completedID, err := reserve(ctx, repo, "auth_2", entities.TransactionCapture, eur(100))
+	require.NoError(t, err)
+	require.NoError(t, repo.CompleteTransaction(ctx, "auth_2", completedID, true))
+
+	require.NoError(t, repo.RecordTransactionAttempt(ctx, "auth_1", secondID))
+	require.NoError(t, repo.RecordTransactionAttempt(ctx, "auth_1", secondID))
+	assert.True(t, requireDBServiceError(t, repo.RecordTransactionAttempt(ctx, "auth_2", secondID)).NotFound)
+	assert.True(t, requireDBServiceError(t, repo.RecordTransactionAttempt(ctx, "auth_3", secondID)).NotFound)
+
+	pending, err := repo.GetPendingTransactions(ctx, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Oldest first
+	pending, err = repo.GetPendingTransactions(ctx, time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, firstID, pending[0].ID)
+	assert.Equal(t, "auth_2", pending[0].AuthorisationID)
+	assert.Equal(t, eur(100), pending[0].Amount)
+	assert.Equal(t, secondID, pending[1].ID)
+	assert.Equal(t, "auth_1", pending[1].AuthorisationID)
+	assert.Equal(t, entities.TransactionVoid, pending[1].Type)
+	assert.Equal(t, 0, pending[0].Attempts)
+	assert.Equal(t, 2, pending[1].Attempts)
+}
+
+func testAuthorisationJournal(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	later := time.Now().Add(time.Minute)
+
+	card, err := repo.SaveCreditCard(ctx, "merchant1", Card("tok_1", "fp_1"))
+	require.NoError(t, err)
+
+	entry := func(reference string) entities.AuthorisationJournalEntry {
+		return entities.AuthorisationJournalEntry{Reference: reference, MerchantName: "merchant1", Amount: eur(1000),
+			CreditCardToken: "tok_1"}
+	}
+	for _, reference := range []string{"ref_1", "ref_2", "ref_3"} {
+		require.NoError(t, repo.JournalAuthorisation(ctx, entry(reference)))
+	}
+
+	unsupported := entry("ref_4")
+	unsupported.Amount.Currency = "ZZZ"
+	assert.True(t, requireDBServiceError(t, repo.JournalAuthorisation(ctx, unsupported)).ValidationFail)
+
+	// Entries are unique and refer to a tokenised card
+	assert.Error(t, repo.JournalAuthorisation(ctx, entry("ref_1")))
+	unknownCard := entry("ref_5")
+	unknownCard.CreditCardToken = "tok_2"
+	assert.Error(t, repo.JournalAuthorisation(ctx, unknownCard))
+
+	require.NoError(t, repo.RecordAuthorisationJournalAttempt(ctx, "ref_1"))
+	require.NoError(t, repo.RecordAuthorisationJournalAttempt(ctx, "ref_1"))
+
+	entries, err := repo.GetAuthorisationJournal(ctx, entities.JournalPending, later)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	assert.False(t, entries[0].CreatedAt.IsZero())
+	entries[0].CreatedAt = time.Time{}
+	expected := entry("ref_1")
+	expected.Status = entities.JournalPending
+	expected.Attempts = 2
+	assert.Equal(t, expected, entries[0])
+
+	entries, err = repo.GetAuthorisationJournal(ctx, entities.JournalPending, time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Storing the authorisation completes its entry
+	require.NoError(t, repo.AddAuthorisation(ctx, entities.Authorisation{ID: "auth_1",
+		State: entities.StateAuthorised, Amount: eur(1000), MerchantName: "merchant1", CreditCard: &card,
+		Reference: "ref_1"}))
+	require.NoError(t, repo.FailAuthorisationJournalEntry(ctx, "ref_2"))
+	require.NoError(t, repo.StartCompensation(ctx, "ref_3", "auth_3"))
+
+	expectedStatuses := map[entities.JournalStatus][]string{
+		entities.JournalPending:      {},
+		entities.JournalCompleted:    {"ref_1:auth_1"},
+		entities.JournalFailed:       {"ref_2:"},
+		entities.JournalCompensating: {"ref_3:auth_3"},
+	}
+	for status, expectedEntries := range expectedStatuses {
+		entries, err := repo.GetAuthorisationJournal(ctx, status, later)
+		require.NoError(t, err)
+		references := []string{}
+		for _, entry := range entries {
+			references = append(references, entry.Reference+":"+entry.AuthorisationID)
+		}
+		assert.Equal(t, expectedEntries, references, status)
+	}
+
+	require.NoError(t, repo.CompleteCompensation(ctx, "ref_3"))
+	entries, err = repo.GetAuthorisationJournal(ctx, entities.JournalVoided, later)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "auth_3", entries[0].AuthorisationID)
+
+	// Unknown entries are ignored
+	assert.NoError(t, repo.FailAuthorisationJournalEntry(ctx, "ref_unknown"))
+	assert.NoError(t, repo.RecordAuthorisationJournalAttempt(ctx, "ref_unknown"))
+}
+
+func testIdempotentRequests(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	staleBefore := time.Now().Add(-time.Minute)
+
+	key, created, err := repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", staleBefore)
+	require.NoError(t, err)
+	assert.True(t, created)
+	assert.Equal(t, entities.IdempotencyKey{Key: "key_1", MerchantName: "merchant1", RequestHash: "hash_1"}, key)
+
+	key, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_2", staleBefore)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.False(t, key.Completed)
+
+	require.NoError(t, repo.CompleteIdempotentRequest(ctx, "merchant1", "key_1", 201, []byte(`{"id":"auth_1"}`)))
+
+	key, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_2", staleBefore)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, entities.IdempotencyKey{Key: "key_1", MerchantName: "merchant1", RequestHash: "hash_1",
+		Completed: true, StatusCode: 201, ResponseBody: []byte(`{"id":"auth_1"}`)}, key)
+
+	// Keys are private to their merchant
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant2", "key_1", "hash_1", staleBefore)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	// Completing an unknown key does not create it
+	require.NoError(t, repo.CompleteIdempotentRequest(ctx, "merchant1", "key_2", 200, []byte(`{}`)))
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_2", "hash_1", staleBefore)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	// Releasing a key lets the request be retried, unless it was completed
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_3", "hash_1", staleBefore)
+	require.NoError(t, err)
+	require.True(t, created)
+	require.NoError(t, repo.ReleaseIdempotentRequest(ctx, "merchant1", "key_3"))
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_3", "hash_2", staleBefore)
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	require.NoError(t, repo.ReleaseIdempotentRequest(ctx, "merchant1", "key_1"))
+	key, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", staleBefore)
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.True(t, key.Completed)
+
+	// Releasing an unknown key does nothing
+	require.NoError(t, repo.ReleaseIdempotentRequest(ctx, "merchant1", "key_4"))
+}
+
+func testStaleIdempotentRequests(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+
+	_, created, err := repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	require.True(t, created)
+
+	// Still in progress
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	// Stale, but with a different request
+	key, created, err := repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_2", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, "hash_1", key.RequestHash)
+
+	// Stale, so the same request is restarted, once
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, created)
+
+	_, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, created)
+
+	// Completed requests never go stale
+	require.NoError(t, repo.CompleteIdempotentRequest(ctx, "merchant1", "key_1", 200, []byte(`{}`)))
+	key, created, err = repo.StartIdempotentRequest(ctx, "merchant1", "key_1", "hash_1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, created)
+	assert.True(t, key.Completed)
+}
+
+func testConcurrentReservations(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAuthorisation(t, repo, "auth_1", eur(1000))
+
+	// 20 captures of 1.00 against 10.00 authorised: only 10 can be reserved
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	transIDs := []string{}
+
+	wg.Add(20)
+	for i := 0; i < 20; i++ {
+		go func() {
+			defer wg.Done()
+			transID, err := reserve(ctx, repo, "auth_1", entities.TransactionCapture, eur(100))
+			if err == nil {
+				mu.Lock()
+				transIDs = append(transIDs, transID)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, transIDs, 10)
+
+	wg.Add(len(transIDs))
+	for _, transID := range transIDs {
+		go func(transID string) {
+			defer wg.Done()
+			assert.NoError(t, repo.CompleteTransaction(ctx, "auth_1", transID, true))
+		}(transID)
+	}
+	wg.Wait()
+
+	details, err := repo.GetAuthorisationDetails(ctx, "auth_1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateCaptured, details.State)
+
+	seen := map[string]bool{}
+	for _, transItem := range details.Transaction {
+		assert.Equal(t, entities.TransactionCompleted, transItem.Status)
+		_, err := strconv.ParseUint(transItem.ID, 10, 64)
+		assert.NoError(t, err)
+		assert.False(t, seen[transItem.ID], "transaction ID %s used twice", transItem.ID)
+		seen[transItem.ID] = true
+	}
+	assert.Len(t, seen, 10)
+}
+
+// addAPIKey stores a new API key of the merchant.
+func addAPIKey(t *testing.T, repo core.Repository, keyID string, merchantName string) {
+	t.Helper()
+
+	err := repo.AddAPIKey(context.Background(), entities.APIKey{
+		ID:              keyID,
+		MerchantName:    merchantName,
+		CreatedAt:       time.Now(),
+		EncryptedSecret: []byte{1, 2, 3},
+		EncryptedKey:    []byte{4, 5, 6},
+	})
+	require.NoError(t, err)
+}
+
+func testAPIKeys(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+
+	addAPIKey(t, repo, "key_1", "merchant1")
+	addAPIKey(t, repo, "key_2", "merchant1")
+	addAPIKey(t, repo, "key_3", "merchant2")
+
+	err := repo.AddAPIKey(ctx, entities.APIKey{ID: "key_1", MerchantName: "merchant2", CreatedAt: time.Now(),
+		EncryptedSecret: []byte{1}, EncryptedKey: []byte{2}})
+	requireDBServiceError(t, err)
+
+	key, err := repo.GetAPIKey(ctx, "key_1")
+	require.NoError(t, err)
+	assert.Equal(t, "key_1", key.ID)
+	assert.Equal(t, "merchant1", key.MerchantName)
+	assert.Equal(t, []byte{1, 2, 3}, key.EncryptedSecret)
+	assert.Equal(t, []byte{4, 5, 6}, key.EncryptedKey)
+	assert.WithinDuration(t, time.Now(), key.CreatedAt, time.Minute)
+	assert.False(t, key.Revoked())
+
+	_, err = repo.GetAPIKey(ctx, "key_4")
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+
+	keys, err := repo.GetAPIKeys(ctx, "merchant1")
+	require.NoError(t, err)
+	require.Len(t, keys, 2)
+	assert.Equal(t, "key_1", keys[0].ID)
+	assert.Equal(t, "key_2", keys[1].ID)
+
+	keys, err = repo.GetAPIKeys(ctx, "merchant3")
+	require.NoError(t, err)
+	assert.Empty(t, keys)
+
+	require.NoError(t, repo.RevokeAPIKey(ctx, "key_1"))
+	key, err = repo.GetAPIKey(ctx, "key_1")
+	require.NoError(t, err)
+	require.True(t, key.Revoked())
+	revokedAt := *key.RevokedAt
+
+	// Revoking again keeps the time the key was first revoked
+	time.Sleep(10 * time.Millisecond)
+	require.NoError(t, repo.RevokeAPIKey(ctx, "key_1"))
+	key, err = repo.GetAPIKey(ctx, "key_1")
+	require.NoError(t, err)
+	require.True(t, key.Revoked())
+	assert.True(t, revokedAt.Equal(*key.RevokedAt))
+
+	key, err = repo.GetAPIKey(ctx, "key_2")
+	require.NoError(t, err)
+	assert.False(t, key.Revoked())
+
+	err = repo.RevokeAPIKey(ctx, "key_4")
+	assert.True(t, requireDBServiceError(t, err).NotFound)
+}
+
+func testAPIKeyNonces(t *testing.T, repo core.Repository) {
+	ctx := context.Background()
+	addAPIKey(t, repo, "key_1", "merchant1")
+	addAPIKey(t, repo, "key_2", "merchant1")
+
+	fresh, err := repo.RecordAPIKeyNonce(ctx, "key_1", "nonce_1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.True(t, fresh)
+
+	fresh, err = repo.RecordAPIKeyNonce(ctx, "key_1", "nonce_1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.False(t, fresh)
+
+	// Nonces are private to their key
+	fresh, err = repo.RecordAPIKeyNonce(ctx, "key_2", "nonce_1", time.Now().Add(-time.Minute))
+	require.NoError(t, err)
+	assert.True(t, fresh)
+
+	// Once expired, a nonce is forgotten
+	time.Sleep(10 * time.Millisecond)
+	fresh, err = repo.RecordAPIKeyNonce(ctx, "key_1", "nonce_1", time.Now().Add(time.Minute))
+	require.NoError(t, err)
+	assert.True(t, fresh)
+}
@@ -0,0 +1,9 @@
+package repository
+
+// StateMachineError wraps an error returned by core.PaymentStateMachine, flagging it as a validation failure
+// while still letting callers inspect the typed error underneath with errors.As.
+//
+// Every Repository implementation must consult the state machine while holding a lock on the authorisation.
+func StateMachineError(err error) *DBServiceError {
+	return &DBServiceError{Msg: "operation not allowed", ValidationFail: true, Err: err}
+}
@@ -1,10 +1,15 @@
 package repository
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"time"
 
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
 	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
 	"gorm.io/gorm"
 )
 
@@ -25,13 +30,20 @@ func (e *DBServiceError) Unwrap() error {
 	return e.Err
 }
 
+// ErrAuthorisationExists is returned when storing an authorisation already stored, e.g. by the reconciler or by a
+// commit whose outcome was unknown to the caller.
+var ErrAuthorisationExists = &DBServiceError{Msg: "authorisation ID already exists in the database", ValidationFail: false}
+
 type DatabaseService struct {
 	Database *Database
+
+	// QueryTimeout bounds how long each operation can take (zero means no deadline other than the caller's).
+	QueryTimeout time.Duration
 }
 
-func NewDatabaseService(host string, port int, username string, password string, dbname string) (dbs *DatabaseService, err error) {
+func NewDatabaseService(config core.DatabaseConfiguration) (dbs *DatabaseService, err error) {
 	dbs = &DatabaseService{}
-	dbs.Database, err = NewDatabase(host, port, username, password, dbname)
+	dbs.Database, err = NewDatabase(config)
 	if err != nil {
 		return nil, err
 	}
@@ -43,12 +55,18 @@ func (dbs *DatabaseService) Close() error {
 	return dbs.Database.Close()
 }
 
-func (dbs *DatabaseService) HealthCheck() error {
-	return dbs.Database.HealthCheck()
+func (dbs *DatabaseService) HealthCheck(ctx context.Context) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	return db.HealthCheck(ctx)
 }
 
-func (dbs *DatabaseService) CurrencyExists(currency string) (bool, error) {
-	_, err := dbs.Database.GetCurrencyID(currency)
+func (dbs *DatabaseService) CurrencyExists(ctx context.Context, currency string) (bool, error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	_, err := db.GetCurrencyID(currency)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return false, nil // Not found
 	} else if err != nil {
@@ -58,71 +76,171 @@ func (dbs *DatabaseService) CurrencyExists(currency string) (bool, error) {
 	return true, nil
 }
 
-func (dbs *DatabaseService) AddAuthorisation(auth entities.Authorisation) error {
-	// Check currency is supported
-	currencyID, err := dbs.Database.GetCurrencyID(auth.Currency)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return &DBServiceError{Msg: "currency provided not supported", ValidationFail: true, Err: gorm.ErrRecordNotFound}
-	} else if err != nil {
-		return &DBServiceError{Msg: "database error", Err: err}
+func (dbs *DatabaseService) AddAuthorisation(ctx context.Context, auth entities.Authorisation) error {
+	// Check credit card was provided
+	if auth.CreditCard == nil {
+		return &DBServiceError{Msg: "credit card missing", ValidationFail: true}
 	}
 
-	// get stateID
-	stateID, err := dbs.Database.GetStateID(auth.State)
-	if err != nil {
-		return &DBServiceError{Msg: "database error", Err: err}
-	}
+	err := dbs.transaction(ctx, func(txDB *Database) error {
+		// Check currency is supported
+		currencyID, err := txDB.GetCurrencyID(auth.Amount.Currency)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "currency provided not supported", ValidationFail: true, Err: gorm.ErrRecordNotFound}
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
 
-	// Check whether credit card exists, if not, create it
-	creditCard, err := dbs.Database.GetCreditCardDetails(auth.CreditCard.Number)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
-		// Create credit card
-		creditCard = CreditCard{
-			Number:      auth.CreditCard.Number,
-			Name:        auth.CreditCard.Name,
-			ExpiryMonth: auth.CreditCard.ExpiryMonth,
-			ExpiryYear:  auth.CreditCard.ExpiryYear,
-			CVV:         auth.CreditCard.CVV,
+		// get stateID
+		stateID, err := txDB.GetStateID(string(auth.State))
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
 		}
-		err = dbs.Database.InsertCreditCardRecord(creditCard)
+
+		// Check credit card has been tokenised already
+		_, err = txDB.GetCreditCardDetails(auth.CreditCard.Token)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "credit card token not found", ValidationFail: true, Err: gorm.ErrRecordNotFound}
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		// check if authID already exists
+		_, err = txDB.GetAuthorisationRecord(auth.ID)
+		if err != nil {
+			if !errors.Is(err, gorm.ErrRecordNotFound) {
+				return &DBServiceError{Msg: "database error", Err: err}
+			}
+		} else {
+			// error! record already exists
+			return ErrAuthorisationExists
+		}
+
+		// Record the card details the authorisation was made with
+		instanceID, err := txDB.InsertCardInstanceRecord(CardInstance{
+			CreditCardToken: auth.CreditCard.Token,
+			Name:            auth.CreditCard.Name,
+			ExpiryMonth:     auth.CreditCard.ExpiryMonth,
+			ExpiryYear:      auth.CreditCard.ExpiryYear,
+		})
 		if err != nil {
 			return &DBServiceError{Msg: "database error", Err: err}
 		}
-	} else if err != nil {
-		return &DBServiceError{Msg: "database error", Err: err}
-	}
 
-	// check if authID already exists
-	_, err = dbs.Database.GetAuthorisationRecord(auth.ID)
-	if err != nil {
-		if !errors.Is(err, gorm.ErrRecordNotFound) {
+		// Create authorisation record
+		authRecord := Authorisation{
+			ID:             auth.ID,
+			StateID:        stateID,
+			CurrencyID:     currencyID,
+			Amount:         auth.Amount.MinorUnits,
+			MerchantName:   auth.MerchantName,
+			CardInstanceID: instanceID,
+		}
+
+		err = txDB.InsertAuthorisationRecord(authRecord)
+		if err != nil {
 			return &DBServiceError{Msg: "database error", Err: err}
 		}
-	} else {
-		// error! record already exists
-		return &DBServiceError{Msg: "authorisation ID already exists in the database", ValidationFail: false}
-	}
 
-	// Create authorisation record
-	authRecord := Authorisation{
-		ID:               auth.ID,
-		StateID:          stateID,
-		CurrencyID:       currencyID,
-		Amount:           auth.Amount,
-		MerchantName:     auth.MerchantName,
-		CreditCardNumber: creditCard.Number,
+		// Close the journal entry written before asking the payment processor for this authorisation
+		if auth.Reference != "" {
+			err = txDB.UpdateAuthorisationJournalStatus(auth.Reference, string(entities.JournalCompleted), auth.ID)
+			if err != nil {
+				return &DBServiceError{Msg: "database error", Err: err}
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil && err != ErrAuthorisationExists {
+		// A concurrent insert of the same authorisation ID might have won the race to the primary key
+		db, cancel := dbs.withContext(ctx)
+		defer cancel()
+		if _, errGet := db.GetAuthorisationRecord(auth.ID); errGet == nil {
+			return ErrAuthorisationExists
+		}
 	}
 
-	err = dbs.Database.InsertAuthorisationRecord(authRecord)
+	return err
+}
+
+// SaveCreditCard stores a tokenised credit card for the merchant.
+// If the merchant has already tokenised the same card number, the existing card is returned instead, updated with the
+// card holder name and expiry date provided.
+func (dbs *DatabaseService) SaveCreditCard(ctx context.Context, merchantName string, card entities.CreditCard) (
+	entities.CreditCard, error) {
+	var creditCardRecord CreditCard
+
+	err := dbs.transaction(ctx, func(txDB *Database) error {
+		var err error
+		creditCardRecord, err = txDB.GetCreditCardByFingerprint(merchantName, card.Fingerprint)
+		if err == nil {
+			return updateCreditCardDetails(txDB, &creditCardRecord, card)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		creditCardRecord = CreditCard{
+			Token:           card.Token,
+			MerchantName:    merchantName,
+			Fingerprint:     card.Fingerprint,
+			EncryptedNumber: card.EncryptedNumber,
+			EncryptedKey:    card.EncryptedKey,
+			BIN:             card.BIN,
+			LastFour:        card.LastFour,
+			Brand:           card.Brand,
+			Name:            card.Name,
+			ExpiryMonth:     card.ExpiryMonth,
+			ExpiryYear:      card.ExpiryYear,
+		}
+
+		err = txDB.InsertCreditCardRecord(creditCardRecord)
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		return nil
+	})
+
 	if err != nil {
-		return &DBServiceError{Msg: "database error", Err: err}
+		// A concurrent request might have tokenised the same card in the meantime
+		db, cancel := dbs.withContext(ctx)
+		defer cancel()
+		existingRecord, errGet := db.GetCreditCardByFingerprint(merchantName, card.Fingerprint)
+		if errGet == nil {
+			if errUpdate := updateCreditCardDetails(db, &existingRecord, card); errUpdate != nil {
+				return card, errUpdate
+			}
+			return creditCardEntity(existingRecord), nil
+		}
+		return card, err
 	}
 
-	return nil
+	return creditCardEntity(creditCardRecord), nil
 }
 
-func (dbs *DatabaseService) GetAllAuthorisations() ([]entities.Authorisation, error) {
-	authorisations, err := dbs.Database.FindAllAuthorisationRecords()
+// GetCreditCard returns the merchant's tokenised credit card.
+func (dbs *DatabaseService) GetCreditCard(ctx context.Context, merchantName string, token string) (
+	card entities.CreditCard, err error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	creditCardRecord, err := db.GetCreditCardDetails(token)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && creditCardRecord.MerchantName != merchantName) {
+		return card, &DBServiceError{Msg: "credit card token not found", NotFound: true}
+	} else if err != nil {
+		return card, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	return creditCardEntity(creditCardRecord), nil
+}
+
+func (dbs *DatabaseService) GetAllAuthorisations(ctx context.Context) ([]entities.Authorisation, error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	authorisations, err := db.FindAllAuthorisationRecords()
 	if errors.Is(err, gorm.ErrRecordNotFound) {
 		return []entities.Authorisation{}, nil
 	} else if err != nil {
@@ -134,9 +252,8 @@ func (dbs *DatabaseService) GetAllAuthorisations() ([]entities.Authorisation, er
 	for _, authRecord := range authorisations {
 		authItem := entities.Authorisation{
 			ID:           authRecord.ID,
-			State:        authRecord.State.Name,
-			Currency:     authRecord.Currency.Name,
-			Amount:       authRecord.Amount,
+			State:        entities.PaymentState(authRecord.State.Name),
+			Amount:       money.Money{MinorUnits: authRecord.Amount, Currency: authRecord.Currency.Name},
 			MerchantName: authRecord.MerchantName,
 		}
 
@@ -146,88 +263,459 @@ func (dbs *DatabaseService) GetAllAuthorisations() ([]entities.Authorisation, er
 	return authList, nil
 }
 
-func (dbs *DatabaseService) GetAuthorisationDetails(authID string) (authItem entities.Authorisation, err error) {
+func (dbs *DatabaseService) GetAuthorisationDetails(ctx context.Context, authID string) (
+	authItem entities.Authorisation, err error) {
+	// All reads happen in the same transaction, so they see a consistent snapshot
+	err = dbs.transaction(ctx, func(txDB *Database) error {
+		// check if authID exists
+		authRecord, err := txDB.GetAuthorisationRecord(authID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "authorisation record not found", NotFound: true}
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		authItem = entities.Authorisation{
+			ID:           authRecord.ID,
+			State:        entities.PaymentState(authRecord.State.Name),
+			Amount:       money.Money{MinorUnits: authRecord.Amount, Currency: authRecord.Currency.Name},
+			MerchantName: authRecord.MerchantName,
+		}
+
+		// get credit card information
+		creditCardRecord, err := txDB.GetCreditCardDetails(authRecord.CardInstance.CreditCardToken)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "credit card record not found", NotFound: true}
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		// The card details are the ones the authorisation was made with, not the latest ones
+		creditCard := creditCardEntity(creditCardRecord)
+		creditCard.Name = authRecord.CardInstance.Name
+		creditCard.ExpiryMonth = authRecord.CardInstance.ExpiryMonth
+		creditCard.ExpiryYear = authRecord.CardInstance.ExpiryYear
+		authItem.CreditCard = &creditCard
+
+		// get all transactions associated with this authorisation
+		transactionRecords, err := txDB.FindAllTransactionRecords(authID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		authItem.Transaction = transactionEntities(transactionRecords, authRecord.Currency.Name)
+
+		return nil
+	})
+
+	return authItem, err
+}
+
+// ReserveTransaction records a pending capture, refund or void for the authorisation and returns its ID.
+//
+// The authorisation row is locked while checking the transaction is allowed, and pending transactions count
+// towards the limits, so concurrent operations on the same authorisation can never take more money than what was
+// authorised or captured. The reservation must be settled with CompleteTransaction once the payment processor answers.
+func (dbs *DatabaseService) ReserveTransaction(ctx context.Context, authID string, transaction entities.Transaction) (
+	transID string, err error) {
+	err = dbs.transaction(ctx, func(txDB *Database) error {
+		authItem, err := lockAuthorisation(txDB, authID)
+		if err != nil {
+			return err
+		}
+
+		if err := core.NewPaymentStateMachine(authItem).CheckTransaction(transaction); err != nil {
+			return StateMachineError(err)
+		}
+
+		transRecord := Transaction{
+			Type:            string(transaction.Type),
+			Status:          string(entities.TransactionPending),
+			Amount:          transaction.Amount.MinorUnits,
+			AuthorisationID: authID,
+		}
+
+		id, err := txDB.InsertTransactionRecord(transRecord)
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		transID = strconv.FormatUint(id, 10)
+		return nil
+	})
 
-	// check if authID exists
-	authRecord, err := dbs.Database.GetAuthorisationRecord(authID)
+	return transID, err
+}
+
+// CompleteTransaction settles a pending transaction.
+// Successful transactions update the authorisation state, failed ones stop counting towards the limits.
+func (dbs *DatabaseService) CompleteTransaction(ctx context.Context, authID string, transID string, success bool) error {
+	id, err := strconv.ParseUint(transID, 10, 64)
+	if err != nil {
+		return &DBServiceError{Msg: "transaction record not found", NotFound: true}
+	}
+
+	return dbs.transaction(ctx, func(txDB *Database) error {
+		authItem, err := lockAuthorisation(txDB, authID)
+		if err != nil {
+			return err
+		}
+		machine := core.NewPaymentStateMachine(authItem)
+
+		transRecord, err := txDB.GetTransactionRecord(authID, id)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "transaction record not found", NotFound: true}
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		if entities.TransactionStatus(transRecord.Status) != entities.TransactionPending {
+			return &DBServiceError{Msg: fmt.Sprintf("transaction already '%s'", transRecord.Status), ValidationFail: true}
+		}
+
+		if !success {
+			err = txDB.UpdateTransactionStatus(id, string(entities.TransactionFailed))
+			if err != nil {
+				return &DBServiceError{Msg: "database error", Err: err}
+			}
+			return nil
+		}
+
+		nextState, err := machine.CompletedState(transactionEntity(transRecord, authItem.Amount.Currency))
+		if err != nil {
+			return StateMachineError(err)
+		}
+
+		stateID, err := txDB.GetStateID(string(nextState))
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		err = txDB.UpdateAuthorisationState(authID, stateID)
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		err = txDB.UpdateTransactionStatus(id, string(entities.TransactionCompleted))
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		return nil
+	})
+}
+
+// UpdateAuthorisationState moves the authorisation straight to the given state, e.g. when it expires or fails.
+// The change is rejected if the state machine does not allow it.
+func (dbs *DatabaseService) UpdateAuthorisationState(ctx context.Context, authID string, state entities.PaymentState) error {
+	return dbs.transaction(ctx, func(txDB *Database) error {
+		authItem, err := lockAuthorisation(txDB, authID)
+		if err != nil {
+			return err
+		}
+		machine := core.NewPaymentStateMachine(authItem)
+
+		if err := machine.Transition(state); err != nil {
+			return StateMachineError(err)
+		}
+
+		stateID, err := txDB.GetStateID(string(state))
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		err = txDB.UpdateAuthorisationState(authID, stateID)
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		return nil
+	})
+}
+
+// GetAuthorisationsByState returns the authorisations in the given state created before the given time, oldest
+// first. Their transactions are not returned.
+func (dbs *DatabaseService) GetAuthorisationsByState(ctx context.Context, state entities.PaymentState,
+	createdBefore time.Time) ([]entities.Authorisation, error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	stateID, err := db.GetStateID(string(state))
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return authItem, &DBServiceError{Msg: "authorisation record not found", NotFound: true}
+		return nil, &DBServiceError{Msg: fmt.Sprintf("state '%s' not supported", state), ValidationFail: true}
 	} else if err != nil {
-		return authItem, &DBServiceError{Msg: "database error", Err: err}
+		return nil, &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	authItem = entities.Authorisation{
-		ID:           authRecord.ID,
-		State:        authRecord.State.Name,
-		Currency:     authRecord.Currency.Name,
-		Amount:       authRecord.Amount,
-		MerchantName: authRecord.MerchantName,
+	authorisations, err := db.FindAuthorisationRecordsByState(stateID, createdBefore)
+	if err != nil {
+		return nil, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	authList := make([]entities.Authorisation, 0, len(authorisations))
+	for _, authRecord := range authorisations {
+		authList = append(authList, entities.Authorisation{
+			ID:           authRecord.ID,
+			State:        entities.PaymentState(authRecord.State.Name),
+			Amount:       money.Money{MinorUnits: authRecord.Amount, Currency: authRecord.Currency.Name},
+			MerchantName: authRecord.MerchantName,
+			CreatedAt:    authRecord.CreatedAt,
+		})
+	}
+
+	return authList, nil
+}
+
+// GetPendingTransactions returns the captures, refunds and voids created before the given time that are still
+// pending, i.e. whose outcome at the payment processor is unknown.
+func (dbs *DatabaseService) GetPendingTransactions(ctx context.Context, createdBefore time.Time) (
+	[]entities.Transaction, error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	transactionRecords, err := db.FindPendingTransactionRecords(createdBefore)
+	if err != nil {
+		return nil, &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	// get credit card information
-	creditCardRecord, err := dbs.Database.GetCreditCardDetails(authRecord.CreditCardNumber)
+	transactionsList := make([]entities.Transaction, 0, len(transactionRecords))
+	for _, transRecord := range transactionRecords {
+		authRecord, err := db.GetAuthorisationRecord(transRecord.AuthorisationID)
+		if err != nil {
+			return nil, &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		transactionsList = append(transactionsList, transactionEntity(transRecord, authRecord.Currency.Name))
+	}
+
+	return transactionsList, nil
+}
+
+// RecordTransactionAttempt counts a failed attempt at resolving the pending transaction.
+func (dbs *DatabaseService) RecordTransactionAttempt(ctx context.Context, authID string, transID string) error {
+	id, err := strconv.ParseUint(transID, 10, 64)
+	if err != nil {
+		return &DBServiceError{Msg: "transaction record not found", NotFound: true}
+	}
+
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	_, err = db.GetTransactionRecord(authID, id)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return authItem, &DBServiceError{Msg: "credit card record not found", NotFound: true}
+		return &DBServiceError{Msg: "transaction record not found", NotFound: true}
 	} else if err != nil {
-		return authItem, &DBServiceError{Msg: "database error", Err: err}
+		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	authItem.CreditCard = &entities.CreditCard{
-		Number:      creditCardRecord.Number,
-		Name:        creditCardRecord.Name,
-		ExpiryMonth: creditCardRecord.ExpiryMonth,
-		ExpiryYear:  creditCardRecord.ExpiryYear,
-		CVV:         creditCardRecord.CVV,
+	err = db.IncrementTransactionAttempts(id)
+	if err != nil {
+		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	// get all transactions associated with this authorisation
-	transactionRecords, err := dbs.Database.FindAllTransactionRecords(authID)
+	return nil
+}
+
+// JournalAuthorisation records an authorisation request about to be sent to the payment processor.
+func (dbs *DatabaseService) JournalAuthorisation(ctx context.Context, entry entities.AuthorisationJournalEntry) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	currencyID, err := db.GetCurrencyID(entry.Amount.Currency)
 	if errors.Is(err, gorm.ErrRecordNotFound) {
-		return authItem, nil
+		return &DBServiceError{Msg: "currency provided not supported", ValidationFail: true, Err: gorm.ErrRecordNotFound}
 	} else if err != nil {
-		return authItem, &DBServiceError{Msg: "database error", Err: err}
+		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	transactionsList := make([]entities.Transaction, 0, len(transactionRecords))
+	journalRecord := AuthorisationJournal{
+		Reference:       entry.Reference,
+		MerchantName:    entry.MerchantName,
+		CurrencyID:      currencyID,
+		Amount:          entry.Amount.MinorUnits,
+		CreditCardToken: entry.CreditCardToken,
+		Status:          string(entities.JournalPending),
+	}
 
-	for _, transRecord := range transactionRecords {
-		transItem := entities.Transaction{
-			ID:     transRecord.AuthorisationID,
-			Type:   transRecord.Type,
-			Amount: transRecord.Amount,
-		}
+	err = db.InsertAuthorisationJournalRecord(journalRecord)
+	if err != nil {
+		return &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	return nil
+}
+
+// FailAuthorisationJournalEntry marks the authorisation request as not authorised by the payment processor.
+func (dbs *DatabaseService) FailAuthorisationJournalEntry(ctx context.Context, reference string) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
 
-		transactionsList = append(transactionsList, transItem)
+	err := db.UpdateAuthorisationJournalStatus(reference, string(entities.JournalFailed), "")
+	if err != nil {
+		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	authItem.Transaction = transactionsList
+	return nil
+}
+
+// StartCompensation marks the authorisation granted by the payment processor as to be voided, as the gateway could
+// not store it.
+func (dbs *DatabaseService) StartCompensation(ctx context.Context, reference string, authID string) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
 
-	return authItem, nil
+	err := db.UpdateAuthorisationJournalStatus(reference, string(entities.JournalCompensating), authID)
+	if err != nil {
+		return &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	return nil
 }
 
-func (dbs *DatabaseService) AddTransaction(authID string, transaction entities.Transaction) error {
-	state := "Captured"
-	if transaction.Type == "Refund" {
-		state = "Refunded"
+// CompleteCompensation marks the authorisation the gateway could not store as voided at the payment processor.
+func (dbs *DatabaseService) CompleteCompensation(ctx context.Context, reference string) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	err := db.UpdateAuthorisationJournalStatus(reference, string(entities.JournalVoided), "")
+	if err != nil {
+		return &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	return nil
+}
+
+// GetAuthorisationJournal returns the authorisation requests in the given status created before the given time.
+func (dbs *DatabaseService) GetAuthorisationJournal(ctx context.Context, status entities.JournalStatus,
+	createdBefore time.Time) ([]entities.AuthorisationJournalEntry, error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	journalRecords, err := db.FindAuthorisationJournalRecords(string(status), createdBefore)
+	if err != nil {
+		return nil, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	entries := make([]entities.AuthorisationJournalEntry, 0, len(journalRecords))
+	for _, journalRecord := range journalRecords {
+		entries = append(entries, journalEntryEntity(journalRecord))
 	}
 
-	stateID, err := dbs.Database.GetStateID(state)
+	return entries, nil
+}
+
+// RecordAuthorisationJournalAttempt counts a failed attempt at resolving (or compensating) the authorisation request.
+func (dbs *DatabaseService) RecordAuthorisationJournalAttempt(ctx context.Context, reference string) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	err := db.IncrementAuthorisationJournalAttempts(reference)
 	if err != nil {
 		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	err = dbs.Database.UpdateAuthorisationState(authID, stateID)
+	return nil
+}
+
+// StartIdempotentRequest registers a new in-progress request for the merchant's idempotency key.
+// If the key is already known, the existing record is returned and created is false, unless it belongs to the same
+// request still in progress since before staleBefore (e.g. the process handling it died), which is restarted.
+func (dbs *DatabaseService) StartIdempotentRequest(ctx context.Context, merchantName string, key string,
+	requestHash string, staleBefore time.Time) (keyItem entities.IdempotencyKey, created bool, err error) {
+
+	err = dbs.transaction(ctx, func(txDB *Database) error {
+		keyRecord, err := txDB.GetIdempotencyKeyRecord(merchantName, key)
+		if err == nil {
+			keyItem = idempotencyKeyEntity(keyRecord)
+
+			if keyRecord.Completed || keyRecord.RequestHash != requestHash || !keyRecord.CreatedAt.Before(staleBefore) {
+				return nil
+			}
+
+			rowsAffected, err := txDB.ClaimStaleIdempotencyKeyRecord(merchantName, key, requestHash, staleBefore,
+				time.Now())
+			if err != nil {
+				return &DBServiceError{Msg: "database error", Err: err}
+			}
+			created = rowsAffected == 1
+			return nil
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		keyRecord = IdempotencyKey{
+			MerchantName: merchantName,
+			Key:          key,
+			RequestHash:  requestHash,
+		}
+
+		err = txDB.InsertIdempotencyKeyRecord(keyRecord)
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		keyItem = idempotencyKeyEntity(keyRecord)
+		created = true
+		return nil
+	})
+
+	if err != nil {
+		// A concurrent request with the same key might have won the race to the unique index
+		db, cancel := dbs.withContext(ctx)
+		defer cancel()
+		existingRecord, errGet := db.GetIdempotencyKeyRecord(merchantName, key)
+		if errGet == nil {
+			return idempotencyKeyEntity(existingRecord), false, nil
+		}
+		return keyItem, false, err
+	}
+
+	return keyItem, created, nil
+}
+
+// CompleteIdempotentRequest stores the response sent back for the merchant's idempotency key.
+func (dbs *DatabaseService) CompleteIdempotentRequest(ctx context.Context, merchantName string, key string,
+	statusCode int, responseBody []byte) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	err := db.UpdateIdempotencyKeyResponse(merchantName, key, statusCode, responseBody)
 	if err != nil {
 		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	transRecord := Transaction{
-		Type:            transaction.Type,
-		Amount:          transaction.Amount,
-		AuthorisationID: authID,
+	return nil
+}
+
+// ReleaseIdempotentRequest forgets the in-progress request made with the merchant's idempotency key, so it can be
+// retried with the same key. Completed requests are kept.
+func (dbs *DatabaseService) ReleaseIdempotentRequest(ctx context.Context, merchantName string, key string) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	err := db.DeleteInProgressIdempotencyKeyRecord(merchantName, key)
+	if err != nil {
+		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	err = dbs.Database.InsertTransactionRecord(transRecord)
+	return nil
+}
+
+// AddAPIKey stores a new API key.
+func (dbs *DatabaseService) AddAPIKey(ctx context.Context, key entities.APIKey) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	err := db.InsertAPIKeyRecord(APIKey{
+		ID:              key.ID,
+		MerchantName:    key.MerchantName,
+		EncryptedSecret: key.EncryptedSecret,
+		EncryptedKey:    key.EncryptedKey,
+		CreatedAt:       key.CreatedAt,
+		RevokedAt:       key.RevokedAt,
+	})
 	if err != nil {
 		return &DBServiceError{Msg: "database error", Err: err}
 	}
@@ -235,16 +723,237 @@ func (dbs *DatabaseService) AddTransaction(authID string, transaction entities.T
 	return nil
 }
 
-func (dbs *DatabaseService) UpdateAuthorisationState(authID string, state string) error {
-	stateID, err := dbs.Database.GetStateID(state)
+// GetAPIKey returns the API key, whether revoked or not.
+func (dbs *DatabaseService) GetAPIKey(ctx context.Context, keyID string) (key entities.APIKey, err error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	keyRecord, err := db.GetAPIKeyRecord(keyID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return key, &DBServiceError{Msg: "api key not found", NotFound: true}
+	} else if err != nil {
+		return key, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	return apiKeyEntity(keyRecord), nil
+}
+
+// GetAPIKeys returns all the API keys of the merchant, oldest first.
+func (dbs *DatabaseService) GetAPIKeys(ctx context.Context, merchantName string) ([]entities.APIKey, error) {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	keyRecords, err := db.FindAPIKeyRecords(merchantName)
+	if err != nil {
+		return nil, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	keys := make([]entities.APIKey, 0, len(keyRecords))
+	for _, keyRecord := range keyRecords {
+		keys = append(keys, apiKeyEntity(keyRecord))
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes the API key. Revoking a key already revoked keeps the time it was first revoked.
+func (dbs *DatabaseService) RevokeAPIKey(ctx context.Context, keyID string) error {
+	return dbs.transaction(ctx, func(txDB *Database) error {
+		_, err := txDB.GetAPIKeyRecord(keyID)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "api key not found", NotFound: true}
+		} else if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		_, err = txDB.RevokeAPIKeyRecord(keyID, time.Now())
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		return nil
+	})
+}
+
+// RecordAPIKeyNonce records the nonce of a signed request made with the API key.
+// If the nonce was already recorded, i.e. the request is a replay, fresh is false.
+// Nonces recorded before expiredBefore are forgotten, as requests signed that long ago are rejected anyway.
+func (dbs *DatabaseService) RecordAPIKeyNonce(ctx context.Context, keyID string, nonce string,
+	expiredBefore time.Time) (fresh bool, err error) {
+	err = dbs.transaction(ctx, func(txDB *Database) error {
+		err := txDB.DeleteAPIKeyNonceRecords(keyID, expiredBefore)
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		_, err = txDB.GetAPIKeyNonceRecord(keyID, nonce)
+		if err == nil {
+			return nil
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		err = txDB.InsertAPIKeyNonceRecord(APIKeyNonce{APIKeyID: keyID, Nonce: nonce, CreatedAt: time.Now()})
+		if err != nil {
+			return &DBServiceError{Msg: "database error", Err: err}
+		}
+
+		fresh = true
+		return nil
+	})
+
 	if err != nil {
+		// A concurrent request with the same nonce might have won the race to the primary key
+		db, cancel := dbs.withContext(ctx)
+		defer cancel()
+		if _, errGet := db.GetAPIKeyNonceRecord(keyID, nonce); errGet == nil {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return fresh, nil
+}
+
+// withContext returns the database bound to ctx, with the query timeout applied.
+// The cancel function must always be called once done.
+func (dbs *DatabaseService) withContext(ctx context.Context) (*Database, context.CancelFunc) {
+	if dbs.QueryTimeout <= 0 {
+		ctx, cancel := context.WithCancel(ctx)
+		return dbs.Database.WithContext(ctx), cancel
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, dbs.QueryTimeout)
+	return dbs.Database.WithContext(ctx), cancel
+}
+
+// transaction runs fn inside a database transaction bound to ctx.
+// Errors not coming from fn itself (e.g. failing to commit) are wrapped in a DBServiceError.
+func (dbs *DatabaseService) transaction(ctx context.Context, fn func(txDB *Database) error) error {
+	db, cancel := dbs.withContext(ctx)
+	defer cancel()
+
+	err := db.Transaction(fn)
+	if _, ok := err.(*DBServiceError); !ok && err != nil {
 		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
-	err = dbs.Database.UpdateAuthorisationState(authID, stateID)
+	return err
+}
+
+// lockAuthorisation locks the authorisation row until the end of the DB transaction and returns the authorisation
+// along with all its transactions.
+func lockAuthorisation(txDB *Database, authID string) (authItem entities.Authorisation, err error) {
+	authRecord, err := txDB.LockAuthorisationRecord(authID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return authItem, &DBServiceError{Msg: "authorisation record not found", NotFound: true}
+	} else if err != nil {
+		return authItem, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	transactionRecords, err := txDB.FindAllTransactionRecords(authID)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return authItem, &DBServiceError{Msg: "database error", Err: err}
+	}
+
+	authItem = entities.Authorisation{
+		ID:           authRecord.ID,
+		State:        entities.PaymentState(authRecord.State.Name),
+		Amount:       money.Money{MinorUnits: authRecord.Amount, Currency: authRecord.Currency.Name},
+		MerchantName: authRecord.MerchantName,
+		Transaction:  transactionEntities(transactionRecords, authRecord.Currency.Name),
+	}
+
+	return authItem, nil
+}
+
+func transactionEntities(transactionRecords []Transaction, currency string) []entities.Transaction {
+	transactionsList := make([]entities.Transaction, 0, len(transactionRecords))
+
+	for _, transRecord := range transactionRecords {
+		transactionsList = append(transactionsList, transactionEntity(transRecord, currency))
+	}
+
+	return transactionsList
+}
+
+func transactionEntity(transRecord Transaction, currency string) entities.Transaction {
+	return entities.Transaction{
+		ID:              strconv.FormatUint(transRecord.ID, 10),
+		Type:            entities.TransactionType(transRecord.Type),
+		Status:          entities.TransactionStatus(transRecord.Status),
+		Amount:          money.Money{MinorUnits: transRecord.Amount, Currency: currency},
+		AuthorisationID: transRecord.AuthorisationID,
+		Attempts:        transRecord.Attempts,
+		CreatedAt:       transRecord.CreatedAt,
+	}
+}
+
+func journalEntryEntity(journalRecord AuthorisationJournal) entities.AuthorisationJournalEntry {
+	return entities.AuthorisationJournalEntry{
+		Reference:       journalRecord.Reference,
+		MerchantName:    journalRecord.MerchantName,
+		Amount:          money.Money{MinorUnits: journalRecord.Amount, Currency: journalRecord.Currency.Name},
+		CreditCardToken: journalRecord.CreditCardToken,
+		Status:          entities.JournalStatus(journalRecord.Status),
+		AuthorisationID: journalRecord.AuthorisationID,
+		Attempts:        journalRecord.Attempts,
+		CreatedAt:       journalRecord.CreatedAt,
+	}
+}
+
+// updateCreditCardDetails replaces the card holder name and expiry date of the stored card with the ones of the card
+// provided, if they differ.
+func updateCreditCardDetails(db *Database, creditCardRecord *CreditCard, card entities.CreditCard) error {
+	if creditCardRecord.Name == card.Name && creditCardRecord.ExpiryMonth == card.ExpiryMonth &&
+		creditCardRecord.ExpiryYear == card.ExpiryYear {
+		return nil
+	}
+
+	err := db.UpdateCreditCardDetails(creditCardRecord.Token, card.Name, card.ExpiryMonth, card.ExpiryYear)
 	if err != nil {
 		return &DBServiceError{Msg: "database error", Err: err}
 	}
 
+	creditCardRecord.Name = card.Name
+	creditCardRecord.ExpiryMonth = card.ExpiryMonth
+	creditCardRecord.ExpiryYear = card.ExpiryYear
 	return nil
 }
+
+func creditCardEntity(creditCardRecord CreditCard) entities.CreditCard {
+	return entities.CreditCard{
+		Token:           creditCardRecord.Token,
+		BIN:             creditCardRecord.BIN,
+		LastFour:        creditCardRecord.LastFour,
+		Brand:           creditCardRecord.Brand,
+		Name:            creditCardRecord.Name,
+		ExpiryMonth:     creditCardRecord.ExpiryMonth,
+		ExpiryYear:      creditCardRecord.ExpiryYear,
+		Fingerprint:     creditCardRecord.Fingerprint,
+		EncryptedNumber: creditCardRecord.EncryptedNumber,
+		EncryptedKey:    creditCardRecord.EncryptedKey,
+	}
+}
+
+func idempotencyKeyEntity(keyRecord IdempotencyKey) entities.IdempotencyKey {
+	return entities.IdempotencyKey{
+		Key:          keyRecord.Key,
+		MerchantName: keyRecord.MerchantName,
+		RequestHash:  keyRecord.RequestHash,
+		Completed:    keyRecord.Completed,
+		StatusCode:   keyRecord.StatusCode,
+		ResponseBody: keyRecord.ResponseBody,
+	}
+}
+
+func apiKeyEntity(keyRecord APIKey) entities.APIKey {
+	return entities.APIKey{
+		ID:              keyRecord.ID,
+		MerchantName:    keyRecord.MerchantName,
+		CreatedAt:       keyRecord.CreatedAt,
+		RevokedAt:       keyRecord.RevokedAt,
+		EncryptedSecret: keyRecord.EncryptedSecret,
+		EncryptedKey:    keyRecord.EncryptedKey,
+	}
+}
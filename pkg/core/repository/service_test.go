@@ -0,0 +1,63 @@
+package repository_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/migrations"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/repotest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSQLiteService returns a database service backed by a new SQLite database, with all the migrations applied.
+func newSQLiteService(t *testing.T) *repository.DatabaseService {
+	t.Helper()
+
+	config := core.DatabaseConfiguration{Driver: core.DriverSQLite, DBName: filepath.Join(t.TempDir(), "pgw.db")}
+	dbs, err := repository.NewDatabaseService(config)
+	require.NoError(t, err)
+	t.Cleanup(func() { dbs.Close() })
+
+	sqlDB, err := dbs.Database.SQLDB()
+	require.NoError(t, err)
+	migrator, err := migrations.NewMigrator(sqlDB, config.Driver)
+	require.NoError(t, err)
+	_, err = migrator.Up(context.Background())
+	require.NoError(t, err)
+
+	return dbs
+}
+
+func TestConformance(t *testing.T) {
+	repotest.Run(t, func(t *testing.T) core.Repository { return newSQLiteService(t) })
+}
+
+func TestMigrationsUpAndDown(t *testing.T) {
+	dbs := newSQLiteService(t)
+	ctx := context.Background()
+
+	sqlDB, err := dbs.Database.SQLDB()
+	require.NoError(t, err)
+	migrator, err := migrations.NewMigrator(sqlDB, core.DriverSQLite)
+	require.NoError(t, err)
+
+	pending, err := migrator.Pending(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 0, pending)
+
+	exists, err := dbs.CurrencyExists(ctx, "EUR")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	reverted, err := migrator.Down(ctx, len(migrator.Migrations))
+	require.NoError(t, err)
+	assert.Len(t, reverted, len(migrator.Migrations))
+
+	applied, err := migrator.Up(ctx)
+	require.NoError(t, err)
+	assert.Len(t, applied, len(migrator.Migrations))
+}
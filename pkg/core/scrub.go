@@ -0,0 +1,83 @@
+package core
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+)
+
+// RedactedValue replaces values that must never be logged.
+const RedactedValue = "[REDACTED]"
+
+// panCandidateRegexp matches sequences of 12 to 19 digits, optionally grouped with spaces or dashes.
+var panCandidateRegexp = regexp.MustCompile(`\b\d(?:[ -]?\d){11,18}\b`)
+
+// cvvRegexp matches CVV like key/value pairs, e.g. `"cvv":123` or `cvc=0123`.
+var cvvRegexp = regexp.MustCompile(`(?i)("?\b(?:cvv2?|cvc2?|csc|security_code)"?\s*[:=]\s*"?)\d{3,4}`)
+
+// sensitiveFieldKeys are log field keys whose values are always redacted.
+var sensitiveFieldKeys = map[string]bool{
+	"cvv":                true,
+	"cvv2":               true,
+	"cvc":                true,
+	"cvc2":               true,
+	"csc":                true,
+	"security_code":      true,
+	"pan":                true,
+	"card_number":        true,
+	"credit_card_number": true,
+}
+
+// ScrubString masks anything that looks like a card number (a digit sequence passing the Luhn check)
+// and redacts CVV values in key/value pairs.
+func ScrubString(s string) string {
+	s = panCandidateRegexp.ReplaceAllStringFunc(s, func(match string) string {
+		digits := strings.NewReplacer(" ", "", "-", "").Replace(match)
+		if !LuhnValid(digits) {
+			return match
+		}
+		return MaskPAN(digits)
+	})
+
+	return cvvRegexp.ReplaceAllString(s, "${1}***")
+}
+
+// ScrubFields returns a copy of the log fields with sensitive values masked or redacted.
+func ScrubFields(fields log.FieldsMap) log.FieldsMap {
+	scrubbed := make(log.FieldsMap, len(fields))
+	for key, value := range fields {
+		scrubbed[key] = scrubField(key, value)
+	}
+	return scrubbed
+}
+
+func scrubField(key string, value interface{}) interface{} {
+	if sensitiveFieldKeys[strings.ToLower(key)] {
+		return RedactedValue
+	}
+
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return ScrubString(v)
+	case error:
+		return ScrubString(v.Error())
+	case int, int32, int64, uint, uint32, uint64:
+		digits := fmt.Sprint(v)
+		if len(digits) >= 12 && LuhnValid(digits) {
+			return MaskPAN(digits)
+		}
+		return v
+	case log.FieldsMap:
+		return ScrubFields(v)
+	case map[string]interface{}:
+		return map[string]interface{}(ScrubFields(v))
+	case fmt.Stringer:
+		return ScrubString(v.String())
+	default:
+		return v
+	}
+}
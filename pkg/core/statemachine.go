@@ -0,0 +1,219 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+)
+
+// ErrInvalidTransactionAmount is returned when a capture or refund amount is not positive or is in the wrong currency.
+var ErrInvalidTransactionAmount = errors.New("transaction amount must be greater than zero and in the authorisation currency")
+
+// IllegalTransitionError is returned when an operation (or a state change) is not allowed in the current state
+// of the payment.
+type IllegalTransitionError struct {
+	From      entities.PaymentState
+	To        entities.PaymentState
+	Operation entities.TransactionType
+}
+
+func (e *IllegalTransitionError) Error() string {
+	if e.Operation != "" {
+		return fmt.Sprintf("cannot %s payment - payment has been '%s'", strings.ToLower(string(e.Operation)), e.From)
+	}
+	return fmt.Sprintf("cannot move payment from '%s' to '%s'", e.From, e.To)
+}
+
+// AmountExceededError is returned when capturing more than what is left to capture,
+// or refunding more than what is left to refund.
+type AmountExceededError struct {
+	Operation entities.TransactionType
+	Requested money.Money
+	Available money.Money
+}
+
+func (e *AmountExceededError) Error() string {
+	if e.Operation == entities.TransactionRefund {
+		return fmt.Sprintf("cannot refund more money than what was captured (available: %s)", e.Available)
+	}
+	return fmt.Sprintf("cannot request more money than what was authorised (available: %s)", e.Available)
+}
+
+// OperationInProgressError is returned when an operation conflicts with another one still pending on the payment.
+type OperationInProgressError struct {
+	Operation entities.TransactionType
+}
+
+func (e *OperationInProgressError) Error() string {
+	if e.Operation == "" {
+		return "cannot change payment state - another operation is in progress"
+	}
+	return fmt.Sprintf("cannot %s payment - another operation is in progress", strings.ToLower(string(e.Operation)))
+}
+
+// paymentTransitions lists every legal state transition.
+// Refunded, Voided, Expired and Failed are final states.
+var paymentTransitions = map[entities.PaymentState][]entities.PaymentState{
+	entities.StateAuthorised: {entities.StatePartiallyCaptured, entities.StateCaptured, entities.StateVoided,
+		entities.StateExpired, entities.StateFailed},
+	entities.StatePartiallyCaptured: {entities.StatePartiallyCaptured, entities.StateCaptured,
+		entities.StatePartiallyRefunded, entities.StateRefunded},
+	entities.StateCaptured:          {entities.StatePartiallyRefunded, entities.StateRefunded},
+	entities.StatePartiallyRefunded: {entities.StatePartiallyRefunded, entities.StateRefunded},
+}
+
+// CanTransition reports whether a payment can move from one state to the other.
+func CanTransition(from entities.PaymentState, to entities.PaymentState) bool {
+	for _, state := range paymentTransitions[from] {
+		if state == to {
+			return true
+		}
+	}
+	return false
+}
+
+// PaymentStateMachine owns the rules on which operations are allowed on a payment and the state it ends up in.
+//
+// It is built from an authorisation and all its transactions. Pending transactions (operations sent to the payment
+// processor whose outcome is not known yet) count towards the limits as if they had completed, failed ones are ignored.
+type PaymentStateMachine struct {
+	state      entities.PaymentState
+	authorised money.Money
+
+	captured        int64
+	pendingCaptured int64
+	refunded        int64
+	pendingRefunded int64
+	pendingVoid     bool
+}
+
+// NewPaymentStateMachine returns the state machine of the authorisation.
+func NewPaymentStateMachine(auth entities.Authorisation) *PaymentStateMachine {
+	m := &PaymentStateMachine{state: auth.State, authorised: auth.Amount}
+
+	for _, transItem := range auth.Transaction {
+		pending := transItem.Status == entities.TransactionPending
+		completed := transItem.Status == entities.TransactionCompleted
+
+		switch transItem.Type {
+		case entities.TransactionCapture:
+			if completed {
+				m.captured += transItem.Amount.MinorUnits
+			} else if pending {
+				m.pendingCaptured += transItem.Amount.MinorUnits
+			}
+		case entities.TransactionRefund:
+			if completed {
+				m.refunded += transItem.Amount.MinorUnits
+			} else if pending {
+				m.pendingRefunded += transItem.Amount.MinorUnits
+			}
+		case entities.TransactionVoid:
+			m.pendingVoid = m.pendingVoid || pending
+		}
+	}
+
+	return m
+}
+
+// State returns the current state of the payment.
+func (m *PaymentStateMachine) State() entities.PaymentState {
+	return m.state
+}
+
+// HasPendingTransactions returns true if there are operations on the payment whose outcome is not known yet.
+func (m *PaymentStateMachine) HasPendingTransactions() bool {
+	return m.pendingCaptured > 0 || m.pendingRefunded > 0 || m.pendingVoid
+}
+
+// CheckTransaction checks a new capture, refund or void can be requested.
+func (m *PaymentStateMachine) CheckTransaction(transaction entities.Transaction) error {
+	if transaction.Type == entities.TransactionCapture || transaction.Type == entities.TransactionRefund {
+		if !transaction.Amount.IsPositive() || transaction.Amount.Currency != m.authorised.Currency {
+			return ErrInvalidTransactionAmount
+		}
+	}
+
+	switch transaction.Type {
+	case entities.TransactionCapture:
+		if !CanTransition(m.state, entities.StatePartiallyCaptured) && !CanTransition(m.state, entities.StateCaptured) {
+			return &IllegalTransitionError{From: m.state, Operation: transaction.Type}
+		}
+		if m.pendingVoid || m.pendingRefunded > 0 {
+			return &OperationInProgressError{Operation: transaction.Type}
+		}
+		available := m.authorised.MinorUnits - m.captured - m.pendingCaptured
+		if transaction.Amount.MinorUnits > available {
+			return &AmountExceededError{Operation: transaction.Type, Requested: transaction.Amount,
+				Available: money.Money{MinorUnits: available, Currency: m.authorised.Currency}}
+		}
+	case entities.TransactionRefund:
+		if !CanTransition(m.state, entities.StatePartiallyRefunded) && !CanTransition(m.state, entities.StateRefunded) {
+			return &IllegalTransitionError{From: m.state, Operation: transaction.Type}
+		}
+		if m.pendingCaptured > 0 {
+			return &OperationInProgressError{Operation: transaction.Type}
+		}
+		available := m.captured - m.refunded - m.pendingRefunded
+		if transaction.Amount.MinorUnits > available {
+			return &AmountExceededError{Operation: transaction.Type, Requested: transaction.Amount,
+				Available: money.Money{MinorUnits: available, Currency: m.authorised.Currency}}
+		}
+	case entities.TransactionVoid:
+		if !CanTransition(m.state, entities.StateVoided) {
+			return &IllegalTransitionError{From: m.state, Operation: transaction.Type}
+		}
+		if m.HasPendingTransactions() {
+			return &OperationInProgressError{Operation: transaction.Type}
+		}
+	default:
+		return fmt.Errorf("transaction type '%s' not supported", transaction.Type)
+	}
+
+	return nil
+}
+
+// CompletedState returns the state the payment moves to once the given pending transaction completes successfully.
+func (m *PaymentStateMachine) CompletedState(transaction entities.Transaction) (entities.PaymentState, error) {
+	var next entities.PaymentState
+
+	switch transaction.Type {
+	case entities.TransactionCapture:
+		next = entities.StatePartiallyCaptured
+		if m.captured+transaction.Amount.MinorUnits >= m.authorised.MinorUnits {
+			next = entities.StateCaptured
+		}
+	case entities.TransactionRefund:
+		next = entities.StatePartiallyRefunded
+		if m.refunded+transaction.Amount.MinorUnits >= m.captured {
+			next = entities.StateRefunded
+		}
+	case entities.TransactionVoid:
+		next = entities.StateVoided
+	default:
+		return m.state, fmt.Errorf("transaction type '%s' not supported", transaction.Type)
+	}
+
+	if !CanTransition(m.state, next) {
+		return m.state, &IllegalTransitionError{From: m.state, To: next, Operation: transaction.Type}
+	}
+
+	return next, nil
+}
+
+// Transition checks the payment can move straight to the given state, e.g. when it expires or fails.
+func (m *PaymentStateMachine) Transition(to entities.PaymentState) error {
+	if !CanTransition(m.state, to) {
+		return &IllegalTransitionError{From: m.state, To: to}
+	}
+
+	if m.HasPendingTransactions() {
+		return &OperationInProgressError{}
+	}
+
+	m.state = to
+	return nil
+}
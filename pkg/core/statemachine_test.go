@@ -0,0 +1,248 @@
+package core_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func eur(minorUnits int64) money.Money {
+	return money.Money{MinorUnits: minorUnits, Currency: "EUR"}
+}
+
+func transaction(transType entities.TransactionType, status entities.TransactionStatus, minorUnits int64) entities.Transaction {
+	return entities.Transaction{Type: transType, Status: status, Amount: eur(minorUnits)}
+}
+
+func TestCanTransition(t *testing.T) {
+	tests := map[string]struct {
+		from           entities.PaymentState
+		to             entities.PaymentState
+		expectedOutput bool
+	}{
+		"authorised to partially captured":   {from: entities.StateAuthorised, to: entities.StatePartiallyCaptured, expectedOutput: true},
+		"authorised to voided":               {from: entities.StateAuthorised, to: entities.StateVoided, expectedOutput: true},
+		"authorised to expired":              {from: entities.StateAuthorised, to: entities.StateExpired, expectedOutput: true},
+		"authorised to refunded":             {from: entities.StateAuthorised, to: entities.StateRefunded, expectedOutput: false},
+		"partially captured to captured":     {from: entities.StatePartiallyCaptured, to: entities.StateCaptured, expectedOutput: true},
+		"partially captured to voided":       {from: entities.StatePartiallyCaptured, to: entities.StateVoided, expectedOutput: false},
+		"captured to partially refunded":     {from: entities.StateCaptured, to: entities.StatePartiallyRefunded, expectedOutput: true},
+		"captured to captured":               {from: entities.StateCaptured, to: entities.StateCaptured, expectedOutput: false},
+		"partially refunded to refunded":     {from: entities.StatePartiallyRefunded, to: entities.StateRefunded, expectedOutput: true},
+		"partially refunded to captured":     {from: entities.StatePartiallyRefunded, to: entities.StateCaptured, expectedOutput: false},
+		"refunded is final":                  {from: entities.StateRefunded, to: entities.StatePartiallyRefunded, expectedOutput: false},
+		"voided is final":                    {from: entities.StateVoided, to: entities.StateCaptured, expectedOutput: false},
+		"expired is final":                   {from: entities.StateExpired, to: entities.StateAuthorised, expectedOutput: false},
+		"failed is final":                    {from: entities.StateFailed, to: entities.StateAuthorised, expectedOutput: false},
+		"unknown state has no transitions":   {from: "Unknown", to: entities.StateCaptured, expectedOutput: false},
+		"authorised to failed":               {from: entities.StateAuthorised, to: entities.StateFailed, expectedOutput: true},
+		"captured cannot expire":             {from: entities.StateCaptured, to: entities.StateExpired, expectedOutput: false},
+		"partially captured to fully refund": {from: entities.StatePartiallyCaptured, to: entities.StateRefunded, expectedOutput: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			value := core.CanTransition(test.from, test.to)
+			assert.Equal(t, test.expectedOutput, value)
+		})
+	}
+}
+
+func TestPaymentStateMachineCheckTransaction(t *testing.T) {
+	tests := map[string]struct {
+		state        entities.PaymentState
+		transactions []entities.Transaction
+		transaction  entities.Transaction
+		expectedErr  interface{}
+	}{
+		"capture from authorised": {
+			state:       entities.StateAuthorised,
+			transaction: transaction(entities.TransactionCapture, "", 1000),
+		},
+		"capture more than authorised": {
+			state:       entities.StateAuthorised,
+			transaction: transaction(entities.TransactionCapture, "", 1001),
+			expectedErr: &core.AmountExceededError{},
+		},
+		"capture counts pending captures": {
+			state:        entities.StatePartiallyCaptured,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 400), transaction(entities.TransactionCapture, entities.TransactionPending, 500)},
+			transaction:  transaction(entities.TransactionCapture, "", 101),
+			expectedErr:  &core.AmountExceededError{},
+		},
+		"capture ignores failed captures": {
+			state:        entities.StateAuthorised,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionFailed, 1000)},
+			transaction:  transaction(entities.TransactionCapture, "", 1000),
+		},
+		"capture from captured": {
+			state:       entities.StateCaptured,
+			transaction: transaction(entities.TransactionCapture, "", 1),
+			expectedErr: &core.IllegalTransitionError{},
+		},
+		"capture from voided": {
+			state:       entities.StateVoided,
+			transaction: transaction(entities.TransactionCapture, "", 1),
+			expectedErr: &core.IllegalTransitionError{},
+		},
+		"capture while voiding": {
+			state:        entities.StateAuthorised,
+			transactions: []entities.Transaction{transaction(entities.TransactionVoid, entities.TransactionPending, 0)},
+			transaction:  transaction(entities.TransactionCapture, "", 1),
+			expectedErr:  &core.OperationInProgressError{Operation: entities.TransactionCapture},
+		},
+		"capture with zero amount": {
+			state:       entities.StateAuthorised,
+			transaction: transaction(entities.TransactionCapture, "", 0),
+			expectedErr: core.ErrInvalidTransactionAmount,
+		},
+		"capture in another currency": {
+			state:       entities.StateAuthorised,
+			transaction: entities.Transaction{Type: entities.TransactionCapture, Amount: money.Money{MinorUnits: 1, Currency: "GBP"}},
+			expectedErr: core.ErrInvalidTransactionAmount,
+		},
+		"refund from partially captured": {
+			state:        entities.StatePartiallyCaptured,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 400)},
+			transaction:  transaction(entities.TransactionRefund, "", 400),
+		},
+		"refund more than captured": {
+			state:        entities.StatePartiallyRefunded,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 1000), transaction(entities.TransactionRefund, entities.TransactionCompleted, 600), transaction(entities.TransactionRefund, entities.TransactionPending, 300)},
+			transaction:  transaction(entities.TransactionRefund, "", 101),
+			expectedErr:  &core.AmountExceededError{},
+		},
+		"refund from authorised": {
+			state:       entities.StateAuthorised,
+			transaction: transaction(entities.TransactionRefund, "", 1),
+			expectedErr: &core.IllegalTransitionError{},
+		},
+		"refund from refunded": {
+			state:        entities.StateRefunded,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 1000), transaction(entities.TransactionRefund, entities.TransactionCompleted, 1000)},
+			transaction:  transaction(entities.TransactionRefund, "", 1),
+			expectedErr:  &core.IllegalTransitionError{},
+		},
+		"refund while capturing": {
+			state:        entities.StatePartiallyCaptured,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 400), transaction(entities.TransactionCapture, entities.TransactionPending, 100)},
+			transaction:  transaction(entities.TransactionRefund, "", 1),
+			expectedErr:  &core.OperationInProgressError{Operation: entities.TransactionRefund},
+		},
+		"void from authorised": {
+			state:       entities.StateAuthorised,
+			transaction: transaction(entities.TransactionVoid, "", 0),
+		},
+		"void while capturing": {
+			state:        entities.StateAuthorised,
+			transactions: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionPending, 100)},
+			transaction:  transaction(entities.TransactionVoid, "", 0),
+			expectedErr:  &core.OperationInProgressError{Operation: entities.TransactionVoid},
+		},
+		"void from partially captured": {
+			state:       entities.StatePartiallyCaptured,
+			transaction: transaction(entities.TransactionVoid, "", 0),
+			expectedErr: &core.IllegalTransitionError{},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			auth := entities.Authorisation{State: test.state, Amount: eur(1000), Transaction: test.transactions}
+			err := core.NewPaymentStateMachine(auth).CheckTransaction(test.transaction)
+
+			switch expectedErr := test.expectedErr.(type) {
+			case nil:
+				assert.NoError(t, err)
+			case *core.AmountExceededError:
+				assert.True(t, errors.As(err, &expectedErr))
+			case *core.IllegalTransitionError:
+				assert.True(t, errors.As(err, &expectedErr))
+			case *core.OperationInProgressError:
+				var inProgressErr *core.OperationInProgressError
+				require.True(t, errors.As(err, &inProgressErr))
+				assert.Equal(t, expectedErr, inProgressErr)
+			case error:
+				assert.True(t, errors.Is(err, expectedErr))
+			}
+		})
+	}
+}
+
+func TestPaymentStateMachineCompletedState(t *testing.T) {
+	tests := map[string]struct {
+		state         entities.PaymentState
+		transactions  []entities.Transaction
+		transaction   entities.Transaction
+		expectedState entities.PaymentState
+	}{
+		"partial capture": {
+			state:         entities.StateAuthorised,
+			transaction:   transaction(entities.TransactionCapture, entities.TransactionPending, 400),
+			expectedState: entities.StatePartiallyCaptured,
+		},
+		"full capture": {
+			state:         entities.StateAuthorised,
+			transaction:   transaction(entities.TransactionCapture, entities.TransactionPending, 1000),
+			expectedState: entities.StateCaptured,
+		},
+		"last partial capture": {
+			state:         entities.StatePartiallyCaptured,
+			transactions:  []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 400)},
+			transaction:   transaction(entities.TransactionCapture, entities.TransactionPending, 600),
+			expectedState: entities.StateCaptured,
+		},
+		"partial refund": {
+			state:         entities.StateCaptured,
+			transactions:  []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 1000)},
+			transaction:   transaction(entities.TransactionRefund, entities.TransactionPending, 300),
+			expectedState: entities.StatePartiallyRefunded,
+		},
+		"full refund of a partial capture": {
+			state:         entities.StatePartiallyCaptured,
+			transactions:  []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionCompleted, 400)},
+			transaction:   transaction(entities.TransactionRefund, entities.TransactionPending, 400),
+			expectedState: entities.StateRefunded,
+		},
+		"void": {
+			state:         entities.StateAuthorised,
+			transaction:   transaction(entities.TransactionVoid, entities.TransactionPending, 0),
+			expectedState: entities.StateVoided,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			auth := entities.Authorisation{State: test.state, Amount: eur(1000),
+				Transaction: append(test.transactions, test.transaction)}
+			state, err := core.NewPaymentStateMachine(auth).CompletedState(test.transaction)
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedState, state)
+		})
+	}
+}
+
+func TestPaymentStateMachineTransition(t *testing.T) {
+	machine := core.NewPaymentStateMachine(entities.Authorisation{State: entities.StateAuthorised, Amount: eur(1000)})
+	require.NoError(t, machine.Transition(entities.StateExpired))
+	assert.Equal(t, entities.StateExpired, machine.State())
+
+	var transitionErr *core.IllegalTransitionError
+	err := machine.Transition(entities.StateAuthorised)
+	require.True(t, errors.As(err, &transitionErr))
+	assert.Equal(t, entities.StateExpired, transitionErr.From)
+	assert.Equal(t, entities.StateAuthorised, transitionErr.To)
+
+	machine = core.NewPaymentStateMachine(entities.Authorisation{State: entities.StateAuthorised, Amount: eur(1000),
+		Transaction: []entities.Transaction{transaction(entities.TransactionCapture, entities.TransactionPending, 100)}})
+	var inProgressErr *core.OperationInProgressError
+	err = machine.Transition(entities.StateFailed)
+	require.True(t, errors.As(err, &inProgressErr))
+	assert.Equal(t, "cannot change payment state - another operation is in progress", err.Error())
+	assert.Equal(t, entities.StateAuthorised, machine.State())
+}
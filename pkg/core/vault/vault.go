@@ -0,0 +1,186 @@
+// Package vault tokenises credit cards so that card numbers are never stored in clear.
+//
+// Card numbers are protected with envelope encryption: each card number is encrypted with its own randomly
+// generated data encryption key (DEK), and the DEK is in turn encrypted (wrapped) with the key encryption key (KEK)
+// configured locally. Only the encrypted card number and the wrapped DEK are ever persisted.
+// Both are bound to the card token (authenticated as additional data), so a ciphertext copied to another card row
+// does not decrypt.
+// The card verification value (CVV) is never part of the tokenised card.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+)
+
+// KeySize is the size in bytes of the key encryption key (AES-256).
+const KeySize = 32
+
+// TokenPrefix is the prefix of every card token, so tokens are easy to tell apart from card numbers.
+const TokenPrefix = "tok_"
+
+// ErrInvalidCardNumber is returned when trying to tokenise something that doesn't look like a card number.
+var ErrInvalidCardNumber = errors.New("card number must have between 12 and 19 digits")
+
+// Vault encrypts and decrypts card numbers.
+type Vault struct {
+	kek            cipher.AEAD
+	fingerprintKey []byte
+}
+
+// New returns a new Vault using the given key encryption key.
+func New(kek []byte) (*Vault, error) {
+	if len(kek) != KeySize {
+		return nil, fmt.Errorf("key encryption key must be %d bytes long", KeySize)
+	}
+
+	aead, err := newAEAD(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	// Derive a separate key for fingerprints, so the KEK itself is only ever used to wrap keys
+	mac := hmac.New(sha256.New, kek)
+	mac.Write([]byte("pgw card fingerprint"))
+
+	return &Vault{kek: aead, fingerprintKey: mac.Sum(nil)}, nil
+}
+
+// Tokenise returns a card holding an opaque token and the encrypted card number.
+// The returned card keeps the BIN (first 6 digits) and the last 4 digits for display purposes.
+func (v *Vault) Tokenise(number string, name string, expiryMonth uint, expiryYear uint) (card entities.CreditCard, err error) {
+	if len(number) < 12 || len(number) > 19 {
+		return card, ErrInvalidCardNumber
+	}
+
+	token, err := NewToken()
+	if err != nil {
+		return card, err
+	}
+
+	encryptedNumber, encryptedKey, err := v.Seal(number, token)
+	if err != nil {
+		return card, err
+	}
+
+	card = entities.CreditCard{
+		Token:           token,
+		BIN:             number[:6],
+		LastFour:        number[len(number)-4:],
+		Name:            name,
+		ExpiryMonth:     expiryMonth,
+		ExpiryYear:      expiryYear,
+		Fingerprint:     v.Fingerprint(number),
+		EncryptedNumber: encryptedNumber,
+		EncryptedKey:    encryptedKey,
+	}
+
+	return card, nil
+}
+
+// Detokenise returns the card number of a tokenised card.
+func (v *Vault) Detokenise(card entities.CreditCard) (number string, err error) {
+	return v.Open(card.EncryptedNumber, card.EncryptedKey, card.Token)
+}
+
+// Seal encrypts the card number with a new DEK and returns it along with the DEK wrapped by the KEK.
+// Both are bound to the associated data (e.g. the card token), which has to be given again to Open them.
+func (v *Vault) Seal(number string, associatedData string) (encryptedNumber []byte, encryptedKey []byte, err error) {
+	dek := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return nil, nil, err
+	}
+
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedNumber, err = seal(dekAEAD, []byte(number), []byte(associatedData))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	encryptedKey, err = seal(v.kek, dek, []byte(associatedData))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return encryptedNumber, encryptedKey, nil
+}
+
+// Open unwraps the DEK with the KEK and decrypts the card number with it.
+// It fails if the associated data is not the one given to Seal.
+func (v *Vault) Open(encryptedNumber []byte, encryptedKey []byte, associatedData string) (number string, err error) {
+	dek, err := open(v.kek, encryptedKey, []byte(associatedData))
+	if err != nil {
+		return "", fmt.Errorf("unwrapping data encryption key: %w", err)
+	}
+
+	dekAEAD, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := open(dekAEAD, encryptedNumber, []byte(associatedData))
+	if err != nil {
+		return "", fmt.Errorf("decrypting card number: %w", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// Fingerprint returns a keyed hash of the card number, which allows finding a card without decrypting anything.
+func (v *Vault) Fingerprint(number string) string {
+	mac := hmac.New(sha256.New, v.fingerprintKey)
+	mac.Write([]byte(number))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// NewToken returns a new random card token.
+func NewToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return "", err
+	}
+
+	return TokenPrefix + hex.EncodeToString(b), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext, authenticating the additional data, and returns it prefixed with the random nonce used.
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a ciphertext produced by seal.
+func open(aead cipher.AEAD, ciphertext []byte, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
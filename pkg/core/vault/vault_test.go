@@ -0,0 +1,99 @@
+package vault_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTokeniseDetokenise(t *testing.T) {
+	v, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	card, err := v.Tokenise("4000000000000119", "customer1", 10, 2030)
+	require.NoError(t, err)
+
+	assert.True(t, strings.HasPrefix(card.Token, vault.TokenPrefix))
+	assert.Equal(t, "400000", card.BIN)
+	assert.Equal(t, "0119", card.LastFour)
+	assert.NotContains(t, string(card.EncryptedNumber), "4000000000000119")
+
+	number, err := v.Detokenise(card)
+	require.NoError(t, err)
+	assert.Equal(t, "4000000000000119", number)
+}
+
+func TestFingerprint(t *testing.T) {
+	v1, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+	v2, err := vault.New(bytes.Repeat([]byte{2}, vault.KeySize))
+	require.NoError(t, err)
+
+	card1, err := v1.Tokenise("4000000000000119", "customer1", 10, 2030)
+	require.NoError(t, err)
+	card2, err := v1.Tokenise("4000000000000119", "customer1", 10, 2030)
+	require.NoError(t, err)
+
+	assert.Equal(t, card1.Fingerprint, card2.Fingerprint)
+	assert.NotEqual(t, card1.Token, card2.Token)
+	assert.NotEqual(t, card1.EncryptedKey, card2.EncryptedKey)
+	assert.NotEqual(t, v1.Fingerprint("4000000000000119"), v2.Fingerprint("4000000000000119"))
+}
+
+func TestOpenWithWrongKey(t *testing.T) {
+	v1, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+	v2, err := vault.New(bytes.Repeat([]byte{2}, vault.KeySize))
+	require.NoError(t, err)
+
+	card, err := v1.Tokenise("4000000000000119", "customer1", 10, 2030)
+	require.NoError(t, err)
+
+	_, err = v2.Detokenise(card)
+	assert.Error(t, err)
+}
+
+func TestOpenWithWrongAssociatedData(t *testing.T) {
+	v, err := vault.New(bytes.Repeat([]byte{1}, vault.KeySize))
+	require.NoError(t, err)
+
+	card1, err := v.Tokenise("4000000000000119", "customer1", 10, 2030)
+	require.NoError(t, err)
+	card2, err := v.Tokenise("5105105105105100", "customer2", 10, 2030)
+	require.NoError(t, err)
+
+	// The encrypted number of a card copied to another one does not decrypt
+	card2.EncryptedNumber, card2.EncryptedKey = card1.EncryptedNumber, card1.EncryptedKey
+	_, err = v.Detokenise(card2)
+	assert.Error(t, err)
+
+	_, err = v.Open(card1.EncryptedNumber, card1.EncryptedKey, "")
+	assert.Error(t, err)
+}
+
+func TestNew(t *testing.T) {
+	tests := map[string]struct {
+		kek         []byte
+		expectedErr bool
+	}{
+		"valid key":     {kek: bytes.Repeat([]byte{1}, 32), expectedErr: false},
+		"short key":     {kek: bytes.Repeat([]byte{1}, 16), expectedErr: true},
+		"empty key":     {kek: nil, expectedErr: true},
+		"too large key": {kek: bytes.Repeat([]byte{1}, 64), expectedErr: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := vault.New(test.kek)
+			if test.expectedErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
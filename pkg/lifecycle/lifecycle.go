@@ -13,26 +13,38 @@ import (
 )
 
 // TerminateHandler terminates the application.
-// This function waits on a SIGINT or SIGTERM signal and shuts down the HTTP servers gracefully.
-func TerminateHandler(logger log.Logger, server1 core.ShutDowner, server2 core.ShutDowner) {
+// This function waits on a SIGINT or SIGTERM signal and shuts down the HTTP servers (and any other component)
+// gracefully, in the order given.
+func TerminateHandler(logger log.Logger, servers ...core.ShutDowner) {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	logger.Info("shutting down application ...")
 
-	// We will wait 5 seconds for the server to shutdown gracefully
-	ctx1, cancel1 := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel1()
-	err := server1.ShutDown(ctx1)
-	if err != nil {
-		logger.Error(fmt.Sprintf("api server1 failed to shutdown gracefully: %s", err.Error()))
+	for i, server := range servers {
+		// We will wait 5 seconds for the server to shutdown gracefully
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := server.ShutDown(ctx)
+		cancel()
+		if err != nil {
+			logger.Error(fmt.Sprintf("api server%d failed to shutdown gracefully: %s", i+1, err.Error()))
+		}
 	}
+}
+
+// ReloadHandler reloads the reloaders (e.g. TLS certificates) every time a SIGHUP signal is received.
+// If a reloader fails, it keeps what it had and the error is logged.
+func ReloadHandler(logger log.Logger, reloaders ...core.Reloader) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	for range hup {
+		logger.Info("reloading configuration ...")
 
-	// We will wait 5 seconds for the server to shutdown gracefully
-	ctx2, cancel2 := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel2()
-	err = server2.ShutDown(ctx2)
-	if err != nil {
-		logger.Error(fmt.Sprintf("api server2 failed to shutdown gracefully: %s", err.Error()))
+		for i, reloader := range reloaders {
+			if err := reloader.Reload(); err != nil {
+				logger.Error(fmt.Sprintf("reloader%d failed to reload: %s", i+1, err.Error()))
+			}
+		}
 	}
 }
@@ -0,0 +1,377 @@
+// Package pprocessorsim simulates the payment processor, so the gateway can be run and tested end to end without it.
+//
+// The simulator speaks the payment processor JSON protocol and approves every request, unless it is scripted
+// otherwise by a magic card number (authorisations only) or by a magic amount (authorisations, captures and refunds).
+// Magic amounts are 90 to 99 minor units (e.g. 0.92 EUR), so ordinary amounts are always approved.
+// Card numbers take precedence over amounts.
+//
+//	Card number        Amount  Behaviour
+//	4000000000000002   0.92    decline (code 2, "card declined")
+//	4000000000009995   0.95    decline (code 5, "insufficient funds")
+//	4000000000000077   0.97    approve after Delay
+//	4000000000000085   0.98    approve, then hang for Hang and answer 504 (the outcome is unknown to the caller)
+//	4000000000000507   0.90    answer 500 without processing the request
+//	4000000000000994   0.99    approve, then answer a malformed body
+//
+// Authorisations, captures, refunds and voids are kept in memory and validated like the real payment processor
+// does, e.g. capturing more than the amount authorised is declined. Requests carrying an Idempotency-Key (and
+// authorisations carrying a reference) are processed once, retries getting the recorded response back, and their
+// outcome can be queried.
+package pprocessorsim
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/api/middleware"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+)
+
+// Behaviour is how the simulator handles a request.
+type Behaviour string
+
+const (
+	Approve           Behaviour = "approve"
+	DeclineCard       Behaviour = "decline card"
+	DeclineFunds      Behaviour = "decline insufficient funds"
+	Delay             Behaviour = "delay"
+	ApproveAndTimeout Behaviour = "approve and timeout"
+	ServerError       Behaviour = "server error"
+	MalformedResponse Behaviour = "malformed response"
+)
+
+// Magic card numbers, selecting the behaviour of authorisations.
+const (
+	CardDeclined          = "4000000000000002"
+	CardInsufficientFunds = "4000000000009995"
+	CardDelayed           = "4000000000000077"
+	CardTimeout           = "4000000000000085"
+	CardServerError       = "4000000000000507"
+	CardMalformedResponse = "4000000000000994"
+)
+
+var cardBehaviours = map[string]Behaviour{
+	CardDeclined:          DeclineCard,
+	CardInsufficientFunds: DeclineFunds,
+	CardDelayed:           Delay,
+	CardTimeout:           ApproveAndTimeout,
+	CardServerError:       ServerError,
+	CardMalformedResponse: MalformedResponse,
+}
+
+// amountBehaviours is keyed on the amount in minor units.
+var amountBehaviours = map[int64]Behaviour{
+	92: DeclineCard,
+	95: DeclineFunds,
+	97: Delay,
+	98: ApproveAndTimeout,
+	90: ServerError,
+	99: MalformedResponse,
+}
+
+// Response codes. Any code other than codeSuccess is a decline.
+const (
+	codeSuccess           = 1
+	codeCardDeclined      = 2
+	codeAmountExceeded    = 3
+	codeNotFound          = pprocessor.DeclineCodeAuthorisationNotFound
+	codeInsufficientFunds = 5
+	codeNotAllowed        = 6
+)
+
+// Simulator is the fake payment processor. It is an http.Handler, so it can be served by httptest.NewServer.
+type Simulator struct {
+	Logger log.Logger
+
+	// Delay is how long delayed requests take to be approved.
+	Delay time.Duration
+	// Hang is how long requests that time out hang before answering 504, unless the caller gives up first.
+	Hang time.Duration
+
+	Router *gin.Engine
+
+	mu             sync.Mutex
+	lastAuthID     uint64
+	authorisations map[string]*authorisation
+	// outcomes holds the responses to authorisations by reference, and to other requests by idempotency key.
+	outcomes map[string]response
+}
+
+type authorisation struct {
+	amount   money.Money
+	captured money.Money
+	refunded money.Money
+	voided   bool
+}
+
+type response struct {
+	Code            uint   `json:"code"`
+	Reason          string `json:"reason,omitempty"`
+	AuthorisationID string `json:"authorisation_id,omitempty"`
+}
+
+type authoriseRequest struct {
+	CreditCard pprocessor.CreditCard `json:"credit_card"`
+	Currency   string                `json:"currency"`
+	Amount     json.Number           `json:"amount"`
+	Reference  string                `json:"reference"`
+}
+
+type transactionRequest struct {
+	AuthorisationID string      `json:"authorisation_id"`
+	Amount          json.Number `json:"amount"`
+}
+
+// NewSimulator creates a new simulator, with no authorisations.
+func NewSimulator(logger log.Logger) *Simulator {
+	s := &Simulator{
+		Logger:         logger,
+		Delay:          2 * time.Second,
+		Hang:           30 * time.Second,
+		authorisations: make(map[string]*authorisation),
+		outcomes:       make(map[string]response),
+	}
+
+	s.Router = gin.New()
+	s.Router.Use(
+		middleware.GinReqLogger(logger, time.RFC3339, "request served by payment processor simulator", "http-router-mux"),
+		gin.Recovery(),
+	)
+
+	s.Router.NoRoute(api.NoRoute)
+	v1 := s.Router.Group("/api/v1")
+	v1.POST("/authorise", s.Authorise)
+	v1.POST("/capture", s.Capture)
+	v1.POST("/refund", s.Refund)
+	v1.POST("/void", s.Void)
+	v1.POST("/query", s.Query)
+
+	return s
+}
+
+// ServeHTTP serves the payment processor API.
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Router.ServeHTTP(w, r)
+}
+
+// Authorise authorises a payment.
+func (s *Simulator) Authorise(c *gin.Context) {
+	var req authoriseRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+
+	amount, err := money.Parse(req.Amount.String(), req.Currency)
+	if err != nil || !amount.IsPositive() {
+		c.JSON(400, gin.H{"message": "invalid amount"})
+		return
+	}
+
+	behaviour, ok := cardBehaviours[req.CreditCard.Number]
+	if !ok {
+		behaviour = amountBehaviour(amount)
+	}
+
+	s.serve(c, req.Reference, behaviour, func() response {
+		s.lastAuthID++
+		authID := fmt.Sprintf("sim-auth-%d", s.lastAuthID)
+		s.authorisations[authID] = &authorisation{amount: amount, captured: money.Zero(amount.Currency),
+			refunded: money.Zero(amount.Currency)}
+		return response{Code: codeSuccess, AuthorisationID: authID}
+	})
+}
+
+// Capture captures money from an authorisation.
+func (s *Simulator) Capture(c *gin.Context) {
+	s.transaction(c, func(auth *authorisation, amount money.Money) response {
+		if auth.voided {
+			return response{Code: codeNotAllowed, Reason: "authorisation voided"}
+		}
+		if available, _ := auth.amount.Sub(auth.captured); amount.MinorUnits > available.MinorUnits {
+			return response{Code: codeAmountExceeded, Reason: "amount exceeds amount available to capture"}
+		}
+		auth.captured, _ = auth.captured.Add(amount)
+		return response{Code: codeSuccess}
+	})
+}
+
+// Refund refunds money captured from an authorisation.
+func (s *Simulator) Refund(c *gin.Context) {
+	s.transaction(c, func(auth *authorisation, amount money.Money) response {
+		if available, _ := auth.captured.Sub(auth.refunded); amount.MinorUnits > available.MinorUnits {
+			return response{Code: codeAmountExceeded, Reason: "amount exceeds amount available to refund"}
+		}
+		auth.refunded, _ = auth.refunded.Add(amount)
+		return response{Code: codeSuccess}
+	})
+}
+
+// Void voids an authorisation, provided nothing was captured from it.
+func (s *Simulator) Void(c *gin.Context) {
+	var req transactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+
+	s.serve(c, c.GetHeader(pprocessor.IdempotencyKeyHeader), Approve, func() response {
+		auth, ok := s.authorisations[req.AuthorisationID]
+		if !ok {
+			return response{Code: codeNotFound, Reason: "authorisation not found"}
+		}
+		if auth.voided || !auth.captured.IsZero() {
+			return response{Code: codeNotAllowed, Reason: "authorisation cannot be voided"}
+		}
+		auth.voided = true
+		return response{Code: codeSuccess}
+	})
+}
+
+// Query returns the outcome of an authorisation (by reference) or of another request (by idempotency key).
+func (s *Simulator) Query(c *gin.Context) {
+	var req pprocessor.QueryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	recorded, ok := s.outcomes[req.Reference]
+	s.mu.Unlock()
+
+	resp := pprocessor.QueryResponse{Code: codeSuccess, Status: pprocessor.QueryNotFound}
+	if ok && recorded.Code == codeSuccess {
+		resp.Status = pprocessor.QuerySucceeded
+		resp.AuthorisationID = recorded.AuthorisationID
+	} else if ok {
+		resp.Status = pprocessor.QueryDeclined
+	}
+
+	c.JSON(200, resp)
+}
+
+// transaction decodes a capture or refund and serves it, process being called on the authorisation it refers to.
+func (s *Simulator) transaction(c *gin.Context, process func(auth *authorisation, amount money.Money) response) {
+	var req transactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"message": err.Error()})
+		return
+	}
+
+	// The currency is the authorisation's, so the amount can only be parsed once it is found
+	s.mu.Lock()
+	auth, ok := s.authorisations[req.AuthorisationID]
+	s.mu.Unlock()
+
+	behaviour := Approve
+	var amount money.Money
+	if ok {
+		var err error
+		amount, err = money.Parse(req.Amount.String(), auth.amount.Currency)
+		if err != nil || !amount.IsPositive() {
+			c.JSON(400, gin.H{"message": "invalid amount"})
+			return
+		}
+		behaviour = amountBehaviour(amount)
+	}
+
+	s.serve(c, c.GetHeader(pprocessor.IdempotencyKeyHeader), behaviour, func() response {
+		if !ok {
+			return response{Code: codeNotFound, Reason: "authorisation not found"}
+		}
+		return process(auth, amount)
+	})
+}
+
+// serve processes the request according to the behaviour and writes the response.
+// Requests with a key are processed once: their outcome is recorded and replayed to retries.
+func (s *Simulator) serve(c *gin.Context, key string, behaviour Behaviour, process func() response) {
+	ctx := c.Request.Context()
+
+	if key != "" {
+		s.mu.Lock()
+		recorded, ok := s.outcomes[key]
+		s.mu.Unlock()
+		if ok {
+			c.JSON(200, recorded)
+			return
+		}
+	}
+
+	switch behaviour {
+	case ServerError:
+		c.JSON(500, gin.H{"message": "internal server error"})
+		return
+	case Delay:
+		if !wait(ctx, s.Delay) {
+			// The request was not processed
+			c.JSON(503, gin.H{"message": "request cancelled"})
+			return
+		}
+	}
+
+	var resp response
+	switch behaviour {
+	case DeclineCard:
+		resp = response{Code: codeCardDeclined, Reason: "card declined"}
+	case DeclineFunds:
+		resp = response{Code: codeInsufficientFunds, Reason: "insufficient funds"}
+	}
+
+	s.mu.Lock()
+	if recorded, ok := s.outcomes[key]; ok && key != "" {
+		// A concurrent retry got here first
+		resp = recorded
+	} else {
+		if resp.Code == 0 {
+			resp = process()
+		}
+		if key != "" {
+			s.outcomes[key] = resp
+		}
+	}
+	s.mu.Unlock()
+
+	s.Logger.Debug(fmt.Sprintf("%s processed with code %d", c.Request.URL.Path, resp.Code),
+		log.Field("behaviour", string(behaviour)), log.Field("key", key))
+
+	switch behaviour {
+	case ApproveAndTimeout:
+		wait(ctx, s.Hang)
+		c.JSON(504, gin.H{"message": "gateway timeout"})
+	case MalformedResponse:
+		c.Data(200, "application/json", []byte(`{"code": 1, "authorisation_id": `))
+	default:
+		c.JSON(200, resp)
+	}
+}
+
+// amountBehaviour returns the behaviour scripted by the amount.
+func amountBehaviour(amount money.Money) Behaviour {
+	if behaviour, ok := amountBehaviours[amount.MinorUnits]; ok {
+		return behaviour
+	}
+	return Approve
+}
+
+// wait waits for d to elapse and returns false if ctx is done first.
+func wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,227 @@
+package pprocessorsim_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/pprocessorsim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestClient returns a payment processor client talking to a new simulator, which delays and hangs briefly.
+func newTestClient(t *testing.T) *pprocessor.Client {
+	sim := pprocessorsim.NewSimulator(log.NullLogger{})
+	sim.Delay = 10 * time.Millisecond
+	sim.Hang = 10 * time.Millisecond
+
+	return newClient(t, sim)
+}
+
+func newClient(t *testing.T, sim *pprocessorsim.Simulator) *pprocessor.Client {
+	server := httptest.NewServer(sim)
+	t.Cleanup(server.Close)
+
+	serverURL, err := url.Parse(server.URL)
+	require.NoError(t, err)
+	port, err := strconv.Atoi(serverURL.Port())
+	require.NoError(t, err)
+
+	return pprocessor.NewClient(serverURL.Hostname(), port, &http.Client{Timeout: time.Second})
+}
+
+func authorise(client *pprocessor.Client, number string, minorUnits int64, reference string) (string, error) {
+	return client.AuthorisePayment(context.Background(), pprocessor.AuthorisationRequest{
+		CreditCard: pprocessor.CreditCard{Name: "Bill", Number: number, ExpiryMonth: 9, ExpiryYear: 2030, CVV: "123"},
+		Amount:     money.Money{MinorUnits: minorUnits, Currency: "EUR"},
+		Reference:  reference,
+	})
+}
+
+func TestAuthoriseBehaviours(t *testing.T) {
+	tests := map[string]struct {
+		number              string
+		minorUnits          int64
+		expectedKind        error
+		expectedDeclineCode uint
+		expectedStatus      pprocessor.QueryStatus
+	}{
+		"approved":                {number: "4242424242424242", minorUnits: 1000, expectedStatus: pprocessor.QuerySucceeded},
+		"card declined":           {number: pprocessorsim.CardDeclined, minorUnits: 1000, expectedKind: pprocessor.ErrDeclined, expectedDeclineCode: 2, expectedStatus: pprocessor.QueryDeclined},
+		"insufficient funds":      {number: pprocessorsim.CardInsufficientFunds, minorUnits: 1000, expectedKind: pprocessor.ErrDeclined, expectedDeclineCode: 5, expectedStatus: pprocessor.QueryDeclined},
+		"delayed":                 {number: pprocessorsim.CardDelayed, minorUnits: 1000, expectedStatus: pprocessor.QuerySucceeded},
+		"approved then timed out": {number: pprocessorsim.CardTimeout, minorUnits: 1000, expectedKind: pprocessor.ErrTimeout, expectedStatus: pprocessor.QuerySucceeded},
+		"server error":            {number: pprocessorsim.CardServerError, minorUnits: 1000, expectedKind: pprocessor.ErrUnavailable, expectedStatus: pprocessor.QueryNotFound},
+		"malformed response":      {number: pprocessorsim.CardMalformedResponse, minorUnits: 1000, expectedKind: pprocessor.ErrProtocol, expectedStatus: pprocessor.QuerySucceeded},
+		"declined by amount":      {number: "4242424242424242", minorUnits: 92, expectedKind: pprocessor.ErrDeclined, expectedDeclineCode: 2, expectedStatus: pprocessor.QueryDeclined},
+		"server error by amount":  {number: "4242424242424242", minorUnits: 90, expectedKind: pprocessor.ErrUnavailable, expectedStatus: pprocessor.QueryNotFound},
+		"card takes precedence":   {number: pprocessorsim.CardDeclined, minorUnits: 90, expectedKind: pprocessor.ErrDeclined, expectedDeclineCode: 2, expectedStatus: pprocessor.QueryDeclined},
+		"ordinary amount":         {number: "4242424242424242", minorUnits: 1092, expectedStatus: pprocessor.QuerySucceeded},
+		"timed out by amount":     {number: "4242424242424242", minorUnits: 98, expectedKind: pprocessor.ErrTimeout, expectedStatus: pprocessor.QuerySucceeded},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t)
+
+			authID, err := authorise(client, test.number, test.minorUnits, "ref1")
+			if test.expectedKind == nil {
+				require.NoError(t, err)
+				assert.NotEmpty(t, authID)
+			} else {
+				require.True(t, errors.Is(err, test.expectedKind), "unexpected error: %v", err)
+			}
+
+			var declineErr *pprocessor.DeclineError
+			if errors.As(err, &declineErr) {
+				assert.Equal(t, test.expectedDeclineCode, declineErr.Code)
+			}
+
+			resp, err := client.QueryOperation(context.Background(), pprocessor.QueryRequest{Reference: "ref1"})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedStatus, resp.Status)
+			if test.expectedStatus == pprocessor.QuerySucceeded {
+				assert.NotEmpty(t, resp.AuthorisationID)
+			}
+		})
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+	eur := func(minorUnits int64) money.Money { return money.Money{MinorUnits: minorUnits, Currency: "EUR"} }
+
+	authID, err := authorise(client, "4242424242424242", 1000, "ref1")
+	require.NoError(t, err)
+
+	err = client.RefundTransaction(ctx, pprocessor.RefundRequest{AuthorisationID: authID, Amount: eur(100), RequestID: "1"})
+	require.True(t, errors.Is(err, pprocessor.ErrDeclined), "refund before capture: %v", err)
+
+	err = client.CaptureTransaction(ctx, pprocessor.CaptureRequest{AuthorisationID: authID, Amount: eur(1001), RequestID: "2"})
+	require.True(t, errors.Is(err, pprocessor.ErrDeclined), "capture above amount authorised: %v", err)
+
+	err = client.CaptureTransaction(ctx, pprocessor.CaptureRequest{AuthorisationID: authID, Amount: eur(600), RequestID: "3"})
+	require.NoError(t, err)
+
+	// Retries are processed once, so the second capture of 600 is not declined
+	err = client.CaptureTransaction(ctx, pprocessor.CaptureRequest{AuthorisationID: authID, Amount: eur(600), RequestID: "3"})
+	require.NoError(t, err)
+
+	err = client.CaptureTransaction(ctx, pprocessor.CaptureRequest{AuthorisationID: authID, Amount: eur(400), RequestID: "4"})
+	require.NoError(t, err)
+
+	err = client.RefundTransaction(ctx, pprocessor.RefundRequest{AuthorisationID: authID, Amount: eur(1000), RequestID: "5"})
+	require.NoError(t, err)
+
+	err = client.VoidPayment(ctx, pprocessor.VoidRequest{AuthorisationID: authID, RequestID: "6"})
+	require.True(t, errors.Is(err, pprocessor.ErrDeclined), "void after capture: %v", err)
+
+	err = client.CaptureTransaction(ctx, pprocessor.CaptureRequest{AuthorisationID: "unknown", Amount: eur(100), RequestID: "7"})
+	require.True(t, errors.Is(err, pprocessor.ErrDeclined), "capture of unknown authorisation: %v", err)
+
+	for requestID, expectedStatus := range map[string]pprocessor.QueryStatus{"2": pprocessor.QueryDeclined,
+		"3": pprocessor.QuerySucceeded, "5": pprocessor.QuerySucceeded, "8": pprocessor.QueryNotFound} {
+		resp, err := client.QueryOperation(ctx, pprocessor.QueryRequest{Reference: requestID})
+		require.NoError(t, err)
+		assert.Equal(t, expectedStatus, resp.Status, "request %s", requestID)
+	}
+}
+
+func TestCaptureBehaviours(t *testing.T) {
+	tests := map[string]struct {
+		minorUnits     int64
+		expectedKind   error
+		expectedStatus pprocessor.QueryStatus
+	}{
+		"approved":                {minorUnits: 300, expectedStatus: pprocessor.QuerySucceeded},
+		"ordinary amount":         {minorUnits: 395, expectedStatus: pprocessor.QuerySucceeded},
+		"insufficient funds":      {minorUnits: 95, expectedKind: pprocessor.ErrDeclined, expectedStatus: pprocessor.QueryDeclined},
+		"delayed":                 {minorUnits: 97, expectedStatus: pprocessor.QuerySucceeded},
+		"approved then timed out": {minorUnits: 98, expectedKind: pprocessor.ErrTimeout, expectedStatus: pprocessor.QuerySucceeded},
+		"server error":            {minorUnits: 90, expectedKind: pprocessor.ErrUnavailable, expectedStatus: pprocessor.QueryNotFound},
+		"malformed response":      {minorUnits: 99, expectedKind: pprocessor.ErrProtocol, expectedStatus: pprocessor.QuerySucceeded},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			client := newTestClient(t)
+
+			authID, err := authorise(client, "4242424242424242", 1000, "ref1")
+			require.NoError(t, err)
+
+			err = client.CaptureTransaction(context.Background(), pprocessor.CaptureRequest{AuthorisationID: authID,
+				Amount: money.Money{MinorUnits: test.minorUnits, Currency: "EUR"}, RequestID: "1"})
+			if test.expectedKind == nil {
+				require.NoError(t, err)
+			} else {
+				require.True(t, errors.Is(err, test.expectedKind), "unexpected error: %v", err)
+			}
+
+			resp, err := client.QueryOperation(context.Background(), pprocessor.QueryRequest{Reference: "1"})
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedStatus, resp.Status)
+		})
+	}
+}
+
+func TestVoid(t *testing.T) {
+	client := newTestClient(t)
+	ctx := context.Background()
+
+	authID, err := authorise(client, "4242424242424242", 1000, "ref1")
+	require.NoError(t, err)
+
+	err = client.VoidPayment(ctx, pprocessor.VoidRequest{AuthorisationID: authID, RequestID: "1"})
+	require.NoError(t, err)
+
+	// A retry gets the recorded response, whereas a new void is declined
+	err = client.VoidPayment(ctx, pprocessor.VoidRequest{AuthorisationID: authID, RequestID: "1"})
+	require.NoError(t, err)
+	err = client.VoidPayment(ctx, pprocessor.VoidRequest{AuthorisationID: authID, RequestID: "2"})
+	require.True(t, errors.Is(err, pprocessor.ErrDeclined), "second void: %v", err)
+
+	err = client.CaptureTransaction(ctx, pprocessor.CaptureRequest{AuthorisationID: authID,
+		Amount: money.Money{MinorUnits: 100, Currency: "EUR"}, RequestID: "3"})
+	require.True(t, errors.Is(err, pprocessor.ErrDeclined), "capture after void: %v", err)
+}
+
+func TestHangBoundedByCaller(t *testing.T) {
+	// The default Hang is far longer than the client is willing to wait
+	client := newClient(t, pprocessorsim.NewSimulator(log.NullLogger{}))
+	client.Timeouts.Authorise = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := authorise(client, pprocessorsim.CardTimeout, 1000, "ref1")
+	assert.True(t, errors.Is(err, pprocessor.ErrTimeout), "unexpected error: %v", err)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestDelayCancelled(t *testing.T) {
+	sim := pprocessorsim.NewSimulator(log.NullLogger{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/authorise", strings.NewReader(`{"credit_card": {"name": "Bill",
+		"number": "4000000000000077", "expiry_month": 9, "expiry_year": 2030, "cvv": "123"}, "currency": "EUR",
+		"amount": 10, "reference": "ref1"}`)).WithContext(ctx)
+
+	w := httptest.NewRecorder()
+	sim.ServeHTTP(w, req)
+	assert.Equal(t, 503, w.Code)
+
+	// The authorisation was not processed
+	resp, err := newClient(t, sim).QueryOperation(context.Background(), pprocessor.QueryRequest{Reference: "ref1"})
+	require.NoError(t, err)
+	assert.Equal(t, pprocessor.QueryNotFound, resp.Status)
+}
@@ -0,0 +1,347 @@
+// Package reconciler resolves operations whose outcome at the payment processor is unknown, e.g. because the
+// payment processor timed out or the gateway failed to record its answer, so that the gateway and the payment
+// processor never silently diverge.
+package reconciler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository"
+)
+
+// Reconciler periodically:
+//   - asks the payment processor about the outcome of authorisation requests still pending in the journal,
+//     recording the authorisations the gateway missed.
+//   - voids the authorisations the gateway could not store, until the payment processor accepts the void.
+//   - asks the payment processor about the outcome of captures, refunds and voids still pending, completing or
+//     failing them.
+//   - expires the authorisations not captured within AuthorisationValidity, as the payment processor releases their
+//     funds by then.
+//
+// Operations the payment processor has not received (yet) are asked about again on the next runs, as they may still
+// be on their way, and are only failed once they are still unknown to it after MaxAttempts.
+//
+// Authorisation requests, captures, refunds and voids still unresolved after MaxAttempts are marked "Failed" and an
+// alert is raised, as they must be resolved manually at the payment processor.
+type Reconciler struct {
+	Logger     log.Logger
+	Repo       core.Repository
+	PProcessor core.PaymentProcessor
+
+	// Interval is how often operations are reconciled
+	Interval time.Duration
+	// MinAge is how old an operation must be before being reconciled, so in-flight requests are left alone
+	MinAge time.Duration
+	// MaxAttempts is how many times resolving an operation (or voiding an authorisation) can fail before giving up
+	MaxAttempts int
+	// AuthorisationValidity is how long an authorisation can be captured for before it expires
+	AuthorisationValidity time.Duration
+
+	// ctx is cancelled to abort the reconciliation in progress
+	ctx    context.Context
+	cancel context.CancelFunc
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// New creates a new reconciler.
+func New(logger log.Logger, repo core.Repository, pproc core.PaymentProcessor, interval time.Duration,
+	minAge time.Duration, maxAttempts int, authValidity time.Duration) *Reconciler {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Reconciler{
+		Logger:                logger,
+		Repo:                  repo,
+		PProcessor:            pproc,
+		Interval:              interval,
+		MinAge:                minAge,
+		MaxAttempts:           maxAttempts,
+		AuthorisationValidity: authValidity,
+		ctx:                   ctx,
+		cancel:                cancel,
+		stop:                  make(chan struct{}),
+		done:                  make(chan struct{}),
+	}
+}
+
+// Run reconciles operations every interval, until the reconciler is shut down.
+func (r *Reconciler) Run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.ReconcileOnce(r.ctx)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// ShutDown stops the reconciler, waiting for the reconciliation in progress (if any) to finish.
+// If it does not finish before ctx is done, it is cancelled.
+func (r *Reconciler) ShutDown(ctx context.Context) error {
+	close(r.stop)
+
+	select {
+	case <-r.done:
+		r.cancel()
+		return nil
+	case <-ctx.Done():
+		r.cancel()
+		<-r.done
+		return ctx.Err()
+	}
+}
+
+// ReconcileOnce reconciles all operations older than MinAge, then expires the authorisations older than
+// AuthorisationValidity.
+func (r *Reconciler) ReconcileOnce(ctx context.Context) {
+	createdBefore := time.Now().Add(-r.MinAge)
+
+	entries, err := r.Repo.GetAuthorisationJournal(ctx, entities.JournalPending, createdBefore)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to get pending authorisation requests: %s", err.Error()))
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if entry.Attempts >= r.MaxAttempts {
+			r.giveUp(ctx, entry, fmt.Sprintf("reconciler: gave up on authorisation request '%s' after %d attempts, "+
+				"its outcome must be checked at the payment processor", entry.Reference, entry.Attempts))
+			continue
+		}
+		r.reconcileAuthorisation(ctx, entry)
+	}
+
+	entries, err = r.Repo.GetAuthorisationJournal(ctx, entities.JournalCompensating, createdBefore)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to get authorisations to void: %s", err.Error()))
+	}
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return
+		}
+		if entry.Attempts >= r.MaxAttempts {
+			r.giveUp(ctx, entry, fmt.Sprintf("reconciler: gave up voiding authorisation '%s' of authorisation "+
+				"request '%s' after %d attempts, it must be voided at the payment processor", entry.AuthorisationID,
+				entry.Reference, entry.Attempts))
+			continue
+		}
+		r.compensateAuthorisation(ctx, entry.Reference, entry.AuthorisationID, entry.Attempts)
+	}
+
+	transactions, err := r.Repo.GetPendingTransactions(ctx, createdBefore)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to get pending transactions: %s", err.Error()))
+	}
+	for _, transItem := range transactions {
+		if ctx.Err() != nil {
+			return
+		}
+		if transItem.Attempts >= r.MaxAttempts {
+			r.giveUpTransaction(ctx, transItem)
+			continue
+		}
+		r.reconcileTransaction(ctx, transItem)
+	}
+
+	auths, err := r.Repo.GetAuthorisationsByState(ctx, entities.StateAuthorised,
+		time.Now().Add(-r.AuthorisationValidity))
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to get authorisations to expire: %s", err.Error()))
+	}
+	for _, authItem := range auths {
+		if ctx.Err() != nil {
+			return
+		}
+		r.expireAuthorisation(ctx, authItem)
+	}
+}
+
+// expireAuthorisation marks an authorisation that was never captured as expired.
+// Authorisations with an operation still in progress are left alone until it is resolved.
+func (r *Reconciler) expireAuthorisation(ctx context.Context, authItem entities.Authorisation) {
+	err := r.Repo.UpdateAuthorisationState(ctx, authItem.ID, entities.StateExpired)
+	var inProgressErr *core.OperationInProgressError
+	if errors.As(err, &inProgressErr) {
+		return
+	} else if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to expire authorisation '%s': %s", authItem.ID, err.Error()))
+		return
+	}
+
+	r.Logger.Info(fmt.Sprintf("reconciler: authorisation '%s' expired", authItem.ID))
+}
+
+// reconcileAuthorisation resolves an authorisation request whose outcome is unknown.
+// If the payment processor authorised the payment, the authorisation is recorded, or voided if it cannot be.
+func (r *Reconciler) reconcileAuthorisation(ctx context.Context, entry entities.AuthorisationJournalEntry) {
+	queryResp, err := r.PProcessor.QueryOperation(ctx, pprocessor.QueryRequest{Reference: entry.Reference})
+	if err != nil {
+		r.authorisationFailed(ctx, entry, fmt.Sprintf("payment processor query failed: %s", err.Error()))
+		return
+	}
+
+	if queryResp.Status == pprocessor.QueryNotFound && entry.Attempts+1 < r.MaxAttempts {
+		r.Logger.Info(fmt.Sprintf("reconciler: authorisation request '%s' not received by the payment processor yet "+
+			"(attempt %d)", entry.Reference, entry.Attempts+1))
+		r.recordAuthorisationAttempt(ctx, entry)
+		return
+	}
+
+	if queryResp.Status != pprocessor.QuerySucceeded {
+		r.Logger.Info(fmt.Sprintf("reconciler: authorisation request '%s' was not authorised (%s)",
+			entry.Reference, queryResp.Status))
+		err = r.Repo.FailAuthorisationJournalEntry(ctx, entry.Reference)
+		if err != nil {
+			r.authorisationFailed(ctx, entry, err.Error())
+		}
+		return
+	}
+
+	card, err := r.Repo.GetCreditCard(ctx, entry.MerchantName, entry.CreditCardToken)
+	if err != nil {
+		r.authorisationFailed(ctx, entry, err.Error())
+		return
+	}
+
+	authRecord := entities.Authorisation{
+		ID:           queryResp.AuthorisationID,
+		State:        entities.StateAuthorised,
+		Amount:       entry.Amount,
+		MerchantName: entry.MerchantName,
+		CreditCard:   &card,
+		Reference:    entry.Reference,
+	}
+
+	err = r.Repo.AddAuthorisation(ctx, authRecord)
+	if e, ok := err.(*repository.DBServiceError); ok && e.ValidationFail {
+		r.Logger.Error(fmt.Sprintf("reconciler: authorisation '%s' of authorisation request '%s' cannot be stored: %s",
+			queryResp.AuthorisationID, entry.Reference, err.Error()))
+
+		err = r.Repo.StartCompensation(ctx, entry.Reference, queryResp.AuthorisationID)
+		if err != nil {
+			r.authorisationFailed(ctx, entry, err.Error())
+			return
+		}
+		r.compensateAuthorisation(ctx, entry.Reference, queryResp.AuthorisationID, entry.Attempts)
+		return
+	} else if err != nil {
+		r.authorisationFailed(ctx, entry, err.Error())
+		return
+	}
+
+	r.Logger.Info(fmt.Sprintf("reconciler: recorded authorisation '%s' of authorisation request '%s'",
+		queryResp.AuthorisationID, entry.Reference))
+}
+
+// authorisationFailed logs the failed attempt at resolving the authorisation request, which is retried later.
+func (r *Reconciler) authorisationFailed(ctx context.Context, entry entities.AuthorisationJournalEntry,
+	reason string) {
+	r.Logger.Error(fmt.Sprintf("reconciler: failed to reconcile authorisation request '%s' (attempt %d): %s",
+		entry.Reference, entry.Attempts+1, reason))
+	r.recordAuthorisationAttempt(ctx, entry)
+}
+
+// recordAuthorisationAttempt counts an attempt at resolving the authorisation request that left it unresolved.
+func (r *Reconciler) recordAuthorisationAttempt(ctx context.Context, entry entities.AuthorisationJournalEntry) {
+	err := r.Repo.RecordAuthorisationJournalAttempt(ctx, entry.Reference)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to record attempt for authorisation request '%s': %s",
+			entry.Reference, err.Error()))
+	}
+}
+
+// giveUp marks the authorisation request as failed, so the reconciler leaves it alone, and raises an alert.
+// The authorisation ID (if known) is kept on the entry.
+func (r *Reconciler) giveUp(ctx context.Context, entry entities.AuthorisationJournalEntry, msg string) {
+	r.Logger.Error(msg, log.Field("type", "alert"), log.Field("reference", entry.Reference),
+		log.Field("authorisation_id", entry.AuthorisationID), log.Field("merchant", entry.MerchantName))
+
+	err := r.Repo.FailAuthorisationJournalEntry(ctx, entry.Reference)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to mark authorisation request '%s' as failed: %s",
+			entry.Reference, err.Error()))
+	}
+}
+
+// compensateAuthorisation voids an authorisation the gateway could not store.
+func (r *Reconciler) compensateAuthorisation(ctx context.Context, reference string, authID string, attempts int) {
+	err := core.CompensateAuthorisation(ctx, r.Repo, r.PProcessor, reference, authID)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: compensation of authorisation request '%s' failed (attempt %d): %s",
+			reference, attempts+1, err.Error()))
+		return
+	}
+
+	r.Logger.Info(fmt.Sprintf("reconciler: voided authorisation '%s' of authorisation request '%s'",
+		authID, reference))
+}
+
+// reconcileTransaction resolves a capture, refund or void whose outcome is unknown.
+func (r *Reconciler) reconcileTransaction(ctx context.Context, transItem entities.Transaction) {
+	queryResp, err := r.PProcessor.QueryOperation(ctx, pprocessor.QueryRequest{Reference: transItem.ID})
+	if err != nil {
+		r.transactionFailed(ctx, transItem, fmt.Sprintf("payment processor query failed: %s", err.Error()))
+		return
+	}
+
+	if queryResp.Status == pprocessor.QueryNotFound && transItem.Attempts+1 < r.MaxAttempts {
+		r.Logger.Info(fmt.Sprintf("reconciler: %s '%s' for authorisation '%s' not received by the payment processor "+
+			"yet (attempt %d)", transItem.Type, transItem.ID, transItem.AuthorisationID, transItem.Attempts+1))
+		r.recordTransactionAttempt(ctx, transItem)
+		return
+	}
+
+	success := queryResp.Status == pprocessor.QuerySucceeded
+	err = r.Repo.CompleteTransaction(ctx, transItem.AuthorisationID, transItem.ID, success)
+	if err != nil {
+		r.transactionFailed(ctx, transItem, fmt.Sprintf("failed to record its outcome: %s", err.Error()))
+		return
+	}
+
+	r.Logger.Info(fmt.Sprintf("reconciler: %s '%s' for authorisation '%s' resolved as %s",
+		transItem.Type, transItem.ID, transItem.AuthorisationID, queryResp.Status))
+}
+
+// transactionFailed logs the failed attempt at resolving the transaction, which is retried later.
+func (r *Reconciler) transactionFailed(ctx context.Context, transItem entities.Transaction, reason string) {
+	r.Logger.Error(fmt.Sprintf("reconciler: failed to reconcile %s '%s' for authorisation '%s' (attempt %d): %s",
+		transItem.Type, transItem.ID, transItem.AuthorisationID, transItem.Attempts+1, reason))
+	r.recordTransactionAttempt(ctx, transItem)
+}
+
+// recordTransactionAttempt counts an attempt at resolving the transaction that left it unresolved.
+func (r *Reconciler) recordTransactionAttempt(ctx context.Context, transItem entities.Transaction) {
+	err := r.Repo.RecordTransactionAttempt(ctx, transItem.AuthorisationID, transItem.ID)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to record attempt for %s '%s' for authorisation '%s': %s",
+			transItem.Type, transItem.ID, transItem.AuthorisationID, err.Error()))
+	}
+}
+
+// giveUpTransaction marks the transaction as failed, so the reconciler leaves it alone, and raises an alert.
+func (r *Reconciler) giveUpTransaction(ctx context.Context, transItem entities.Transaction) {
+	r.Logger.Error(fmt.Sprintf("reconciler: gave up on %s '%s' for authorisation '%s' after %d attempts, "+
+		"its outcome must be checked at the payment processor", transItem.Type, transItem.ID,
+		transItem.AuthorisationID, transItem.Attempts), log.Field("type", "alert"),
+		log.Field("transaction_id", transItem.ID), log.Field("authorisation_id", transItem.AuthorisationID))
+
+	err := r.Repo.CompleteTransaction(ctx, transItem.AuthorisationID, transItem.ID, false)
+	if err != nil {
+		r.Logger.Error(fmt.Sprintf("reconciler: failed to mark %s '%s' for authorisation '%s' as failed: %s",
+			transItem.Type, transItem.ID, transItem.AuthorisationID, err.Error()))
+	}
+}
@@ -0,0 +1,431 @@
+package reconciler_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/entities"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/log"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/money"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/pprocessor"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/core/repository/inmemory"
+	"github.com/gustavooferreira/pgw-payment-gateway-service/pkg/reconciler"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queryProcessor answers queries from a table of outcomes, keyed by reference.
+// Unknown references fail as if the payment processor was unavailable.
+// Voids fail with voidErr, if set.
+type queryProcessor struct {
+	outcomes map[string]pprocessor.QueryResponse
+	voidErr  error
+	voids    []pprocessor.VoidRequest
+}
+
+func (p *queryProcessor) AuthorisePayment(context.Context, pprocessor.AuthorisationRequest) (string, error) {
+	return "", &pprocessor.Error{Kind: pprocessor.ErrUnavailable, Op: "authorise"}
+}
+
+func (p *queryProcessor) CaptureTransaction(context.Context, pprocessor.CaptureRequest) error {
+	return &pprocessor.Error{Kind: pprocessor.ErrUnavailable, Op: "capture"}
+}
+
+func (p *queryProcessor) RefundTransaction(context.Context, pprocessor.RefundRequest) error {
+	return &pprocessor.Error{Kind: pprocessor.ErrUnavailable, Op: "refund"}
+}
+
+func (p *queryProcessor) VoidPayment(_ context.Context, req pprocessor.VoidRequest) error {
+	p.voids = append(p.voids, req)
+	return p.voidErr
+}
+
+func (p *queryProcessor) QueryOperation(_ context.Context, req pprocessor.QueryRequest) (pprocessor.QueryResponse, error) {
+	queryResp, ok := p.outcomes[req.Reference]
+	if !ok {
+		return pprocessor.QueryResponse{}, &pprocessor.Error{Kind: pprocessor.ErrUnavailable, Op: "query"}
+	}
+	return queryResp, nil
+}
+
+var eur10 = money.Money{MinorUnits: 1000, Currency: "EUR"}
+
+func setupRepo(t *testing.T) *inmemory.Repository {
+	repo := inmemory.NewRepository("EUR")
+	_, err := repo.SaveCreditCard(context.Background(), "bill", entities.CreditCard{Token: "tok_1", Fingerprint: "fp_1"})
+	require.NoError(t, err)
+	return repo
+}
+
+func journal(t *testing.T, repo *inmemory.Repository, reference string) {
+	err := repo.JournalAuthorisation(context.Background(), entities.AuthorisationJournalEntry{
+		Reference:       reference,
+		MerchantName:    "bill",
+		Amount:          eur10,
+		CreditCardToken: "tok_1",
+	})
+	require.NoError(t, err)
+}
+
+func TestReconcileAuthorisations(t *testing.T) {
+	tests := map[string]struct {
+		outcome          *pprocessor.QueryResponse
+		expectedAuthID   string
+		expectedAttempts int
+		expectedPending  bool
+	}{
+		"authorised": {outcome: &pprocessor.QueryResponse{Code: 1, Status: pprocessor.QuerySucceeded,
+			AuthorisationID: "auth1"}, expectedAuthID: "auth1"},
+		"declined": {outcome: &pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryDeclined}},
+		"never arrived": {outcome: &pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryNotFound},
+			expectedAttempts: 1, expectedPending: true},
+		"query failed": {expectedAttempts: 1, expectedPending: true},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := setupRepo(t)
+			journal(t, repo, "ref1")
+
+			pproc := &queryProcessor{outcomes: map[string]pprocessor.QueryResponse{}}
+			if test.outcome != nil {
+				pproc.outcomes["ref1"] = *test.outcome
+			}
+
+			r := reconciler.New(log.NullLogger{}, repo, pproc, time.Hour, 0, 10, 24*time.Hour)
+			r.ReconcileOnce(context.Background())
+
+			pending, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalPending, time.Now())
+			require.NoError(t, err)
+			if test.expectedPending {
+				require.Len(t, pending, 1)
+				assert.Equal(t, test.expectedAttempts, pending[0].Attempts)
+			} else {
+				assert.Empty(t, pending)
+			}
+
+			auths, err := repo.GetAllAuthorisations(context.Background())
+			require.NoError(t, err)
+			if test.expectedAuthID != "" {
+				require.Len(t, auths, 1)
+				assert.Equal(t, test.expectedAuthID, auths[0].ID)
+				assert.Equal(t, entities.StateAuthorised, auths[0].State)
+				assert.Equal(t, eur10, auths[0].Amount)
+			} else {
+				assert.Empty(t, auths)
+			}
+		})
+	}
+}
+
+func TestReconcileLeavesRecentOperationsAlone(t *testing.T) {
+	repo := setupRepo(t)
+	journal(t, repo, "ref1")
+
+	pproc := &queryProcessor{outcomes: map[string]pprocessor.QueryResponse{
+		"ref1": {Code: 1, Status: pprocessor.QueryNotFound},
+	}}
+
+	r := reconciler.New(log.NullLogger{}, repo, pproc, time.Hour, time.Hour, 10, 24*time.Hour)
+	r.ReconcileOnce(context.Background())
+
+	pending, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalPending, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, pending, 1)
+}
+
+func TestReconcileRetriesCompensations(t *testing.T) {
+	repo := setupRepo(t)
+	journal(t, repo, "ref1")
+	require.NoError(t, repo.StartCompensation(context.Background(), "ref1", "auth1"))
+
+	pproc := &queryProcessor{voidErr: &pprocessor.Error{Kind: pprocessor.ErrTimeout, Op: "void"}}
+	r := reconciler.New(log.NullLogger{}, repo, pproc, time.Hour, 0, 10, 24*time.Hour)
+
+	// The void keeps being retried until the payment processor accepts it
+	r.ReconcileOnce(context.Background())
+	r.ReconcileOnce(context.Background())
+	pproc.voidErr = nil
+	r.ReconcileOnce(context.Background())
+	r.ReconcileOnce(context.Background())
+
+	require.Len(t, pproc.voids, 3)
+	for _, voidReq := range pproc.voids {
+		assert.Equal(t, "auth1", voidReq.AuthorisationID)
+		assert.Equal(t, pproc.voids[0].RequestID, voidReq.RequestID)
+	}
+
+	entries, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalVoided, time.Now())
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, 2, entries[0].Attempts)
+}
+
+// alertLogger records the messages of the alerts logged.
+type alertLogger struct {
+	log.NullLogger
+	alerts []string
+}
+
+func (l *alertLogger) Error(msg string, fields ...log.FieldFunc) {
+	fieldsMap := log.FieldsMap{}
+	for _, field := range fields {
+		field(fieldsMap)
+	}
+	if fieldsMap["type"] == "alert" {
+		l.alerts = append(l.alerts, msg)
+	}
+}
+
+func TestReconcileGivesUp(t *testing.T) {
+	tests := map[string]struct {
+		compensating  bool
+		expectedVoids int
+	}{
+		"query keeps failing": {},
+		"void keeps failing":  {compensating: true, expectedVoids: 2},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := setupRepo(t)
+			journal(t, repo, "ref1")
+			if test.compensating {
+				require.NoError(t, repo.StartCompensation(context.Background(), "ref1", "auth1"))
+			}
+
+			pproc := &queryProcessor{voidErr: &pprocessor.Error{Kind: pprocessor.ErrTimeout, Op: "void"}}
+			logger := &alertLogger{}
+			r := reconciler.New(logger, repo, pproc, time.Hour, 0, 2, 24*time.Hour)
+
+			r.ReconcileOnce(context.Background())
+			r.ReconcileOnce(context.Background())
+			assert.Empty(t, logger.alerts)
+
+			// Left alone once given up on
+			r.ReconcileOnce(context.Background())
+			r.ReconcileOnce(context.Background())
+			assert.Len(t, logger.alerts, 1)
+			assert.Len(t, pproc.voids, test.expectedVoids)
+
+			entries, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalFailed, time.Now())
+			require.NoError(t, err)
+			require.Len(t, entries, 1)
+			assert.Equal(t, 2, entries[0].Attempts)
+			if test.compensating {
+				assert.Equal(t, "auth1", entries[0].AuthorisationID)
+			}
+		})
+	}
+}
+
+func TestReconcileTransactions(t *testing.T) {
+	tests := map[string]struct {
+		outcome          *pprocessor.QueryResponse
+		expectedStatus   entities.TransactionStatus
+		expectedState    entities.PaymentState
+		expectedAttempts int
+	}{
+		"captured": {outcome: &pprocessor.QueryResponse{Code: 1, Status: pprocessor.QuerySucceeded},
+			expectedStatus: entities.TransactionCompleted, expectedState: entities.StatePartiallyCaptured},
+		"declined": {outcome: &pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryDeclined},
+			expectedStatus: entities.TransactionFailed, expectedState: entities.StateAuthorised},
+		"never arrived": {outcome: &pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryNotFound},
+			expectedStatus: entities.TransactionPending, expectedState: entities.StateAuthorised, expectedAttempts: 1},
+		"query failed": {expectedStatus: entities.TransactionPending, expectedState: entities.StateAuthorised,
+			expectedAttempts: 1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			repo := setupRepo(t)
+			err := repo.AddAuthorisation(context.Background(), entities.Authorisation{
+				ID:           "auth1",
+				State:        entities.StateAuthorised,
+				Amount:       eur10,
+				MerchantName: "bill",
+				CreditCard:   &entities.CreditCard{Token: "tok_1"},
+			})
+			require.NoError(t, err)
+
+			transID, err := repo.ReserveTransaction(context.Background(), "auth1", entities.Transaction{
+				Type:   entities.TransactionCapture,
+				Amount: money.Money{MinorUnits: 400, Currency: "EUR"},
+			})
+			require.NoError(t, err)
+
+			pproc := &queryProcessor{outcomes: map[string]pprocessor.QueryResponse{}}
+			if test.outcome != nil {
+				pproc.outcomes[transID] = *test.outcome
+			}
+
+			r := reconciler.New(log.NullLogger{}, repo, pproc, time.Hour, 0, 10, 24*time.Hour)
+			r.ReconcileOnce(context.Background())
+
+			auth, err := repo.GetAuthorisationDetails(context.Background(), "auth1")
+			require.NoError(t, err)
+			require.Len(t, auth.Transaction, 1)
+			assert.Equal(t, test.expectedStatus, auth.Transaction[0].Status)
+			assert.Equal(t, test.expectedState, auth.State)
+			assert.Equal(t, test.expectedAttempts, auth.Transaction[0].Attempts)
+		})
+	}
+}
+
+// noQueryProcessor is a payment processor without the protocol extension, answering queries with a 404.
+type noQueryProcessor struct {
+	queryProcessor
+}
+
+func (p *noQueryProcessor) QueryOperation(context.Context, pprocessor.QueryRequest) (pprocessor.QueryResponse, error) {
+	return pprocessor.QueryResponse{}, &pprocessor.Error{Kind: pprocessor.ErrProtocol, Op: "query",
+		Err: fmt.Errorf("unexpected status code 404")}
+}
+
+func TestReconcileGivesUpOnTransactions(t *testing.T) {
+	repo := setupRepo(t)
+	err := repo.AddAuthorisation(context.Background(), entities.Authorisation{
+		ID:           "auth1",
+		State:        entities.StateAuthorised,
+		Amount:       eur10,
+		MerchantName: "bill",
+		CreditCard:   &entities.CreditCard{Token: "tok_1"},
+	})
+	require.NoError(t, err)
+
+	_, err = repo.ReserveTransaction(context.Background(), "auth1", entities.Transaction{
+		Type:   entities.TransactionCapture,
+		Amount: money.Money{MinorUnits: 400, Currency: "EUR"},
+	})
+	require.NoError(t, err)
+
+	logger := &alertLogger{}
+	r := reconciler.New(logger, repo, &noQueryProcessor{}, time.Hour, 0, 2, 24*time.Hour)
+
+	r.ReconcileOnce(context.Background())
+	r.ReconcileOnce(context.Background())
+	assert.Empty(t, logger.alerts)
+
+	// Left alone once given up on
+	r.ReconcileOnce(context.Background())
+	r.ReconcileOnce(context.Background())
+	assert.Len(t, logger.alerts, 1)
+
+	auth, err := repo.GetAuthorisationDetails(context.Background(), "auth1")
+	require.NoError(t, err)
+	require.Len(t, auth.Transaction, 1)
+	assert.Equal(t, entities.TransactionFailed, auth.Transaction[0].Status)
+	assert.Equal(t, 2, auth.Transaction[0].Attempts)
+	assert.Equal(t, entities.StateAuthorised, auth.State)
+}
+
+func TestReconcileFailsOperationsNeverReceived(t *testing.T) {
+	repo := setupRepo(t)
+	journal(t, repo, "ref1")
+	err := repo.AddAuthorisation(context.Background(), entities.Authorisation{
+		ID:           "auth1",
+		State:        entities.StateAuthorised,
+		Amount:       eur10,
+		MerchantName: "bill",
+		CreditCard:   &entities.CreditCard{Token: "tok_1"},
+	})
+	require.NoError(t, err)
+
+	transID, err := repo.ReserveTransaction(context.Background(), "auth1", entities.Transaction{
+		Type:   entities.TransactionCapture,
+		Amount: money.Money{MinorUnits: 400, Currency: "EUR"},
+	})
+	require.NoError(t, err)
+
+	notFound := pprocessor.QueryResponse{Code: 1, Status: pprocessor.QueryNotFound}
+	pproc := &queryProcessor{outcomes: map[string]pprocessor.QueryResponse{"ref1": notFound, transID: notFound}}
+	logger := &alertLogger{}
+	r := reconciler.New(logger, repo, pproc, time.Hour, 0, 3, 24*time.Hour)
+
+	r.ReconcileOnce(context.Background())
+	r.ReconcileOnce(context.Background())
+
+	pending, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalPending, time.Now())
+	require.NoError(t, err)
+	require.Len(t, pending, 1)
+	auth, err := repo.GetAuthorisationDetails(context.Background(), "auth1")
+	require.NoError(t, err)
+	require.Len(t, auth.Transaction, 1)
+	assert.Equal(t, entities.TransactionPending, auth.Transaction[0].Status)
+
+	// Still unknown to the payment processor after the last attempt, so they never reached it
+	r.ReconcileOnce(context.Background())
+	assert.Empty(t, logger.alerts)
+
+	failed, err := repo.GetAuthorisationJournal(context.Background(), entities.JournalFailed, time.Now())
+	require.NoError(t, err)
+	require.Len(t, failed, 1)
+	assert.Equal(t, "ref1", failed[0].Reference)
+	auth, err = repo.GetAuthorisationDetails(context.Background(), "auth1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.TransactionFailed, auth.Transaction[0].Status)
+	assert.Equal(t, entities.StateAuthorised, auth.State)
+}
+
+func TestReconcileExpiresAuthorisations(t *testing.T) {
+	repo := setupRepo(t)
+	for _, authID := range []string{"auth1", "auth2", "auth3"} {
+		err := repo.AddAuthorisation(context.Background(), entities.Authorisation{
+			ID:           authID,
+			State:        entities.StateAuthorised,
+			Amount:       eur10,
+			MerchantName: "bill",
+			CreditCard:   &entities.CreditCard{Token: "tok_1"},
+		})
+		require.NoError(t, err)
+	}
+
+	// auth2 has a capture in progress, auth3 was partially captured
+	_, err := repo.ReserveTransaction(context.Background(), "auth2", entities.Transaction{
+		Type:   entities.TransactionCapture,
+		Amount: money.Money{MinorUnits: 400, Currency: "EUR"},
+	})
+	require.NoError(t, err)
+	captureID, err := repo.ReserveTransaction(context.Background(), "auth3", entities.Transaction{
+		Type:   entities.TransactionCapture,
+		Amount: money.Money{MinorUnits: 400, Currency: "EUR"},
+	})
+	require.NoError(t, err)
+	require.NoError(t, repo.CompleteTransaction(context.Background(), "auth3", captureID, true))
+
+	pproc := &queryProcessor{outcomes: map[string]pprocessor.QueryResponse{}}
+
+	// Still valid
+	r := reconciler.New(log.NullLogger{}, repo, pproc, time.Hour, time.Hour, 10, time.Hour)
+	r.ReconcileOnce(context.Background())
+	auth, err := repo.GetAuthorisationDetails(context.Background(), "auth1")
+	require.NoError(t, err)
+	assert.Equal(t, entities.StateAuthorised, auth.State)
+
+	r = reconciler.New(log.NullLogger{}, repo, pproc, time.Hour, time.Hour, 10, time.Nanosecond)
+	r.ReconcileOnce(context.Background())
+
+	expectedStates := map[string]entities.PaymentState{
+		"auth1": entities.StateExpired,
+		"auth2": entities.StateAuthorised,
+		"auth3": entities.StatePartiallyCaptured,
+	}
+	for authID, expectedState := range expectedStates {
+		auth, err := repo.GetAuthorisationDetails(context.Background(), authID)
+		require.NoError(t, err)
+		assert.Equal(t, expectedState, auth.State, authID)
+	}
+}
+
+func TestReconcilerShutDown(t *testing.T) {
+	r := reconciler.New(log.NullLogger{}, setupRepo(t), &queryProcessor{}, time.Millisecond, 0, 10, 24*time.Hour)
+
+	go r.Run()
+	time.Sleep(5 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, r.ShutDown(ctx))
+}
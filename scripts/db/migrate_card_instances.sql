@@ -0,0 +1,51 @@
+-- Moves the card details of authorisations to card instances, so each authorisation keeps the card holder name and
+-- expiry date it was made with, instead of sharing the ones of its tokenised card.
+--
+-- Existing authorisations get the details currently stored with their card. Until now these were never updated after
+-- the card was first tokenised, so they are the details of the first authorisation made with the card.
+--
+-- Usage: mysql -h <host> -u <user> -p <database> < scripts/db/migrate_card_instances.sql
+-- The gateway must be stopped while migrating, as it expects the new schema.
+
+CREATE TABLE `card_instances` (
+  `id` bigint unsigned NOT NULL AUTO_INCREMENT,
+  `credit_card_token` varchar(50) NOT NULL,
+  `name` varchar(50) NOT NULL,
+  `expiry_month` bigint unsigned NOT NULL,
+  `expiry_year` bigint unsigned NOT NULL,
+  `created_at` datetime(3) NOT NULL,
+  -- Only used while migrating, to link each authorisation to its card instance
+  `authorisation_id` varchar(50) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_card_instances_credit_card_token` (`credit_card_token`),
+  KEY `idx_card_instances_authorisation_id` (`authorisation_id`),
+  CONSTRAINT `fk_credit_cards_card_instances` FOREIGN KEY (`credit_card_token`) REFERENCES `credit_cards` (`token`)
+);
+
+ALTER TABLE `authorisations` ADD COLUMN `card_instance_id` bigint unsigned DEFAULT NULL;
+
+START TRANSACTION;
+
+INSERT INTO `card_instances` (`credit_card_token`, `name`, `expiry_month`, `expiry_year`, `created_at`,
+  `authorisation_id`)
+SELECT `a`.`credit_card_token`, `c`.`name`, `c`.`expiry_month`, `c`.`expiry_year`, NOW(3), `a`.`id`
+FROM `authorisations` `a`
+JOIN `credit_cards` `c` ON `c`.`token` = `a`.`credit_card_token`;
+
+UPDATE `authorisations` `a`
+JOIN `card_instances` `ci` ON `ci`.`authorisation_id` = `a`.`id`
+SET `a`.`card_instance_id` = `ci`.`id`;
+
+COMMIT;
+
+-- Fails if an authorisation was left without card instance (i.e. its card is missing), leaving the old column in place
+ALTER TABLE `authorisations`
+  -- Constraint of the authorisations of a credit card, as named by gorm
+  DROP FOREIGN KEY `fk_credit_cards_authorisations`,
+  MODIFY `card_instance_id` bigint unsigned NOT NULL,
+  ADD CONSTRAINT `fk_authorisations_card_instance` FOREIGN KEY (`card_instance_id`) REFERENCES `card_instances` (`id`),
+  DROP COLUMN `credit_card_token`;
+
+ALTER TABLE `card_instances`
+  DROP INDEX `idx_card_instances_authorisation_id`,
+  DROP COLUMN `authorisation_id`;